@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"myredis/internal"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// ACL categories a command can be in, as ACL CAT lists them
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous",
+	"connection", "transaction", "scripting",
+}
+
+// Categories for a command's group, as COMMAND DOCS reports it
+var groupCategories = map[string]string{
+	"generic":      "keyspace",
+	"string":       "string",
+	"list":         "list",
+	"hash":         "hash",
+	"set":          "set",
+	"sorted-set":   "sortedset",
+	"stream":       "stream",
+	"pubsub":       "pubsub",
+	"connection":   "connection",
+	"transactions": "transaction",
+	"scripting":    "scripting",
+}
+
+// Returns the ACL categories of the command, from its flags and group
+func (s *commandSpec) categories() []string {
+	var categories []string
+	if group, ok := groupCategories[s.group]; ok {
+		categories = append(categories, group)
+	}
+	if s.is(flagReadonly) {
+		categories = append(categories, "read")
+	}
+	if s.is(flagWrite) {
+		categories = append(categories, "write")
+	}
+	if s.is(flagAdmin) {
+		categories = append(categories, "admin", "dangerous")
+	}
+	if s.is(flagBlocking) {
+		categories = append(categories, "blocking")
+	}
+	if s.is(flagFast) {
+		categories = append(categories, "fast")
+	} else {
+		categories = append(categories, "slow")
+	}
+	return categories
+}
+
+// aclUser is a user clients can authenticate as, with what it may access
+type aclUser struct {
+	name    string
+	enabled bool
+	// Any password is accepted
+	nopass bool
+	// SHA-256 of the user's passwords, in hex
+	passwords []string
+	// Commands the user can run, and the rules that allowed them, in order,
+	// for ACL GETUSER and ACL LIST
+	commands map[string]struct{}
+	rules    []string
+	// Patterns of keys and channels the user can access
+	keys     []string
+	channels []string
+}
+
+// New users are disabled, and can't do anything until rules allow it
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, commands: make(map[string]struct{})}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.commands = maps.Clone(u.commands)
+	c.rules = slices.Clone(u.rules)
+	c.keys = slices.Clone(u.keys)
+	c.channels = slices.Clone(u.channels)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns whether the user is enabled, and password is one of its passwords
+func (u *aclUser) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Private method to allow or deny commands, with their names in upper case
+func (u *aclUser) setCommands(names []string, allow bool) {
+	for _, name := range names {
+		if allow {
+			u.commands[name] = struct{}{}
+		} else {
+			delete(u.commands, name)
+		}
+	}
+}
+
+// Returns the names of the commands in category
+func categoryCommands(category string) []string {
+	var names []string
+	for name, spec := range commands {
+		if category == "all" || slices.Contains(spec.categories(), category) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Private method to apply an ACL SETUSER rule
+func (u *aclUser) applyRule(rule string) error {
+	syntaxError := fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Syntax error", rule)
+
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass, u.passwords = true, nil
+	case lower == "resetpass":
+		u.nopass, u.passwords = false, nil
+	case lower == "allkeys":
+		u.keys = []string{"*"}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case lower == "allcommands":
+		return u.applyRule("+@all")
+	case lower == "nocommands":
+		return u.applyRule("-@all")
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.applyRule(r)
+		}
+	case rule[0] == '>':
+		hash := hashPassword(rule[1:])
+		if !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case rule[0] == '<':
+		hash := hashPassword(rule[1:])
+		i := slices.Index(u.passwords, hash)
+		if i < 0 {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': no such password", rule)
+		}
+		u.passwords = slices.Delete(u.passwords, i, i+1)
+	case rule[0] == '#':
+		hash := strings.ToLower(rule[1:])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters", rule)
+		}
+		if !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case rule[0] == '!':
+		i := slices.Index(u.passwords, strings.ToLower(rule[1:]))
+		if i < 0 {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': no such password", rule)
+		}
+		u.passwords = slices.Delete(u.passwords, i, i+1)
+	case rule[0] == '~':
+		if !slices.Contains(u.keys, rule[1:]) {
+			u.keys = append(u.keys, rule[1:])
+		}
+	case rule[0] == '&':
+		if !slices.Contains(u.channels, rule[1:]) {
+			u.channels = append(u.channels, rule[1:])
+		}
+	case rule[0] == '+' || rule[0] == '-':
+		allow := rule[0] == '+'
+		if category, ok := strings.CutPrefix(lower[1:], "@"); ok {
+			if category != "all" && !slices.Contains(aclCategories, category) {
+				return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Unknown command category", rule)
+			}
+			u.setCommands(categoryCommands(category), allow)
+			// Allowing or denying every command makes earlier rules moot
+			if category == "all" {
+				u.rules = nil
+				if allow {
+					u.rules = []string{"+@all"}
+				}
+				return nil
+			}
+		} else {
+			name := strings.ToUpper(lower[1:])
+			if _, ok := commands[name]; !ok {
+				return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Unknown command", rule)
+			}
+			u.setCommands([]string{name}, allow)
+		}
+		u.rules = append(u.rules, string(rule[0])+lower[1:])
+	default:
+		return syntaxError
+	}
+	return nil
+}
+
+// Private method to describe the user's commands as rules
+func (u *aclUser) describeCommands() string {
+	if len(u.rules) > 0 && u.rules[0] == "+@all" {
+		return strings.Join(u.rules, " ")
+	}
+	return strings.Join(append([]string{"-@all"}, u.rules...), " ")
+}
+
+// Private method to describe patterns with prefix, such as ~ for keys
+func describePatterns(prefix string, patterns []string) string {
+	described := make([]string, len(patterns))
+	for i, p := range patterns {
+		described[i] = prefix + p
+	}
+	return strings.Join(described, " ")
+}
+
+// Private method to describe the user as rules, as ACL LIST does
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	parts = append(parts, describePatterns("#", u.passwords))
+	parts = append(parts, describePatterns("~", u.keys))
+	if len(u.channels) == 0 {
+		parts = append(parts, "resetchannels")
+	} else {
+		parts = append(parts, describePatterns("&", u.channels))
+	}
+	parts = append(parts, u.describeCommands())
+	return strings.Join(slices.DeleteFunc(parts, func(s string) bool { return s == "" }), " ")
+}
+
+// Returns whether one of patterns matches s
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if globMatch(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the channels a command publishes or subscribes to, and whether
+// they're patterns
+func commandChannels(command string, args []string) ([]string, bool) {
+	switch command {
+	case "PUBLISH":
+		return args[:1], false
+	case "SUBSCRIBE":
+		return args, false
+	case "PSUBSCRIBE":
+		return args, true
+	default:
+		return nil, false
+	}
+}
+
+// Private method to check the user may run the command
+func (u *aclUser) check(spec *commandSpec, args []string) error {
+	if _, ok := u.commands[spec.name]; !ok {
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", u.name, strings.ToLower(spec.name))
+	}
+	for _, key := range spec.getKeys(args) {
+		if !matchesAny(u.keys, key) {
+			return errors.New("NOPERM No permissions to access a key")
+		}
+	}
+	// A pattern is only allowed if the user's patterns include it as it is,
+	// as it may match channels other patterns don't
+	channels, patterns := commandChannels(spec.name, args)
+	for _, channel := range channels {
+		if patterns && !slices.Contains(u.channels, "*") && !slices.Contains(u.channels, channel) {
+			return errors.New("NOPERM No permissions to access a channel")
+		}
+		if !patterns && !matchesAny(u.channels, channel) {
+			return errors.New("NOPERM No permissions to access a channel")
+		}
+	}
+	return nil
+}
+
+// acl holds users, and checks their commands
+type acl struct {
+	m     sync.RWMutex
+	users map[string]*aclUser
+}
+
+// The default user can do anything, without a password, until given one
+func newACL() *acl {
+	user := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "+@all"} {
+		user.applyRule(rule)
+	}
+	return &acl{users: map[string]*aclUser{"default": user}}
+}
+
+// Private method to find the user to authenticate as, with password
+func (a *acl) authenticate(username string, password string) error {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	user, ok := a.users[username]
+	if !ok || !user.checkPassword(password) {
+		return errWrongPass
+	}
+	return nil
+}
+
+// Private method to check client may run the command. Clients of a
+// connection start as the default user if it needs no password, and are
+// unauthenticated otherwise.
+func (a *acl) check(client *Client, spec *commandSpec, args []internal.Data) error {
+	a.m.RLock()
+	defer a.m.RUnlock()
+	if client.user == "" {
+		if user := a.users["default"]; user.enabled && user.nopass {
+			client.user = user.name
+		}
+	}
+	// Users that were deleted leave their clients unauthenticated
+	user, ok := a.users[client.user]
+	if !ok {
+		if spec.is(flagNoAuth) {
+			return nil
+		}
+		return errNoAuth
+	}
+	strs, _ := stringArgs(args)
+	return user.check(spec, strs)
+}
+
+// Authorize implements the Authorizer interface for DefaultCommandHandler
+func (h *DefaultCommandHandler) Authorize(ctx context.Context, command string, args []internal.Data) error {
+	spec, ok := commands[command]
+	if !ok || !spec.validArity(len(args)+1) {
+		// Handle fails with the right error
+		return nil
+	}
+	return h.acl.check(clientFromContext(ctx), spec, args)
+}
+
+// SetRequirePass sets the default user's password, as the requirepass
+// option does. An empty password removes it.
+func (h *DefaultCommandHandler) SetRequirePass(password string) {
+	h.acl.m.Lock()
+	defer h.acl.m.Unlock()
+	user := h.acl.users["default"]
+	if password == "" {
+		user.applyRule("nopass")
+	} else {
+		user.applyRule("resetpass")
+		user.applyRule(">" + password)
+	}
+}
+
+// AUTH [username] password
+func (h *DefaultCommandHandler) handleAuthCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errWrongNumberOfArgs("AUTH")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password := "default", strs[0]
+	if len(strs) == 2 {
+		username, password = strs[0], strs[1]
+	} else {
+		h.acl.m.RLock()
+		nopass := h.acl.users["default"].nopass
+		h.acl.m.RUnlock()
+		if nopass {
+			return nil, errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	}
+	if err := h.acl.authenticate(username, password); err != nil {
+		return nil, err
+	}
+	clientFromContext(ctx).user = username
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// ACL SETUSER username [rule ...] | GETUSER username |
+// DELUSER username [username ...] | LIST | WHOAMI | CAT [category]
+func (h *DefaultCommandHandler) handleACLCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("ACL")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	a := h.acl
+	subcommand := strings.ToUpper(strs[0])
+	switch {
+	case subcommand == "SETUSER" && len(strs) >= 2:
+		a.m.Lock()
+		defer a.m.Unlock()
+		// Rules apply to a copy, so the user is unchanged if one fails
+		user, ok := a.users[strs[1]]
+		if ok {
+			user = user.clone()
+		} else {
+			user = newACLUser(strs[1])
+		}
+		for _, rule := range strs[2:] {
+			if rule == "" {
+				return nil, fmt.Errorf("ERR Error in ACL SETUSER modifier '': Syntax error")
+			}
+			if err := user.applyRule(rule); err != nil {
+				return nil, err
+			}
+		}
+		a.users[user.name] = user
+		return internal.NewSimpleStringData("OK"), nil
+	case subcommand == "GETUSER" && len(strs) == 2:
+		a.m.RLock()
+		defer a.m.RUnlock()
+		user, ok := a.users[strs[1]]
+		if !ok {
+			return internal.NewNullData(), nil
+		}
+		flags := []string{"off"}
+		if user.enabled {
+			flags[0] = "on"
+		}
+		if user.nopass {
+			flags = append(flags, "nopass")
+		}
+		proto := clientFromContext(ctx).protocol
+		return pairsData(proto, []internal.Data{
+			*internal.NewBulkStringData("flags"), *internal.NewArrayData(bulkStrings(flags)),
+			*internal.NewBulkStringData("passwords"), *internal.NewArrayData(bulkStrings(user.passwords)),
+			*internal.NewBulkStringData("commands"), *internal.NewBulkStringData(user.describeCommands()),
+			*internal.NewBulkStringData("keys"), *internal.NewBulkStringData(describePatterns("~", user.keys)),
+			*internal.NewBulkStringData("channels"), *internal.NewBulkStringData(describePatterns("&", user.channels)),
+		}), nil
+	case subcommand == "DELUSER" && len(strs) >= 2:
+		a.m.Lock()
+		defer a.m.Unlock()
+		if slices.Contains(strs[1:], "default") {
+			return nil, errors.New("ERR The 'default' user cannot be removed")
+		}
+		deleted := 0
+		for _, name := range strs[1:] {
+			if _, ok := a.users[name]; ok {
+				delete(a.users, name)
+				deleted++
+			}
+		}
+		return internal.NewIntData(deleted), nil
+	case subcommand == "LIST" && len(strs) == 1:
+		a.m.RLock()
+		defer a.m.RUnlock()
+		var lines []string
+		for _, name := range slices.Sorted(maps.Keys(a.users)) {
+			lines = append(lines, a.users[name].describe())
+		}
+		return internal.NewArrayData(bulkStrings(lines)), nil
+	case subcommand == "WHOAMI" && len(strs) == 1:
+		user := clientFromContext(ctx).user
+		if user == "" {
+			user = "default"
+		}
+		return internal.NewBulkStringData(user), nil
+	case subcommand == "CAT" && len(strs) == 1:
+		return internal.NewArrayData(bulkStrings(aclCategories)), nil
+	case subcommand == "CAT" && len(strs) == 2:
+		category := strings.ToLower(strs[1])
+		if !slices.Contains(aclCategories, category) {
+			return nil, fmt.Errorf("ERR Unknown category '%s'", strs[1])
+		}
+		names := categoryCommands(category)
+		for i, name := range names {
+			names[i] = strings.ToLower(name)
+		}
+		slices.Sort(names)
+		return internal.NewArrayData(bulkStrings(names)), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try ACL HELP.", strs[0])
+	}
+}
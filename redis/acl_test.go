@@ -0,0 +1,134 @@
+package main
+
+import (
+	"myredis/internal"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestACLSetUser(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	ok := internal.NewSimpleStringData("OK")
+
+	expectResponse(t, h, bulkArray("user default on nopass ~* &* +@all"), "ACL", "LIST")
+	expectResponse(t, h, ok, "ACL", "SETUSER", "alice", "on", ">secret", "~cache:*", "&news", "+@read", "-hget", "+set")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("flags"), *bulkArray("on"),
+		*internal.NewBulkStringData("passwords"), *bulkArray(hashPassword("secret")),
+		*internal.NewBulkStringData("commands"), *internal.NewBulkStringData("-@all +@read -hget +set"),
+		*internal.NewBulkStringData("keys"), *internal.NewBulkStringData("~cache:*"),
+		*internal.NewBulkStringData("channels"), *internal.NewBulkStringData("&news"),
+	}), "ACL", "GETUSER", "alice")
+	expectResponse(t, h, internal.NewNullData(), "ACL", "GETUSER", "nobody")
+
+	// Rules add to the user. allkeys replaces key patterns, and +@all makes
+	// earlier command rules moot
+	expectResponse(t, h, ok, "ACL", "SETUSER", "alice", "allkeys", "+@all", "-del")
+	// New users can't do anything
+	expectResponse(t, h, ok, "ACL", "SETUSER", "bob")
+	expectResponse(t, h, bulkArray(
+		"user alice on #"+hashPassword("secret")+" ~* &news +@all -del",
+		"user bob off resetchannels -@all",
+		"user default on nopass ~* &* +@all",
+	), "ACL", "LIST")
+
+	// A failing rule leaves the user as it was
+	expectError(t, h, "ERR Error in ACL SETUSER modifier 'bogus': Syntax error", "ACL", "SETUSER", "alice", "off", "bogus")
+	expectError(t, h, "ERR Error in ACL SETUSER modifier '+nope': Unknown command", "ACL", "SETUSER", "alice", "+nope")
+	expectError(t, h, "ERR Error in ACL SETUSER modifier '+@nope': Unknown command category", "ACL", "SETUSER", "alice", "+@nope")
+	got, _ := handle(t, h, "ACL", "GETUSER", "alice")
+	if fields, _ := got.GetArray(); !reflect.DeepEqual(fields[1], *bulkArray("on")) {
+		t.Fatalf("ACL GETUSER after failed SETUSER. want on, got %v", fields[1])
+	}
+
+	expectResponse(t, h, internal.NewIntData(1), "ACL", "DELUSER", "bob", "nobody")
+	expectError(t, h, "ERR The 'default' user cannot be removed", "ACL", "DELUSER", "default")
+	expectResponse(t, h, internal.NewBulkStringData("default"), "ACL", "WHOAMI")
+}
+
+func TestACLCat(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	expectResponse(t, h, internal.NewArrayData(bulkStrings(aclCategories)), "ACL", "CAT")
+	got, err := handle(t, h, "ACL", "CAT", "list")
+	if err != nil {
+		t.Fatalf("ACL CAT list, unexpected error: %v", err)
+	}
+	names := sortedStrings(t, got)
+	if !slices.Contains(names, "lpush") || !slices.Contains(names, "blmove") || slices.Contains(names, "get") {
+		t.Fatalf("ACL CAT list. got %v", names)
+	}
+	expectError(t, h, "ERR Unknown category 'nope'", "ACL", "CAT", "nope")
+}
+
+func TestServerAuth(t *testing.T) {
+	addr := startTestServer(t)
+	admin, adminReader := dialTestServer(t, addr)
+	ok := internal.NewSimpleStringData("OK")
+
+	// Without a password, connections are the default user
+	if got := sendCommand(t, admin, adminReader, "AUTH", "x"); got.GetKind() != internal.SimpleErrorKind {
+		t.Fatalf("AUTH without a password set. want error, got %v", got)
+	}
+	if got := sendCommand(t, admin, adminReader, "ACL", "SETUSER", "default", ">pass"); !reflect.DeepEqual(got, ok) {
+		t.Fatalf("ACL SETUSER default. want OK, got %v", got)
+	}
+	sendCommand(t, admin, adminReader, "ACL", "SETUSER", "reader", "on", ">read", "~cache:*", "&news", "+@read", "+publish", "+subscribe")
+
+	// Once it has one, new connections must authenticate
+	conn, reader := dialTestServer(t, addr)
+	if got := sendCommand(t, conn, reader, "GET", "cache:a"); !reflect.DeepEqual(got, internal.NewSimpleError(errNoAuth.Error())) {
+		t.Fatalf("GET before AUTH. want NOAUTH, got %v", got)
+	}
+	if got := sendCommand(t, conn, reader, "AUTH", "wrong"); !reflect.DeepEqual(got, internal.NewSimpleError(errWrongPass.Error())) {
+		t.Fatalf("AUTH with wrong password. want WRONGPASS, got %v", got)
+	}
+	if got := sendCommand(t, conn, reader, "AUTH", "reader", "read"); !reflect.DeepEqual(got, ok) {
+		t.Fatalf("AUTH reader. want OK, got %v", got)
+	}
+	if got := sendCommand(t, conn, reader, "ACL", "WHOAMI"); got.GetKind() != internal.SimpleErrorKind {
+		t.Fatalf("ACL WHOAMI as reader. want NOPERM, got %v", got)
+	}
+
+	// Commands, keys and channels are checked
+	if got := sendCommand(t, conn, reader, "GET", "cache:a"); !reflect.DeepEqual(got, internal.NewNullData()) {
+		t.Fatalf("GET cache:a. want null, got %v", got)
+	}
+	checks := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "cache:a", "1"}, "NOPERM User reader has no permissions to run the 'set' command"},
+		{[]string{"GET", "other"}, "NOPERM No permissions to access a key"},
+		{[]string{"EXISTS", "cache:a", "other"}, "NOPERM No permissions to access a key"},
+		{[]string{"PUBLISH", "sports", "x"}, "NOPERM No permissions to access a channel"},
+		{[]string{"SUBSCRIBE", "news", "sports"}, "NOPERM No permissions to access a channel"},
+	}
+	for _, check := range checks {
+		if got := sendCommand(t, conn, reader, check.args...); !reflect.DeepEqual(got, internal.NewSimpleError(check.want)) {
+			t.Fatalf("%v. want %s, got %v", check.args, check.want, got)
+		}
+	}
+	if got := sendCommand(t, conn, reader, "PUBLISH", "news", "x"); !reflect.DeepEqual(got, internal.NewIntData(0)) {
+		t.Fatalf("PUBLISH news. want 0, got %v", got)
+	}
+	// Scripts run commands as their caller
+	if got := sendCommand(t, admin, adminReader, "ACL", "SETUSER", "reader", "+eval"); !reflect.DeepEqual(got, ok) {
+		t.Fatalf("ACL SETUSER reader +eval. want OK, got %v", got)
+	}
+	got := sendCommand(t, conn, reader, "EVAL", "return redis.call('SET', 'cache:a', '1')", "0")
+	if got.GetKind() != internal.SimpleErrorKind || mustString(t, got) != "NOPERM User reader has no permissions to run the 'set' command" {
+		t.Fatalf("EVAL calling SET as reader. want NOPERM, got %v", got)
+	}
+
+	// HELLO can authenticate too, and deleting a user logs its clients out
+	hello, helloReader := dialTestServer(t, addr)
+	if got := sendCommand(t, hello, helloReader, "HELLO", "2", "AUTH", "default", "pass"); got.GetKind() == internal.SimpleErrorKind {
+		t.Fatalf("HELLO AUTH. got %v", got)
+	}
+	sendCommand(t, admin, adminReader, "ACL", "DELUSER", "reader")
+	if got := sendCommand(t, conn, reader, "GET", "cache:a"); !reflect.DeepEqual(got, internal.NewSimpleError(errNoAuth.Error())) {
+		t.Fatalf("GET after DELUSER. want NOAUTH, got %v", got)
+	}
+}
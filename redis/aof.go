@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AppendFsync is when the AOF is synced to disk
+type AppendFsync int
+
+const (
+	// After every write, before replying
+	AppendFsyncAlways AppendFsync = iota
+	// Once a second, so a crash loses at most a second of writes
+	AppendFsyncEverySec
+	// Never, leaving it to the OS
+	AppendFsyncNo
+)
+
+func ParseAppendFsync(s string) (AppendFsync, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return AppendFsyncAlways, nil
+	case "everysec":
+		return AppendFsyncEverySec, nil
+	case "no":
+		return AppendFsyncNo, nil
+	default:
+		return 0, fmt.Errorf("invalid appendfsync %q, must be one of always, everysec or no", s)
+	}
+}
+
+// Max elements in each command written by an AOF rewrite, as in Redis
+const aofRewriteItemsPerCommand = 64
+
+// aof logs writes to the append only file
+type aof struct {
+	// Guards the fields below
+	m     sync.Mutex
+	path  string
+	fsync AppendFsync
+	// Nil while the AOF is off
+	file *os.File
+	// Set when a write or sync fails. Writes are refused until one succeeds,
+	// as they can't be made durable.
+	err error
+	// Set when written to since the last sync
+	dirty bool
+	// Set while BGREWRITEAOF runs. Writes made meanwhile are kept, to append
+	// to the rewritten file.
+	rewriting  bool
+	rewriteBuf []byte
+}
+
+func newAOF() *aof {
+	return &aof{path: "appendonly.aof", fsync: AppendFsyncEverySec}
+}
+
+// Serializes commands as RESP arrays, as clients send them
+func aofCommands(commands [][]string) []byte {
+	var buf []byte
+	for _, command := range commands {
+		s, _ := internal.Serialize(*internal.NewArrayData(bulkStrings(command)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// Private method to log commands. Called under the dictionary write lock,
+// so commands are logged in the order they were applied.
+func (a *aof) append(commands [][]string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.file == nil && !a.rewriting {
+		return
+	}
+	buf := aofCommands(commands)
+	if a.rewriting {
+		a.rewriteBuf = append(a.rewriteBuf, buf...)
+	}
+	if a.file == nil {
+		return
+	}
+
+	if _, err := a.file.Write(buf); err != nil {
+		a.err = err
+		return
+	}
+	a.err = nil
+	switch a.fsync {
+	case AppendFsyncAlways:
+		a.err = a.file.Sync()
+	case AppendFsyncEverySec:
+		a.dirty = true
+	}
+}
+
+// Returns an error if the last write to the AOF failed
+func (a *aof) writeError() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.err != nil {
+		return fmt.Errorf("MISCONF Errors writing to the AOF file: %w", a.err)
+	}
+	return nil
+}
+
+// Returns whether writes are logged to the AOF
+func (a *aof) enabled() bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.file != nil
+}
+
+// Private method to sync the AOF, if written to since the last sync
+func (a *aof) sync() {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.file == nil || !a.dirty {
+		return
+	}
+	a.err = a.file.Sync()
+	a.dirty = a.err != nil
+}
+
+// Syncs the AOF every second with appendfsync everysec, until ctx is done.
+// The AOF is synced once more before returning.
+func (a *aof) runFsync(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.sync()
+			return
+		case <-ticker.C:
+			a.sync()
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// EnableAOF replays the AOF at path, and then logs every write to it. A
+// command cut off at the end of the file, as by a crash mid write, is
+// truncated with a warning, along with a transaction left without EXEC.
+func (h *DefaultCommandHandler) EnableAOF(path string, fsync AppendFsync, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+
+	if err := h.replayAOF(path, logger); err != nil {
+		return fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	h.aof.m.Lock()
+	defer h.aof.m.Unlock()
+	h.aof.path, h.aof.fsync, h.aof.file = path, fsync, f
+	return nil
+}
+
+// Private method to run the commands in the AOF at path
+func (h *DefaultCommandHandler) replayAOF(path string, logger *slog.Logger) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	reader := internal.NewReader(counter, 0)
+	// Like the writes of a primary, the log's are applied as they were,
+	// without eviction
+	client := NewClient()
+	client.primary = true
+	ctx := withClient(context.Background(), client)
+
+	// Offset of the last complete command, and of the last MULTI
+	var offset, multiOffset int64
+	for {
+		request, err := reader.ReadData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			logger.Warn("truncating incomplete command at the end of the AOF", "path", path, "offset", offset)
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		command, err := request.GetArray()
+		if err != nil || len(command) == 0 {
+			return fmt.Errorf("invalid command at offset %d", offset)
+		}
+		name, err := command[0].GetString()
+		if err != nil {
+			return fmt.Errorf("invalid command at offset %d", offset)
+		}
+		name = strings.ToUpper(name)
+		if _, err := checkCommand(name, command[1:]); err != nil {
+			return fmt.Errorf("invalid command at offset %d: %w", offset, err)
+		}
+		if name == "MULTI" {
+			multiOffset = offset
+		}
+		// Commands are logged once they succeed, so can't fail when replayed
+		h.Handle(ctx, name, command[1:])
+		offset = counter.n - int64(reader.Buffered())
+	}
+
+	if client.tx.active {
+		logger.Warn("truncating transaction without EXEC at the end of the AOF", "path", path, "offset", multiOffset)
+		offset = multiOffset
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > offset {
+		return os.Truncate(path, offset)
+	}
+	return nil
+}
+
+// Private method to build commands that recreate the live records. Consumer
+// must acquire lock.
+func (d *Dictionary) rewriteCommands() [][]string {
+	now := time.Now()
+	var commands [][]string
+	// Adds commands of prefix followed by items, items per command at a time
+	batch := func(prefix []string, items []string, per int) {
+		for len(items) > 0 {
+			n := min(len(items), per*aofRewriteItemsPerCommand)
+			commands = append(commands, append(append([]string{}, prefix...), items[:n]...))
+			items = items[n:]
+		}
+	}
+
+	for k, record := range d.kv {
+		if record.expired(now) {
+			continue
+		}
+
+		switch record.kind {
+		case StringRecord:
+			commands = append(commands, []string{"SET", k, record.value})
+		case ListRecord:
+			batch([]string{"RPUSH", k}, record.listValue.Range(0, record.listValue.Len()), 1)
+		case HashRecord:
+			var items []string
+			for field, value := range record.hashValue {
+				items = append(items, field, value)
+			}
+			batch([]string{"HSET", k}, items, 2)
+		case SetRecord:
+			var items []string
+			for member := range record.setValue {
+				items = append(items, member)
+			}
+			batch([]string{"SADD", k}, items, 1)
+		case ZSetRecord:
+			var items []string
+			for member, score := range record.zsetValue.scores {
+				items = append(items, formatFloat(score), member)
+			}
+			batch([]string{"ZADD", k}, items, 2)
+		case StreamRecord:
+			s := record.streamValue
+			for _, entry := range s.entries {
+				commands = append(commands, append([]string{"XADD", k, entry.id.String()}, entry.fields...))
+			}
+			// An empty stream is created by trimming what's added, as Redis
+			// does. The last ID may be past the last entry, once it's deleted.
+			if len(s.entries) == 0 {
+				commands = append(commands, []string{"XADD", k, "MAXLEN", "0", "0-1", "x", "y"})
+			}
+			commands = append(commands, []string{"XSETID", k, s.lastID.String()})
+			for name, g := range s.groups {
+				commands = append(commands, []string{"XGROUP", "CREATE", k, name, g.lastID.String(), "MKSTREAM"})
+				for _, id := range g.pendingIDs() {
+					p := g.pending[id]
+					commands = append(commands, []string{
+						"XCLAIM", k, name, p.consumer, "0", id.String(), "FORCE", "JUSTID",
+						"TIME", strconv.FormatInt(p.deliveryTime.UnixMilli(), 10),
+						"RETRYCOUNT", strconv.Itoa(p.deliveryCount),
+					})
+				}
+			}
+		}
+
+		if record.expire {
+			commands = append(commands, []string{"PEXPIREAT", k, strconv.FormatInt(record.ttl.UnixMilli(), 10)})
+		}
+	}
+	return commands
+}
+
+// BGREWRITEAOF. The AOF is rewritten in the background with the fewest
+// commands that recreate the dictionary, from a snapshot taken under the
+// dictionary lock. Writes made while it's written are appended after.
+func (h *DefaultCommandHandler) handleBgrewriteaofCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("BGREWRITEAOF")
+	}
+
+	var commands [][]string
+	var err error
+	// Writes are logged under the dictionary lock, so none are lost between
+	// the snapshot and starting to keep them
+	h.dict.Locked(func(tx Dictionary) {
+		h.aof.m.Lock()
+		defer h.aof.m.Unlock()
+		if h.aof.rewriting {
+			err = fmt.Errorf("ERR Background append only file rewriting already in progress")
+			return
+		}
+		h.aof.rewriting, h.aof.rewriteBuf = true, nil
+		commands = tx.rewriteCommands()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go h.aof.rewrite(commands)
+	return internal.NewSimpleStringData("Background append only file rewriting started"), nil
+}
+
+// Private method to replace the AOF with commands, followed by the writes
+// made since they were built
+func (a *aof) rewrite(commands [][]string) {
+	a.m.Lock()
+	path := a.path
+	a.m.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		a.finishRewrite(nil)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	w.Write(aofCommands(commands))
+	if err := w.Flush(); err != nil {
+		f.Close()
+		a.finishRewrite(nil)
+		return
+	}
+	a.finishRewrite(f)
+}
+
+// Private method to append the writes kept during a rewrite to f, and
+// replace the AOF with it. The AOF can't be written to meanwhile. f is nil
+// if the rewrite failed.
+func (a *aof) finishRewrite(f *os.File) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.rewriting = false
+	buf := a.rewriteBuf
+	a.rewriteBuf = nil
+	if f == nil {
+		return
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		f.Close()
+		return
+	}
+	// f is the AOF now, so later writes go to it
+	if a.file != nil {
+		a.file.Close()
+		a.file, a.dirty = f, false
+		return
+	}
+	f.Close()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a handler logging to the AOF at path, after replaying it
+func newAOFHandler(t *testing.T, path string) *DefaultCommandHandler {
+	t.Helper()
+	h := NewDefaultCommandHandler()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := h.EnableAOF(path, AppendFsyncAlways, logger); err != nil {
+		t.Fatalf("EnableAOF. unexpected error: %v", err)
+	}
+	t.Cleanup(func() { h.aof.file.Close() })
+	return h
+}
+
+func TestAOFReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	h := newAOFHandler(t, path)
+
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "counter", "1")
+	expectResponse(t, h, internal.NewIntData(2), "INCR", "counter")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "expiring", "value", "EX", "100")
+	expectResponse(t, h, internal.NewIntData(1), "EXPIRE", "counter", "200")
+	expectResponse(t, h, internal.NewIntData(3), "SADD", "set", "a", "b", "c")
+	expectResponse(t, h, internal.NewIntData(2), "RPUSH", "list", "a", "b")
+	id, _ := handle(t, h, "XADD", "stream", "*", "field", "value")
+	// Writes that fail, or change nothing, aren't logged
+	expectError(t, h, ErrWrongType.Error(), "LPUSH", "counter", "x")
+	expectResponse(t, h, internal.NewNullData(), "SET", "counter", "3", "NX")
+	expectResponse(t, h, internal.NewIntData(0), "DEL", "missing")
+	expectResponse(t, h, internal.NewIntData(0), "SREM", "set", "missing")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "XGROUP", "CREATE", "stream", "group", "$")
+	expectResponse(t, h, internal.NewNullData(), "XREADGROUP", "GROUP", "group", "consumer", "STREAMS", "stream", ">")
+
+	ctx := withClient(context.Background(), NewClient())
+	for _, command := range [][]string{{"MULTI"}, {"LPUSH", "list", "x"}, {"RPOP", "list"}, {"EXEC"}} {
+		if _, err := h.Handle(ctx, command[0], bulkStrings(command[1:])); err != nil {
+			t.Fatalf("%v, unexpected error: %v", command, err)
+		}
+	}
+	popped, _ := handle(t, h, "SPOP", "set")
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	for _, want := range []string{"PXAT", "PEXPIREAT", "MULTI", "SREM"} {
+		if !strings.Contains(string(contents), want) {
+			t.Errorf("AOF. want %q in %q", want, contents)
+		}
+	}
+	for _, unwanted := range []string{"missing", "XREADGROUP"} {
+		if strings.Contains(string(contents), unwanted) {
+			t.Errorf("AOF. want no %q in %q", unwanted, contents)
+		}
+	}
+	if strings.Contains(string(contents), "$1\r\n*\r\n") {
+		t.Errorf("AOF. want XADD with a generated ID, got %q", contents)
+	}
+
+	replayed := newAOFHandler(t, path)
+	expectResponse(t, replayed, internal.NewBulkStringData("2"), "GET", "counter")
+	expectResponse(t, replayed, bulkArray("x", "a"), "LRANGE", "list", "0", "-1")
+	expectResponse(t, replayed, internal.NewIntData(0), "SISMEMBER", "set", mustString(t, popped))
+	expectResponse(t, replayed, streamEntries([]string{mustString(t, id), "field", "value"}), "XRANGE", "stream", "-", "+")
+	for key, want := range map[string]time.Duration{"expiring": 100 * time.Second, "counter": 200 * time.Second} {
+		at, _, _ := replayed.dict.ExpireTime(key)
+		if ttl := time.Until(at); ttl > want || ttl < want-5*time.Second {
+			t.Errorf("TTL of %s after replay. got %v, want %v", key, ttl, want)
+		}
+	}
+}
+
+func mustString(t *testing.T, d *internal.Data) string {
+	t.Helper()
+	s, err := d.GetString()
+	if err != nil {
+		t.Fatalf("want a string, got %v", d)
+	}
+	return s
+}
+
+// A pop by a blocked client is logged when it happens, after the push that
+// served it
+func TestAOFBlockedPopOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	h := newAOFHandler(t, path)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handle(t, h, "BRPOP", "queue", "0")
+	}()
+	waitForBlocked(t, h.dict, "queue", 1)
+	expectResponse(t, h, internal.NewIntData(1), "RPUSH", "queue", "first")
+	<-done
+	expectResponse(t, h, internal.NewIntData(1), "RPUSH", "queue", "second")
+
+	replayed := newAOFHandler(t, path)
+	expectResponse(t, replayed, bulkArray("second"), "LRANGE", "queue", "0", "-1")
+}
+
+func TestAOFTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := aofCommands([][]string{{"SET", "a", "1"}, {"SET", "b", "2"}})
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"command cut off", []byte("*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1")},
+		{"transaction without EXEC", aofCommands([][]string{{"MULTI"}, {"SET", "c", "3"}})},
+	}
+
+	for _, tt := range tests {
+		if err := os.WriteFile(path, append(complete, tt.tail...), 0644); err != nil {
+			t.Fatalf("failed to write AOF: %v", err)
+		}
+		h := newAOFHandler(t, path)
+		expectResponse(t, h, internal.NewBulkStringData("2"), "GET", "b")
+		expectResponse(t, h, internal.NewNullData(), "GET", "c")
+		if contents, _ := os.ReadFile(path); string(contents) != string(complete) {
+			t.Fatalf("%s. want AOF truncated to %q, got %q", tt.name, complete, contents)
+		}
+	}
+
+	// Anything else is corrupt
+	if err := os.WriteFile(path, []byte("*1\r\n$7\r\nUNKNOWN\r\n"), 0644); err != nil {
+		t.Fatalf("failed to write AOF: %v", err)
+	}
+	if err := NewDefaultCommandHandler().EnableAOF(path, AppendFsyncAlways, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Fatalf("EnableAOF with unknown command. want error")
+	}
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	h := newAOFHandler(t, path)
+
+	for range 100 {
+		handle(t, h, "INCR", "counter")
+	}
+	handle(t, h, "EXPIRE", "counter", "100")
+	handle(t, h, "RPUSH", "list", "a", "b", "c")
+	handle(t, h, "HSET", "hash", "field", "value")
+	handle(t, h, "SADD", "set", "member")
+	handle(t, h, "ZADD", "zset", "1.5", "member", "+inf", "top")
+	handle(t, h, "XADD", "stream", "1-1", "field", "value")
+	handle(t, h, "XADD", "stream", "2-1", "field", "value")
+	handle(t, h, "XGROUP", "CREATE", "stream", "group", "0")
+	handle(t, h, "XREADGROUP", "GROUP", "group", "consumer", "COUNT", "1", "STREAMS", "stream", ">")
+	// Deleted entries leave the last ID past the last entry, or the stream
+	// empty
+	handle(t, h, "XADD", "stream", "3-1", "field", "value")
+	handle(t, h, "XDEL", "stream", "3-1")
+	handle(t, h, "XADD", "empty", "5-0", "field", "value")
+	handle(t, h, "XDEL", "empty", "5-0")
+	before, _ := os.Stat(path)
+
+	expectResponse(t, h, internal.NewSimpleStringData("Background append only file rewriting started"), "BGREWRITEAOF")
+	handle(t, h, "SET", "after", "rewrite")
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.aof.m.Lock()
+		rewriting := h.aof.rewriting
+		h.aof.m.Unlock()
+		if !rewriting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGREWRITEAOF didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Writes go to the rewritten file
+	handle(t, h, "SET", "after", "switch")
+
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("BGREWRITEAOF. size=%d, want less than %d", after.Size(), before.Size())
+	}
+
+	replayed := newAOFHandler(t, path)
+	for _, command := range [][]string{
+		{"GET", "counter"},
+		{"GET", "after"},
+		{"LRANGE", "list", "0", "-1"},
+		{"HGETALL", "hash"},
+		{"SMEMBERS", "set"},
+		{"ZRANGE", "zset", "0", "-1", "WITHSCORES"},
+		{"XRANGE", "stream", "-", "+"},
+		{"XPENDING", "stream", "group"},
+		{"TTL", "counter"},
+	} {
+		want, _ := handle(t, h, command...)
+		got, _ := handle(t, replayed, command...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v after rewrite. want %v, got %v", command, want, got)
+		}
+	}
+	expectResponse(t, replayed, internal.NewIntData(0), "XLEN", "empty")
+	for _, k := range []string{"stream", "empty"} {
+		expectError(t, replayed, errStreamIDTooSmall.Error(), "XADD", k, "3-1", "field", "value")
+	}
+}
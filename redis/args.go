@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"myredis/internal"
+	"strconv"
+)
+
+// Converts command args to strings. Clients send commands as arrays of bulk
+// strings, so any other kind is a syntax error.
+func stringArgs(args []internal.Data) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, err := arg.GetString()
+		if err != nil {
+			return nil, ErrSyntax
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// Parses an integer argument, with the error Redis sends for invalid ints
+func parseInt(s string) (int64, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return i, nil
+}
+
+// Parses a float argument, with the error Redis sends for invalid floats
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("ERR value is not a valid float")
+	}
+	return f, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a client waiting in BLPOP, BRPOP or BLMOVE for one of
+// its keys to be written to
+type blockedClient struct {
+	keys []string
+	// Tries to serve the client from k. Called under the write lock.
+	// Returns false if k still can't serve it.
+	serve func(k string) (bool, error)
+	// Closed once served
+	done   chan struct{}
+	served bool
+	err    error
+}
+
+// blockingState tracks blocked clients. Guarded by the Dictionary lock.
+type blockingState struct {
+	// Clients blocked on each key, in the order they blocked
+	waiters map[string][]*blockedClient
+	// Keys written to that have waiters, to serve before the lock is
+	// released
+	ready   []string
+	serving bool
+}
+
+func newBlockingState() *blockingState {
+	return &blockingState{waiters: make(map[string][]*blockedClient)}
+}
+
+// Returned by Block for a client that disconnected, which gets no reply
+var errClientDisconnected = errors.New("client disconnected")
+
+// Block tries serve with each of keys in order, under the write lock. If
+// none can serve the client, it waits until a write to one of keys lets
+// serve succeed, the timeout passes, ctx is done, or the client
+// disconnects. A timeout of 0 waits forever. Returns false on timeout.
+// Clients blocked on the same key are served in the order they blocked. In
+// a transaction the lock can't be released to wait, so Block times out at
+// once, as in Redis.
+func (d *Dictionary) Block(ctx context.Context, keys []string, timeout time.Duration, serve func(k string) (bool, error)) (bool, error) {
+	d.m.Lock()
+	for _, k := range keys {
+		ok, err := serve(k)
+		if err != nil || ok {
+			d.m.Unlock()
+			return ok, err
+		}
+	}
+	if _, ok := d.m.(heldLock); ok {
+		d.m.Unlock()
+		return false, nil
+	}
+	client := &blockedClient{keys: keys, serve: serve, done: make(chan struct{})}
+	for _, k := range keys {
+		d.blocking.waiters[k] = append(d.blocking.waiters[k], client)
+	}
+	d.m.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-client.done:
+		return true, client.err
+	case <-expired:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-clientFromContext(ctx).disconnected:
+		err = errClientDisconnected
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	// A write may have served the client before the lock was reacquired
+	if client.served {
+		return true, client.err
+	}
+	d.unblock(client)
+	return false, err
+}
+
+// Private method to serve clients blocked on k, after a write that may let
+// them proceed. Serving a client may write to other keys, such as the
+// destination of BLMOVE, which are served in turn. Consumer must acquire
+// write lock.
+func (d *Dictionary) signalKeyReady(k string) {
+	b := d.blocking
+	if len(b.waiters[k]) == 0 {
+		return
+	}
+	b.ready = append(b.ready, k)
+	if b.serving {
+		return
+	}
+
+	b.serving = true
+	for len(b.ready) > 0 {
+		k := b.ready[0]
+		b.ready = b.ready[1:]
+		for len(b.waiters[k]) > 0 {
+			client := b.waiters[k][0]
+			ok, err := client.serve(k)
+			if !ok && err == nil {
+				break
+			}
+			client.served, client.err = true, err
+			d.unblock(client)
+			close(client.done)
+		}
+	}
+	b.serving = false
+}
+
+// Private method to remove a client from the waiters of all its keys.
+// Consumer must acquire write lock.
+func (d *Dictionary) unblock(client *blockedClient) {
+	for _, k := range client.keys {
+		waiters := slices.DeleteFunc(d.blocking.waiters[k], func(c *blockedClient) bool {
+			return c == client
+		})
+		if len(waiters) == 0 {
+			delete(d.blocking.waiters, k)
+		} else {
+			d.blocking.waiters[k] = waiters
+		}
+	}
+}
+
+// Parses the timeout of a blocking command, in seconds. 0 blocks forever.
+func parseTimeout(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
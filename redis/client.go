@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"myredis/internal"
+	"sync"
+	"sync/atomic"
+)
+
+// Client holds per connection state
+type Client struct {
+	id       int64
+	protocol internal.Protocol
+	name     string
+	// Remote and local addresses of the connection
+	addr  string
+	laddr string
+
+	// Serializes writes to the connection, as other clients publish to it.
+	// Also held to change protocol, which the writer reads.
+	writeMu sync.Mutex
+	// Writes data to the connection. Set by the server, and nil for clients
+	// outside a connection.
+	send func(data *internal.Data) error
+	// Writes bytes to the connection as they are, for the replication
+	// stream. Set along with send.
+	sendRaw func(p []byte) error
+	// Closes the connection. Set along with send.
+	close func()
+
+	// Messages published to the client, waiting to be written by a writer
+	// goroutine, so publishers don't wait for a slow subscriber. Guarded
+	// by queueMu, as publishers don't hold writeMu.
+	queueMu sync.Mutex
+	queue   []queuedMessage
+	// Bytes of the queued messages. The connection is closed once they'd
+	// pass outputLimit, as Redis does with client-output-buffer-limit
+	// pubsub.
+	queued      int
+	outputLimit int
+	// Set while a writer goroutine runs, and once the client overflowed
+	writing    bool
+	overflowed bool
+
+	// Pub/Sub subscriptions. Only the client's connection changes them.
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// Commands queued by MULTI, and keys watched by WATCH
+	tx    transaction
+	watch *watcher
+
+	// User the client authenticated as, or empty before the first command.
+	// Clients outside a connection have no user, and aren't checked.
+	user string
+
+	// Closed once the connection is done reading, to stop blocked commands
+	// waiting for a client that's gone
+	disconnected     chan struct{}
+	disconnectedOnce sync.Once
+
+	// Set for the link to this server's primary, whose writes are applied
+	// even though replicas are read only, and for loading the AOF
+	primary bool
+	// Port a replica listens on, from REPLCONF listening-port
+	listeningPort int
+}
+
+// A message published to a client, and its size
+type queuedMessage struct {
+	data *internal.Data
+	size int
+}
+
+// Bytes of published messages a client may have waiting to be written,
+// Redis's default hard limit for Pub/Sub clients
+const pubsubOutputLimit = 32 * 1024 * 1024
+
+var lastClientID atomic.Int64
+
+func NewClient() *Client {
+	return &Client{
+		id:       lastClientID.Add(1),
+		protocol: internal.RESP2,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		watch:    newWatcher(),
+
+		disconnected: make(chan struct{}),
+
+		outputLimit: pubsubOutputLimit,
+	}
+}
+
+// Send writes data to the client's connection
+func (c *Client) Send(data *internal.Data) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.sendLocked(data)
+}
+
+// Private method to write data, after the messages queued before it.
+// Consumer must hold writeMu.
+func (c *Client) sendLocked(data *internal.Data) error {
+	if c.send == nil {
+		return nil
+	}
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	return c.send(data)
+}
+
+// Publish queues a message of size bytes for the client, without waiting
+// for it to be written. A client with too much queued already is closed.
+func (c *Client) Publish(data *internal.Data, size int) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.overflowed || c.send == nil {
+		return
+	}
+	if c.queued+size > c.outputLimit {
+		c.overflowed, c.queue, c.queued = true, nil, 0
+		if c.close != nil {
+			c.close()
+		}
+		return
+	}
+	c.queue = append(c.queue, queuedMessage{data, size})
+	c.queued += size
+	if !c.writing {
+		c.writing = true
+		go c.writeQueued()
+	}
+}
+
+// Private method to write queued messages, until none are left
+func (c *Client) writeQueued() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for {
+		// A failed write closes the connection, so the rest are dropped
+		if err := c.flushLocked(); err != nil {
+			c.queueMu.Lock()
+			c.queue, c.queued = nil, 0
+			c.queueMu.Unlock()
+		}
+
+		c.queueMu.Lock()
+		if len(c.queue) == 0 {
+			c.writing = false
+			c.queueMu.Unlock()
+			return
+		}
+		c.queueMu.Unlock()
+	}
+}
+
+// Private method to write queued messages. Messages are taken off the queue
+// under writeMu, so they're written in order, and before later replies.
+// Consumer must hold writeMu.
+func (c *Client) flushLocked() error {
+	for {
+		c.queueMu.Lock()
+		if len(c.queue) == 0 {
+			c.queueMu.Unlock()
+			return nil
+		}
+		m := c.queue[0]
+		c.queue = c.queue[1:]
+		c.queueMu.Unlock()
+
+		err := c.send(m.data)
+		c.queueMu.Lock()
+		c.queued -= m.size
+		c.queueMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SendRaw writes p to the client's connection as it is
+func (c *Client) SendRaw(p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.sendRaw == nil {
+		return nil
+	}
+	return c.sendRaw(p)
+}
+
+// Private method to mark the client as gone, once its connection can't be
+// read from
+func (c *Client) disconnect() {
+	c.disconnectedOnce.Do(func() { close(c.disconnected) })
+}
+
+// Returns the number of channels and patterns the client is subscribed to
+func (c *Client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+type clientContextKey struct{}
+
+// Attaches the connection's client to the context passed to handlers
+func withClient(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, c)
+}
+
+// Returns the client for the current connection. Handlers called outside a
+// connection, such as in tests, get a fresh RESP2 client.
+func clientFromContext(ctx context.Context) *Client {
+	c, ok := ctx.Value(clientContextKey{}).(*Client)
+	if !ok {
+		return NewClient()
+	}
+	return c
+}
+
+// Client names are limited to printable chars without spaces
+func validClientName(name string) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
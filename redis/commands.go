@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"myredis/internal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandFunc runs a command. It's passed the command's name, as some
+// handlers serve several commands.
+type commandFunc func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error)
+
+// Adapts a handler that only needs its arguments
+func argsHandler(fn func(h *DefaultCommandHandler, args []internal.Data) (*internal.Data, error)) commandFunc {
+	return func(h *DefaultCommandHandler, _ context.Context, _ string, args []internal.Data) (*internal.Data, error) {
+		return fn(h, args)
+	}
+}
+
+// Adapts a handler that needs the client's context
+func ctxHandler(fn func(h *DefaultCommandHandler, ctx context.Context, args []internal.Data) (*internal.Data, error)) commandFunc {
+	return func(h *DefaultCommandHandler, ctx context.Context, _ string, args []internal.Data) (*internal.Data, error) {
+		return fn(h, ctx, args)
+	}
+}
+
+// commandFlag describes how a command behaves, as COMMAND reports it
+type commandFlag uint
+
+const (
+	// Modifies the dictionary, so is logged to the AOF and replicated
+	flagWrite commandFlag = 1 << iota
+	// Reads keys without modifying them
+	flagReadonly
+	// Runs in constant or log time
+	flagFast
+	// May wait for another client's write, so can't hold the dictionary lock
+	flagBlocking
+	// Manages the server
+	flagAdmin
+	// Pub/Sub
+	flagPubSub
+	// Can't be called by scripts
+	flagNoScript
+	// Can be run before authenticating
+	flagNoAuth
+	// May use more memory, so is refused once over maxmemory
+	flagDenyOOM
+)
+
+var commandFlagNames = []struct {
+	flag commandFlag
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagDenyOOM, "denyoom"},
+	{flagAdmin, "admin"},
+	{flagPubSub, "pubsub"},
+	{flagNoScript, "noscript"},
+	{flagBlocking, "blocking"},
+	{flagFast, "fast"},
+	{flagNoAuth, "no_auth"},
+}
+
+// keySpec gives the positions of a command's keys, counting the command
+// name as 0, as Redis does. A negative last counts back from the end, so
+// -1 is the last argument.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var (
+	keyNone     = keySpec{}
+	keyFirst    = keySpec{1, 1, 1}
+	keyFirstTwo = keySpec{1, 2, 1}
+	keyAll      = keySpec{1, -1, 1}
+	// Every argument but a trailing timeout
+	keyAllButLast = keySpec{1, -2, 1}
+)
+
+// commandSpec describes a command
+type commandSpec struct {
+	name string
+	// Number of arguments, counting the command name. A negative arity is a
+	// minimum, so -2 takes at least one argument.
+	arity int
+	flags commandFlag
+	keys  keySpec
+	// Finds keys whose position depends on other arguments, such as a
+	// count of keys. Used instead of keys when set.
+	movableKeys func(args []string) []string
+	// For COMMAND DOCS
+	group   string
+	summary string
+	handler commandFunc
+}
+
+func (s *commandSpec) is(flag commandFlag) bool {
+	return s.flags&flag != 0
+}
+
+// Returns the keys in args, which don't include the command name
+func (s *commandSpec) getKeys(args []string) []string {
+	if s.movableKeys != nil {
+		return s.movableKeys(args)
+	}
+	if s.keys.first == 0 {
+		return nil
+	}
+	last := s.keys.last
+	if last < 0 {
+		last += len(args) + 1
+	}
+	var keys []string
+	for i := s.keys.first; i <= last && i <= len(args); i += s.keys.step {
+		keys = append(keys, args[i-1])
+	}
+	return keys
+}
+
+// Keys of EVAL and EVALSHA, after the count of keys
+func scriptKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > len(args)-2 {
+		return nil
+	}
+	return args[2 : 2+n]
+}
+
+// Keys of XREAD and XREADGROUP, the first half of the arguments after
+// STREAMS
+func streamsKeys(args []string) []string {
+	for i, arg := range args {
+		if strings.EqualFold(arg, "STREAMS") {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// commandTable lists every command. The dispatch map, commands, is built
+// from it.
+var commandTable = []commandSpec{
+	// Connection
+	{name: "PING", arity: -1, flags: flagFast, group: "connection", summary: "Returns the server's liveliness response.",
+		handler: ctxHandler((*DefaultCommandHandler).handlePingCommand)},
+	{name: "ECHO", arity: 2, flags: flagFast, group: "connection", summary: "Returns the given string.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return internal.NewArrayData(args), nil
+		}},
+	{name: "HELLO", arity: -1, flags: flagNoScript | flagFast | flagNoAuth, group: "connection", summary: "Handshakes with the Redis server.",
+		handler: ctxHandler((*DefaultCommandHandler).handleHelloCommand)},
+	{name: "AUTH", arity: -2, flags: flagNoScript | flagFast | flagNoAuth, group: "connection", summary: "Authenticates the connection.",
+		handler: ctxHandler((*DefaultCommandHandler).handleAuthCommand)},
+
+	// Generic
+	{name: "EXISTS", arity: -2, flags: flagReadonly | flagFast, keys: keyAll, group: "generic", summary: "Determines whether one or more keys exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleExistsCommand)},
+	{name: "DEL", arity: -2, flags: flagWrite, keys: keyAll, group: "generic", summary: "Deletes one or more keys.",
+		handler: argsHandler((*DefaultCommandHandler).handleDelCommand)},
+	{name: "EXPIRE", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "generic", summary: "Sets the expiration time of a key in seconds.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleExpireCommand(command, args, time.Second, false)
+		}},
+	{name: "PEXPIRE", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "generic", summary: "Sets the expiration time of a key in milliseconds.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleExpireCommand(command, args, time.Millisecond, false)
+		}},
+	{name: "EXPIREAT", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "generic", summary: "Sets the expiration time of a key to a Unix timestamp.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleExpireCommand(command, args, time.Second, true)
+		}},
+	{name: "PEXPIREAT", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "generic", summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleExpireCommand(command, args, time.Millisecond, true)
+		}},
+	{name: "TTL", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "generic", summary: "Returns the expiration time in seconds of a key.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleTTLCommand(command, args, time.Second, false)
+		}},
+	{name: "PTTL", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "generic", summary: "Returns the expiration time in milliseconds of a key.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleTTLCommand(command, args, time.Millisecond, false)
+		}},
+	{name: "EXPIRETIME", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "generic", summary: "Returns the expiration time of a key as a Unix timestamp.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleTTLCommand(command, args, time.Second, true)
+		}},
+	{name: "PEXPIRETIME", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "generic", summary: "Returns the expiration time of a key as a Unix milliseconds timestamp.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleTTLCommand(command, args, time.Millisecond, true)
+		}},
+	{name: "PERSIST", arity: 2, flags: flagWrite | flagFast, keys: keyFirst, group: "generic", summary: "Removes the expiration time of a key.",
+		handler: argsHandler((*DefaultCommandHandler).handlePersistCommand)},
+	{name: "OBJECT", arity: -2, flags: flagReadonly, keys: keySpec{2, 2, 1}, group: "generic", summary: "A container for object introspection commands.",
+		handler: argsHandler((*DefaultCommandHandler).handleObjectCommand)},
+
+	// Strings
+	{name: "SET", arity: -3, flags: flagWrite | flagDenyOOM, keys: keyFirst, group: "string", summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleSetCommand)},
+	{name: "GET", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "string", summary: "Returns the string value of a key.",
+		handler: argsHandler((*DefaultCommandHandler).handleGetCommand)},
+	{name: "INCR", arity: 2, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "string", summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleIncrCommand)},
+	{name: "DECR", arity: 2, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "string", summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleDecrCommand)},
+
+	// Lists
+	{name: "LPUSH", arity: -3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "list", summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePushCommand(command, args, true, false)
+		}},
+	{name: "RPUSH", arity: -3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "list", summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePushCommand(command, args, false, false)
+		}},
+	{name: "LPUSHX", arity: -3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "list", summary: "Prepends one or more elements to a list only when the list exists.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePushCommand(command, args, true, true)
+		}},
+	{name: "RPUSHX", arity: -3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "list", summary: "Appends one or more elements to a list only when the list exists.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePushCommand(command, args, false, true)
+		}},
+	{name: "LPOP", arity: -2, flags: flagWrite | flagFast, keys: keyFirst, group: "list", summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePopCommand(command, args, true)
+		}},
+	{name: "RPOP", arity: -2, flags: flagWrite | flagFast, keys: keyFirst, group: "list", summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handlePopCommand(command, args, false)
+		}},
+	{name: "LRANGE", arity: 4, flags: flagReadonly, keys: keyFirst, group: "list", summary: "Returns a range of elements from a list.",
+		handler: argsHandler((*DefaultCommandHandler).handleLrangeCommand)},
+	{name: "LLEN", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "list", summary: "Returns the length of a list.",
+		handler: argsHandler((*DefaultCommandHandler).handleLlenCommand)},
+	{name: "LINDEX", arity: 3, flags: flagReadonly, keys: keyFirst, group: "list", summary: "Returns an element from a list by its index.",
+		handler: argsHandler((*DefaultCommandHandler).handleLindexCommand)},
+	{name: "LSET", arity: 4, flags: flagWrite | flagDenyOOM, keys: keyFirst, group: "list", summary: "Sets the value of an element in a list by its index.",
+		handler: argsHandler((*DefaultCommandHandler).handleLsetCommand)},
+	{name: "LINSERT", arity: 5, flags: flagWrite | flagDenyOOM, keys: keyFirst, group: "list", summary: "Inserts an element before or after another element in a list.",
+		handler: argsHandler((*DefaultCommandHandler).handleLinsertCommand)},
+	{name: "LREM", arity: 4, flags: flagWrite, keys: keyFirst, group: "list", summary: "Removes elements from a list. Deletes the list if the last element was removed.",
+		handler: argsHandler((*DefaultCommandHandler).handleLremCommand)},
+	{name: "LTRIM", arity: 4, flags: flagWrite, keys: keyFirst, group: "list", summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed.",
+		handler: argsHandler((*DefaultCommandHandler).handleLtrimCommand)},
+	{name: "LPOS", arity: -3, flags: flagReadonly, keys: keyFirst, group: "list", summary: "Returns the index of matching elements in a list.",
+		handler: argsHandler((*DefaultCommandHandler).handleLposCommand)},
+	{name: "LMOVE", arity: 5, flags: flagWrite | flagDenyOOM, keys: keyFirstTwo, group: "list", summary: "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved.",
+		handler: argsHandler((*DefaultCommandHandler).handleLmoveCommand)},
+	{name: "BLPOP", arity: -3, flags: flagWrite | flagBlocking, keys: keyAllButLast, group: "list", summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleBlockingPopCommand(ctx, command, args, true)
+		}},
+	{name: "BRPOP", arity: -3, flags: flagWrite | flagBlocking, keys: keyAllButLast, group: "list", summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleBlockingPopCommand(ctx, command, args, false)
+		}},
+	{name: "BLMOVE", arity: 6, flags: flagWrite | flagDenyOOM | flagBlocking, keys: keyFirstTwo, group: "list", summary: "Pops an element from a list, pushes it to another list and returns it. Blocks until an element is available otherwise. Deletes the list if the last element was moved.",
+		handler: ctxHandler((*DefaultCommandHandler).handleBlmoveCommand)},
+
+	// Hashes
+	{name: "HSET", arity: -4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "hash", summary: "Creates or modifies the value of a field in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHsetCommand)},
+	{name: "HSETNX", arity: 4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "hash", summary: "Sets the value of a field in a hash only when the field doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleHsetnxCommand)},
+	{name: "HGET", arity: 3, flags: flagReadonly | flagFast, keys: keyFirst, group: "hash", summary: "Returns the value of a field in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHgetCommand)},
+	{name: "HMGET", arity: -3, flags: flagReadonly | flagFast, keys: keyFirst, group: "hash", summary: "Returns the values of all fields in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHmgetCommand)},
+	{name: "HGETALL", arity: 2, flags: flagReadonly, keys: keyFirst, group: "hash", summary: "Returns all fields and values in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHgetallCommand)},
+	{name: "HKEYS", arity: 2, flags: flagReadonly, keys: keyFirst, group: "hash", summary: "Returns all fields in a hash.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleHkeysCommand(command, args, false)
+		}},
+	{name: "HVALS", arity: 2, flags: flagReadonly, keys: keyFirst, group: "hash", summary: "Returns all values in a hash.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleHkeysCommand(command, args, true)
+		}},
+	{name: "HDEL", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "hash", summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.",
+		handler: argsHandler((*DefaultCommandHandler).handleHdelCommand)},
+	{name: "HEXISTS", arity: 3, flags: flagReadonly | flagFast, keys: keyFirst, group: "hash", summary: "Determines whether a field exists in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHexistsCommand)},
+	{name: "HLEN", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "hash", summary: "Returns the number of fields in a hash.",
+		handler: argsHandler((*DefaultCommandHandler).handleHlenCommand)},
+	{name: "HSTRLEN", arity: 3, flags: flagReadonly | flagFast, keys: keyFirst, group: "hash", summary: "Returns the length of the value of a field.",
+		handler: argsHandler((*DefaultCommandHandler).handleHstrlenCommand)},
+	{name: "HINCRBY", arity: 4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "hash", summary: "Increments the integer value of a field in a hash by a number. Uses 0 as initial value if the field doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleHincrbyCommand)},
+	{name: "HINCRBYFLOAT", arity: 4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "hash", summary: "Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleHincrbyfloatCommand)},
+
+	// Sets
+	{name: "SADD", arity: -3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "set", summary: "Adds one or more members to a set. Creates the key if it doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleSaddCommand)},
+	{name: "SREM", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "set", summary: "Removes one or more members from a set. Deletes the set if the last member was removed.",
+		handler: argsHandler((*DefaultCommandHandler).handleSremCommand)},
+	{name: "SISMEMBER", arity: 3, flags: flagReadonly | flagFast, keys: keyFirst, group: "set", summary: "Determines whether a member belongs to a set.",
+		handler: argsHandler((*DefaultCommandHandler).handleSismemberCommand)},
+	{name: "SMISMEMBER", arity: -3, flags: flagReadonly | flagFast, keys: keyFirst, group: "set", summary: "Determines whether multiple members belong to a set.",
+		handler: argsHandler((*DefaultCommandHandler).handleSmismemberCommand)},
+	{name: "SMEMBERS", arity: 2, flags: flagReadonly, keys: keyFirst, group: "set", summary: "Returns all members of a set.",
+		handler: argsHandler((*DefaultCommandHandler).handleSmembersCommand)},
+	{name: "SCARD", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "set", summary: "Returns the number of members in a set.",
+		handler: argsHandler((*DefaultCommandHandler).handleScardCommand)},
+	{name: "SPOP", arity: -2, flags: flagWrite | flagFast, keys: keyFirst, group: "set", summary: "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped.",
+		handler: argsHandler((*DefaultCommandHandler).handleSpopCommand)},
+	{name: "SRANDMEMBER", arity: -2, flags: flagReadonly, keys: keyFirst, group: "set", summary: "Get one or multiple random members from a set",
+		handler: argsHandler((*DefaultCommandHandler).handleSrandmemberCommand)},
+	{name: "SMOVE", arity: 4, flags: flagWrite | flagFast, keys: keyFirstTwo, group: "set", summary: "Moves a member from one set to another.",
+		handler: argsHandler((*DefaultCommandHandler).handleSmoveCommand)},
+	{name: "SINTER", arity: -2, flags: flagReadonly, keys: keyAll, group: "set", summary: "Returns the intersect of multiple sets.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineCommand(command, args, SetIntersection)
+		}},
+	{name: "SUNION", arity: -2, flags: flagReadonly, keys: keyAll, group: "set", summary: "Returns the union of multiple sets.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineCommand(command, args, SetUnion)
+		}},
+	{name: "SDIFF", arity: -2, flags: flagReadonly, keys: keyAll, group: "set", summary: "Returns the difference of multiple sets.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineCommand(command, args, SetDifference)
+		}},
+	{name: "SINTERSTORE", arity: -3, flags: flagWrite | flagDenyOOM, keys: keyAll, group: "set", summary: "Stores the intersect of multiple sets in a key.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineStoreCommand(command, args, SetIntersection)
+		}},
+	{name: "SUNIONSTORE", arity: -3, flags: flagWrite | flagDenyOOM, keys: keyAll, group: "set", summary: "Stores the union of multiple sets in a key.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineStoreCommand(command, args, SetUnion)
+		}},
+	{name: "SDIFFSTORE", arity: -3, flags: flagWrite | flagDenyOOM, keys: keyAll, group: "set", summary: "Stores the difference of multiple sets in a key.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSetCombineStoreCommand(command, args, SetDifference)
+		}},
+
+	// Sorted sets
+	{name: "ZADD", arity: -4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "sorted-set", summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleZaddCommand)},
+	{name: "ZINCRBY", arity: 4, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "sorted-set", summary: "Increments the score of a member in a sorted set.",
+		handler: argsHandler((*DefaultCommandHandler).handleZincrbyCommand)},
+	{name: "ZREM", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "sorted-set", summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.",
+		handler: argsHandler((*DefaultCommandHandler).handleZremCommand)},
+	{name: "ZSCORE", arity: 3, flags: flagReadonly | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the score of a member in a sorted set.",
+		handler: argsHandler((*DefaultCommandHandler).handleZscoreCommand)},
+	{name: "ZCARD", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the number of members in a sorted set.",
+		handler: argsHandler((*DefaultCommandHandler).handleZcardCommand)},
+	{name: "ZRANK", arity: -3, flags: flagReadonly | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the index of a member in a sorted set ordered by ascending scores.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleZrankCommand(command, args, false)
+		}},
+	{name: "ZREVRANK", arity: -3, flags: flagReadonly | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the index of a member in a sorted set ordered by descending scores.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleZrankCommand(command, args, true)
+		}},
+	{name: "ZRANGE", arity: -4, flags: flagReadonly, keys: keyFirst, group: "sorted-set", summary: "Returns members in a sorted set within a range of indexes.",
+		handler: ctxHandler((*DefaultCommandHandler).handleZrangeCommand)},
+	{name: "ZCOUNT", arity: 4, flags: flagReadonly | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the count of members in a sorted set that have scores within a range.",
+		handler: argsHandler((*DefaultCommandHandler).handleZcountCommand)},
+	{name: "ZPOPMIN", arity: -2, flags: flagWrite | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleZpopCommand(ctx, command, args, false)
+		}},
+	{name: "ZPOPMAX", arity: -2, flags: flagWrite | flagFast, keys: keyFirst, group: "sorted-set", summary: "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleZpopCommand(ctx, command, args, true)
+		}},
+	{name: "ZREMRANGEBYSCORE", arity: 4, flags: flagWrite, keys: keyFirst, group: "sorted-set", summary: "Removes members in a sorted set within a range of scores. Deletes the sorted set if all members were removed.",
+		handler: argsHandler((*DefaultCommandHandler).handleZremrangebyscoreCommand)},
+
+	// Streams
+	{name: "XADD", arity: -5, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "stream", summary: "Appends a new message to a stream. Creates the key if it doesn't exist.",
+		handler: argsHandler((*DefaultCommandHandler).handleXaddCommand)},
+	{name: "XRANGE", arity: -4, flags: flagReadonly, keys: keyFirst, group: "stream", summary: "Returns the messages from a stream within a range of IDs.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleXrangeCommand(command, args, false)
+		}},
+	{name: "XREVRANGE", arity: -4, flags: flagReadonly, keys: keyFirst, group: "stream", summary: "Returns the messages from a stream within a range of IDs in reverse order.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleXrangeCommand(command, args, true)
+		}},
+	{name: "XLEN", arity: 2, flags: flagReadonly | flagFast, keys: keyFirst, group: "stream", summary: "Return the number of messages in a stream.",
+		handler: argsHandler((*DefaultCommandHandler).handleXlenCommand)},
+	{name: "XDEL", arity: -3, flags: flagWrite | flagFast, keys: keyFirst, group: "stream", summary: "Returns the number of messages after removing them from a stream.",
+		handler: argsHandler((*DefaultCommandHandler).handleXdelCommand)},
+	{name: "XTRIM", arity: -4, flags: flagWrite, keys: keyFirst, group: "stream", summary: "Deletes messages from the beginning of a stream.",
+		handler: argsHandler((*DefaultCommandHandler).handleXtrimCommand)},
+	{name: "XSETID", arity: 3, flags: flagWrite | flagDenyOOM | flagFast, keys: keyFirst, group: "stream", summary: "An internal command for replicating stream values.",
+		handler: argsHandler((*DefaultCommandHandler).handleXsetidCommand)},
+	{name: "XREAD", arity: -4, flags: flagReadonly, movableKeys: streamsKeys, group: "stream", summary: "Returns messages from multiple streams with IDs greater than the ones requested.",
+		handler: ctxHandler((*DefaultCommandHandler).handleXreadCommand)},
+	{name: "XGROUP", arity: -2, flags: flagWrite, keys: keySpec{2, 2, 1}, group: "stream", summary: "Creates a consumer group.",
+		handler: argsHandler((*DefaultCommandHandler).handleXgroupCommand)},
+	{name: "XREADGROUP", arity: -7, flags: flagWrite, movableKeys: streamsKeys, group: "stream", summary: "Returns new or historical messages from a stream for a consumer in a group.",
+		handler: ctxHandler((*DefaultCommandHandler).handleXreadgroupCommand)},
+	{name: "XACK", arity: -4, flags: flagWrite | flagFast, keys: keyFirst, group: "stream", summary: "Returns the number of messages that were successfully acknowledged by the consumer group member of a stream.",
+		handler: argsHandler((*DefaultCommandHandler).handleXackCommand)},
+	{name: "XPENDING", arity: -3, flags: flagReadonly, keys: keyFirst, group: "stream", summary: "Returns the information and entries from a stream consumer group's pending entries list.",
+		handler: argsHandler((*DefaultCommandHandler).handleXpendingCommand)},
+	{name: "XCLAIM", arity: -6, flags: flagWrite | flagFast, keys: keyFirst, group: "stream", summary: "Changes, or acquires, ownership of a message in a consumer group, as if the message was delivered a consumer group member.",
+		handler: argsHandler((*DefaultCommandHandler).handleXclaimCommand)},
+	{name: "XAUTOCLAIM", arity: -6, flags: flagWrite | flagFast, keys: keyFirst, group: "stream", summary: "Changes, or acquires, ownership of messages in a consumer group, as if the messages were delivered to as consumer group member.",
+		handler: argsHandler((*DefaultCommandHandler).handleXautoclaimCommand)},
+
+	// Pub/Sub
+	{name: "SUBSCRIBE", arity: -2, flags: flagPubSub | flagNoScript, group: "pubsub", summary: "Listens for messages published to channels.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSubscribeCommand(ctx, command, args, false)
+		}},
+	{name: "PSUBSCRIBE", arity: -2, flags: flagPubSub | flagNoScript, group: "pubsub", summary: "Listens for messages published to channels that match one or more patterns.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleSubscribeCommand(ctx, command, args, true)
+		}},
+	{name: "UNSUBSCRIBE", arity: -1, flags: flagPubSub | flagNoScript, group: "pubsub", summary: "Stops listening to messages posted to channels.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleUnsubscribeCommand(ctx, args, false)
+		}},
+	{name: "PUNSUBSCRIBE", arity: -1, flags: flagPubSub | flagNoScript, group: "pubsub", summary: "Stops listening to messages published to channels that match one or more patterns.",
+		handler: func(h *DefaultCommandHandler, ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+			return h.handleUnsubscribeCommand(ctx, args, true)
+		}},
+	{name: "PUBLISH", arity: 3, flags: flagPubSub | flagFast, group: "pubsub", summary: "Posts a message to a channel.",
+		handler: argsHandler((*DefaultCommandHandler).handlePublishCommand)},
+	{name: "PUBSUB", arity: -2, flags: flagPubSub, group: "pubsub", summary: "Inspects the state of the Pub/Sub subsystem.",
+		handler: ctxHandler((*DefaultCommandHandler).handlePubsubCommand)},
+
+	// Transactions
+	{name: "MULTI", arity: 1, flags: flagNoScript | flagFast, group: "transactions", summary: "Starts a transaction.",
+		handler: ctxHandler((*DefaultCommandHandler).handleMultiCommand)},
+	{name: "EXEC", arity: 1, flags: flagNoScript, group: "transactions", summary: "Executes all commands in a transaction.",
+		handler: ctxHandler((*DefaultCommandHandler).handleExecCommand)},
+	{name: "DISCARD", arity: 1, flags: flagNoScript | flagFast, group: "transactions", summary: "Discards a transaction.",
+		handler: ctxHandler((*DefaultCommandHandler).handleDiscardCommand)},
+	{name: "WATCH", arity: -2, flags: flagNoScript | flagFast, keys: keyAll, group: "transactions", summary: "Monitors changes to keys to determine the execution of a transaction.",
+		handler: ctxHandler((*DefaultCommandHandler).handleWatchCommand)},
+	{name: "UNWATCH", arity: 1, flags: flagNoScript | flagFast, group: "transactions", summary: "Forgets about watched keys of a transaction.",
+		handler: ctxHandler((*DefaultCommandHandler).handleUnwatchCommand)},
+
+	// Scripting
+	{name: "EVAL", arity: -3, flags: flagNoScript | flagDenyOOM, movableKeys: scriptKeys, group: "scripting", summary: "Executes a server-side Lua script.",
+		handler: ctxHandler((*DefaultCommandHandler).handleEvalCommand)},
+	{name: "EVALSHA", arity: -3, flags: flagNoScript | flagDenyOOM, movableKeys: scriptKeys, group: "scripting", summary: "Executes a server-side Lua script by SHA1 digest.",
+		handler: ctxHandler((*DefaultCommandHandler).handleEvalshaCommand)},
+	{name: "SCRIPT", arity: -2, flags: flagNoScript, group: "scripting", summary: "A container for Lua scripts management commands.",
+		handler: argsHandler((*DefaultCommandHandler).handleScriptCommand)},
+
+	// Server
+	{name: "ACL", arity: -2, flags: flagAdmin | flagNoScript, group: "server", summary: "A container for Access List Control commands.",
+		handler: ctxHandler((*DefaultCommandHandler).handleACLCommand)},
+	{name: "CONFIG", arity: -2, flags: flagAdmin | flagNoScript, group: "server", summary: "A container for server configuration commands.",
+		handler: ctxHandler((*DefaultCommandHandler).handleConfigCommand)},
+	{name: "INFO", arity: -1, group: "server", summary: "Returns information and statistics about the server.",
+		handler: ctxHandler((*DefaultCommandHandler).handleInfoCommand)},
+	{name: "COMMAND", arity: -1, group: "server", summary: "Returns detailed information about all commands.",
+		handler: ctxHandler((*DefaultCommandHandler).handleCommandCommand)},
+	{name: "SAVE", arity: 1, flags: flagAdmin | flagNoScript, group: "server", summary: "Synchronously saves the database(s) to disk.",
+		handler: argsHandler((*DefaultCommandHandler).handleSaveCommand)},
+	{name: "BGSAVE", arity: 1, flags: flagAdmin | flagNoScript, group: "server", summary: "Asynchronously saves the database(s) to disk.",
+		handler: argsHandler((*DefaultCommandHandler).handleBgsaveCommand)},
+	{name: "LASTSAVE", arity: 1, flags: flagFast, group: "server", summary: "Returns the Unix timestamp of the last successful save to disk.",
+		handler: argsHandler((*DefaultCommandHandler).handleLastsaveCommand)},
+	{name: "BGREWRITEAOF", arity: 1, flags: flagAdmin | flagNoScript, group: "server", summary: "Asynchronously rewrites the append-only file to disk.",
+		handler: argsHandler((*DefaultCommandHandler).handleBgrewriteaofCommand)},
+	{name: "REPLICAOF", arity: 3, flags: flagAdmin | flagNoScript, group: "server", summary: "Configures a server as replica of another, or promotes it to a master.",
+		handler: (*DefaultCommandHandler).handleReplicaofCommand},
+	{name: "SLAVEOF", arity: 3, flags: flagAdmin | flagNoScript, group: "server", summary: "Sets a Redis server as a replica of another, or promotes it to being a master.",
+		handler: (*DefaultCommandHandler).handleReplicaofCommand},
+	{name: "PSYNC", arity: 3, flags: flagAdmin | flagNoScript, group: "server", summary: "An internal command used in replication.",
+		handler: ctxHandler((*DefaultCommandHandler).handlePsyncCommand)},
+	{name: "REPLCONF", arity: -1, flags: flagAdmin | flagNoScript, group: "server", summary: "An internal command for configuring the replication stream.",
+		handler: ctxHandler((*DefaultCommandHandler).handleReplconfCommand)},
+	{name: "WAIT", arity: 3, flags: flagNoScript, group: "generic", summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.",
+		handler: ctxHandler((*DefaultCommandHandler).handleWaitCommand)},
+	{name: "ROLE", arity: 1, flags: flagNoScript | flagFast, group: "server", summary: "Returns the replication role.",
+		handler: argsHandler((*DefaultCommandHandler).handleRoleCommand)},
+}
+
+// Commands by name, built from commandTable
+var commands = make(map[string]*commandSpec)
+
+func init() {
+	for i := range commandTable {
+		commands[commandTable[i].name] = &commandTable[i]
+	}
+}
+
+// Looks up command, and checks it's given a valid number of arguments
+func checkCommand(command string, args []internal.Data) (*commandSpec, error) {
+	spec, ok := commands[command]
+	if !ok {
+		strs, _ := stringArgs(args)
+		return nil, errUnknownCommand(command, strs)
+	}
+	if !spec.validArity(len(args) + 1) {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	return spec, nil
+}
+
+// Returns whether n arguments, counting the command name, are valid
+func (s *commandSpec) validArity(n int) bool {
+	return (s.arity > 0 && n == s.arity) || (s.arity < 0 && n >= -s.arity)
+}
+
+// Private method to describe a command, as COMMAND INFO does
+func (s *commandSpec) info() internal.Data {
+	flags := []internal.Data{}
+	for _, f := range commandFlagNames {
+		if s.is(f.flag) {
+			flags = append(flags, *internal.NewSimpleStringData(f.name))
+		}
+	}
+	keys := s.keys
+	if s.movableKeys != nil {
+		flags = append(flags, *internal.NewSimpleStringData("movablekeys"))
+		keys = keyNone
+	}
+	categories := []internal.Data{}
+	for _, c := range s.categories() {
+		categories = append(categories, *internal.NewSimpleStringData("@" + c))
+	}
+	return *internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData(strings.ToLower(s.name)),
+		*internal.NewIntData(s.arity),
+		*internal.NewArrayData(flags),
+		*internal.NewIntData(keys.first),
+		*internal.NewIntData(keys.last),
+		*internal.NewIntData(keys.step),
+		*internal.NewArrayData(categories),
+		// Tips, key specifications and subcommands
+		*internal.NewArrayData([]internal.Data{}),
+		*internal.NewArrayData([]internal.Data{}),
+		*internal.NewArrayData([]internal.Data{}),
+	})
+}
+
+// Private method to document a command, as COMMAND DOCS does. A map for
+// RESP3 clients, and a flat array of fields and values for RESP2 clients.
+func (s *commandSpec) docs(proto internal.Protocol) internal.Data {
+	fields := []internal.Data{
+		*internal.NewBulkStringData("summary"), *internal.NewBulkStringData(s.summary),
+		*internal.NewBulkStringData("group"), *internal.NewBulkStringData(s.group),
+	}
+	return *pairsData(proto, fields)
+}
+
+// Returns alternating keys and values as a map for RESP3, or as they are
+// for RESP2
+func pairsData(proto internal.Protocol, pairs []internal.Data) *internal.Data {
+	if proto != internal.RESP3 {
+		return internal.NewArrayData(pairs)
+	}
+	m := make(map[internal.Data]internal.Data, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		m[pairs[i]] = pairs[i+1]
+	}
+	return internal.NewMapData(m)
+}
+
+// Returns the specs of the named commands, or of every command in order
+// if there are no names. Unknown names give nil.
+func commandSpecs(names []string) []*commandSpec {
+	if len(names) == 0 {
+		names = slices.Sorted(maps.Keys(commands))
+	}
+	specs := make([]*commandSpec, len(names))
+	for i, name := range names {
+		specs[i] = commands[strings.ToUpper(name)]
+	}
+	return specs
+}
+
+// COMMAND [COUNT | INFO [command ...] | DOCS [command ...] |
+// GETKEYS command [arg ...]]
+func (h *DefaultCommandHandler) handleCommandCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs) == 0 {
+		strs = []string{"INFO"}
+	}
+
+	subcommand := strings.ToUpper(strs[0])
+	switch {
+	case subcommand == "COUNT" && len(strs) == 1:
+		return internal.NewIntData(len(commands)), nil
+	case subcommand == "INFO":
+		specs := commandSpecs(strs[1:])
+		data := make([]internal.Data, len(specs))
+		for i, spec := range specs {
+			if spec == nil {
+				data[i] = *internal.NewNullData()
+			} else {
+				data[i] = spec.info()
+			}
+		}
+		return internal.NewArrayData(data), nil
+	case subcommand == "DOCS":
+		// Unknown commands are left out
+		proto := clientFromContext(ctx).protocol
+		var pairs []internal.Data
+		for _, spec := range commandSpecs(strs[1:]) {
+			if spec != nil {
+				pairs = append(pairs, *internal.NewBulkStringData(strings.ToLower(spec.name)), spec.docs(proto))
+			}
+		}
+		return pairsData(proto, pairs), nil
+	case subcommand == "GETKEYS" && len(strs) >= 2:
+		spec, ok := commands[strings.ToUpper(strs[1])]
+		if !ok {
+			return nil, errors.New("ERR Invalid command specified")
+		}
+		if !spec.validArity(len(strs) - 1) {
+			return nil, errors.New("ERR Invalid number of arguments specified for command")
+		}
+		keys := spec.getKeys(strs[2:])
+		if len(keys) == 0 {
+			return nil, errors.New("ERR The command has no key arguments")
+		}
+		return internal.NewArrayData(bulkStrings(keys)), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", strs[0])
+	}
+}
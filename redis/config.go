@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"myredis/internal"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// configParam is an option that can be set in redis.conf, on the command
+// line, or with CONFIG SET unless it's immutable
+type configParam struct {
+	name string
+	def  string
+	// Only set at startup
+	immutable bool
+	// Takes several arguments, such as bind's addresses
+	multi bool
+	// Checks a value, returning it as CONFIG GET shows it
+	parse func(value string) (string, error)
+}
+
+func parseAny(value string) (string, error) {
+	return value, nil
+}
+
+func parseYesNo(value string) (string, error) {
+	return parseEnum("yes", "no")(value)
+}
+
+func parseEnum(choices ...string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		for _, choice := range choices {
+			if strings.EqualFold(value, choice) {
+				return choice, nil
+			}
+		}
+		return "", fmt.Errorf("argument must be one of %s", strings.Join(choices, ", "))
+	}
+}
+
+func parseIntRange(min int, max int) func(string) (string, error) {
+	return func(value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return "", fmt.Errorf("argument must be an integer between %d and %d", min, max)
+		}
+		return strconv.Itoa(n), nil
+	}
+}
+
+func parseOctal(value string) (string, error) {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n > 0o777 {
+		return "", errors.New("argument must be an octal number of permissions")
+	}
+	return strconv.FormatUint(n, 8), nil
+}
+
+// Units of memory, as in redis.conf. k is 1000, and kb 1024.
+var memoryUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+}
+
+// Parses an amount of memory, such as 100mb
+func parseMemory(value string) (int64, error) {
+	s := strings.ToLower(value)
+	unit := int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/unit {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * unit, nil
+}
+
+func parseMemoryValue(value string) (string, error) {
+	n, err := parseMemory(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// Log levels, as redis.conf names them
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"verbose": slog.LevelInfo,
+	"notice":  slog.LevelInfo,
+	"warning": slog.LevelWarn,
+}
+
+// Options, in the order CONFIG GET and CONFIG REWRITE list them. Durations
+// are in seconds.
+var configParams = []configParam{
+	{name: "bind", def: "localhost", immutable: true, multi: true, parse: parseAny},
+	{name: "port", def: "6379", immutable: true, parse: parseIntRange(0, 65535)},
+	{name: "unixsocket", def: "", immutable: true, parse: parseAny},
+	{name: "unixsocketperm", def: "0", immutable: true, parse: parseOctal},
+	{name: "tls-port", def: "0", immutable: true, parse: parseIntRange(0, 65535)},
+	{name: "tls-cert-file", def: "", immutable: true, parse: parseAny},
+	{name: "tls-key-file", def: "", immutable: true, parse: parseAny},
+	{name: "tls-ca-cert-file", def: "", immutable: true, parse: parseAny},
+	{name: "tls-auth-clients", def: "yes", immutable: true, parse: parseEnum("yes", "optional", "no")},
+	{name: "timeout", def: "1800", parse: parseIntRange(0, 1<<31-1)},
+	{name: "write-timeout", def: "30", parse: parseIntRange(1, 1<<31-1)},
+	{name: "shutdown-timeout", def: "30", immutable: true, parse: parseIntRange(0, 1<<31-1)},
+	{name: "proto-max-bulk-len", def: "1048576", immutable: true, parse: parseMemoryValue},
+	{name: "loglevel", def: "notice", parse: parseEnum("debug", "verbose", "notice", "warning")},
+	{name: "requirepass", def: "", parse: parseAny},
+	{name: "maxmemory", def: "0", parse: parseMemoryValue},
+	{name: "maxmemory-policy", def: "noeviction", parse: parseEnum(evictionPolicyNames...)},
+	{name: "maxmemory-samples", def: "5", parse: parseIntRange(1, 64)},
+	{name: "dbfilename", def: "dump.rdb", immutable: true, parse: parseAny},
+	{name: "appendonly", def: "no", immutable: true, parse: parseYesNo},
+	{name: "appendfilename", def: "appendonly.aof", immutable: true, parse: parseAny},
+	{name: "appendfsync", def: "everysec", immutable: true, parse: parseEnum("always", "everysec", "no")},
+}
+
+func findConfigParam(name string) *configParam {
+	for i := range configParams {
+		if configParams[i].name == strings.ToLower(name) {
+			return &configParams[i]
+		}
+	}
+	return nil
+}
+
+// configStore holds the value of each option, and calls watchers when
+// CONFIG SET changes one
+type configStore struct {
+	// Guards the fields below
+	m sync.Mutex
+	// The file loaded, which CONFIG REWRITE writes. Empty if there's none.
+	path     string
+	values   map[string]string
+	watchers map[string][]func(value string)
+}
+
+// Returns a store with every option at its default
+func newConfigStore() *configStore {
+	c := &configStore{
+		values:   make(map[string]string, len(configParams)),
+		watchers: make(map[string][]func(string)),
+	}
+	for _, p := range configParams {
+		c.values[p.name] = p.def
+	}
+	return c
+}
+
+// Loads options from command line arguments, as redis-server takes them:
+// an optional config file, then options such as --port 7000 that override
+// it
+func loadConfig(args []string) (*configStore, error) {
+	c := newConfigStore()
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c.path = args[0]
+		f, err := os.Open(c.path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		directives, err := parseConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.path, err)
+		}
+		for _, d := range directives {
+			if err := c.apply(d.args); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", c.path, d.line, err)
+			}
+		}
+		args = args[1:]
+	}
+
+	directives, err := parseConfigArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range directives {
+		if err := c.apply(d); err != nil {
+			return nil, fmt.Errorf("--%s: %w", d[0], err)
+		}
+	}
+	return c, nil
+}
+
+// configDirective is a line of a config file, split into its name and
+// arguments
+type configDirective struct {
+	line int
+	args []string
+}
+
+// Parses a config file, skipping blank lines and comments
+func parseConfig(r io.Reader) ([]configDirective, error) {
+	var directives []configDirective
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(args) > 0 {
+			directives = append(directives, configDirective{line: line, args: args})
+		}
+	}
+	return directives, scanner.Err()
+}
+
+// Splits a line of a config file into arguments. Arguments may be quoted,
+// with escapes inside double quotes. A line starting with # is a comment.
+func splitConfigLine(line string) ([]string, error) {
+	var args []string
+	s := strings.TrimSpace(line)
+	if strings.HasPrefix(s, "#") {
+		return nil, nil
+	}
+	for s != "" {
+		var arg string
+		switch s[0] {
+		case '"':
+			// Find the closing quote, skipping escaped ones
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("unbalanced quotes")
+			}
+			unquoted, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", s[:end+1])
+			}
+			arg, s = unquoted, s[end+1:]
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unbalanced quotes")
+			}
+			arg, s = s[1:end+1], s[end+2:]
+		default:
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			arg, s = s[:end], s[end:]
+		}
+		// Quoted arguments must be followed by a space
+		if s != "" && !unicode.IsSpace(rune(s[0])) {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, arg)
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	}
+	return args, nil
+}
+
+// Splits command line options into directives. Each starts with its name,
+// prefixed by -- or -, followed by its arguments.
+func parseConfigArgs(args []string) ([][]string, error) {
+	var directives [][]string
+	for _, arg := range args {
+		name, ok := strings.CutPrefix(arg, "--")
+		if !ok && len(arg) > 1 && arg[0] == '-' && unicode.IsLetter(rune(arg[1])) {
+			name, ok = arg[1:], true
+		}
+		if ok {
+			directives = append(directives, []string{name})
+			continue
+		}
+		if len(directives) == 0 {
+			return nil, fmt.Errorf("argument %q must follow an option", arg)
+		}
+		last := len(directives) - 1
+		directives[last] = append(directives[last], arg)
+	}
+	return directives, nil
+}
+
+// Private method to apply a directive while loading, with the option's
+// name first
+func (c *configStore) apply(directive []string) error {
+	p := findConfigParam(directive[0])
+	if p == nil {
+		return fmt.Errorf("bad directive '%s'", directive[0])
+	}
+	args := directive[1:]
+	if len(args) == 0 || (!p.multi && len(args) > 1) {
+		return fmt.Errorf("wrong number of arguments for '%s'", p.name)
+	}
+	value, err := p.parse(strings.Join(args, " "))
+	if err != nil {
+		return fmt.Errorf("invalid '%s': %w", p.name, err)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.values[p.name] = value
+	return nil
+}
+
+// Returns the value of an option
+func (c *configStore) get(name string) string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.values[name]
+}
+
+// Returns the value of an integer option
+func (c *configStore) int(name string) int {
+	n, _ := strconv.Atoi(c.get(name))
+	return n
+}
+
+// Returns the value of an option in seconds as a duration
+func (c *configStore) seconds(name string) time.Duration {
+	return time.Duration(c.int(name)) * time.Second
+}
+
+// Calls fn with the option's value, and again whenever CONFIG SET changes it
+func (c *configStore) watch(name string, fn func(value string)) {
+	c.m.Lock()
+	c.watchers[name] = append(c.watchers[name], fn)
+	value := c.values[name]
+	c.m.Unlock()
+	fn(value)
+}
+
+// Private method to set options, given as pairs of names and values. If
+// one is invalid, none are set.
+func (c *configStore) set(pairs []string) error {
+	values := make(map[string]string, len(pairs)/2)
+	var names []string
+	for i := 0; i < len(pairs); i += 2 {
+		p := findConfigParam(pairs[i])
+		if p == nil {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", pairs[i])
+		}
+		if p.immutable {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", pairs[i])
+		}
+		if _, ok := values[p.name]; ok {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", pairs[i])
+		}
+		value, err := p.parse(pairs[i+1])
+		if err != nil {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", pairs[i], err)
+		}
+		values[p.name] = value
+		names = append(names, p.name)
+	}
+
+	c.m.Lock()
+	var notify []func()
+	for _, name := range names {
+		c.values[name] = values[name]
+		for _, fn := range c.watchers[name] {
+			notify = append(notify, func() { fn(values[name]) })
+		}
+	}
+	c.m.Unlock()
+	// Watchers may take locks of their own
+	for _, fn := range notify {
+		fn()
+	}
+	return nil
+}
+
+// Returns the names and values of options matching any of patterns
+func (c *configStore) matching(patterns []string) []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var pairs []string
+	for _, p := range configParams {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), p.name) {
+				pairs = append(pairs, p.name, c.values[p.name])
+				break
+			}
+		}
+	}
+	return pairs
+}
+
+// Quotes an argument for a config file, if it needs it
+func quoteConfigArg(arg string) string {
+	if arg != "" && !strings.ContainsFunc(arg, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r) || strings.ContainsRune(`"'\#`, r)
+	}) {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
+
+// Private method to format an option as a config file line
+func (c *configStore) line(p *configParam) string {
+	args := []string{c.values[p.name]}
+	if p.multi {
+		args = strings.Fields(args[0])
+	}
+	for i, arg := range args {
+		args[i] = quoteConfigArg(arg)
+	}
+	return p.name + " " + strings.Join(args, " ")
+}
+
+// Private method to write the current options to the config file. Lines
+// of options are updated in place, keeping comments and the file's order.
+// Options that aren't in the file are appended, unless at their default.
+func (c *configStore) rewrite() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.path == "" {
+		return errors.New("ERR The server is running without a config file")
+	}
+	content, err := os.ReadFile(c.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		args, err := splitConfigLine(line)
+		if err != nil || len(args) == 0 {
+			lines = append(lines, line)
+			continue
+		}
+		p := findConfigParam(args[0])
+		if p == nil {
+			lines = append(lines, line)
+			continue
+		}
+		// Only the first line of an option is kept
+		if !written[p.name] {
+			lines = append(lines, c.line(p))
+			written[p.name] = true
+		}
+	}
+	generated := false
+	for i := range configParams {
+		p := &configParams[i]
+		if written[p.name] || c.values[p.name] == p.def {
+			continue
+		}
+		if !generated {
+			lines = append(lines, "# Generated by CONFIG REWRITE")
+			generated = true
+		}
+		lines = append(lines, c.line(p))
+	}
+
+	// Written to a temporary file first, so a failure leaves the old file
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %v", err)
+	}
+	return nil
+}
+
+// Returns the server's config from the options
+func (c *configStore) serverConfig() (Config, error) {
+	config := Config{
+		ReadTimeout:     c.seconds("timeout"),
+		WriteTimeout:    c.seconds("write-timeout"),
+		MaxMessageSize:  c.int("proto-max-bulk-len"),
+		ShutdownTimeout: c.seconds("shutdown-timeout"),
+		TLSCertFile:     c.get("tls-cert-file"),
+		TLSKeyFile:      c.get("tls-key-file"),
+		TLSCAFile:       c.get("tls-ca-cert-file"),
+	}
+	var err error
+	config.TLSAuthClients, err = ParseTLSAuthClients(c.get("tls-auth-clients"))
+	if err != nil {
+		return Config{}, err
+	}
+
+	binds := strings.Fields(c.get("bind"))
+	for _, port := range []struct {
+		kind EndpointKind
+		port int
+	}{{EndpointTCP, c.int("port")}, {EndpointTLS, c.int("tls-port")}} {
+		if port.port == 0 {
+			continue
+		}
+		for _, bind := range binds {
+			config.Endpoints = append(config.Endpoints, Endpoint{Kind: port.kind, Address: net.JoinHostPort(bind, strconv.Itoa(port.port))})
+		}
+	}
+	if path := c.get("unixsocket"); path != "" {
+		perm, _ := strconv.ParseUint(c.get("unixsocketperm"), 8, 32)
+		config.Endpoints = append(config.Endpoints, Endpoint{Kind: EndpointUnix, Address: path, Perm: fs.FileMode(perm)})
+	}
+	return config, nil
+}
+
+// UseConfig applies options to the server, now and when CONFIG SET
+// changes them
+func (s *Server) UseConfig(c *configStore) {
+	c.watch("timeout", func(value string) {
+		n, _ := strconv.Atoi(value)
+		s.readTimeout.Store(int64(n) * int64(time.Second))
+	})
+	c.watch("write-timeout", func(value string) {
+		n, _ := strconv.Atoi(value)
+		s.writeTimeout.Store(int64(n) * int64(time.Second))
+	})
+}
+
+// UseConfig applies options to the handler, now and when CONFIG SET
+// changes them
+func (h *DefaultCommandHandler) UseConfig(c *configStore) {
+	h.config = c
+	c.watch("requirepass", h.SetRequirePass)
+	c.watch("maxmemory", func(value string) {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		h.dict.memory.limit.Store(n)
+	})
+	c.watch("maxmemory-policy", func(value string) {
+		policy, _ := ParseEvictionPolicy(value)
+		h.dict.memory.policy.Store(int32(policy))
+	})
+	c.watch("maxmemory-samples", func(value string) {
+		n, _ := strconv.Atoi(value)
+		h.dict.memory.samples.Store(int32(n))
+	})
+	c.watch("dbfilename", func(value string) {
+		h.rdb.m.Lock()
+		defer h.rdb.m.Unlock()
+		h.rdb.path = value
+	})
+}
+
+// CONFIG GET pattern [pattern ...] | SET parameter value [parameter value
+// ...] | REWRITE | RESETSTAT
+func (h *DefaultCommandHandler) handleConfigCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("CONFIG")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	subcommand := strings.ToUpper(strs[0])
+	switch {
+	case subcommand == "GET" && len(strs) >= 2:
+		pairs := h.config.matching(strs[1:])
+		return pairsData(clientFromContext(ctx).protocol, bulkStrings(pairs)), nil
+	case subcommand == "SET" && len(strs) >= 3 && len(strs)%2 == 1:
+		if err := h.config.set(strs[1:]); err != nil {
+			return nil, err
+		}
+		return internal.NewSimpleStringData("OK"), nil
+	case subcommand == "REWRITE" && len(strs) == 1:
+		if err := h.config.rewrite(); err != nil {
+			return nil, err
+		}
+		return internal.NewSimpleStringData("OK"), nil
+	case subcommand == "RESETSTAT" && len(strs) == 1:
+		h.stats.reset()
+		return internal.NewSimpleStringData("OK"), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", strs[0])
+	}
+}
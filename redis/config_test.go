@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes content to a config file in a temporary directory
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, strings.Join([]string{
+		"# A comment",
+		"bind 127.0.0.1 ::1",
+		"",
+		"  port 7000",
+		`requirepass "secret \"word\""`,
+		"maxmemory 2mb",
+		"loglevel warning",
+	}, "\n"))
+
+	// Options given on the command line override the file
+	c, err := loadConfig([]string{path, "--port", "7001", "-appendonly", "yes", "--maxmemory", "1gb"})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	for name, want := range map[string]string{
+		"bind":        "127.0.0.1 ::1",
+		"port":        "7001",
+		"requirepass": `secret "word"`,
+		"maxmemory":   "1073741824",
+		"loglevel":    "warning",
+		"appendonly":  "yes",
+		"timeout":     "1800",
+	} {
+		if got := c.get(name); got != want {
+			t.Fatalf("%s. want %q, got %q", name, want, got)
+		}
+	}
+
+	config, err := c.serverConfig()
+	if err != nil {
+		t.Fatalf("failed to make server config: %v", err)
+	}
+	want := []Endpoint{
+		{Kind: EndpointTCP, Address: "127.0.0.1:7001"},
+		{Kind: EndpointTCP, Address: "[::1]:7001"},
+	}
+	if !reflect.DeepEqual(config.Endpoints, want) {
+		t.Fatalf("endpoints. want %v, got %v", want, config.Endpoints)
+	}
+	if config.ReadTimeout != 1800*time.Second {
+		t.Fatalf("read timeout. want 30m, got %v", config.ReadTimeout)
+	}
+
+	// Errors name the line or option
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{writeConfigFile(t, "port 7000\nnope 1")}, "redis.conf:2: bad directive 'nope'"},
+		{[]string{writeConfigFile(t, "port seven")}, "redis.conf:1: invalid 'port'"},
+		{[]string{writeConfigFile(t, `requirepass "secret`)}, "redis.conf: line 1: unbalanced quotes"},
+		{[]string{"--timeout"}, "--timeout: wrong number of arguments for 'timeout'"},
+		{[]string{"--appendonly", "maybe"}, "--appendonly: invalid 'appendonly'"},
+		{[]string{filepath.Join(t.TempDir(), "missing.conf")}, "no such file"},
+	} {
+		if _, err := loadConfig(tc.args); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("loadConfig(%v). want error containing %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestConfigGetSet(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	expectResponse(t, h, bulkArray("timeout", "1800", "write-timeout", "30", "shutdown-timeout", "30"), "CONFIG", "GET", "*timeout")
+	expectResponse(t, h, bulkArray("port", "6379", "maxmemory", "0"), "CONFIG", "GET", "PORT", "maxmem?ry")
+	expectResponse(t, h, bulkArray(), "CONFIG", "GET", "nope")
+
+	// Values are checked before any is set
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET", "timeout", "60", "maxmemory", "1mb", "loglevel", "debug")
+	expectResponse(t, h, bulkArray("timeout", "60", "loglevel", "debug", "maxmemory", "1048576"), "CONFIG", "GET", "timeout", "maxmemory", "loglevel")
+	expectError(t, h, "ERR CONFIG SET failed (possibly related to argument 'loglevel') - argument must be one of debug, verbose, notice, warning", "CONFIG", "SET", "timeout", "10", "loglevel", "loud")
+	expectError(t, h, "ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config", "CONFIG", "SET", "port", "7000")
+	expectError(t, h, "ERR CONFIG SET failed (possibly related to argument 'TIMEOUT') - duplicate parameter", "CONFIG", "SET", "timeout", "10", "TIMEOUT", "20")
+	expectError(t, h, "ERR Unknown option or number of arguments for CONFIG SET - 'nope'", "CONFIG", "SET", "nope", "1")
+	expectResponse(t, h, bulkArray("timeout", "60"), "CONFIG", "GET", "timeout")
+	expectError(t, h, "ERR unknown subcommand or wrong number of arguments for 'SET'. Try CONFIG HELP.", "CONFIG", "SET", "timeout")
+
+	// Setting requirepass changes the default user's password
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET", "requirepass", "secret")
+	if err := h.acl.authenticate("default", "secret"); err != nil {
+		t.Fatalf("AUTH after CONFIG SET requirepass: %v", err)
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	expectError(t, h, "ERR The server is running without a config file", "CONFIG", "REWRITE")
+
+	path := writeConfigFile(t, strings.Join([]string{
+		"# Timeouts",
+		"timeout 100",
+		"port 7000",
+		"timeout 200",
+		"",
+	}, "\n"))
+	c, err := loadConfig([]string{path})
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	h.UseConfig(c)
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET", "timeout", "300", "requirepass", "a secret")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "REWRITE")
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	want := strings.Join([]string{
+		"# Timeouts",
+		"timeout 300",
+		"port 7000",
+		"# Generated by CONFIG REWRITE",
+		`requirepass "a secret"`,
+		"",
+	}, "\n")
+	if string(content) != want {
+		t.Fatalf("rewritten config. want %q, got %q", want, content)
+	}
+
+	// The rewritten file loads back to the same options
+	reloaded, err := loadConfig([]string{path})
+	if err != nil {
+		t.Fatalf("failed to load rewritten config: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded.values, c.values) {
+		t.Fatalf("reloaded config. want %v, got %v", c.values, reloaded.values)
+	}
+}
+
+func TestConfigResetStat(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	handle(t, h, "SET", "key", "value")
+	handle(t, h, "NOPE")
+	got, err := handle(t, h, "INFO", "stats")
+	if err != nil {
+		t.Fatalf("INFO stats, unexpected error: %v", err)
+	}
+	info := mustString(t, got)
+	if !strings.Contains(info, "total_commands_processed:2\r\n") || !strings.Contains(info, "total_error_replies:1\r\n") {
+		t.Fatalf("INFO stats. want 2 commands and 1 error, got %q", info)
+	}
+	if strings.Contains(info, "# Server") {
+		t.Fatalf("INFO stats. want only the stats section, got %q", info)
+	}
+
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "RESETSTAT")
+	got, err = handle(t, h, "INFO")
+	if err != nil {
+		t.Fatalf("INFO, unexpected error: %v", err)
+	}
+	info = mustString(t, got)
+	if !strings.Contains(info, "# Server\r\n") || !strings.Contains(info, "total_commands_processed:1\r\n") {
+		t.Fatalf("INFO after CONFIG RESETSTAT. want 1 command, got %q", info)
+	}
+}
+
+// CONFIG SET timeout applies to connections already made
+func TestServerConfigTimeout(t *testing.T) {
+	server := startConfiguredTestServer(t, Config{Address: "127.0.0.1:0"})
+	c := newConfigStore()
+	server.handler.(*DefaultCommandHandler).UseConfig(c)
+	server.UseConfig(c)
+
+	conn, reader := dialTestServer(t, server.listeners[0].Addr().String())
+	if got := sendCommand(t, conn, reader, "CONFIG", "SET", "timeout", "1"); !reflect.DeepEqual(got, internal.NewSimpleStringData("OK")) {
+		t.Fatalf("CONFIG SET timeout. want OK, got %v", got)
+	}
+	// The new timeout applies from the next read
+	sendCommand(t, conn, reader, "PING")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := reader.ReadData(); err != nil || got.GetKind() != internal.SimpleErrorKind {
+		t.Fatalf("read from idle connection. want error, got %v, %v", got, err)
+	}
+	if _, err := reader.ReadData(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read from idle connection. want closed, got %v", err)
+	}
+}
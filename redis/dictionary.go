@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type RecordKind int
+
+const (
+	StringRecord RecordKind = iota
+	ListRecord
+	HashRecord
+	SetRecord
+	ZSetRecord
+	StreamRecord
+)
+
+type KVRecord struct {
+	kind        RecordKind
+	value       string
+	listValue   *quicklist
+	hashValue   map[string]string
+	setValue    map[string]struct{}
+	zsetValue   *zset
+	streamValue *stream
+	expire      bool
+	ttl         time.Time
+	// When the record was last accessed, and how often, for eviction
+	access *recordAccess
+}
+
+// Returns true if the record has a TTL that has passed
+func (r KVRecord) expired(now time.Time) bool {
+	return r.expire && !now.Before(r.ttl)
+}
+
+// rwLocker is the lock guarding a Dictionary. It's an interface so commands
+// run by Locked can use a Dictionary whose lock is already held.
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+}
+
+// Dictionary stores key value pairs
+type Dictionary struct {
+	m  rwLocker
+	kv map[string]KVRecord
+	// Keys with a TTL, sampled by the active expire cycle
+	expires map[string]struct{}
+	// Clients blocked on list keys
+	blocking *blockingState
+	// Clients watching each key, for WATCH
+	watchers map[string]map[*watcher]struct{}
+	// Writes to log to the AOF
+	feed *propagator
+	// Memory records use, and the limit past which keys are evicted
+	memory *memoryState
+}
+
+// TODO: Return pointer?
+func NewDictionary() Dictionary {
+	feed := &propagator{}
+	return Dictionary{
+		m:        &dictLock{feed: feed},
+		kv:       make(map[string]KVRecord),
+		expires:  make(map[string]struct{}),
+		blocking: newBlockingState(),
+		watchers: make(map[string]map[*watcher]struct{}),
+		feed:     feed,
+		memory:   newMemoryState(),
+	}
+}
+
+// Kind returns the kind of record at k. It isn't counted as an access, as
+// commands check a key's kind before reading it.
+func (d *Dictionary) Kind(k string) (kind RecordKind, ok bool) {
+	d.m.RLock()
+	record, ok := d.kv[k]
+	expired := ok && record.expired(time.Now())
+	d.m.RUnlock()
+
+	if expired {
+		d.expireIfNeeded(k)
+		return 0, false
+	}
+	return record.kind, ok
+}
+
+func (d *Dictionary) Set(k string, v string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.set(k, v)
+}
+
+func (d *Dictionary) set(k string, v string) {
+	d.setRecord(k, KVRecord{kind: StringRecord, value: v, ttl: time.Time{}, expire: false})
+}
+
+// SetWithOptions sets a string value as the SET command does.
+// Returns the previous value if there was one, and whether the value was set.
+// With the GET option, a previous value that isn't a string is an error.
+func (d *Dictionary) SetWithOptions(k string, v string, options SetCommandOptions) (old string, existed bool, set bool, err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, existed := d.lookup(k)
+	if options.get && existed && record.kind != StringRecord {
+		return "", false, false, ErrWrongType
+	}
+	if (options.nx && existed) || (options.xx && !existed) {
+		return record.value, existed, false, nil
+	}
+
+	updated := KVRecord{kind: StringRecord, value: v}
+	if options.expire {
+		updated.expire = true
+		updated.ttl = options.expireAt
+	} else if options.keepTTL && existed {
+		updated.expire = record.expire
+		updated.ttl = record.ttl
+	}
+	d.setRecord(k, updated)
+
+	return record.value, existed, true, nil
+}
+
+// Private method to replace value in dict record. Consumer must acquire lock
+func (d *Dictionary) replaceOrSet(k string, v string) {
+	record, ok := d.lookup(k)
+	// Does not exist, so set
+	if !ok {
+		d.set(k, v)
+		return
+	}
+	// Exists, so replace value, but retain existing expiration.
+	// Record is a copy, so must be stored again.
+	record.value = v
+	d.setRecord(k, record)
+}
+
+func (d *Dictionary) SetWithExpire(k string, v string, expireMs int) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	ttl := time.Now().Add(time.Duration(expireMs) * time.Millisecond)
+
+	d.setRecord(k, KVRecord{kind: StringRecord, value: v, ttl: ttl, expire: true})
+}
+
+// TODO: Dedupe set functions
+func (d *Dictionary) SetWithExpireAt(k string, v string, expireAt int64) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	ttl := time.UnixMilli(expireAt)
+
+	d.setRecord(k, KVRecord{kind: StringRecord, value: v, ttl: ttl, expire: true})
+}
+
+func (d *Dictionary) Get(k string) (string, bool) {
+	var value string
+	var ok bool
+	d.read(k, func(record KVRecord, exists bool) {
+		value, ok = record.value, exists
+	})
+	return value, ok
+}
+
+// Returns int, but stores string
+func (d *Dictionary) Incr(k string) (int64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var i int64
+	record, ok := d.lookup(k)
+	if !ok {
+		i = 0
+	} else {
+		var err error
+		i, err = strconv.ParseInt(record.value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error unable to parse value to int: %v", record.value)
+		}
+	}
+
+	// Increment, then store
+	i++
+	d.replaceOrSet(k, strconv.FormatInt(i, 10))
+
+	return i, nil
+}
+
+// TODO: Dedupe with Incr
+func (d *Dictionary) Decr(k string) (int64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	var i int64
+	record, ok := d.lookup(k)
+	if !ok {
+		i = 0
+	} else {
+		var err error
+		i, err = strconv.ParseInt(record.value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error unable to parse value to int: %v", record.value)
+		}
+	}
+
+	// Decrement, then store
+	i--
+	d.replaceOrSet(k, strconv.FormatInt(i, 10))
+
+	return i, nil
+}
+
+// Private method to run fn with the live record at k under the read lock.
+// An expired record is passed as missing, and deleted once the read lock is
+// released. fn must not keep references into the record after returning.
+func (d *Dictionary) read(k string, fn func(record KVRecord, ok bool)) {
+	d.m.RLock()
+	now := time.Now()
+	record, ok := d.kv[k]
+	expired := ok && record.expired(now)
+	if expired {
+		record, ok = KVRecord{}, false
+	} else if ok {
+		record.access.access(now)
+	}
+	fn(record, ok)
+	d.m.RUnlock()
+
+	if expired {
+		d.expireIfNeeded(k)
+	}
+}
+
+// Private method to run fn with the live records at keys under the read
+// lock, as read does for one key. ok[i] is whether keys[i] exists.
+func (d *Dictionary) readKeys(keys []string, fn func(records []KVRecord, ok []bool)) {
+	d.m.RLock()
+	now := time.Now()
+	records, ok := make([]KVRecord, len(keys)), make([]bool, len(keys))
+	var expired []string
+	for i, k := range keys {
+		records[i], ok[i] = d.kv[k]
+		if ok[i] && records[i].expired(now) {
+			records[i], ok[i] = KVRecord{}, false
+			expired = append(expired, k)
+		} else if ok[i] {
+			records[i].access.access(now)
+		}
+	}
+	fn(records, ok)
+	d.m.RUnlock()
+
+	for _, k := range expired {
+		d.expireIfNeeded(k)
+	}
+}
+
+// Private method to get a live record. Expired records are deleted on access.
+// Consumer must acquire write lock.
+func (d *Dictionary) lookup(k string) (KVRecord, bool) {
+	now := time.Now()
+	record, ok := d.kv[k]
+	if !ok {
+		return KVRecord{}, false
+	}
+	if record.expired(now) {
+		d.delete(k)
+		return KVRecord{}, false
+	}
+	record.access.access(now)
+	return record, true
+}
+
+// Private method to store a record, keeping the expires index in sync. A
+// new record replacing another keeps its access counters, as in Redis.
+// Consumer must acquire write lock.
+func (d *Dictionary) setRecord(k string, record KVRecord) {
+	d.touch(k)
+	if record.access == nil {
+		if old, ok := d.kv[k]; ok {
+			record.access = old.access
+		} else {
+			record.access = newRecordAccess(time.Now())
+		}
+	}
+	d.kv[k] = record
+	if record.expire {
+		d.expires[k] = struct{}{}
+	} else {
+		delete(d.expires, k)
+	}
+}
+
+// Private method to remove a record. Consumer must acquire write lock.
+func (d *Dictionary) delete(k string) {
+	d.touch(k)
+	delete(d.kv, k)
+	delete(d.expires, k)
+}
+
+func (d *Dictionary) Del(k string) bool {
+	// Acquire write lock before reading and deleting
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	_, ok := d.lookup(k)
+
+	if !ok {
+		return false
+	}
+
+	d.delete(k)
+
+	return true
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors sent to clients. The first word is the error code clients match on.
+var (
+	ErrSyntax     = errors.New("ERR syntax error")
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+func errWrongNumberOfArgs(command string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+func errUnknownCommand(command string, args []string) error {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "'%s' ", arg)
+	}
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", strings.ToLower(command), b.String())
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"myredis/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Active expire cycle parameters, modelled on Redis's activeExpireCycle.
+// Every tick, keys with a TTL are sampled and expired ones are deleted. If
+// enough of the sample was expired, there are likely more, so the cycle
+// repeats until it runs out of time.
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	activeExpireSample   = 20
+	// Repeat while more than this percentage of the sample was expired
+	activeExpireAcceptable = 25
+	// Share of each interval the cycle may spend, as a percentage
+	activeExpireCPUPercent = 25
+)
+
+// Deletes k if it has expired. Used by read paths that only hold the read
+// lock when they find an expired record.
+func (d *Dictionary) expireIfNeeded(k string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.lookup(k)
+}
+
+// RunActiveExpire deletes expired keys in the background until ctx is done.
+// Lazy expiration only removes keys on access, so this stops memory growing
+// with keys that are never read again.
+func (d *Dictionary) RunActiveExpire(ctx context.Context) {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+
+	budget := activeExpireInterval * activeExpireCPUPercent / 100
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.activeExpireCycle(budget)
+		}
+	}
+}
+
+// Runs sample rounds until few expired keys are found or time is up.
+// Returns the number of keys deleted.
+func (d *Dictionary) activeExpireCycle(budget time.Duration) int {
+	start := time.Now()
+	total := 0
+	for {
+		sampled, expired := d.activeExpireSample()
+		total += expired
+		if sampled == 0 || expired*100 <= sampled*activeExpireAcceptable {
+			return total
+		}
+		if time.Since(start) > budget {
+			return total
+		}
+	}
+}
+
+// Checks a random sample of keys with a TTL, deleting expired ones.
+// Map iteration starts at a random position, so ranging over the expires
+// index gives a cheap random sample.
+func (d *Dictionary) activeExpireSample() (sampled int, expired int) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := time.Now()
+	for k := range d.expires {
+		if sampled == activeExpireSample {
+			break
+		}
+		sampled++
+		if d.kv[k].expired(now) {
+			d.delete(k)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+// ExpireCondition restricts when a new expire time is applied.
+// Conditions are flags, so XX can be combined with GT or LT.
+type ExpireCondition int
+
+const ExpireAlways ExpireCondition = 0
+
+const (
+	// Only when the key has no expiry
+	ExpireNX ExpireCondition = 1 << iota
+	// Only when the key has an expiry
+	ExpireXX
+	// Only when the new expiry is greater than the current one
+	ExpireGT
+	// Only when the new expiry is less than the current one
+	ExpireLT
+)
+
+// Expire sets the expire time of an existing key, subject to cond.
+// A time in the past deletes the key. Returns false if the key doesn't exist
+// or cond is not met.
+func (d *Dictionary) Expire(k string, at time.Time, cond ExpireCondition) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, ok := d.lookup(k)
+	if !ok {
+		return false
+	}
+
+	// Keys without expiry are treated as having an infinite TTL
+	if cond&ExpireNX != 0 && record.expire {
+		return false
+	}
+	if cond&ExpireXX != 0 && !record.expire {
+		return false
+	}
+	if cond&ExpireGT != 0 && (!record.expire || !at.After(record.ttl)) {
+		return false
+	}
+	if cond&ExpireLT != 0 && record.expire && !at.Before(record.ttl) {
+		return false
+	}
+
+	if !at.After(time.Now()) {
+		d.delete(k)
+		return true
+	}
+
+	record.expire = true
+	record.ttl = at
+	d.setRecord(k, record)
+	return true
+}
+
+// Persist removes the expire time of a key.
+// Returns false if the key doesn't exist or has no expire time.
+func (d *Dictionary) Persist(k string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, ok := d.lookup(k)
+	if !ok || !record.expire {
+		return false
+	}
+
+	record.expire = false
+	record.ttl = time.Time{}
+	d.setRecord(k, record)
+	return true
+}
+
+// ExpireTime returns when a key expires. expire is false if the key has no
+// expire time, and ok is false if the key doesn't exist.
+func (d *Dictionary) ExpireTime(k string) (at time.Time, expire bool, ok bool) {
+	d.read(k, func(record KVRecord, exists bool) {
+		at, expire, ok = record.ttl, record.expire, exists
+	})
+	return at, expire, ok
+}
+
+// EXPIRE key seconds [NX | XX | GT | LT], and the PEXPIRE, EXPIREAT and
+// PEXPIREAT variants. unit is the unit of the time argument, and absolute is
+// true when it's a unix timestamp rather than relative to now.
+func (h *DefaultCommandHandler) handleExpireCommand(command string, args []internal.Data, unit time.Duration, absolute bool) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	n, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	cond := ExpireAlways
+	for _, option := range strs[2:] {
+		switch strings.ToUpper(option) {
+		case "NX":
+			cond |= ExpireNX
+		case "XX":
+			cond |= ExpireXX
+		case "GT":
+			cond |= ExpireGT
+		case "LT":
+			cond |= ExpireLT
+		default:
+			return nil, fmt.Errorf("ERR Unsupported option %s", option)
+		}
+	}
+	if cond&ExpireNX != 0 && cond != ExpireNX {
+		return nil, fmt.Errorf("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond&ExpireGT != 0 && cond&ExpireLT != 0 {
+		return nil, fmt.Errorf("ERR GT and LT options at the same time are not compatible")
+	}
+
+	at, ok := expireAt(n, unit, absolute)
+	if !ok {
+		return nil, fmt.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(command))
+	}
+
+	if !h.dict.Expire(key, at, cond) {
+		h.dict.rewriteCommand()
+		return internal.NewIntData(0), nil
+	}
+	// Logged with an absolute time, so replaying the AOF later expires the
+	// key at the same time
+	h.dict.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(at.UnixMilli(), 10))
+	return internal.NewIntData(1), nil
+}
+
+// Converts a command's time argument to an absolute time.
+// Returns false if the time overflows when converted to milliseconds.
+func expireAt(n int64, unit time.Duration, absolute bool) (time.Time, bool) {
+	perUnit := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/perUnit || n < math.MinInt64/perUnit {
+		return time.Time{}, false
+	}
+	ms := n * perUnit
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return time.Time{}, false
+		}
+		ms += now
+	}
+	return time.UnixMilli(ms), true
+}
+
+// TTL key, and the PTTL, EXPIRETIME and PEXPIRETIME variants.
+// Replies -2 if the key doesn't exist, and -1 if it has no expire time.
+func (h *DefaultCommandHandler) handleTTLCommand(command string, args []internal.Data, unit time.Duration, absolute bool) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	at, expire, ok := h.dict.ExpireTime(key)
+	if !ok {
+		return internal.NewIntData(-2), nil
+	}
+	if !expire {
+		return internal.NewIntData(-1), nil
+	}
+
+	perUnit := int64(unit / time.Millisecond)
+	ms := at.UnixMilli()
+	if !absolute {
+		ms = max(time.Until(at).Milliseconds(), 0)
+	}
+	// Round to the nearest unit, as Redis does
+	return internal.NewIntData(int((ms + perUnit/2) / perUnit)), nil
+}
+
+// PERSIST key
+func (h *DefaultCommandHandler) handlePersistCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("PERSIST")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	if h.dict.Persist(key) {
+		return internal.NewIntData(1), nil
+	}
+	return internal.NewIntData(0), nil
+}
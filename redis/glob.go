@@ -0,0 +1,94 @@
+package main
+
+// globMatch reports whether s matches a Redis glob pattern, as used by KEYS
+// and PSUBSCRIBE. "*" matches any run of bytes and "?" any single byte.
+// "[abc]", "[^abc]" and "[a-z]" match a byte in, or not in, a set. "\"
+// escapes the next byte. Unlike path.Match, "/" isn't special.
+//
+// Matching is iterative. On a mismatch it only backtracks to the last "*",
+// which takes one more byte, as whatever more an earlier "*" could match,
+// the last one can match instead. It takes O(len(pattern)*len(s)) time,
+// rather than the exponential time of backtracking to every "*".
+func globMatch(pattern string, s string) bool {
+	// Where to resume after the last "*": the pattern after it, and the
+	// part of s it doesn't match yet. star is -1 before any "*".
+	star, starS := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				for p < len(pattern) && pattern[p] == '*' {
+					p++
+				}
+				if p == len(pattern) {
+					return true
+				}
+				star, starS = p, i
+				continue
+			}
+			if next, ok := matchByte(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last "*" match one more byte, and try again after it
+		starS++
+		p, i = star, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches c against the element of pattern at p, which isn't "*". Returns
+// the position of the next element.
+func matchByte(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		rest, ok := matchClass(pattern[p+1:], c)
+		return len(pattern) - len(rest), ok
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, pattern[p] == c
+}
+
+// Matches c against a class, with pattern just after the "[". Returns the
+// pattern after the closing "]". An unterminated class ends with the pattern.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			match = match || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			match = match || (c >= start && c <= end)
+			pattern = pattern[3:]
+		default:
+			match = match || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, match != negate
+}
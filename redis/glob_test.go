@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "anything/at/all", true},
+		{"news.*", "news.sports", true},
+		{"news.*", "weather.today", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hello world", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"a**b", "axxb", true},
+		{"[abc", "b", true},
+		{"*.txt", "a.txt.txt", true},
+		{"a*b*c", "abxbyc", true},
+		{"a*b*c", "abxbyd", false},
+		{"*?", "", false},
+		{`\`, `\`, true},
+		// Patterns that take exponential time to backtrack through
+		{strings.Repeat("*a", 12) + "b", strings.Repeat("a", 60), false},
+		{strings.Repeat("*a", 12) + "b", strings.Repeat("a", 60) + "b", true},
+	}
+
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q). want=%t, got=%t", tt.pattern, tt.s, tt.want, got)
+		}
+	}
+}
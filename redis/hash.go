@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"myredis/internal"
+	"strconv"
+)
+
+// Private method to get a hash record for writing. Returns ErrWrongType if
+// the key holds another kind. Consumer must acquire write lock.
+func (d *Dictionary) lookupHash(k string) (KVRecord, bool, error) {
+	record, ok := d.lookup(k)
+	if !ok {
+		return KVRecord{}, false, nil
+	}
+	if record.kind != HashRecord {
+		return KVRecord{}, false, ErrWrongType
+	}
+	return record, true, nil
+}
+
+// Private method to get a hash record for writing, or a new empty one if the
+// key doesn't exist. New records must be stored by the consumer once
+// modified, so failed commands don't leave empty hashes behind. Consumer must
+// acquire write lock.
+func (d *Dictionary) lookupOrNewHash(k string) (KVRecord, error) {
+	record, exists, err := d.lookupHash(k)
+	if err != nil {
+		return KVRecord{}, err
+	}
+	if !exists {
+		record = KVRecord{kind: HashRecord, hashValue: make(map[string]string)}
+	}
+	return record, nil
+}
+
+// Private method to run fn with the hash at k under the read lock. fn is not
+// called if the key doesn't exist.
+func (d *Dictionary) readHash(k string, fn func(hash map[string]string)) (err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != HashRecord {
+			err = ErrWrongType
+			return
+		}
+		fn(record.hashValue)
+	})
+	return err
+}
+
+// HashSet sets fields of a hash. fieldValues holds field and value pairs.
+// Returns the number of fields that were added rather than updated.
+func (d *Dictionary) HashSet(k string, fieldValues []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewHash(k)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		if _, ok := record.hashValue[fieldValues[i]]; !ok {
+			added++
+		}
+		record.hashValue[fieldValues[i]] = fieldValues[i+1]
+	}
+	d.setRecord(k, record)
+	return added, nil
+}
+
+// HashSetNX sets a field only if it doesn't exist. Returns true if set.
+func (d *Dictionary) HashSetNX(k string, field string, value string) (bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewHash(k)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := record.hashValue[field]; ok {
+		return false, nil
+	}
+	record.hashValue[field] = value
+	d.setRecord(k, record)
+	return true, nil
+}
+
+func (d *Dictionary) HashGet(k string, field string) (value string, ok bool, err error) {
+	err = d.readHash(k, func(hash map[string]string) {
+		value, ok = hash[field]
+	})
+	return value, ok, err
+}
+
+// HashMGet returns the values of fields. found is false for missing fields.
+func (d *Dictionary) HashMGet(k string, fields []string) (values []string, found []bool, err error) {
+	values = make([]string, len(fields))
+	found = make([]bool, len(fields))
+	err = d.readHash(k, func(hash map[string]string) {
+		for i, field := range fields {
+			values[i], found[i] = hash[field]
+		}
+	})
+	return values, found, err
+}
+
+// HashGetAll returns a copy of the hash. Missing keys are an empty hash.
+func (d *Dictionary) HashGetAll(k string) (hash map[string]string, err error) {
+	err = d.readHash(k, func(h map[string]string) {
+		hash = maps.Clone(h)
+	})
+	if hash == nil {
+		hash = map[string]string{}
+	}
+	return hash, err
+}
+
+// HashDel removes fields, deleting the key once the hash is empty.
+// Returns the number of fields removed.
+func (d *Dictionary) HashDel(k string, fields []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupHash(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	removed := 0
+	for _, field := range fields {
+		if _, ok := record.hashValue[field]; ok {
+			delete(record.hashValue, field)
+			removed++
+		}
+	}
+	if len(record.hashValue) == 0 {
+		d.delete(k)
+	} else if removed > 0 {
+		d.touch(k)
+	}
+	return removed, nil
+}
+
+func (d *Dictionary) HashExists(k string, field string) (ok bool, err error) {
+	err = d.readHash(k, func(hash map[string]string) {
+		_, ok = hash[field]
+	})
+	return ok, err
+}
+
+func (d *Dictionary) HashLen(k string) (n int, err error) {
+	err = d.readHash(k, func(hash map[string]string) {
+		n = len(hash)
+	})
+	return n, err
+}
+
+// HashStrLen returns the length of a field's value, or 0 if it doesn't exist
+func (d *Dictionary) HashStrLen(k string, field string) (n int, err error) {
+	err = d.readHash(k, func(hash map[string]string) {
+		n = len(hash[field])
+	})
+	return n, err
+}
+
+// HashIncrBy adds incr to an integer field. Missing fields start at 0.
+func (d *Dictionary) HashIncrBy(k string, field string, incr int64) (int64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewHash(k)
+	if err != nil {
+		return 0, err
+	}
+
+	var i int64
+	if value, ok := record.hashValue[field]; ok {
+		i, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("ERR hash value is not an integer")
+		}
+	}
+	if (incr > 0 && i > math.MaxInt64-incr) || (incr < 0 && i < math.MinInt64-incr) {
+		return 0, fmt.Errorf("ERR increment or decrement would overflow")
+	}
+	i += incr
+	record.hashValue[field] = strconv.FormatInt(i, 10)
+	d.setRecord(k, record)
+	return i, nil
+}
+
+// HashIncrByFloat adds incr to a float field. Missing fields start at 0.
+func (d *Dictionary) HashIncrByFloat(k string, field string, incr float64) (float64, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewHash(k)
+	if err != nil {
+		return 0, err
+	}
+
+	var f float64
+	if value, ok := record.hashValue[field]; ok {
+		f, err = strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("ERR hash value is not a float")
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("ERR increment would produce NaN or Infinity")
+	}
+	record.hashValue[field] = formatFloat(f)
+	d.setRecord(k, record)
+	return f, nil
+}
+
+// Formats a float the way Redis stores them, without an exponent
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// HSET key field value [field value ...]
+func (h *DefaultCommandHandler) handleHsetCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, errWrongNumberOfArgs("HSET")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	added, err := h.dict.HashSet(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(added), nil
+}
+
+// HSETNX key field value
+func (h *DefaultCommandHandler) handleHsetnxCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("HSETNX")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := h.dict.HashSetNX(strs[0], strs[1], strs[2])
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return internal.NewIntData(1), nil
+	}
+	return internal.NewIntData(0), nil
+}
+
+// HGET key field
+func (h *DefaultCommandHandler) handleHgetCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("HGET")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok, err := h.dict.HashGet(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewBulkStringData(value), nil
+}
+
+// HMGET key field [field ...]
+func (h *DefaultCommandHandler) handleHmgetCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("HMGET")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	values, found, err := h.dict.HashMGet(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]internal.Data, len(values))
+	for i, value := range values {
+		if found[i] {
+			data[i] = *internal.NewBulkStringData(value)
+		} else {
+			data[i] = *internal.NewNullData()
+		}
+	}
+	return internal.NewArrayData(data), nil
+}
+
+// HGETALL key. Replies with a map, which RESP2 clients get as a flat array.
+func (h *DefaultCommandHandler) handleHgetallCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("HGETALL")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	hash, err := h.dict.HashGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[internal.Data]internal.Data, len(hash))
+	for field, value := range hash {
+		m[*internal.NewBulkStringData(field)] = *internal.NewBulkStringData(value)
+	}
+	return internal.NewMapData(m), nil
+}
+
+// HKEYS and HVALS key
+func (h *DefaultCommandHandler) handleHkeysCommand(command string, args []internal.Data, values bool) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	hash, err := h.dict.HashGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]internal.Data, 0, len(hash))
+	for field, value := range hash {
+		if values {
+			data = append(data, *internal.NewBulkStringData(value))
+		} else {
+			data = append(data, *internal.NewBulkStringData(field))
+		}
+	}
+	return internal.NewArrayData(data), nil
+}
+
+// HDEL key field [field ...]
+func (h *DefaultCommandHandler) handleHdelCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("HDEL")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := h.dict.HashDel(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(removed), nil
+}
+
+// HEXISTS key field
+func (h *DefaultCommandHandler) handleHexistsCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("HEXISTS")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := h.dict.HashExists(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return internal.NewIntData(1), nil
+	}
+	return internal.NewIntData(0), nil
+}
+
+// HLEN key
+func (h *DefaultCommandHandler) handleHlenCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("HLEN")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.HashLen(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// HSTRLEN key field
+func (h *DefaultCommandHandler) handleHstrlenCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("HSTRLEN")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := h.dict.HashStrLen(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// HINCRBY key field increment
+func (h *DefaultCommandHandler) handleHincrbyCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("HINCRBY")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	incr, err := parseInt(strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	i, err := h.dict.HashIncrBy(strs[0], strs[1], incr)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(int(i)), nil
+}
+
+// HINCRBYFLOAT key field increment. Replies with a bulk string, as Redis does.
+func (h *DefaultCommandHandler) handleHincrbyfloatCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("HINCRBYFLOAT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	incr, err := parseFloat(strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := h.dict.HashIncrByFloat(strs[0], strs[1], incr)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewBulkStringData(formatFloat(f)), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"myredis/internal"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stats counts what the server has done, for INFO. CONFIG RESETSTAT
+// zeroes them.
+type stats struct {
+	commands atomic.Int64
+	errors   atomic.Int64
+	evicted  atomic.Int64
+}
+
+func (s *stats) reset() {
+	s.commands.Store(0)
+	s.errors.Store(0)
+	s.evicted.Store(0)
+}
+
+// An INFO section, with the fields it reports in order
+type infoSection struct {
+	name   string
+	fields func(h *DefaultCommandHandler) [][2]string
+}
+
+var infoSections = []infoSection{
+	{"server", func(h *DefaultCommandHandler) [][2]string {
+		return [][2]string{
+			{"redis_version", ServerVersion},
+			{"redis_mode", "standalone"},
+			{"process_id", fmt.Sprint(os.Getpid())},
+			{"tcp_port", h.config.get("port")},
+			{"uptime_in_seconds", fmt.Sprint(int(time.Since(h.started).Seconds()))},
+			{"config_file", h.config.path},
+		}
+	}},
+	{"memory", func(h *DefaultCommandHandler) [][2]string {
+		used, limit := h.dict.UsedMemory(), h.dict.memory.limit.Load()
+		return [][2]string{
+			{"used_memory", fmt.Sprint(used)},
+			{"used_memory_human", bytesToHuman(used)},
+			{"maxmemory", fmt.Sprint(limit)},
+			{"maxmemory_human", bytesToHuman(limit)},
+			{"maxmemory_policy", EvictionPolicy(h.dict.memory.policy.Load()).String()},
+		}
+	}},
+	{"stats", func(h *DefaultCommandHandler) [][2]string {
+		return [][2]string{
+			{"total_commands_processed", fmt.Sprint(h.stats.commands.Load())},
+			{"total_error_replies", fmt.Sprint(h.stats.errors.Load())},
+			{"evicted_keys", fmt.Sprint(h.stats.evicted.Load())},
+		}
+	}},
+}
+
+// Formats an amount of memory as INFO does, such as 1.50M
+func bytesToHuman(n int64) string {
+	units := []string{"K", "M", "G", "T"}
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	size, unit := float64(n)/1024, 0
+	for size >= 1024 && unit < len(units)-1 {
+		size, unit = size/1024, unit+1
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
+
+// INFO [section ...]
+func (h *DefaultCommandHandler) handleInfoCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	all := len(strs) == 0
+	wanted := make(map[string]bool)
+	for _, s := range strs {
+		switch s = strings.ToLower(s); s {
+		case "all", "default", "everything":
+			all = true
+		default:
+			wanted[s] = true
+		}
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		for _, field := range section.fields(h) {
+			fmt.Fprintf(&b, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+	return internal.NewBulkStringData(b.String()), nil
+}
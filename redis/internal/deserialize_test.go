@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"math"
+	"math/big"
 	"reflect"
 	"testing"
 )
@@ -46,6 +48,68 @@ func TestDeserialize(t *testing.T) {
 		},
 	})
 	// runDeserializeTest(t, "SimpleError", "-Error message\r\n", &Data{kind: SimpleErrorKind, value: "Error message"})
+	runDeserializeTest(t, "RESP3 Null", "_\r\n", Data{kind: NullKind})
+	runDeserializeTest(t, "Boolean True", "#t\r\n", Data{kind: BooleanKind, value: true})
+	runDeserializeTest(t, "Boolean False", "#f\r\n", Data{kind: BooleanKind, value: false})
+	runDeserializeTest(t, "Double", ",1.5\r\n", Data{kind: DoubleKind, value: 1.5})
+	runDeserializeTest(t, "Double Exponent", ",1.5e3\r\n", Data{kind: DoubleKind, value: 1500.0})
+	runDeserializeTest(t, "Double Inf", ",-inf\r\n", Data{kind: DoubleKind, value: math.Inf(-1)})
+	runDeserializeTest(t, "BigNumber", "(3492890328409238509324850943850943825024385\r\n", Data{
+		kind: BigNumberKind, value: "3492890328409238509324850943850943825024385"})
+	runDeserializeTest(t, "BulkError", "!21\r\nSYNTAX invalid syntax\r\n", Data{kind: BulkErrorKind, value: "SYNTAX invalid syntax"})
+	runDeserializeTest(t, "VerbatimString", "=15\r\ntxt:Some string\r\n", Data{
+		kind: VerbatimStringKind, value: Verbatim{Format: "txt", Text: "Some string"}})
+	runDeserializeTest(t, "Set", "~2\r\n+a\r\n:1\r\n", Data{
+		kind:  SetKind,
+		value: []Data{{kind: SimpleStringKind, value: "a"}, {kind: IntKind, value: 1}}})
+	runDeserializeTest(t, "Push", ">2\r\n$7\r\nmessage\r\n$2\r\nhi\r\n", Data{
+		kind:  PushKind,
+		value: []Data{{kind: BulkStringKind, value: "message"}, {kind: BulkStringKind, value: "hi"}}})
+	runDeserializeTest(t, "Attribute", "|1\r\n+ttl\r\n:3600\r\n$5\r\nvalue\r\n", Data{
+		kind: AttributeKind,
+		value: Attribute{
+			Attributes: map[Data]Data{*NewSimpleStringData("ttl"): *NewIntData(3600)},
+			Value:      *NewBulkStringData("value"),
+		}})
+}
+
+func TestDeserializeRESP3Invalid(t *testing.T) {
+	inputs := []string{"_x\r\n", "#x\r\n", ",abc\r\n", "(12a\r\n", "=5\r\nab:cd\r\n", "~-1\r\n"}
+	for _, input := range inputs {
+		if _, err := Deserialize(input); err == nil {
+			t.Errorf("input %q, want error", input)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []Data{
+		*NewBooleanData(true),
+		*NewDoubleData(3.14),
+		*NewDoubleData(math.Inf(1)),
+		*NewBigNumberData(new(big.Int).Lsh(big.NewInt(1), 100)),
+		*NewBulkErrorData("ERR multi\r\nline"),
+		*NewVerbatimStringData("mkd", "# héllo"),
+		*NewSetData([]Data{*NewBulkStringData("a"), *NewBulkStringData("b")}),
+		*NewPushData([]Data{*NewBulkStringData("message"), *NewIntData(1)}),
+		*NewAttributeData(map[Data]Data{*NewSimpleStringData("key"): *NewBooleanData(false)}, *NewArrayData([]Data{*NewIntData(1)})),
+		*NewBulkStringData("héllo"),
+		*NewNullData(),
+	}
+
+	for _, input := range inputs {
+		serialized, err := Serialize(input)
+		if err != nil {
+			t.Fatalf("input %v, unexpected serialize error: %v", input, err)
+		}
+		got, err := Deserialize(serialized)
+		if err != nil {
+			t.Fatalf("input %v, unexpected deserialize error: %v", input, err)
+		}
+		if !reflect.DeepEqual(*got, input) {
+			t.Fatalf("input %v, round trip got %v", input, got)
+		}
+	}
 }
 
 func runDeserializeTest(t *testing.T, name string, input string, want Data) {
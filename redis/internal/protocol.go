@@ -0,0 +1,61 @@
+package internal
+
+import "strings"
+
+// Protocol is the RESP version spoken on a connection
+type Protocol int
+
+const (
+	RESP2 Protocol = 2
+	RESP3 Protocol = 3
+)
+
+// SerializeProtocol encodes data for a client speaking proto.
+// RESP2 clients get RESP3 only types downgraded, see Downgrade.
+func SerializeProtocol(data Data, proto Protocol) (string, error) {
+	if proto == RESP3 {
+		return serialize(data, RESP3)
+	}
+	return serialize(Downgrade(data), RESP2)
+}
+
+// Downgrade converts RESP3 only types to their RESP2 equivalent, following
+// the same rules as Redis. Maps become flat arrays of key value pairs, sets
+// and pushes become arrays, booleans become 1 or 0, doubles and big numbers
+// become bulk strings, and attributes are dropped.
+func Downgrade(d Data) Data {
+	switch d.kind {
+	case ArrayKind, SetKind, PushKind:
+		a := d.value.([]Data)
+		result := make([]Data, len(a))
+		for i, item := range a {
+			result[i] = Downgrade(item)
+		}
+		return Data{kind: ArrayKind, value: result}
+	case MapKind:
+		m := d.value.(map[Data]Data)
+		result := make([]Data, 0, 2*len(m))
+		for key, value := range m {
+			result = append(result, Downgrade(key), Downgrade(value))
+		}
+		return Data{kind: ArrayKind, value: result}
+	case BooleanKind:
+		if d.value.(bool) {
+			return Data{kind: IntKind, value: 1}
+		}
+		return Data{kind: IntKind, value: 0}
+	case DoubleKind:
+		return Data{kind: BulkStringKind, value: FormatDouble(d.value.(float64))}
+	case BigNumberKind:
+		return Data{kind: BulkStringKind, value: d.value}
+	case VerbatimStringKind:
+		return Data{kind: BulkStringKind, value: d.value.(Verbatim).Text}
+	case BulkErrorKind:
+		// Simple errors can't span lines
+		return Data{kind: SimpleErrorKind, value: strings.NewReplacer("\r", " ", "\n", " ").Replace(d.value.(string))}
+	case AttributeKind:
+		return Downgrade(d.value.(Attribute).Value)
+	default:
+		return d
+	}
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSerializeProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		input Data
+		proto Protocol
+		want  string
+	}{
+		{"RESP2 Null", *NewNullData(), RESP2, "$-1\r\n"},
+		{"RESP3 Null", *NewNullData(), RESP3, "_\r\n"},
+		{"RESP3 Null In Array", *NewArrayData([]Data{*NewNullData()}), RESP3, "*1\r\n_\r\n"},
+		{"RESP2 Map", *NewMapData(map[Data]Data{*NewBulkStringData("k"): *NewIntData(1)}), RESP2, "*2\r\n$1\r\nk\r\n:1\r\n"},
+		{"RESP3 Map", *NewMapData(map[Data]Data{*NewBulkStringData("k"): *NewIntData(1)}), RESP3, "%1\r\n$1\r\nk\r\n:1\r\n"},
+		{"RESP2 Set", *NewSetData([]Data{*NewBulkStringData("a")}), RESP2, "*1\r\n$1\r\na\r\n"},
+		{"RESP2 Boolean", *NewBooleanData(true), RESP2, ":1\r\n"},
+		{"RESP2 Double", *NewDoubleData(1.5), RESP2, "$3\r\n1.5\r\n"},
+		{"RESP2 Verbatim", *NewVerbatimStringData("txt", "hi"), RESP2, "$2\r\nhi\r\n"},
+		{"RESP2 BulkError", *NewBulkErrorData("ERR a\r\nb"), RESP2, "-ERR a  b\r\n"},
+		{"RESP2 Attribute", *NewAttributeData(map[Data]Data{*NewBulkStringData("k"): *NewIntData(1)}, *NewIntData(2)), RESP2, ":2\r\n"},
+		{"RESP2 Nested", *NewArrayData([]Data{*NewSetData([]Data{*NewBooleanData(false)})}), RESP2, "*1\r\n*1\r\n:0\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SerializeProtocol(tt.input, tt.proto)
+			if err != nil {
+				t.Fatalf("input %v, unexpected error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Fatalf("input %v, want %q, got %q", tt.input, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDowngradeLeavesRESP2Types(t *testing.T) {
+	input := *NewArrayData([]Data{*NewBulkStringData("a"), *NewIntData(1), *NewNullData()})
+	if got := Downgrade(input); !reflect.DeepEqual(got, input) {
+		t.Fatalf("input %v, got %v", input, got)
+	}
+}
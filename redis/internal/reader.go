@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Size of the read buffer, which also bounds the length of a single RESP line
+const readBufferSize = 64 * 1024
+
+// Cap on slice preallocation so a bogus aggregate length can't exhaust memory
+const maxPrealloc = 1024
+
+var ErrProtocol = errors.New("protocol error")
+
+// Reader incrementally decodes RESP values from a stream.
+// Values split across multiple reads are reassembled, and pipelined values
+// are returned one at a time.
+type Reader struct {
+	rd          *bufio.Reader
+	maxBulkSize int
+}
+
+// NewReader creates a reader. maxBulkSize limits the length of a single bulk
+// string, 0 means no limit.
+func NewReader(rd io.Reader, maxBulkSize int) *Reader {
+	return &Reader{rd: bufio.NewReaderSize(rd, readBufferSize), maxBulkSize: maxBulkSize}
+}
+
+// Buffered returns the number of bytes received but not yet decoded.
+// Zero means there is no pipelined request waiting.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadData blocks until one complete value is read.
+// Returns io.EOF if the stream ends cleanly between values, and
+// io.ErrUnexpectedEOF if it ends in the middle of one.
+func (r *Reader) ReadData() (*Data, error) {
+	return r.readData(true)
+}
+
+// ReadSnapshot reads a bulk string sent without the trailing CRLF, as a
+// primary sends its RDB snapshot to a replica
+func (r *Reader) ReadSnapshot() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected snapshot, got %q", ErrProtocol, line)
+	}
+	l, err := r.readLength(line[1:])
+	if err != nil || l < 0 {
+		return nil, fmt.Errorf("%w: invalid snapshot length", ErrProtocol)
+	}
+
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *Reader) readData(first bool) (*Data, error) {
+	line, err := r.readLine()
+	if err != nil {
+		if !first && errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	value := line[1:]
+	switch line[0] {
+	case '$':
+		return r.readBulkString(value)
+	case '+':
+		return &Data{kind: SimpleStringKind, value: value}, nil
+	case '-':
+		return &Data{kind: SimpleErrorKind, value: value}, nil
+	case ':':
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid int: %q", ErrProtocol, value)
+		}
+		return &Data{kind: IntKind, value: i}, nil
+	case '*':
+		return r.readArray(value)
+	case '%':
+		return r.readMap(value)
+	case '_':
+		if value != "" {
+			return nil, fmt.Errorf("%w: invalid null: %q", ErrProtocol, value)
+		}
+		return &Data{kind: NullKind}, nil
+	case '#':
+		switch value {
+		case "t":
+			return &Data{kind: BooleanKind, value: true}, nil
+		case "f":
+			return &Data{kind: BooleanKind, value: false}, nil
+		default:
+			return nil, fmt.Errorf("%w: invalid boolean: %q", ErrProtocol, value)
+		}
+	case ',':
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid double: %q", ErrProtocol, value)
+		}
+		return &Data{kind: DoubleKind, value: f}, nil
+	case '(':
+		n, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid big number: %q", ErrProtocol, value)
+		}
+		return &Data{kind: BigNumberKind, value: n.String()}, nil
+	case '!':
+		s, err := r.readBlob(value)
+		if err != nil {
+			return nil, err
+		}
+		return &Data{kind: BulkErrorKind, value: s}, nil
+	case '=':
+		s, err := r.readBlob(value)
+		if err != nil {
+			return nil, err
+		}
+		format, text, ok := strings.Cut(s, ":")
+		if !ok || len(format) != 3 {
+			return nil, fmt.Errorf("%w: invalid verbatim string: %q", ErrProtocol, s)
+		}
+		return &Data{kind: VerbatimStringKind, value: Verbatim{Format: format, Text: text}}, nil
+	case '~':
+		return r.readAggregate(SetKind, value)
+	case '>':
+		return r.readAggregate(PushKind, value)
+	case '|':
+		return r.readAttribute(value)
+	default:
+		return nil, fmt.Errorf("%w: unexpected first char: %q", ErrProtocol, line[0])
+	}
+}
+
+// Reads a line and strips the CRLF terminator
+func (r *Reader) readLine() (string, error) {
+	line, err := r.rd.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("%w: line must end with CRLF", ErrProtocol)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+func (r *Reader) readLength(s string) (int, error) {
+	l, err := strconv.Atoi(s)
+	if err != nil || l < -1 {
+		return 0, fmt.Errorf("%w: invalid length: %q", ErrProtocol, s)
+	}
+	return l, nil
+}
+
+func (r *Reader) readBulkString(s string) (*Data, error) {
+	if s == "-1" {
+		return &Data{kind: NullKind}, nil
+	}
+	value, err := r.readBlob(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Data{kind: BulkStringKind, value: value}, nil
+}
+
+// Reads a length prefixed string, such as a bulk string or bulk error
+func (r *Reader) readBlob(s string) (string, error) {
+	l, err := r.readLength(s)
+	if err != nil {
+		return "", err
+	}
+	if l < 0 || (r.maxBulkSize > 0 && l > r.maxBulkSize) {
+		return "", fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+
+	// Blob is followed by CRLF
+	buf := make([]byte, l+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[l] != '\r' || buf[l+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string should end with CRLF", ErrProtocol)
+	}
+	return string(buf[:l]), nil
+}
+
+func (r *Reader) readArray(s string) (*Data, error) {
+	// Null array
+	if s == "-1" {
+		return &Data{kind: NullKind}, nil
+	}
+	return r.readAggregate(ArrayKind, s)
+}
+
+// Reads array-like types, which differ only in their prefix
+func (r *Reader) readAggregate(kind Kind, s string) (*Data, error) {
+	length, err := r.readLength(s)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid %s length: %q", ErrProtocol, kind, s)
+	}
+
+	value := make([]Data, 0, min(length, maxPrealloc))
+	for range length {
+		element, err := r.readData(false)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, *element)
+	}
+	return &Data{kind: kind, value: value}, nil
+}
+
+func (r *Reader) readMap(s string) (*Data, error) {
+	m, err := r.readPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Data{kind: MapKind, value: m}, nil
+}
+
+// Attributes are followed by the value they describe
+func (r *Reader) readAttribute(s string) (*Data, error) {
+	attributes, err := r.readPairs(s)
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.readData(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Data{kind: AttributeKind, value: Attribute{Attributes: attributes, Value: *value}}, nil
+}
+
+func (r *Reader) readPairs(s string) (map[Data]Data, error) {
+	length, err := r.readLength(s)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid map length: %q", ErrProtocol, s)
+	}
+
+	m := make(map[Data]Data, min(length, maxPrealloc))
+	for range length {
+		key, err := r.readData(false)
+		if err != nil {
+			return nil, err
+		}
+		// Aggregate keys can't be used as Go map keys
+		switch key.kind {
+		case ArrayKind, MapKind, SetKind, PushKind, AttributeKind:
+			return nil, fmt.Errorf("%w: unsupported map key: %s", ErrProtocol, key.kind)
+		}
+		value, err := r.readData(false)
+		if err != nil {
+			return nil, err
+		}
+		m[*key] = *value
+	}
+	return m, nil
+}
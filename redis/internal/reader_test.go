@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReaderPipelined(t *testing.T) {
+	input := "*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n:5\r\n"
+	r := NewReader(strings.NewReader(input), 0)
+
+	want := []Data{
+		*NewArrayData([]Data{*NewBulkStringData("PING")}),
+		*NewArrayData([]Data{*NewBulkStringData("GET"), *NewBulkStringData("key")}),
+		*NewIntData(5),
+	}
+	for i, w := range want {
+		got, err := r.ReadData()
+		if err != nil {
+			t.Fatalf("value %d, unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(*got, w) {
+			t.Fatalf("value %d, want %v, got %v", i, w, got)
+		}
+	}
+
+	if _, err := r.ReadData(); err != io.EOF {
+		t.Fatalf("after last value, want io.EOF, got %v", err)
+	}
+}
+
+func TestReaderFragmented(t *testing.T) {
+	value := strings.Repeat("x", 100_000)
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$100000\r\n" + value + "\r\n"
+	// Deliver input one byte per read
+	r := NewReader(iotest.OneByteReader(strings.NewReader(input)), 0)
+
+	got, err := r.ReadData()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := NewArrayData([]Data{*NewBulkStringData("SET"), *NewBulkStringData("key"), *NewBulkStringData(value)})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("fragmented SET not reassembled")
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"truncated bulk string", "$5\r\nhel", io.ErrUnexpectedEOF},
+		{"truncated array", "*2\r\n$3\r\nGET\r\n", io.ErrUnexpectedEOF},
+		{"truncated line", "+OK", io.ErrUnexpectedEOF},
+		{"missing CR", "+OK\n", ErrProtocol},
+		{"unknown type", "?1\r\n", ErrProtocol},
+		{"invalid length", "$abc\r\n", ErrProtocol},
+		{"bulk too large", "$11\r\nhello world\r\n", ErrProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input), 10)
+			_, err := r.ReadData()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("input %q, want %v, got %v", tt.input, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestReaderSnapshot(t *testing.T) {
+	// The snapshot has no trailing CRLF, and the stream continues after it
+	r := NewReader(strings.NewReader("+FULLRESYNC id 0\r\n$5\r\nREDIS*1\r\n$4\r\nPING\r\n"), 0)
+	if _, err := r.ReadData(); err != nil {
+		t.Fatalf("reply, unexpected error: %v", err)
+	}
+	snapshot, err := r.ReadSnapshot()
+	if err != nil {
+		t.Fatalf("ReadSnapshot, unexpected error: %v", err)
+	}
+	if string(snapshot) != "REDIS" {
+		t.Fatalf("ReadSnapshot, want %q, got %q", "REDIS", snapshot)
+	}
+	got, err := r.ReadData()
+	if err != nil {
+		t.Fatalf("after snapshot, unexpected error: %v", err)
+	}
+	if want := NewArrayData([]Data{*NewBulkStringData("PING")}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after snapshot, want %v, got %v", want, got)
+	}
+
+	if _, err := NewReader(strings.NewReader("$5\r\nRED"), 0).ReadSnapshot(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated snapshot, want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -2,14 +2,23 @@ package internal
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 )
 
+// Serialize encodes data as is. Null is written in its RESP2 form.
+// Use SerializeProtocol to encode for a specific protocol version.
 func Serialize(data Data) (string, error) {
+	return serialize(data, RESP2)
+}
+
+// Protocol only decides the null encoding. Other types are written as is.
+func serialize(data Data, proto Protocol) (string, error) {
 	switch data.kind {
 	case ArrayKind:
-		return serializeArray(data)
+		return serializeArray(data, proto)
 	case NullKind:
-		return serializeNull(), nil
+		return serializeNull(proto), nil
 	case SimpleStringKind:
 		return serializeSimpleString(data)
 	case BulkStringKind:
@@ -19,13 +28,33 @@ func Serialize(data Data) (string, error) {
 	case SimpleErrorKind:
 		return serializeSimpleError(data)
 	case MapKind:
-		return serializeMap(data)
+		return serializeMap(data, proto)
+	case BooleanKind:
+		return serializeBoolean(data)
+	case DoubleKind:
+		return serializeDouble(data)
+	case BigNumberKind:
+		return fmt.Sprintf("(%s\r\n", data.value), nil
+	case BulkErrorKind:
+		return serializeBulkError(data)
+	case VerbatimStringKind:
+		return serializeVerbatimString(data)
+	case SetKind:
+		return serializeAggregate('~', data.value.([]Data), proto)
+	case PushKind:
+		return serializeAggregate('>', data.value.([]Data), proto)
+	case AttributeKind:
+		return serializeAttribute(data, proto)
 	default:
 		return "", fmt.Errorf("error unexpected data type: %v", data.kind)
 	}
 }
 
-func serializeNull() string {
+// RESP2 null is a null bulk string, which RESP3 clients also accept
+func serializeNull(proto Protocol) string {
+	if proto == RESP3 {
+		return "_\r\n"
+	}
 	return "$-1\r\n"
 }
 
@@ -44,8 +73,8 @@ func serializeBulkString(d Data) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error serializing bulk string: %w", err)
 	}
-	l := len([]rune(s))
-	return fmt.Sprintf("$%d\r\n%s\r\n", l, s), nil
+	// Length is in bytes, not runes
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s), nil
 }
 
 func serializeInt(d Data) (string, error) {
@@ -56,16 +85,20 @@ func serializeInt(d Data) (string, error) {
 	return fmt.Sprintf(":%d\r\n", i), nil
 }
 
-func serializeArray(d Data) (string, error) {
+func serializeArray(d Data, proto Protocol) (string, error) {
 	a, err := d.GetArray()
 	if err != nil {
 		return "", fmt.Errorf("error serializing array: %w", err)
 	}
+	return serializeAggregate('*', a, proto)
+}
 
-	result := fmt.Sprintf("*%d\r\n", len(a))
+// Serializes array-like types, which differ only in their prefix
+func serializeAggregate(prefix byte, a []Data, proto Protocol) (string, error) {
+	result := fmt.Sprintf("%c%d\r\n", prefix, len(a))
 
 	for _, item := range a {
-		s, err := Serialize(item)
+		s, err := serialize(item, proto)
 		if err != nil {
 			return "", err
 		}
@@ -75,22 +108,25 @@ func serializeArray(d Data) (string, error) {
 	return result, nil
 }
 
-func serializeMap(d Data) (string, error) {
+func serializeMap(d Data, proto Protocol) (string, error) {
 	m, err := d.GetMap()
 	if err != nil {
 		return "", fmt.Errorf("error serializing map: %w", err)
 	}
+	return serializePairs('%', m, proto)
+}
 
-	result := fmt.Sprintf("%%%d\r\n", len(m))
+func serializePairs(prefix byte, m map[Data]Data, proto Protocol) (string, error) {
+	result := fmt.Sprintf("%c%d\r\n", prefix, len(m))
 
 	for key, value := range m {
-		k, err := Serialize(key)
+		k, err := serialize(key, proto)
 		if err != nil {
 			return "", err
 		}
 		result += k
 
-		v, err := Serialize(value)
+		v, err := serialize(value, proto)
 		if err != nil {
 			return "", err
 		}
@@ -107,3 +143,71 @@ func serializeSimpleError(d Data) (string, error) {
 	}
 	return fmt.Sprintf("-%s\r\n", s), nil
 }
+
+func serializeBoolean(d Data) (string, error) {
+	b, err := d.GetBool()
+	if err != nil {
+		return "", fmt.Errorf("error serializing boolean: %w", err)
+	}
+	if b {
+		return "#t\r\n", nil
+	}
+	return "#f\r\n", nil
+}
+
+func serializeDouble(d Data) (string, error) {
+	f, err := d.GetDouble()
+	if err != nil {
+		return "", fmt.Errorf("error serializing double: %w", err)
+	}
+	return fmt.Sprintf(",%s\r\n", FormatDouble(f)), nil
+}
+
+// FormatDouble formats a float the way RESP3 doubles are written
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+func serializeBulkError(d Data) (string, error) {
+	s, err := d.GetString()
+	if err != nil {
+		return "", fmt.Errorf("error serializing bulk error: %w", err)
+	}
+	return fmt.Sprintf("!%d\r\n%s\r\n", len(s), s), nil
+}
+
+func serializeVerbatimString(d Data) (string, error) {
+	v, err := d.GetVerbatim()
+	if err != nil {
+		return "", fmt.Errorf("error serializing verbatim string: %w", err)
+	}
+	if len(v.Format) != 3 {
+		return "", fmt.Errorf("error verbatim format must be 3 chars: %q", v.Format)
+	}
+	return fmt.Sprintf("=%d\r\n%s:%s\r\n", len(v.Text)+4, v.Format, v.Text), nil
+}
+
+func serializeAttribute(d Data, proto Protocol) (string, error) {
+	a, err := d.GetAttribute()
+	if err != nil {
+		return "", fmt.Errorf("error serializing attribute: %w", err)
+	}
+	attributes, err := serializePairs('|', a.Attributes, proto)
+	if err != nil {
+		return "", err
+	}
+	value, err := serialize(a.Value, proto)
+	if err != nil {
+		return "", err
+	}
+	return attributes + value, nil
+}
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"math"
+	"math/big"
 	"testing"
 )
 
@@ -40,6 +42,19 @@ func TestSerialize(t *testing.T) {
 		}, "%1\r\n+key1\r\n$6\r\nvalue1\r\n")
 	// TODO: map test with multiple elements. Need to handle ordering
 	runSerializeTest(t, "SimpleError", Data{kind: SimpleErrorKind, value: "Error message"}, "-Error message\r\n")
+	runSerializeTest(t, "BulkString Multibyte", Data{kind: BulkStringKind, value: "héllo"}, "$6\r\nhéllo\r\n")
+	runSerializeTest(t, "Boolean", Data{kind: BooleanKind, value: true}, "#t\r\n")
+	runSerializeTest(t, "Double", Data{kind: DoubleKind, value: 1.5}, ",1.5\r\n")
+	runSerializeTest(t, "Double Integral", Data{kind: DoubleKind, value: 10.0}, ",10\r\n")
+	runSerializeTest(t, "Double NaN", Data{kind: DoubleKind, value: math.NaN()}, ",nan\r\n")
+	runSerializeTest(t, "BigNumber", *NewBigNumberData(big.NewInt(-42)), "(-42\r\n")
+	runSerializeTest(t, "BulkError", Data{kind: BulkErrorKind, value: "SYNTAX invalid syntax"}, "!21\r\nSYNTAX invalid syntax\r\n")
+	runSerializeTest(t, "VerbatimString", *NewVerbatimStringData("txt", "Some string"), "=15\r\ntxt:Some string\r\n")
+	runSerializeTest(t, "Set", *NewSetData([]Data{*NewIntData(1)}), "~1\r\n:1\r\n")
+	runSerializeTest(t, "Push", *NewPushData([]Data{*NewBulkStringData("pong")}), ">1\r\n$4\r\npong\r\n")
+	runSerializeTest(t, "Attribute",
+		*NewAttributeData(map[Data]Data{*NewSimpleStringData("ttl"): *NewIntData(10)}, *NewIntData(1)),
+		"|1\r\n+ttl\r\n:10\r\n:1\r\n")
 }
 
 func runSerializeTest(t *testing.T, name string, input Data, want string) {
@@ -1,6 +1,9 @@
 package internal
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+)
 
 type Kind int
 
@@ -12,6 +15,15 @@ const (
 	ArrayKind
 	MapKind
 	SimpleErrorKind
+	// RESP3 types
+	BooleanKind
+	DoubleKind
+	BigNumberKind
+	BulkErrorKind
+	VerbatimStringKind
+	SetKind
+	PushKind
+	AttributeKind
 )
 
 func (k Kind) String() string {
@@ -30,6 +42,22 @@ func (k Kind) String() string {
 		return "SimpleError"
 	case MapKind:
 		return "Map"
+	case BooleanKind:
+		return "Boolean"
+	case DoubleKind:
+		return "Double"
+	case BigNumberKind:
+		return "BigNumber"
+	case BulkErrorKind:
+		return "BulkError"
+	case VerbatimStringKind:
+		return "VerbatimString"
+	case SetKind:
+		return "Set"
+	case PushKind:
+		return "Push"
+	case AttributeKind:
+		return "Attribute"
 	default:
 		return "Unknown"
 	}
@@ -40,6 +68,18 @@ type Data struct {
 	value interface{}
 }
 
+// Verbatim string value. Format is a three char type hint, such as "txt" or "mkd"
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+// Attribute value. Attributes are auxiliary data sent before the reply itself
+type Attribute struct {
+	Attributes map[Data]Data
+	Value      Data
+}
+
 func (d Data) String() string {
 	switch d.kind {
 	case NullKind:
@@ -56,6 +96,24 @@ func (d Data) String() string {
 		return fmt.Sprintf("Data(%v)", d.value)
 	case SimpleErrorKind:
 		return fmt.Sprintf("Data{Error: %q}", d.value)
+	case BooleanKind:
+		return fmt.Sprintf("Data{%t}", d.value)
+	case DoubleKind:
+		return fmt.Sprintf("Data{%g}", d.value)
+	case BigNumberKind:
+		return fmt.Sprintf("Data{%s}", d.value)
+	case BulkErrorKind:
+		return fmt.Sprintf("Data{Error: %q}", d.value)
+	case VerbatimStringKind:
+		v := d.value.(Verbatim)
+		return fmt.Sprintf("Data{%s:%q}", v.Format, v.Text)
+	case SetKind:
+		return fmt.Sprintf("Data{Set: %v}", d.value)
+	case PushKind:
+		return fmt.Sprintf("Data{Push: %v}", d.value)
+	case AttributeKind:
+		a := d.value.(Attribute)
+		return fmt.Sprintf("Data{Attribute: %v, %v}", a.Attributes, a.Value)
 	default:
 		return "Unknown"
 	}
@@ -66,7 +124,10 @@ func (d Data) GetKind() Kind {
 }
 
 func (d Data) GetString() (string, error) {
-	if !(d.kind == SimpleStringKind || d.kind == BulkStringKind || d.kind == SimpleErrorKind) {
+	if d.kind == VerbatimStringKind {
+		return d.value.(Verbatim).Text, nil
+	}
+	if !(d.kind == SimpleStringKind || d.kind == BulkStringKind || d.kind == SimpleErrorKind || d.kind == BulkErrorKind) {
 		return "", fmt.Errorf("cannot GetString of kind: %s", d.kind)
 	}
 	s, ok := d.value.(string)
@@ -110,6 +171,60 @@ func (d Data) GetMap() (map[Data]Data, error) {
 	return m, nil
 }
 
+func (d Data) GetBool() (bool, error) {
+	if d.kind != BooleanKind {
+		return false, fmt.Errorf("cannot GetBool of kind: %s", d.kind)
+	}
+	return d.value.(bool), nil
+}
+
+func (d Data) GetDouble() (float64, error) {
+	if d.kind != DoubleKind {
+		return 0, fmt.Errorf("cannot GetDouble of kind: %s", d.kind)
+	}
+	return d.value.(float64), nil
+}
+
+func (d Data) GetBigNumber() (*big.Int, error) {
+	if d.kind != BigNumberKind {
+		return nil, fmt.Errorf("cannot GetBigNumber of kind: %s", d.kind)
+	}
+	// Stored as a string so Data stays comparable
+	n, ok := new(big.Int).SetString(d.value.(string), 10)
+	if !ok {
+		return nil, fmt.Errorf("error value is not a big number: %v", d.value)
+	}
+	return n, nil
+}
+
+func (d Data) GetVerbatim() (Verbatim, error) {
+	if d.kind != VerbatimStringKind {
+		return Verbatim{}, fmt.Errorf("cannot GetVerbatim of kind: %s", d.kind)
+	}
+	return d.value.(Verbatim), nil
+}
+
+func (d Data) GetSet() ([]Data, error) {
+	if d.kind != SetKind {
+		return nil, fmt.Errorf("cannot GetSet of kind: %s", d.kind)
+	}
+	return d.value.([]Data), nil
+}
+
+func (d Data) GetPush() ([]Data, error) {
+	if d.kind != PushKind {
+		return nil, fmt.Errorf("cannot GetPush of kind: %s", d.kind)
+	}
+	return d.value.([]Data), nil
+}
+
+func (d Data) GetAttribute() (Attribute, error) {
+	if d.kind != AttributeKind {
+		return Attribute{}, fmt.Errorf("cannot GetAttribute of kind: %s", d.kind)
+	}
+	return d.value.(Attribute), nil
+}
+
 func NewSimpleStringData(s string) *Data {
 	return &Data{kind: SimpleStringKind, value: s}
 }
@@ -137,3 +252,36 @@ func NewSimpleError(e string) *Data {
 func NewNullData() *Data {
 	return &Data{kind: NullKind}
 }
+
+func NewBooleanData(b bool) *Data {
+	return &Data{kind: BooleanKind, value: b}
+}
+
+func NewDoubleData(f float64) *Data {
+	return &Data{kind: DoubleKind, value: f}
+}
+
+func NewBigNumberData(n *big.Int) *Data {
+	return &Data{kind: BigNumberKind, value: n.String()}
+}
+
+func NewBulkErrorData(e string) *Data {
+	return &Data{kind: BulkErrorKind, value: e}
+}
+
+// Format must be exactly three chars, such as "txt" or "mkd"
+func NewVerbatimStringData(format string, s string) *Data {
+	return &Data{kind: VerbatimStringKind, value: Verbatim{Format: format, Text: s}}
+}
+
+func NewSetData(a []Data) *Data {
+	return &Data{kind: SetKind, value: a}
+}
+
+func NewPushData(a []Data) *Data {
+	return &Data{kind: PushKind, value: a}
+}
+
+func NewAttributeData(attributes map[Data]Data, d Data) *Data {
+	return &Data{kind: AttributeKind, value: Attribute{Attributes: attributes, Value: d}}
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"myredis/internal"
+	"strings"
+	"time"
+)
+
+// Private method to get a list record for writing. Returns ErrWrongType if
+// the key holds another kind. Consumer must acquire write lock.
+func (d *Dictionary) lookupList(k string) (KVRecord, bool, error) {
+	record, ok := d.lookup(k)
+	if !ok {
+		return KVRecord{}, false, nil
+	}
+	if record.kind != ListRecord {
+		return KVRecord{}, false, ErrWrongType
+	}
+	return record, true, nil
+}
+
+// Private method to store a modified list. Empty lists are deleted, as Redis
+// never stores them. Consumer must acquire write lock.
+func (d *Dictionary) storeList(k string, record KVRecord) {
+	if record.listValue.Len() == 0 {
+		d.delete(k)
+		return
+	}
+	d.setRecord(k, record)
+}
+
+func (d *Dictionary) LeftPushList(k string, elements []string) (int, error) {
+	return d.PushList(k, elements, true, false)
+}
+
+func (d *Dictionary) RightPushList(k string, elements []string) (int, error) {
+	return d.PushList(k, elements, false, false)
+}
+
+// PushList pushes elements to the head or tail of a list, in order, so left
+// pushed elements end up reversed. A missing key creates the list, unless
+// onlyExisting is set. Returns the length of the list after the push.
+func (d *Dictionary) PushList(k string, elements []string, left bool, onlyExisting bool) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupList(k)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		if onlyExisting {
+			return 0, nil
+		}
+		record = KVRecord{kind: ListRecord, listValue: newQuicklist()}
+	}
+
+	for _, element := range elements {
+		if left {
+			record.listValue.PushHead(element)
+		} else {
+			record.listValue.PushTail(element)
+		}
+	}
+	// Retains existing expiration
+	d.setRecord(k, record)
+	n := record.listValue.Len()
+	// Clients blocked on k may pop what was pushed, but the reply is the
+	// length after the push, as in Redis
+	d.signalKeyReady(k)
+
+	return n, nil
+}
+
+// PopList removes up to count elements from the head or tail of a list.
+// Returns false if the key doesn't exist.
+func (d *Dictionary) PopList(k string, count int, left bool) ([]string, bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.popList(k, count, left)
+}
+
+// Private method to pop from a list, for PopList and blocked clients.
+// Consumer must acquire write lock.
+func (d *Dictionary) popList(k string, count int, left bool) ([]string, bool, error) {
+	record, exists, err := d.lookupList(k)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	popped := make([]string, 0, min(count, record.listValue.Len()))
+	for len(popped) < count {
+		var element string
+		var ok bool
+		if left {
+			element, ok = record.listValue.PopHead()
+		} else {
+			element, ok = record.listValue.PopTail()
+		}
+		if !ok {
+			break
+		}
+		popped = append(popped, element)
+	}
+	d.storeList(k, record)
+
+	return popped, true, nil
+}
+
+// ListRange returns the elements between start and stop, inclusive.
+// Negative indexes count from the tail.
+func (d *Dictionary) ListRange(k string, start int, stop int) (elements []string, err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != ListRecord {
+			err = ErrWrongType
+			return
+		}
+		from, to, ok := normalizeRange(start, stop, record.listValue.Len())
+		if ok {
+			elements = record.listValue.Range(from, to)
+		}
+	})
+	return elements, err
+}
+
+func (d *Dictionary) ListLen(k string) (n int, err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != ListRecord {
+			err = ErrWrongType
+			return
+		}
+		n = record.listValue.Len()
+	})
+	return n, err
+}
+
+// ListIndex returns the element at index, which counts from the tail when
+// negative. Returns false if the key doesn't exist or index is out of range.
+func (d *Dictionary) ListIndex(k string, index int) (element string, found bool, err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != ListRecord {
+			err = ErrWrongType
+			return
+		}
+		if i, ok := normalizeIndex(index, record.listValue.Len()); ok {
+			element, found = record.listValue.Index(i), true
+		}
+	})
+	return element, found, err
+}
+
+func (d *Dictionary) ListSet(k string, index int, element string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupList(k)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ERR no such key")
+	}
+	i, ok := normalizeIndex(index, record.listValue.Len())
+	if !ok {
+		return fmt.Errorf("ERR index out of range")
+	}
+	record.listValue.Set(i, element)
+	d.touch(k)
+	return nil
+}
+
+// ListInsert inserts element before or after the first occurrence of pivot.
+// Returns the new length, -1 if pivot wasn't found, or 0 if the key doesn't
+// exist.
+func (d *Dictionary) ListInsert(k string, before bool, pivot string, element string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupList(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+	i := -1
+	record.listValue.Each(false, func(j int, s string) bool {
+		if s == pivot {
+			i = j
+			return false
+		}
+		return true
+	})
+	if i == -1 {
+		return -1, nil
+	}
+	if !before {
+		i++
+	}
+	record.listValue.Insert(i, element)
+	d.touch(k)
+
+	return record.listValue.Len(), nil
+}
+
+// ListRemove removes occurrences of element. A positive count removes up to
+// count from the head, negative up to count from the tail, and 0 removes all.
+// Returns the number removed.
+func (d *Dictionary) ListRemove(k string, count int, element string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupList(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	removed := record.listValue.RemoveFunc(count < 0, max(count, -count), func(s string) bool {
+		return s == element
+	})
+	if removed > 0 {
+		d.storeList(k, record)
+	}
+
+	return removed, nil
+}
+
+// ListTrim keeps only the elements between start and stop, inclusive.
+func (d *Dictionary) ListTrim(k string, start int, stop int) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupList(k)
+	if err != nil || !exists {
+		return err
+	}
+
+	from, to, ok := normalizeRange(start, stop, record.listValue.Len())
+	if !ok {
+		from, to = 0, 0
+	}
+	record.listValue.Trim(from, to)
+	d.storeList(k, record)
+
+	return nil
+}
+
+// ListPosOptions are the LPOS options
+type ListPosOptions struct {
+	// Skip to the nth match. Negative searches from the tail.
+	rank int
+	// Maximum matches to return. 0 returns all.
+	count int
+	// Maximum elements to compare. 0 compares all.
+	maxLen int
+}
+
+// ListPos returns the indexes of elements matching element
+func (d *Dictionary) ListPos(k string, element string, options ListPosOptions) (positions []int, err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != ListRecord {
+			err = ErrWrongType
+			return
+		}
+
+		skip := max(options.rank, -options.rank) - 1
+		compared := 0
+		record.listValue.Each(options.rank < 0, func(i int, s string) bool {
+			if options.maxLen != 0 && compared == options.maxLen {
+				return false
+			}
+			compared++
+			if s != element {
+				return true
+			}
+			if skip > 0 {
+				skip--
+				return true
+			}
+			positions = append(positions, i)
+			return options.count == 0 || len(positions) < options.count
+		})
+	})
+	return positions, err
+}
+
+// ListMove pops an element from one end of src and pushes it to one end of
+// dst. src and dst may be the same list. Returns false if src doesn't exist.
+func (d *Dictionary) ListMove(src string, dst string, fromLeft bool, toLeft bool) (string, bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.listMove(src, dst, fromLeft, toLeft)
+}
+
+// Private method to move an element between lists, for ListMove and blocked
+// clients. Consumer must acquire write lock.
+func (d *Dictionary) listMove(src string, dst string, fromLeft bool, toLeft bool) (string, bool, error) {
+	source, exists, err := d.lookupList(src)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	// Check the destination type before modifying anything
+	destination, dstExists, err := d.lookupList(dst)
+	if err != nil {
+		return "", false, err
+	}
+
+	var element string
+	if fromLeft {
+		element, _ = source.listValue.PopHead()
+	} else {
+		element, _ = source.listValue.PopTail()
+	}
+	d.storeList(src, source)
+
+	if src == dst {
+		destination, dstExists = source, true
+	}
+	if !dstExists {
+		destination = KVRecord{kind: ListRecord, listValue: newQuicklist()}
+	}
+	if toLeft {
+		destination.listValue.PushHead(element)
+	} else {
+		destination.listValue.PushTail(element)
+	}
+	d.setRecord(dst, destination)
+	d.signalKeyReady(dst)
+
+	return element, true, nil
+}
+
+// BlockingPopList pops an element from the head or tail of the first
+// non-empty list in keys. If all are empty, it blocks until an element is
+// pushed to one of them, up to timeout. Returns the key popped from, or false
+// on timeout.
+func (d *Dictionary) BlockingPopList(ctx context.Context, keys []string, timeout time.Duration, left bool) (key string, element string, ok bool, err error) {
+	ok, err = d.Block(ctx, keys, timeout, func(k string) (bool, error) {
+		popped, _, err := d.popList(k, 1, left)
+		if err != nil || len(popped) == 0 {
+			return false, err
+		}
+		key, element = k, popped[0]
+		// Logged as the pop it is, whichever client's write served it
+		if left {
+			d.propagate("LPOP", k)
+		} else {
+			d.propagate("RPOP", k)
+		}
+		return true, nil
+	})
+	return key, element, ok, err
+}
+
+// BlockingListMove is ListMove, blocking until src exists, up to timeout.
+// Returns false on timeout.
+func (d *Dictionary) BlockingListMove(ctx context.Context, src string, dst string, fromLeft bool, toLeft bool, timeout time.Duration) (element string, ok bool, err error) {
+	ok, err = d.Block(ctx, []string{src}, timeout, func(k string) (bool, error) {
+		moved, exists, err := d.listMove(src, dst, fromLeft, toLeft)
+		if err != nil || !exists {
+			return false, err
+		}
+		element = moved
+		d.propagate("LMOVE", src, dst, listSideName(fromLeft), listSideName(toLeft))
+		return true, nil
+	})
+	return element, ok, err
+}
+
+// Converts a possibly negative index into a list of length n.
+// Returns false if out of range.
+func normalizeIndex(index int, n int) (int, bool) {
+	if index < 0 {
+		index += n
+	}
+	if index < 0 || index >= n {
+		return 0, false
+	}
+	return index, true
+}
+
+// Converts inclusive start and stop indexes, which may be negative, to a
+// slice range of a list of length n. Returns false if the range is empty.
+func normalizeRange(start int, stop int, n int) (int, int, bool) {
+	if start < 0 {
+		start = max(start+n, 0)
+	}
+	if stop < 0 {
+		stop += n
+	}
+	stop = min(stop, n-1)
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop + 1, true
+}
+
+// Converts strings to bulk string data
+func bulkStrings(strs []string) []internal.Data {
+	data := make([]internal.Data, len(strs))
+	for i, s := range strs {
+		data[i] = *internal.NewBulkStringData(s)
+	}
+	return data
+}
+
+// Parses the LEFT or RIGHT argument of LMOVE. Returns true for LEFT.
+func parseListSide(s string) (bool, error) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	default:
+		return false, ErrSyntax
+	}
+}
+
+// Returns the LEFT or RIGHT argument for a side of a list
+func listSideName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// LPUSH, RPUSH, LPUSHX and RPUSHX key element [element ...]
+func (h *DefaultCommandHandler) handlePushCommand(command string, args []internal.Data, left bool, onlyExisting bool) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := h.dict.PushList(strs[0], strs[1:], left, onlyExisting)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(l), nil
+}
+
+// LPOP and RPOP key [count]
+func (h *DefaultCommandHandler) handlePopCommand(command string, args []internal.Data, left bool) (*internal.Data, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 1
+	if len(strs) == 2 {
+		n, err := parseInt(strs[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ERR value is out of range, must be positive")
+		}
+		count = int(n)
+	}
+
+	popped, ok, err := h.dict.PopList(strs[0], count, left)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	// Without count, reply with a single element
+	if len(strs) == 1 {
+		return internal.NewBulkStringData(popped[0]), nil
+	}
+	return internal.NewArrayData(bulkStrings(popped)), nil
+}
+
+// LRANGE key start stop
+func (h *DefaultCommandHandler) handleLrangeCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("LRANGE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+	stop, err := parseInt(strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	elements, err := h.dict.ListRange(strs[0], int(start), int(stop))
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewArrayData(bulkStrings(elements)), nil
+}
+
+// LLEN key
+func (h *DefaultCommandHandler) handleLlenCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("LLEN")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.ListLen(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// LINDEX key index
+func (h *DefaultCommandHandler) handleLindexCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("LINDEX")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	element, ok, err := h.dict.ListIndex(strs[0], int(index))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewBulkStringData(element), nil
+}
+
+// LSET key index element
+func (h *DefaultCommandHandler) handleLsetCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("LSET")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.dict.ListSet(strs[0], int(index), strs[2]); err != nil {
+		return nil, err
+	}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// LINSERT key BEFORE | AFTER pivot element
+func (h *DefaultCommandHandler) handleLinsertCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 4 {
+		return nil, errWrongNumberOfArgs("LINSERT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	var before bool
+	switch strings.ToUpper(strs[1]) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.ListInsert(strs[0], before, strs[2], strs[3])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// LREM key count element
+func (h *DefaultCommandHandler) handleLremCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("LREM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	count, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := h.dict.ListRemove(strs[0], int(count), strs[2])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// LTRIM key start stop
+func (h *DefaultCommandHandler) handleLtrimCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("LTRIM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseInt(strs[1])
+	if err != nil {
+		return nil, err
+	}
+	stop, err := parseInt(strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.dict.ListTrim(strs[0], int(start), int(stop)); err != nil {
+		return nil, err
+	}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func (h *DefaultCommandHandler) handleLposCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("LPOS")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	options := ListPosOptions{rank: 1}
+	withCount := false
+	for i := 2; i < len(strs); i += 2 {
+		if i+1 >= len(strs) {
+			return nil, ErrSyntax
+		}
+		n, err := parseInt(strs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(strs[i]) {
+		case "RANK":
+			if n == 0 {
+				return nil, fmt.Errorf("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			options.rank = int(n)
+		case "COUNT":
+			if n < 0 {
+				return nil, fmt.Errorf("ERR COUNT can't be negative")
+			}
+			options.count = int(n)
+			withCount = true
+		case "MAXLEN":
+			if n < 0 {
+				return nil, fmt.Errorf("ERR MAXLEN can't be negative")
+			}
+			options.maxLen = int(n)
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	// Without COUNT, only the first match is needed
+	if !withCount {
+		options.count = 1
+	}
+
+	positions, err := h.dict.ListPos(strs[0], strs[1], options)
+	if err != nil {
+		return nil, err
+	}
+
+	if !withCount {
+		if len(positions) == 0 {
+			return internal.NewNullData(), nil
+		}
+		return internal.NewIntData(positions[0]), nil
+	}
+	data := make([]internal.Data, len(positions))
+	for i, p := range positions {
+		data[i] = *internal.NewIntData(p)
+	}
+	return internal.NewArrayData(data), nil
+}
+
+// LMOVE source destination LEFT | RIGHT LEFT | RIGHT
+func (h *DefaultCommandHandler) handleLmoveCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 4 {
+		return nil, errWrongNumberOfArgs("LMOVE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	fromLeft, err := parseListSide(strs[2])
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := parseListSide(strs[3])
+	if err != nil {
+		return nil, err
+	}
+
+	element, ok, err := h.dict.ListMove(strs[0], strs[1], fromLeft, toLeft)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewBulkStringData(element), nil
+}
+
+// BLPOP and BRPOP key [key ...] timeout
+func (h *DefaultCommandHandler) handleBlockingPopCommand(ctx context.Context, command string, args []internal.Data, left bool) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(strs[len(strs)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	key, element, ok, err := h.dict.BlockingPopList(ctx, strs[:len(strs)-1], timeout, left)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewArrayData(bulkStrings([]string{key, element})), nil
+}
+
+// BLMOVE source destination LEFT | RIGHT LEFT | RIGHT timeout
+func (h *DefaultCommandHandler) handleBlmoveCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 5 {
+		return nil, errWrongNumberOfArgs("BLMOVE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	fromLeft, err := parseListSide(strs[2])
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := parseListSide(strs[3])
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseTimeout(strs[4])
+	if err != nil {
+		return nil, err
+	}
+
+	element, ok, err := h.dict.BlockingListMove(ctx, strs[0], strs[1], fromLeft, toLeft, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewBulkStringData(element), nil
+}
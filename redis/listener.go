@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// EndpointKind is how an endpoint accepts connections
+type EndpointKind int
+
+const (
+	// Plaintext TCP
+	EndpointTCP EndpointKind = iota
+	// Unix domain socket
+	EndpointUnix
+	// TCP with TLS, using the certificates in Config
+	EndpointTLS
+)
+
+func (k EndpointKind) String() string {
+	switch k {
+	case EndpointTCP:
+		return "tcp"
+	case EndpointUnix:
+		return "unix"
+	case EndpointTLS:
+		return "tls"
+	default:
+		return fmt.Sprintf("EndpointKind(%d)", int(k))
+	}
+}
+
+// Endpoint is an address the server listens on
+type Endpoint struct {
+	Kind EndpointKind
+	// host:port, or the path of a Unix socket
+	Address string
+	// Permissions of a Unix socket, such as 0o770. Zero leaves the umask's.
+	Perm fs.FileMode
+}
+
+// Returns the endpoints to listen on, with Address as the first if set
+func (c Config) endpoints() []Endpoint {
+	if c.Address == "" {
+		return c.Endpoints
+	}
+	return append([]Endpoint{{Kind: EndpointTCP, Address: c.Address}}, c.Endpoints...)
+}
+
+// Private method to listen on endpoint. TLS endpoints need s.tls loaded.
+func (s *Server) listen(endpoint Endpoint) (net.Listener, error) {
+	switch endpoint.Kind {
+	case EndpointTCP:
+		return net.Listen("tcp", endpoint.Address)
+	case EndpointTLS:
+		listener, err := net.Listen("tcp", endpoint.Address)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(listener, s.tls.listenerConfig()), nil
+	case EndpointUnix:
+		// A socket left by a server that didn't shut down would fail the
+		// listen, so it's removed. Other files are left alone.
+		if info, err := os.Lstat(endpoint.Address); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(endpoint.Address); err != nil {
+				return nil, err
+			}
+		}
+		listener, err := net.Listen("unix", endpoint.Address)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Perm != 0 {
+			if err := os.Chmod(endpoint.Address, endpoint.Perm); err != nil {
+				listener.Close()
+				return nil, err
+			}
+		}
+		return listener, nil
+	default:
+		return nil, fmt.Errorf("unknown endpoint kind %v", endpoint.Kind)
+	}
+}
+
+// Private method to accept connections on listener, passing them to conns
+// until the listener is closed
+func (s *Server) accept(listener net.Listener, conns chan<- net.Conn) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("failed to accept connection", "address", listener.Addr().String(), "error", err)
+			continue
+		}
+		conns <- conn
+	}
+}
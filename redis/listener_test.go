@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"myredis/internal"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerEndpoints(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "redis.sock")
+	// A socket left behind is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := Config{
+		Address: "127.0.0.1:0",
+		Endpoints: []Endpoint{
+			{Kind: EndpointUnix, Address: socket, Perm: 0o600},
+			{Kind: EndpointTCP, Address: "127.0.0.1:0"},
+		},
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    5 * time.Second,
+		MaxMessageSize:  1024 * 1024,
+		ShutdownTimeout: time.Second,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewServer(config, logger, NewDefaultCommandHandler())
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode. want socket with 0600, got %v", info.Mode())
+	}
+
+	// Every endpoint serves the same data
+	var conns []net.Conn
+	for i, listener := range server.listeners {
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial %v: %v", listener.Addr(), err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		reader := internal.NewReader(conn, 0)
+		if got := sendCommand(t, conn, reader, "INCR", "counter"); !reflect.DeepEqual(got, internal.NewIntData(i+1)) {
+			t.Fatalf("INCR on %v. want %d, got %v", listener.Addr(), i+1, got)
+		}
+	}
+
+	// Shutdown closes every listener, and removes the socket
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown server: %v", err)
+	}
+	for _, listener := range server.listeners {
+		if conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String()); err == nil {
+			conn.Close()
+			t.Fatalf("dial %v after shutdown. want error, got nil", listener.Addr())
+		}
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket after shutdown. want removed, got %v", err)
+	}
+}
+
+// A file at a socket's path isn't replaced, and listeners that started
+// are closed
+func TestServerEndpointFails(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewServer(Config{
+		Address:   "127.0.0.1:0",
+		Endpoints: []Endpoint{{Kind: EndpointUnix, Address: path}},
+	}, logger, NewDefaultCommandHandler())
+	if err := server.Start(context.Background()); err == nil {
+		t.Fatalf("Start with a file at the socket path. want error, got nil")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "data" {
+		t.Fatalf("file at socket path. want data, got %q", got)
+	}
+	if _, err := server.listeners[0].Accept(); err == nil {
+		t.Fatalf("TCP listener after failed start. want closed, got open")
+	}
+}
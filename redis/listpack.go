@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Listpacks are how Redis serializes small collections, and the nodes of
+// streams. A listpack is a header with its size and number of elements,
+// each element encoded as a string or an integer, and an end byte. Each
+// element is followed by its length, so it can be walked backwards.
+// https://github.com/antirez/listpack/blob/master/listpack.md
+const (
+	listpackHeaderSize = 6
+	listpackEnd        = 0xff
+
+	// Encodings, in the top bits of an element's first byte
+	listpack7BitUint  = 0x00
+	listpack6BitStr   = 0x80
+	listpack13BitInt  = 0xc0
+	listpack12BitStr  = 0xe0
+	listpack32BitStr  = 0xf0
+	listpack16BitInt  = 0xf1
+	listpack24BitInt  = 0xf2
+	listpack32BitInt  = 0xf3
+	listpack64BitInt  = 0xf4
+	listpackMaxLength = math.MaxUint16
+)
+
+// Encodes elements as a listpack. Elements that are integers, written as
+// Redis would format them, are encoded as integers, as Redis does.
+func appendListpack(p []byte, elements []string) []byte {
+	start := len(p)
+	p = append(p, make([]byte, listpackHeaderSize)...)
+	for _, element := range elements {
+		entryStart := len(p)
+		if i, err := strconv.ParseInt(element, 10, 64); err == nil && strconv.FormatInt(i, 10) == element {
+			p = appendListpackInt(p, i)
+		} else {
+			p = appendListpackString(p, element)
+		}
+		p = appendListpackBacklen(p, len(p)-entryStart)
+	}
+	p = append(p, listpackEnd)
+
+	binary.LittleEndian.PutUint32(p[start:], uint32(len(p)-start))
+	binary.LittleEndian.PutUint16(p[start+4:], uint16(min(len(elements), listpackMaxLength)))
+	return p
+}
+
+func appendListpackInt(p []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i < 1<<7:
+		return append(p, listpack7BitUint|byte(i))
+	case i >= -1<<12 && i < 1<<12:
+		u := uint16(i) & 0x1fff
+		return append(p, listpack13BitInt|byte(u>>8), byte(u))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return binary.LittleEndian.AppendUint16(append(p, listpack16BitInt), uint16(i))
+	case i >= -1<<23 && i < 1<<23:
+		u := uint32(i)
+		return append(p, listpack24BitInt, byte(u), byte(u>>8), byte(u>>16))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return binary.LittleEndian.AppendUint32(append(p, listpack32BitInt), uint32(i))
+	default:
+		return binary.LittleEndian.AppendUint64(append(p, listpack64BitInt), uint64(i))
+	}
+}
+
+func appendListpackString(p []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 1<<6:
+		p = append(p, listpack6BitStr|byte(n))
+	case n < 1<<12:
+		p = append(p, listpack12BitStr|byte(n>>8), byte(n))
+	default:
+		p = binary.LittleEndian.AppendUint32(append(p, listpack32BitStr), uint32(n))
+	}
+	return append(p, s...)
+}
+
+// Appends the length of an element, 7 bits a byte, most significant first.
+// Every byte but the first has its top bit set, so when reading backwards
+// the end of the length is the byte without it.
+func appendListpackBacklen(p []byte, n int) []byte {
+	size := listpackBacklenSize(n)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(n>>(7*i)) & 0x7f
+		if i < size-1 {
+			b |= 0x80
+		}
+		p = append(p, b)
+	}
+	return p
+}
+
+// Returns the bytes taken by the length of an element of n bytes
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// Decodes the elements of a listpack. Integers are formatted as strings.
+func readListpack(p []byte) ([]string, error) {
+	corrupt := fmt.Errorf("%w: invalid listpack", ErrRDBCorrupt)
+	if len(p) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(p)) != len(p) {
+		return nil, corrupt
+	}
+
+	var elements []string
+	for i := listpackHeaderSize; ; {
+		if i >= len(p) {
+			return nil, corrupt
+		}
+		b := p[i]
+		if b == listpackEnd {
+			if i != len(p)-1 {
+				return nil, corrupt
+			}
+			return elements, nil
+		}
+
+		// The size of the encoding, and of the string after it, if any
+		header, strLen := 1, 0
+		var value int64
+		switch {
+		case b&0x80 == listpack7BitUint:
+			value = int64(b & 0x7f)
+		case b&0xc0 == listpack6BitStr:
+			strLen = int(b & 0x3f)
+		case b&0xe0 == listpack13BitInt:
+			header = 2
+		case b&0xf0 == listpack12BitStr:
+			header = 2
+		case b == listpack32BitStr:
+			header = 5
+		case b == listpack16BitInt:
+			header = 3
+		case b == listpack24BitInt:
+			header = 4
+		case b == listpack32BitInt:
+			header = 5
+		case b == listpack64BitInt:
+			header = 9
+		default:
+			return nil, corrupt
+		}
+		if i+header > len(p) {
+			return nil, corrupt
+		}
+		data := p[i+1 : i+header]
+		switch {
+		case b&0xe0 == listpack13BitInt:
+			// Sign extended from 13 bits
+			value = int64(int16(uint16(b&0x1f)<<11|uint16(data[0])<<3) >> 3)
+		case b&0xf0 == listpack12BitStr:
+			strLen = int(b&0x0f)<<8 | int(data[0])
+		case b == listpack32BitStr:
+			strLen = int(binary.LittleEndian.Uint32(data))
+		case b == listpack16BitInt:
+			value = int64(int16(binary.LittleEndian.Uint16(data)))
+		case b == listpack24BitInt:
+			value = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+		case b == listpack32BitInt:
+			value = int64(int32(binary.LittleEndian.Uint32(data)))
+		case b == listpack64BitInt:
+			value = int64(binary.LittleEndian.Uint64(data))
+		}
+
+		n := header + strLen
+		if strLen < 0 || i+n > len(p) {
+			return nil, corrupt
+		}
+		if b&0xc0 == listpack6BitStr || b&0xf0 == listpack12BitStr || b == listpack32BitStr {
+			elements = append(elements, string(p[i+header:i+n]))
+		} else {
+			elements = append(elements, strconv.FormatInt(value, 10))
+		}
+		i += n + listpackBacklenSize(n)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -14,246 +15,120 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// Redis version reported to clients
+const ServerVersion = "7.2.0"
+
 // Server configuration
 type Config struct {
+	// Plaintext TCP address, served along with Endpoints. Empty for none.
 	Address         string
+	Endpoints       []Endpoint
 	ReadTimeout     time.Duration
 	WriteTimeout    time.Duration
 	MaxMessageSize  int
 	ShutdownTimeout time.Duration
+
+	// Certificates of TLS endpoints
+	TLSCertFile string
+	TLSKeyFile  string
+	// CA that signs client certificates
+	TLSCAFile      string
+	TLSAuthClients TLSAuthClients
 }
 
-// TCP server
+// Server accepts connections on TCP, Unix socket and TLS endpoints
 type Server struct {
-	config     Config
-	listener   net.Listener
+	config Config
+	// A listener for each endpoint, in order
+	listeners  []net.Listener
+	tls        tlsState
 	logger     *slog.Logger
 	handler    CommandHandler
 	shutdownWg sync.WaitGroup
-}
-
-type RecordKind int
-
-const (
-	StringRecord RecordKind = iota
-	ListRecord
-)
-
-type KVRecord struct {
-	kind      RecordKind
-	value     string
-	listValue []string
-	expire    bool
-	ttl       time.Time
-}
-
-// Dictionary stores key value pairs
-type Dictionary struct {
-	m  *sync.RWMutex
-	kv map[string]KVRecord
+	// Timeouts in nanoseconds, changed by CONFIG SET. A read timeout of 0
+	// is none.
+	readTimeout  atomic.Int64
+	writeTimeout atomic.Int64
+	// Stops background work started with the server
+	cancel context.CancelFunc
 }
 
 type SetCommandOptions struct {
-	ex               bool
-	exSeconds        int
-	px               bool
-	pxMilliseconds   int
-	exat             bool
-	exatSeconds      int64
-	pxat             bool
-	pxatMilliseconds int64
-}
-
-// CommandHandler defines the interface for handling commands
+	// Only set if the key does not exist
+	nx bool
+	// Only set if the key exists
+	xx bool
+	// Reply with the previous value
+	get bool
+	// Retain the existing expire time
+	keepTTL bool
+	// Set when one of EX, PX, EXAT or PXAT is given
+	expire   bool
+	expireAt time.Time
+}
+
+// CommandHandler defines the interface for handling commands. A nil
+// response means the handler has already replied through the client, as
+// SUBSCRIBE does with a confirmation per channel.
 type CommandHandler interface {
 	Handle(ctx context.Context, command string, args []internal.Data) (*internal.Data, error)
 }
 
-// DefaultCommandHandler implements basic command handling
-type DefaultCommandHandler struct {
-	dict Dictionary
-}
-
-// TODO: Return pointer?
-func NewDictionary() Dictionary {
-	return Dictionary{m: &sync.RWMutex{}, kv: make(map[string]KVRecord)}
-}
-
-func (d *Dictionary) LeftPushList(k string, elements []string) (int, error) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	fmt.Println(elements)
-
-	var list []string
-	record, exists := d.kv[k]
-	if !exists {
-		// key not exist, create list
-		slices.Reverse(elements) // Reverse for left push
-		d.setList(k, elements)
-		return len(elements), nil
-	}
-
-	// If key exists, check it's a list or throw
-	if record.kind != ListRecord {
-		return 0, fmt.Errorf("value at key is not a list")
-	}
-	list = record.listValue
-
-	slices.Reverse(elements) // Reverse for left push
-	elements = append(elements, list...)
-	d.setList(k, elements)
-
-	return len(elements), nil
-}
-
-// Private method. Caller should use mutex
-func (d *Dictionary) setList(k string, l []string) {
-	d.kv[k] = KVRecord{kind: ListRecord, listValue: l, ttl: time.Time{}, expire: false}
-}
-
-func (d *Dictionary) Kind(k string) (RecordKind, bool) {
-	record, ok := d.kv[k]
-	if !ok {
-		return 0, false
-	}
-	return record.kind, true
-}
-
-// TODO: Add mutex
-func (d *Dictionary) Set(k string, v string) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	d.set(k, v)
-}
-
-func (d *Dictionary) set(k string, v string) {
-	d.kv[k] = KVRecord{kind: StringRecord, value: v, ttl: time.Time{}, expire: false}
-}
-
-// Private method to replace value in dict record. Consumer must acquire lock
-func (d *Dictionary) replaceOrSet(k string, v string) {
-	record, ok := d.kv[k]
-	// Does not exist, so set
-	if !ok {
-		d.set(k, v)
-		return
-	}
-	// Exists, so replace value, but retain existing expiration
-	record.value = v
-	// TODO: Why record need to be set? Is record copied?
-	d.kv[k] = record
-}
-
-func (d *Dictionary) SetWithExpire(k string, v string, expireMs int) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	ttl := time.Now().Add(time.Duration(expireMs) * time.Millisecond)
-
-	d.kv[k] = KVRecord{kind: StringRecord, value: v, ttl: ttl, expire: true}
-}
-
-// TODO: Dedupe set functions
-func (d *Dictionary) SetWithExpireAt(k string, v string, expireAt int64) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	ttl := time.UnixMilli(expireAt)
-
-	d.kv[k] = KVRecord{kind: StringRecord, value: v, ttl: ttl, expire: true}
-}
-
-func (d *Dictionary) Get(k string) (string, bool) {
-	d.m.RLock()
-	defer d.m.RUnlock()
-	return d.get(k)
+// BackgroundRunner is implemented by handlers with work to run while the
+// server is up. Run is started by Server.Start, and must return once ctx is
+// done.
+type BackgroundRunner interface {
+	Run(ctx context.Context)
 }
 
-func (d *Dictionary) GetList(k string) ([]string, bool) {
-	d.m.RLock()
-	defer d.m.RUnlock()
-	record, ok := d.kv[k]
-	return record.listValue, ok
+// Authorizer is implemented by handlers that restrict what clients may run.
+// Authorize is called before each command is handled, and its error is sent
+// instead of running the command.
+type Authorizer interface {
+	Authorize(ctx context.Context, command string, args []internal.Data) error
 }
 
-// Returns int, but stores string
-func (d *Dictionary) Incr(k string) (int64, error) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	var i int64
-	value, ok := d.get(k)
-	if !ok {
-		i = 0
-	} else {
-		var err error
-		i, err = strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return 0, fmt.Errorf("error unable to parse value to int: %v", value)
-		}
-	}
-
-	// Increment, then store
-	i++
-	d.replaceOrSet(k, strconv.FormatInt(i, 10))
-
-	return i, nil
-}
-
-// TODO: Dedupe with Incr
-func (d *Dictionary) Decr(k string) (int64, error) {
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	var i int64
-	value, ok := d.get(k)
-	if !ok {
-		i = 0
-	} else {
-		var err error
-		i, err = strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return 0, fmt.Errorf("error unable to parse value to int: %v", value)
-		}
-	}
-
-	// Decrement, then store
-	i--
-	d.replaceOrSet(k, strconv.FormatInt(i, 10))
-
-	return i, nil
+// ClientCloser is implemented by handlers that keep per client state, such
+// as subscriptions. CloseClient is called once the client's connection
+// closes.
+type ClientCloser interface {
+	CloseClient(client *Client)
 }
 
-// Private method to get value. Expect consumer to acquire mutex lock.
-func (d *Dictionary) get(k string) (string, bool) {
-	record, ok := d.kv[k]
-	if record.expire {
-		if !(time.Now().Before(record.ttl)) {
-			return "", false
-		}
-	}
-	return record.value, ok
-}
-
-func (d *Dictionary) Del(k string) bool {
-	// Acquire write lock before reading and deleting
-	d.m.Lock()
-	defer d.m.Unlock()
-
-	_, ok := d.get(k)
-
-	if !ok {
-		return false
-	}
-
-	delete(d.kv, k)
-
-	return true
+// DefaultCommandHandler implements basic command handling
+type DefaultCommandHandler struct {
+	dict    Dictionary
+	pubsub  *PubSub
+	rdb     *rdbState
+	aof     *aof
+	repl    *replication
+	scripts *scriptCache
+	acl     *acl
+	config  *configStore
+	stats   *stats
+	started time.Time
+}
+
+func NewDefaultCommandHandler() *DefaultCommandHandler {
+	h := &DefaultCommandHandler{
+		dict:    NewDictionary(),
+		pubsub:  NewPubSub(),
+		rdb:     newRDBState("dump.rdb"),
+		aof:     newAOF(),
+		repl:    newReplication(),
+		scripts: newScriptCache(),
+		acl:     newACL(),
+		stats:   &stats{},
+		started: time.Now(),
+	}
+	h.dict.feed.sink = h.propagate
+	h.UseConfig(newConfigStore())
+	return h
 }
 
 // NewServer creates a new server instance
@@ -261,32 +136,70 @@ func NewServer(config Config, logger *slog.Logger, handler CommandHandler) *Serv
 	if logger == nil {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 	}
-	return &Server{
+	s := &Server{
 		config:  config,
 		logger:  logger,
 		handler: handler,
 	}
+	s.readTimeout.Store(int64(config.ReadTimeout))
+	s.writeTimeout.Store(int64(config.WriteTimeout))
+	return s
 }
 
 // Start begins listening for connections
 func (s *Server) Start(ctx context.Context) error {
-	var err error
-	s.listener, err = net.Listen("tcp", s.config.Address)
-	if err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
+	endpoints := s.config.endpoints()
+	if len(endpoints) == 0 {
+		return errors.New("failed to start server: no address to listen on")
+	}
+	if slices.ContainsFunc(endpoints, func(e Endpoint) bool { return e.Kind == EndpointTLS }) {
+		tlsConfig, err := loadTLSConfig(s.config)
+		if err != nil {
+			return fmt.Errorf("failed to start server: %w", err)
+		}
+		s.tls.set(tlsConfig)
+	}
+
+	for _, endpoint := range endpoints {
+		listener, err := s.listen(endpoint)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("failed to start server: %w", err)
+		}
+		s.listeners = append(s.listeners, listener)
+		s.logger.Info("server started", "kind", endpoint.Kind, "address", listener.Addr().String())
 	}
 
-	s.logger.Info("server started", "address", s.config.Address)
+	ctx, s.cancel = context.WithCancel(ctx)
+	if runner, ok := s.handler.(BackgroundRunner); ok {
+		s.shutdownWg.Add(1)
+		go func() {
+			defer s.shutdownWg.Done()
+			runner.Run(ctx)
+		}()
+	}
 
 	go s.acceptConnections(ctx)
 	return nil
 }
 
+// Closes every listener, returning the first error
+func (s *Server) closeListeners() error {
+	var firstErr error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Shutdown gracefully stops the server
 func (s *Server) Shutdown(ctx context.Context) error {
-	if err := s.listener.Close(); err != nil {
-		return fmt.Errorf("failed to close listener: %w, err", err)
+	if err := s.closeListeners(); err != nil {
+		return fmt.Errorf("failed to close listener: %w", err)
 	}
+	s.cancel()
 
 	done := make(chan struct{})
 	go func() {
@@ -302,16 +215,23 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
+// Accepts connections from every listener, until they're all closed
 func (s *Server) acceptConnections(ctx context.Context) {
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			if errors.Is(err, net.ErrClosed) {
-				return
-			}
-			s.logger.Error("failed to accept connection", "error", err)
-		}
+	conns := make(chan net.Conn)
+	var wg sync.WaitGroup
+	for _, listener := range s.listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.accept(listener, conns)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(conns)
+	}()
 
+	for conn := range conns {
 		s.shutdownWg.Add(1)
 		go func() {
 			defer s.shutdownWg.Done()
@@ -328,43 +248,129 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	)
 	logger.Info("new connection established")
 
+	// Handshake before reading, so a failed handshake isn't answered
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		handshakeCtx, cancel := context.WithCancel(ctx)
+		if timeout := time.Duration(s.readTimeout.Load()); timeout > 0 {
+			handshakeCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			logger.Error("TLS handshake failed", "error", err)
+			return
+		}
+	}
+
+	client := NewClient()
+	client.addr, client.laddr = conn.RemoteAddr().String(), conn.LocalAddr().String()
+	client.send = func(data *internal.Data) error {
+		return s.sendResponse(conn, client.protocol, data)
+	}
+	client.sendRaw = func(p []byte) error {
+		return s.write(conn, p)
+	}
+	client.close = func() {
+		logger.Warn("closing client over its output buffer limit")
+		conn.Close()
+	}
+	commandCtx := withClient(ctx, client)
+	if closer, ok := s.handler.(ClientCloser); ok {
+		defer closer.CloseClient(client)
+	}
+	reader := internal.NewReader(conn, s.config.MaxMessageSize)
+
+	// Requests are read while commands run, so a client that disconnects
+	// while blocked stops waiting. Commands that don't block run to the
+	// end, so a client that half closes after a pipeline gets its replies.
+	requests := make(chan readResult)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			request, err := s.readRequest(reader)
+			if err != nil {
+				client.disconnect()
+			}
+			select {
+			case requests <- readResult{request, err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
 	for {
-		// TODO: Investigate whether read deadline is correct appraoch.
-		// If it is, gracefully handle read request after deadline.
-		if err := conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout)); err != nil {
+		// Idle clients time out, but not those running a command, such as
+		// a blocked BLPOP
+		var deadline time.Time
+		if timeout := time.Duration(s.readTimeout.Load()); timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
 			logger.Error("failed to set read deadline", "error", err)
 		}
 
-		request, err := s.readRequest(conn)
+		// Pipelined requests are read one at a time, and answered in order
+		var result readResult
+		select {
+		case result = <-requests:
+		case <-ctx.Done():
+			return
+		}
+		request, err := result.request, result.err
 		if err != nil {
-			if errors.Is(err, io.EOF) {
+			// The connection was closed by the client, or by the server
+			// once the client's output overflowed
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
 				return
 			}
 			logger.Error("failed to read request", "error", err)
-			s.sendError(conn, "failed to read request")
+			if errors.Is(err, internal.ErrProtocol) {
+				s.sendError(client, "ERR "+err.Error())
+			} else {
+				s.sendError(client, "failed to read request")
+			}
 			return
 		}
 
-		if err := s.processRequest(ctx, conn, request); err != nil {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			logger.Error("failed to set read deadline", "error", err)
+		}
+		if err := s.processRequest(commandCtx, conn, request); err != nil {
 			logger.Error("failed to process request", "error", err)
-			s.sendError(conn, "internal server error")
+			s.sendError(client, "internal server error")
+			return
+		}
+
+		// Close the connection once the server is shutting down, rather than
+		// waiting for the next request
+		if ctx.Err() != nil {
 			return
 		}
 	}
 }
 
-func (s *Server) readRequest(conn net.Conn) (*internal.Data, error) {
-	buffer := make([]byte, s.config.MaxMessageSize)
-	n, err := conn.Read(buffer)
+// A request read from a connection, or the error that ended reading
+type readResult struct {
+	request *internal.Data
+	err     error
+}
+
+func (s *Server) readRequest(reader *internal.Reader) (*internal.Data, error) {
+	request, err := reader.ReadData()
 	if err != nil {
 		return nil, err
 	}
 
-	request := string(buffer[:n])
+	// Requests can carry passwords, as AUTH and CONFIG SET requirepass do, so
+	// they're only logged when debugging
+	s.logger.Debug("request received", "request", request)
 
-	s.logger.Info("request received", "request", request)
-
-	return internal.Deserialize(request)
+	return request, nil
 }
 
 func (s *Server) processRequest(ctx context.Context, conn net.Conn, request *internal.Data) error {
@@ -374,8 +380,9 @@ func (s *Server) processRequest(ctx context.Context, conn net.Conn, request *int
 		return fmt.Errorf("failed to get command array: %w", err)
 	}
 
+	client := clientFromContext(ctx)
 	if len(command) < 1 {
-		return s.sendError(conn, "empty command")
+		return s.sendError(client, "empty command")
 	}
 
 	cmdStr, err := command[0].GetString()
@@ -383,178 +390,219 @@ func (s *Server) processRequest(ctx context.Context, conn net.Conn, request *int
 		return fmt.Errorf("failed to get command string: %w", err)
 	}
 
-	response, err := s.handler.Handle(ctx, strings.ToUpper(cmdStr), command[1:])
+	// RESP2 clients can't tell pushes from replies, so subscribed clients
+	// may only run commands that manage subscriptions
+	cmdStr = strings.ToUpper(cmdStr)
+	if client.subscriptions() > 0 && client.protocol == internal.RESP2 && !allowedWhileSubscribed(cmdStr) {
+		return s.sendError(client, fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmdStr)))
+	}
+
+	if authorizer, ok := s.handler.(Authorizer); ok {
+		if err := authorizer.Authorize(ctx, cmdStr, command[1:]); err != nil {
+			return s.sendError(client, err.Error())
+		}
+	}
+
+	response, err := s.handler.Handle(ctx, cmdStr, command[1:])
+	// Blocked commands are interrupted on shutdown, and get no reply
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errClientDisconnected)) {
+		return nil
+	}
 	if err != nil {
-		return s.sendError(conn, err.Error())
+		return s.sendError(client, err.Error())
+	}
+	if response == nil {
+		return nil
 	}
 
-	return s.sendResponse(conn, response)
+	// Protocol is read after handling, so a HELLO reply uses the new protocol
+	return client.Send(response)
 }
 
-func (s *Server) sendResponse(conn net.Conn, response *internal.Data) error {
-	if err := conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout)); err != nil {
+func (s *Server) sendResponse(conn net.Conn, proto internal.Protocol, response *internal.Data) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Duration(s.writeTimeout.Load()))); err != nil {
 		return fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
-	serialized, err := internal.Serialize(*response)
+	serialized, err := internal.SerializeProtocol(*response, proto)
 	if err != nil {
 		return fmt.Errorf("failed to serialize response: %w", err)
 	}
 
-	s.logger.Info("send response", "response", serialized)
+	s.logger.Debug("send response", "response", serialized)
 
 	_, err = conn.Write([]byte(serialized))
 	return err
 }
 
-func (s *Server) sendError(conn net.Conn, message string) error {
-	return s.sendResponse(conn, internal.NewSimpleError(message))
+// Writes p as it is, such as the replication stream
+func (s *Server) write(conn net.Conn, p []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Duration(s.writeTimeout.Load()))); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	_, err := conn.Write(p)
+	return err
+}
+
+func (s *Server) sendError(client *Client, message string) error {
+	return client.Send(internal.NewSimpleError(message))
+}
+
+// Run implements the BackgroundRunner interface for DefaultCommandHandler
+func (h *DefaultCommandHandler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		h.aof.runFsync(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		h.repl.runPing(ctx)
+	}()
+	h.dict.RunActiveExpire(ctx)
+	wg.Wait()
+	h.repl.stopLink()
+}
+
+// CloseClient implements the ClientCloser interface for DefaultCommandHandler
+func (h *DefaultCommandHandler) CloseClient(client *Client) {
+	h.pubsub.closeClient(client)
+	h.dict.Unwatch(client.watch)
+	h.repl.remove(client)
 }
 
 // Handle implements the CommandHandler interface for DefaultCommandHanlder
 func (h *DefaultCommandHandler) Handle(ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
-	switch command {
-	case "PING":
-		return internal.NewSimpleStringData("PONG"), nil
-	case "ECHO":
-		return internal.NewArrayData(args), nil
-	case "COMMAND":
-		return internal.NewSimpleStringData("CONNECTED"), nil
-	case "SET":
-		return h.handleSetCommand(args)
-	case "GET":
-		return h.handleGetCommand(args)
-	case "EXISTS":
-		return h.handleExistsCommand(args)
-	case "DEL":
-		return h.handleDelCommand(args)
-	case "INCR":
-		return h.handleIncrCommand(args)
-	case "DECR":
-		return h.handleDecrCommand(args)
-	case "LPUSH":
-		return h.handleLpushCommand(args)
-	case "HELLO":
-		return h.handleHelloCommand(args)
-	default:
-		return nil, fmt.Errorf("unknown command: %s", command)
+	response, err := h.dispatch(ctx, command, args)
+	h.stats.commands.Add(1)
+	if err != nil {
+		h.stats.errors.Add(1)
+	}
+	return response, err
+}
+
+// Private method to check a command, and then queue, log or run it
+func (h *DefaultCommandHandler) dispatch(ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+	client := clientFromContext(ctx)
+	// Commands that fail to queue abort the transaction
+	spec, err := checkCommand(command, args)
+	if err != nil {
+		if client.tx.active {
+			client.tx.failed = true
+		}
+		return nil, err
+	}
+	if spec.is(flagWrite) && h.repl.rejectsWrites(client) {
+		if client.tx.active {
+			client.tx.failed = true
+		}
+		return nil, errReadOnly
+	}
+	if err := h.freeMemory(client, spec); err != nil {
+		if client.tx.active {
+			client.tx.failed = true
+		}
+		return nil, err
 	}
+	if client.tx.active && !runsInMulti(command) {
+		return h.queueCommand(client, command, args)
+	}
+	if spec.is(flagWrite) && !spec.is(flagBlocking) {
+		return h.handleWrite(ctx, command, args)
+	}
+	return h.handle(ctx, command, args)
+}
+
+// Private method to run a command, once checked
+func (h *DefaultCommandHandler) handle(ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+	return commands[command].handler(h, ctx, command, args)
 }
 
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
 func (h *DefaultCommandHandler) handleSetCommand(args []internal.Data) (*internal.Data, error) {
 	// Validate input
 	if len(args) < 2 {
-		return nil, fmt.Errorf("invalid set command")
+		return nil, errWrongNumberOfArgs("SET")
 	}
-
-	key, err := args[0].GetString()
-	if err != nil {
-		return nil, fmt.Errorf("first arg must be string")
-	}
-	// TODO: Relax string requirement
-	value, err := args[1].GetString()
+	strs, err := stringArgs(args)
 	if err != nil {
-		return nil, fmt.Errorf("second arg must be string")
+		return nil, err
 	}
+	key, value := strs[0], strs[1]
 
 	options := SetCommandOptions{}
-	for i := 2; i < len(args); i++ {
-		option, err := args[i].GetString()
-		if err != nil {
-			// TODO: include command in error for logging
-			return nil, fmt.Errorf("invalid option flag")
-		}
-		switch strings.ToUpper(option) {
-		// TODO: Dedupe cases
-		case "EX":
-			i++
-			options.ex = true
-			if i >= len(args) {
-				return nil, fmt.Errorf("command error. EX must be followed by int")
-			}
-			s, err := args[i].GetString()
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("EX not followed by int")
+	for i := 2; i < len(strs); i++ {
+		option := strings.ToUpper(strs[i])
+		switch option {
+		case "NX":
+			if options.xx {
+				return nil, ErrSyntax
 			}
-			seconds, err := strconv.Atoi(s)
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("EX not followed by int")
+			options.nx = true
+		case "XX":
+			if options.nx {
+				return nil, ErrSyntax
 			}
-			options.exSeconds = seconds
-		case "PX":
-			i++
-			options.px = true
-			if i >= len(args) {
-				return nil, fmt.Errorf("command error. PX must be followed by int")
+			options.xx = true
+		case "GET":
+			options.get = true
+		case "KEEPTTL":
+			if options.expire {
+				return nil, ErrSyntax
 			}
-			s, err := args[i].GetString()
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("PX not followed by int")
+			options.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			// Only one of the expire options may be given
+			if options.expire || options.keepTTL || i+1 >= len(strs) {
+				return nil, ErrSyntax
 			}
-			milliseconds, err := strconv.Atoi(s)
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("PX not followed by int")
-			}
-			options.pxMilliseconds = milliseconds
-		case "EXAT":
 			i++
-			options.exat = true
-			if i >= len(args) {
-				return nil, fmt.Errorf("command error. EXAT must be followed by int")
-			}
-			s, err := args[i].GetString()
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("EXAT not followed by int")
-			}
-			seconds, err := strconv.ParseInt(s, 10, 64)
+			n, err := parseInt(strs[i])
 			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("EXAT not followed by int")
-			}
-			options.exatSeconds = seconds
-		case "PXAT":
-			i++
-			options.pxat = true
-			if i >= len(args) {
-				return nil, fmt.Errorf("command error. PXAT must be followed by int")
+				return nil, err
 			}
-			s, err := args[i].GetString()
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("PXAT not followed by int")
+			unit := time.Second
+			if option == "PX" || option == "PXAT" {
+				unit = time.Millisecond
 			}
-			milliseconds, err := strconv.ParseInt(s, 10, 64)
-			if err != nil {
-				// TODO: use generic error
-				return nil, fmt.Errorf("PXAT not followed by int")
+			absolute := option == "EXAT" || option == "PXAT"
+			at, ok := expireAt(n, unit, absolute)
+			if n <= 0 || !ok {
+				return nil, fmt.Errorf("ERR invalid expire time in 'set' command")
 			}
-			options.pxatMilliseconds = milliseconds
+			options.expire = true
+			options.expireAt = at
 		default:
-			return nil, fmt.Errorf("error unexpected option: %v", args[i])
+			return nil, ErrSyntax
 		}
 	}
-	// TODO: Remove
-	// fmt.Printf("Options: %v", options)
 
-	// Allow multiple options, but priority order is EX > PX> EXAT
-	if options.ex {
-		h.dict.SetWithExpire(key, value, options.exSeconds*1000)
-	} else if options.px {
-		h.dict.SetWithExpire(key, value, options.pxMilliseconds)
-	} else if options.exat {
-		h.dict.SetWithExpireAt(key, value, options.exatSeconds*1000)
-	} else if options.pxat {
-		h.dict.SetWithExpireAt(key, value, options.pxatMilliseconds)
-	} else {
-		h.dict.Set(key, value)
+	old, existed, set, err := h.dict.SetWithOptions(key, value, options)
+	if err != nil {
+		return nil, err
 	}
 
-	return internal.NewBulkStringData("OK"), nil
+	// Relative expire times are logged as absolute ones, so replaying the
+	// AOF later expires the key at the same time
+	if !set {
+		h.dict.rewriteCommand()
+	} else if options.expire {
+		h.dict.rewriteCommand("SET", key, value, "PXAT", strconv.FormatInt(options.expireAt.UnixMilli(), 10))
+	}
+
+	if options.get {
+		if !existed {
+			return internal.NewNullData(), nil
+		}
+		return internal.NewBulkStringData(old), nil
+	}
+	// NX or XX condition not met
+	if !set {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewSimpleStringData("OK"), nil
 }
 
 func (h *DefaultCommandHandler) handleGetCommand(args []internal.Data) (*internal.Data, error) {
@@ -574,20 +622,16 @@ func (h *DefaultCommandHandler) handleGetCommand(args []internal.Data) (*interna
 		return internal.NewNullData(), nil
 	}
 
+	// Key may expire between checking kind and reading value
 	switch kind {
 	case StringRecord:
-		value, _ := h.dict.Get(key)
+		value, ok := h.dict.Get(key)
+		if !ok {
+			return internal.NewNullData(), nil
+		}
 		return internal.NewBulkStringData(value), nil
-	case ListRecord:
-		value, _ := h.dict.GetList(key)
-		// Convert to string data
-		data := make([]internal.Data, len(value))
-		for i, s := range value {
-			data[i] = *internal.NewBulkStringData(s)
-		}
-		return internal.NewArrayData(data), nil
 	default:
-		return nil, fmt.Errorf("unexpected value type stored at key")
+		return nil, ErrWrongType
 	}
 }
 
@@ -665,56 +709,124 @@ func (h *DefaultCommandHandler) handleDecrCommand(args []internal.Data) (*intern
 	return internal.NewIntData(int(i)), nil
 }
 
-func (h *DefaultCommandHandler) handleLpushCommand(args []internal.Data) (*internal.Data, error) {
-	// Validation
-	if len(args) < 2 {
-		return nil, fmt.Errorf("invalid LPUSH command")
-	}
-	// TODO: Change GetString to return `ok` instead of error
-	key, err := args[0].GetString()
-	if err != nil {
-		return nil, fmt.Errorf("LPUSH key arg must be string")
-	}
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (h *DefaultCommandHandler) handleHelloCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	client := clientFromContext(ctx)
+	protocol := client.protocol
+	name := client.name
+	user := client.user
 
-	stringList := make([]string, len(args)-1)
-	for i, a := range args[1:] {
-		s, err := a.GetString()
+	if len(args) > 0 {
+		s, err := args[0].GetString()
+		if err != nil {
+			return nil, fmt.Errorf("ERR Protocol version is not an integer or out of range")
+		}
+		version, err := strconv.Atoi(s)
 		if err != nil {
-			return nil, fmt.Errorf("element %d is not a string", i)
+			return nil, fmt.Errorf("ERR Protocol version is not an integer or out of range")
 		}
-		stringList[i] = s
+		if version != int(internal.RESP2) && version != int(internal.RESP3) {
+			return nil, fmt.Errorf("NOPROTO unsupported protocol version")
+		}
+		protocol = internal.Protocol(version)
 	}
 
-	l, err := h.dict.LeftPushList(key, stringList)
-	if err != nil {
-		// TODO: use error that can be sent to client
-		return nil, fmt.Errorf("LPUSH failed: %w", err)
+	for i := 1; i < len(args); i++ {
+		option, err := args[i].GetString()
+		if err != nil {
+			return nil, fmt.Errorf("ERR Syntax error in HELLO option")
+		}
+		switch strings.ToUpper(option) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", option)
+			}
+			strs, err := stringArgs(args[i+1 : i+3])
+			if err != nil {
+				return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", option)
+			}
+			if err := h.acl.authenticate(strs[0], strs[1]); err != nil {
+				return nil, err
+			}
+			user = strs[0]
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", option)
+			}
+			name, err = args[i+1].GetString()
+			if err != nil || !validClientName(name) {
+				return nil, fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return nil, fmt.Errorf("ERR Syntax error in HELLO option '%s'", option)
+		}
 	}
 
-	return internal.NewIntData(l), nil
-}
-
-func (h *DefaultCommandHandler) handleHelloCommand(args []internal.Data) (*internal.Data, error) {
-	return internal.NewArrayData([]internal.Data{
-		*internal.NewBulkStringData("server"),
-		*internal.NewBulkStringData("redis"),
+	// Only apply once every option is valid. Publishers read the protocol
+	// while holding the write lock.
+	client.writeMu.Lock()
+	client.protocol = protocol
+	client.writeMu.Unlock()
+	client.name = name
+	client.user = user
+
+	role := "master"
+	if h.repl.isReplica() {
+		role = "replica"
+	}
+	return internal.NewMapData(map[internal.Data]internal.Data{
+		*internal.NewBulkStringData("server"):  *internal.NewBulkStringData("redis"),
+		*internal.NewBulkStringData("version"): *internal.NewBulkStringData(ServerVersion),
+		*internal.NewBulkStringData("proto"):   *internal.NewIntData(int(client.protocol)),
+		*internal.NewBulkStringData("id"):      *internal.NewIntData(int(client.id)),
+		*internal.NewBulkStringData("mode"):    *internal.NewBulkStringData("standalone"),
+		*internal.NewBulkStringData("role"):    *internal.NewBulkStringData(role),
+		*internal.NewBulkStringData("modules"): *internal.NewArrayData([]internal.Data{}),
 	}), nil
 }
 
 func main() {
-	config := Config{
-		Address:         "localhost:6379",
-		ReadTimeout:     30 * time.Minute,
-		WriteTimeout:    30 * time.Second,
-		MaxMessageSize:  1024 * 1024, // 1MB
-		ShutdownTimeout: 30 * time.Second,
-	}
-
+	// Options come from redis.conf, if its path is the first argument, and
+	// options such as --port 7000 that override it
+	level := new(slog.LevelVar)
 	logger := slog.New((slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: slog.LevelInfo,
+		Level: level,
 	})))
+	store, err := loadConfig(os.Args[1:])
+	if err != nil {
+		logger.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	config, err := store.serverConfig()
+	if err != nil {
+		logger.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	store.watch("loglevel", func(value string) {
+		level.Set(logLevels[value])
+	})
+
+	// The AOF has every write, so the RDB file is only loaded without it
+	handler := NewDefaultCommandHandler()
+	handler.UseConfig(store)
+	if store.get("appendonly") == "yes" {
+		var fsync AppendFsync
+		fsync, err = ParseAppendFsync(store.get("appendfsync"))
+		if err == nil {
+			err = handler.EnableAOF(store.get("appendfilename"), fsync, logger)
+		}
+	} else {
+		err = handler.LoadRDB()
+	}
+	if err != nil {
+		logger.Error("failed to load data", "error", err)
+		os.Exit(1)
+	}
 
-	server := NewServer(config, logger, &DefaultCommandHandler{dict: NewDictionary()})
+	server := NewServer(config, logger, handler)
+	server.UseConfig(store)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -724,11 +836,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Handle shutdown signals
+	// Handle shutdown signals. SIGHUP reloads TLS certificates, such as
+	// once they're renewed.
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGHUP)
 
-	<-sigChan
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if store.int("tls-port") == 0 {
+			continue
+		}
+		if err := server.ReloadTLS(); err != nil {
+			logger.Error("failed to reload TLS certificates", "error", err)
+		}
+	}
 	logger.Info("shutting down server...")
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
@@ -1,6 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"myredis/internal"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -44,3 +56,1413 @@ func TestDictionaryGetExpire(t *testing.T) {
 		t.Fatalf("Get after expire. ok=%t. want=%t", ok, false)
 	}
 }
+
+func TestDictionaryLazyExpire(t *testing.T) {
+	d := NewDictionary()
+
+	d.SetWithExpire("string", "value", 1)
+	d.SetWithExpire("deleted", "value", 1)
+	d.LeftPushList("list", []string{"a"})
+	if !d.Expire("list", time.Now().Add(time.Millisecond), ExpireAlways) {
+		t.Fatalf("Expire list. want=true, got=false")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := d.Kind("string"); ok != false {
+		t.Fatalf("Kind after expire. ok=%t. want=%t", ok, false)
+	}
+	if n, _ := d.ListLen("list"); n != 0 {
+		t.Fatalf("ListLen after expire. result=%d. want=%d", n, 0)
+	}
+	if ok := d.Del("deleted"); ok != false {
+		t.Fatalf("Del after expire. ok=%t. want=%t", ok, false)
+	}
+
+	// Every expired key was removed on access
+	if len(d.kv) != 0 || len(d.expires) != 0 {
+		t.Fatalf("after access. len(kv)=%d, len(expires)=%d. want=0", len(d.kv), len(d.expires))
+	}
+}
+
+func TestDictionaryIncrExpired(t *testing.T) {
+	d := NewDictionary()
+
+	d.SetWithExpire("key", "10", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	// Expired value is treated as missing, and the TTL is not carried over
+	i, err := d.Incr("key")
+	if err != nil || i != 1 {
+		t.Fatalf("Incr after expire. result=%d, err=%v. want=%d", i, err, 1)
+	}
+	if _, ok := d.expires["key"]; ok {
+		t.Fatalf("Incr after expire. key still has TTL")
+	}
+}
+
+func TestDictionaryActiveExpire(t *testing.T) {
+	d := NewDictionary()
+
+	for i := 0; i < 1000; i++ {
+		d.SetWithExpire(fmt.Sprintf("expiring:%d", i), "value", 1)
+	}
+	for i := 0; i < 10; i++ {
+		d.SetWithExpire(fmt.Sprintf("volatile:%d", i), "value", 60_000)
+		d.Set(fmt.Sprintf("persistent:%d", i), "value")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.RunActiveExpire(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.m.RLock()
+		n := len(d.kv)
+		d.m.RUnlock()
+		if n == 20 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("active expire. len(kv)=%d. want=%d", n, 20)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("active expire did not stop after cancel")
+	}
+}
+
+// Starts a server with config, on random ports
+func startConfiguredTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	config.ReadTimeout = 5 * time.Second
+	config.WriteTimeout = 5 * time.Second
+	config.MaxMessageSize = 1024 * 1024
+	config.ShutdownTimeout = time.Second
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := NewServer(config, logger, NewDefaultCommandHandler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := server.Start(ctx); err != nil {
+		cancel()
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() {
+		defer cancel()
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			t.Errorf("failed to shutdown server: %v", err)
+		}
+	})
+	return server
+}
+
+// Starts a server on a random port. Returns its address.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	server := startConfiguredTestServer(t, Config{Address: "127.0.0.1:0"})
+	return server.listeners[0].Addr().String()
+}
+
+func TestServerPipeline(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Send all commands in one write, with the last one split across two writes
+	pipeline := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n" +
+		"*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"
+	if _, err := conn.Write([]byte(pipeline + "*2\r\n$3\r\nGET\r")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := conn.Write([]byte("\n$7\r\ncounter\r\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	want := []string{"+OK\r\n", ":1\r\n", ":2\r\n", "$5\r\nvalue\r\n", "$1\r\n2\r\n"}
+	reader := internal.NewReader(conn, 0)
+	for i, w := range want {
+		got, err := reader.ReadData()
+		if err != nil {
+			t.Fatalf("response %d, unexpected error: %v", i, err)
+		}
+		serialized, _ := internal.Serialize(*got)
+		if serialized != w {
+			t.Fatalf("response %d, want %q, got %q", i, w, serialized)
+		}
+	}
+}
+
+// Sends a command and returns the decoded response
+func sendCommand(t *testing.T, conn net.Conn, reader *internal.Reader, args ...string) *internal.Data {
+	t.Helper()
+	command := make([]internal.Data, len(args))
+	for i, arg := range args {
+		command[i] = *internal.NewBulkStringData(arg)
+	}
+	request, _ := internal.Serialize(*internal.NewArrayData(command))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	response, err := reader.ReadData()
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return response
+}
+
+func TestServerHello(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := internal.NewReader(conn, 0)
+
+	// RESP2 by default, so the info map is flattened
+	response := sendCommand(t, conn, reader, "HELLO")
+	if response.GetKind() != internal.ArrayKind {
+		t.Fatalf("HELLO on RESP2. kind=%s. want=%s", response.GetKind(), internal.ArrayKind)
+	}
+	if a, _ := response.GetArray(); len(a) != 14 {
+		t.Fatalf("HELLO on RESP2. len=%d. want=%d", len(a), 14)
+	}
+
+	response = sendCommand(t, conn, reader, "HELLO", "3", "SETNAME", "myclient")
+	m, err := response.GetMap()
+	if err != nil {
+		t.Fatalf("HELLO 3. unexpected error: %v", err)
+	}
+	if proto := m[*internal.NewBulkStringData("proto")]; proto != *internal.NewIntData(3) {
+		t.Fatalf("HELLO 3. proto=%v. want=%d", proto, 3)
+	}
+
+	// Nulls use the RESP3 encoding once switched. The reader parses both
+	// encodings alike, so the bytes are read from the connection.
+	request, _ := internal.Serialize(*bulkArray("GET", "missing"))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	null := make([]byte, 3)
+	if _, err := io.ReadFull(conn, null); err != nil || string(null) != "_\r\n" {
+		t.Fatalf("GET missing on RESP3. got %q, %v. want %q", null, err, "_\r\n")
+	}
+
+	response = sendCommand(t, conn, reader, "HELLO", "4")
+	if s, _ := response.GetString(); response.GetKind() != internal.SimpleErrorKind || s != "NOPROTO unsupported protocol version" {
+		t.Fatalf("HELLO 4. response=%v", response)
+	}
+
+	response = sendCommand(t, conn, reader, "HELLO", "2")
+	if response.GetKind() != internal.ArrayKind {
+		t.Fatalf("HELLO 2. kind=%s. want=%s", response.GetKind(), internal.ArrayKind)
+	}
+}
+
+// Runs a command directly against a handler
+func handle(t *testing.T, h *DefaultCommandHandler, args ...string) (*internal.Data, error) {
+	t.Helper()
+	data := make([]internal.Data, len(args)-1)
+	for i, arg := range args[1:] {
+		data[i] = *internal.NewBulkStringData(arg)
+	}
+	return h.Handle(context.Background(), strings.ToUpper(args[0]), data)
+}
+
+// Runs a command that must succeed, and checks its response
+func expectResponse(t *testing.T, h *DefaultCommandHandler, want *internal.Data, args ...string) {
+	t.Helper()
+	got, err := handle(t, h, args...)
+	if err != nil {
+		t.Fatalf("%v, unexpected error: %v", args, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%v, want %v, got %v", args, want, got)
+	}
+}
+
+// Runs a command that must fail, and checks the error
+func expectError(t *testing.T, h *DefaultCommandHandler, want string, args ...string) {
+	t.Helper()
+	_, err := handle(t, h, args...)
+	if err == nil || err.Error() != want {
+		t.Fatalf("%v, want error %q, got %v", args, want, err)
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	one, zero := internal.NewIntData(1), internal.NewIntData(0)
+
+	expectResponse(t, h, internal.NewIntData(-2), "TTL", "key")
+	expectResponse(t, h, zero, "EXPIRE", "key", "100")
+
+	handle(t, h, "SET", "key", "value")
+	expectResponse(t, h, internal.NewIntData(-1), "TTL", "key")
+	expectResponse(t, h, zero, "EXPIRE", "key", "100", "XX")
+	expectResponse(t, h, zero, "EXPIRE", "key", "100", "GT")
+	expectResponse(t, h, one, "EXPIRE", "key", "100", "NX")
+	expectResponse(t, h, internal.NewIntData(100), "TTL", "key")
+	expectResponse(t, h, zero, "EXPIRE", "key", "200", "NX")
+	expectResponse(t, h, zero, "EXPIRE", "key", "50", "GT")
+	expectResponse(t, h, one, "EXPIRE", "key", "50", "XX", "LT")
+	expectResponse(t, h, internal.NewIntData(50), "TTL", "key")
+	expectResponse(t, h, one, "PEXPIRE", "key", "2500")
+	expectResponse(t, h, internal.NewIntData(2), "TTL", "key")
+
+	at := time.Now().Add(time.Hour).Unix()
+	expectResponse(t, h, one, "EXPIREAT", "key", strconv.FormatInt(at, 10))
+	expectResponse(t, h, internal.NewIntData(int(at)), "EXPIRETIME", "key")
+	expectResponse(t, h, internal.NewIntData(int(at*1000)), "PEXPIRETIME", "key")
+	// EXPIRETIME rounds to the nearest second, as TTL does
+	expectResponse(t, h, one, "PEXPIREAT", "key", strconv.FormatInt(at*1000+600, 10))
+	expectResponse(t, h, internal.NewIntData(int(at+1)), "EXPIRETIME", "key")
+
+	expectResponse(t, h, one, "PERSIST", "key")
+	expectResponse(t, h, zero, "PERSIST", "key")
+	expectResponse(t, h, internal.NewIntData(-1), "PTTL", "key")
+
+	// Lists can expire too
+	handle(t, h, "LPUSH", "list", "a")
+	expectResponse(t, h, one, "PEXPIREAT", "list", strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10))
+	expectResponse(t, h, internal.NewIntData(60), "TTL", "list")
+
+	// Expire time in the past deletes the key
+	expectResponse(t, h, one, "EXPIRE", "list", "-1")
+	expectResponse(t, h, zero, "EXISTS", "list")
+
+	expectError(t, h, "ERR NX and XX, GT or LT options at the same time are not compatible", "EXPIRE", "key", "10", "NX", "XX")
+	expectError(t, h, "ERR GT and LT options at the same time are not compatible", "EXPIRE", "key", "10", "GT", "LT")
+	expectError(t, h, "ERR value is not an integer or out of range", "EXPIRE", "key", "ten")
+	expectError(t, h, "ERR invalid expire time in 'expire' command", "EXPIRE", "key", "9223372036854775807")
+	expectError(t, h, "ERR wrong number of arguments for 'ttl' command", "TTL")
+}
+
+func TestSetCommand(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	ok, null := internal.NewSimpleStringData("OK"), internal.NewNullData()
+
+	// Lock pattern. Second acquire fails until the first expires.
+	expectResponse(t, h, ok, "SET", "lock", "owner1", "NX", "PX", "30000")
+	expectResponse(t, h, null, "SET", "lock", "owner2", "NX", "PX", "30000")
+	expectResponse(t, h, internal.NewBulkStringData("owner1"), "GET", "lock")
+	expectResponse(t, h, internal.NewIntData(30), "TTL", "lock")
+
+	expectResponse(t, h, null, "SET", "missing", "value", "XX")
+	expectResponse(t, h, null, "GET", "missing")
+	expectResponse(t, h, ok, "SET", "lock", "owner3", "XX")
+	// Plain SET clears the TTL
+	expectResponse(t, h, internal.NewIntData(-1), "TTL", "lock")
+
+	expectResponse(t, h, null, "SET", "key", "v1", "GET")
+	expectResponse(t, h, internal.NewBulkStringData("v1"), "SET", "key", "v2", "GET", "EX", "100")
+	expectResponse(t, h, internal.NewBulkStringData("v2"), "SET", "key", "v3", "NX", "GET")
+	expectResponse(t, h, ok, "SET", "key", "v3", "KEEPTTL")
+	expectResponse(t, h, internal.NewIntData(100), "TTL", "key")
+	expectResponse(t, h, internal.NewBulkStringData("v3"), "GET", "key")
+
+	handle(t, h, "LPUSH", "list", "a")
+	expectError(t, h, ErrWrongType.Error(), "SET", "list", "value", "GET")
+	expectResponse(t, h, ok, "SET", "list", "value")
+
+	syntax := "ERR syntax error"
+	expectError(t, h, syntax, "SET", "key", "value", "NX", "XX")
+	expectError(t, h, syntax, "SET", "key", "value", "EX", "10", "PX", "100")
+	expectError(t, h, syntax, "SET", "key", "value", "EX", "10", "KEEPTTL")
+	expectError(t, h, syntax, "SET", "key", "value", "KEEPTTL", "PXAT", "100")
+	expectError(t, h, syntax, "SET", "key", "value", "EX")
+	expectError(t, h, syntax, "SET", "key", "value", "FOO")
+	expectError(t, h, "ERR value is not an integer or out of range", "SET", "key", "value", "EX", "ten")
+	expectError(t, h, "ERR invalid expire time in 'set' command", "SET", "key", "value", "EX", "0")
+	expectError(t, h, "ERR wrong number of arguments for 'set' command", "SET", "key")
+}
+
+// Builds an array of bulk strings
+func bulkArray(strs ...string) *internal.Data {
+	return internal.NewArrayData(bulkStrings(strs))
+}
+
+func TestListCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	ok, null := internal.NewSimpleStringData("OK"), internal.NewNullData()
+
+	expectResponse(t, h, internal.NewIntData(0), "LPUSHX", "list", "a")
+	expectResponse(t, h, internal.NewIntData(3), "RPUSH", "list", "c", "d", "e")
+	expectResponse(t, h, internal.NewIntData(5), "LPUSH", "list", "b", "a")
+	expectResponse(t, h, internal.NewIntData(6), "RPUSHX", "list", "f")
+	expectResponse(t, h, bulkArray("a", "b", "c", "d", "e", "f"), "LRANGE", "list", "0", "-1")
+	expectResponse(t, h, bulkArray("e", "f"), "LRANGE", "list", "-2", "100")
+	expectResponse(t, h, bulkArray(), "LRANGE", "list", "4", "2")
+	expectResponse(t, h, internal.NewIntData(6), "LLEN", "list")
+	expectResponse(t, h, internal.NewIntData(0), "LLEN", "missing")
+
+	expectResponse(t, h, internal.NewBulkStringData("f"), "LINDEX", "list", "-1")
+	expectResponse(t, h, null, "LINDEX", "list", "6")
+	expectResponse(t, h, ok, "LSET", "list", "1", "B")
+	expectError(t, h, "ERR index out of range", "LSET", "list", "10", "x")
+	expectError(t, h, "ERR no such key", "LSET", "missing", "0", "x")
+
+	expectResponse(t, h, internal.NewIntData(7), "LINSERT", "list", "BEFORE", "c", "x")
+	expectResponse(t, h, internal.NewIntData(8), "LINSERT", "list", "AFTER", "f", "x")
+	expectResponse(t, h, internal.NewIntData(-1), "LINSERT", "list", "AFTER", "z", "x")
+	expectResponse(t, h, internal.NewIntData(0), "LINSERT", "missing", "AFTER", "z", "x")
+	expectResponse(t, h, bulkArray("a", "B", "x", "c", "d", "e", "f", "x"), "LRANGE", "list", "0", "-1")
+
+	expectResponse(t, h, internal.NewIntData(2), "LPOS", "list", "x")
+	expectResponse(t, h, internal.NewIntData(7), "LPOS", "list", "x", "RANK", "-1")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{*internal.NewIntData(2), *internal.NewIntData(7)}), "LPOS", "list", "x", "COUNT", "0")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{}), "LPOS", "list", "x", "COUNT", "0", "MAXLEN", "2")
+	expectResponse(t, h, null, "LPOS", "list", "z")
+	expectError(t, h, "ERR COUNT can't be negative", "LPOS", "list", "x", "COUNT", "-1")
+
+	expectResponse(t, h, internal.NewIntData(1), "LREM", "list", "-1", "x")
+	expectResponse(t, h, bulkArray("a", "B", "x", "c", "d", "e", "f"), "LRANGE", "list", "0", "-1")
+	expectResponse(t, h, ok, "LTRIM", "list", "1", "-2")
+	expectResponse(t, h, bulkArray("B", "x", "c", "d", "e"), "LRANGE", "list", "0", "-1")
+
+	expectResponse(t, h, internal.NewBulkStringData("B"), "LPOP", "list")
+	expectResponse(t, h, bulkArray("e", "d"), "RPOP", "list", "2")
+	expectResponse(t, h, null, "RPOP", "missing", "2")
+	expectError(t, h, "ERR value is out of range, must be positive", "LPOP", "list", "-1")
+
+	// LMOVE between lists, and rotating a single list
+	expectResponse(t, h, internal.NewBulkStringData("x"), "LMOVE", "list", "other", "LEFT", "RIGHT")
+	expectResponse(t, h, internal.NewBulkStringData("c"), "LMOVE", "list", "list", "LEFT", "RIGHT")
+	expectResponse(t, h, bulkArray("c"), "LRANGE", "list", "0", "-1")
+	expectResponse(t, h, internal.NewBulkStringData("c"), "LMOVE", "list", "other", "RIGHT", "LEFT")
+	expectResponse(t, h, bulkArray("c", "x"), "LRANGE", "other", "0", "-1")
+	expectResponse(t, h, null, "LMOVE", "list", "other", "LEFT", "LEFT")
+
+	// Emptied lists are deleted
+	expectResponse(t, h, internal.NewIntData(0), "EXISTS", "list")
+	expectResponse(t, h, ok, "LTRIM", "other", "5", "10")
+	expectResponse(t, h, internal.NewIntData(0), "EXISTS", "other")
+
+	handle(t, h, "SET", "string", "value")
+	handle(t, h, "RPUSH", "list", "a")
+	wrongType := ErrWrongType.Error()
+	expectError(t, h, wrongType, "LPUSH", "string", "a")
+	expectError(t, h, wrongType, "LRANGE", "string", "0", "-1")
+	expectError(t, h, wrongType, "LMOVE", "list", "string", "LEFT", "LEFT")
+	expectError(t, h, wrongType, "GET", "list")
+	expectResponse(t, h, internal.NewIntData(1), "LLEN", "list")
+}
+
+// Pushes and pops cost the same however long the list is. With a slice
+// backed list each LPUSH copied the whole list.
+func BenchmarkLeftPushList(b *testing.B) {
+	for _, size := range []int{1_000, 1_000_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			d := NewDictionary()
+			fillList(d, "list", size)
+			element := []string{"element"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.LeftPushList("list", element)
+			}
+		})
+	}
+}
+
+func BenchmarkRightPushList(b *testing.B) {
+	for _, size := range []int{1_000, 1_000_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			d := NewDictionary()
+			fillList(d, "list", size)
+			element := []string{"element"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				d.RightPushList("list", element)
+			}
+		})
+	}
+}
+
+// Pops then pushes back, so the list never empties
+func BenchmarkPopList(b *testing.B) {
+	for _, size := range []int{1_000, 1_000_000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			d := NewDictionary()
+			fillList(d, "list", size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				popped, _, _ := d.PopList("list", 1, i%2 == 0)
+				d.PushList("list", popped, i%2 != 0, false)
+			}
+		})
+	}
+}
+
+func BenchmarkListRange(b *testing.B) {
+	d := NewDictionary()
+	fillList(d, "list", 1_000_000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.ListRange("list", 500_000, 500_099)
+	}
+}
+
+func fillList(d Dictionary, k string, n int) {
+	elements := make([]string, n)
+	for i := range elements {
+		elements[i] = strconv.Itoa(i)
+	}
+	d.RightPushList(k, elements)
+}
+
+func TestHashCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	one, zero, null := internal.NewIntData(1), internal.NewIntData(0), internal.NewNullData()
+
+	expectResponse(t, h, internal.NewIntData(2), "HSET", "session", "user", "alice", "visits", "1")
+	expectResponse(t, h, zero, "HSET", "session", "user", "bob")
+	expectResponse(t, h, internal.NewBulkStringData("bob"), "HGET", "session", "user")
+	expectResponse(t, h, null, "HGET", "session", "missing")
+	expectResponse(t, h, null, "HGET", "missing", "user")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("bob"), *null, *internal.NewBulkStringData("1"),
+	}), "HMGET", "session", "user", "missing", "visits")
+
+	expectResponse(t, h, zero, "HSETNX", "session", "user", "carol")
+	expectResponse(t, h, one, "HSETNX", "session", "theme", "dark")
+	expectResponse(t, h, internal.NewIntData(3), "HLEN", "session")
+	expectResponse(t, h, internal.NewIntData(4), "HSTRLEN", "session", "theme")
+	expectResponse(t, h, zero, "HSTRLEN", "session", "missing")
+	expectResponse(t, h, one, "HEXISTS", "session", "theme")
+	expectResponse(t, h, zero, "HEXISTS", "session", "missing")
+
+	expectResponse(t, h, internal.NewIntData(6), "HINCRBY", "session", "visits", "5")
+	expectResponse(t, h, internal.NewIntData(-1), "HINCRBY", "session", "new", "-1")
+	expectError(t, h, "ERR hash value is not an integer", "HINCRBY", "session", "user", "1")
+	expectError(t, h, "ERR increment or decrement would overflow", "HINCRBY", "session", "visits", "9223372036854775807")
+	expectResponse(t, h, internal.NewBulkStringData("10.5"), "HINCRBYFLOAT", "session", "score", "10.5")
+	expectResponse(t, h, internal.NewBulkStringData("10.6"), "HINCRBYFLOAT", "session", "score", "0.1")
+	expectError(t, h, "ERR hash value is not a float", "HINCRBYFLOAT", "session", "user", "1")
+	expectError(t, h, "ERR value is not a valid float", "HINCRBYFLOAT", "session", "score", "abc")
+	// A failed increment doesn't leave an empty hash behind
+	expectError(t, h, "ERR increment would produce NaN or Infinity", "HINCRBYFLOAT", "other", "score", "inf")
+	expectResponse(t, h, zero, "EXISTS", "other")
+
+	expectResponse(t, h, internal.NewIntData(2), "HDEL", "session", "new", "score", "missing")
+	expectResponse(t, h, internal.NewMapData(map[internal.Data]internal.Data{
+		*internal.NewBulkStringData("user"):   *internal.NewBulkStringData("bob"),
+		*internal.NewBulkStringData("visits"): *internal.NewBulkStringData("6"),
+		*internal.NewBulkStringData("theme"):  *internal.NewBulkStringData("dark"),
+	}), "HGETALL", "session")
+	expectResponse(t, h, internal.NewMapData(map[internal.Data]internal.Data{}), "HGETALL", "missing")
+
+	keys, _ := handle(t, h, "HKEYS", "session")
+	if got := sortedStrings(t, keys); !slices.Equal(got, []string{"theme", "user", "visits"}) {
+		t.Fatalf("HKEYS. got=%v", got)
+	}
+	vals, _ := handle(t, h, "HVALS", "session")
+	if got := sortedStrings(t, vals); !slices.Equal(got, []string{"6", "bob", "dark"}) {
+		t.Fatalf("HVALS. got=%v", got)
+	}
+
+	// Removing the last field deletes the key
+	expectResponse(t, h, internal.NewIntData(3), "HDEL", "session", "user", "visits", "theme")
+	expectResponse(t, h, zero, "EXISTS", "session")
+
+	handle(t, h, "SET", "string", "value")
+	handle(t, h, "HSET", "hash", "f", "v")
+	expectError(t, h, ErrWrongType.Error(), "HSET", "string", "f", "v")
+	expectError(t, h, ErrWrongType.Error(), "HGETALL", "string")
+	expectError(t, h, ErrWrongType.Error(), "GET", "hash")
+	expectError(t, h, "ERR wrong number of arguments for 'hset' command", "HSET", "hash", "f")
+}
+
+// Returns the strings in an array or set response, sorted
+func sortedStrings(t *testing.T, d *internal.Data) []string {
+	t.Helper()
+	a, err := d.GetArray()
+	if err != nil {
+		a, err = d.GetSet()
+	}
+	if err != nil {
+		t.Fatalf("response %v is not an array or set", d)
+	}
+	strs := make([]string, len(a))
+	for i, item := range a {
+		strs[i], _ = item.GetString()
+	}
+	slices.Sort(strs)
+	return strs
+}
+
+func TestSetCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	one, zero, null := internal.NewIntData(1), internal.NewIntData(0), internal.NewNullData()
+
+	expectResponse(t, h, internal.NewIntData(3), "SADD", "colors", "red", "green", "blue")
+	expectResponse(t, h, zero, "SADD", "colors", "red")
+	expectResponse(t, h, internal.NewIntData(3), "SCARD", "colors")
+	expectResponse(t, h, zero, "SCARD", "missing")
+	expectResponse(t, h, one, "SISMEMBER", "colors", "red")
+	expectResponse(t, h, zero, "SISMEMBER", "colors", "pink")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{*one, *zero, *one}),
+		"SMISMEMBER", "colors", "red", "pink", "blue")
+	expectResponse(t, h, internal.NewSetData([]internal.Data{}), "SMEMBERS", "missing")
+	members, _ := handle(t, h, "SMEMBERS", "colors")
+	if members.GetKind() != internal.SetKind {
+		t.Fatalf("SMEMBERS. want set reply, got %v", members.GetKind())
+	}
+	if got := sortedStrings(t, members); !slices.Equal(got, []string{"blue", "green", "red"}) {
+		t.Fatalf("SMEMBERS. got=%v", got)
+	}
+
+	expectResponse(t, h, internal.NewIntData(1), "SREM", "colors", "green", "pink")
+	expectResponse(t, h, one, "SMOVE", "colors", "warm", "red")
+	expectResponse(t, h, zero, "SMOVE", "colors", "warm", "red")
+	expectResponse(t, h, one, "SISMEMBER", "warm", "red")
+
+	// Removing the last member deletes the key
+	expectResponse(t, h, one, "SREM", "colors", "blue")
+	expectResponse(t, h, zero, "EXISTS", "colors")
+
+	handle(t, h, "SADD", "a", "1", "2", "3", "4")
+	handle(t, h, "SADD", "b", "3", "4", "5")
+	for _, tt := range []struct {
+		command string
+		want    []string
+	}{
+		{"SINTER", []string{"3", "4"}},
+		{"SUNION", []string{"1", "2", "3", "4", "5"}},
+		{"SDIFF", []string{"1", "2"}},
+	} {
+		got, err := handle(t, h, tt.command, "a", "b")
+		if err != nil {
+			t.Fatalf("%s. unexpected error: %v", tt.command, err)
+		}
+		if got := sortedStrings(t, got); !slices.Equal(got, tt.want) {
+			t.Fatalf("%s. want=%v, got=%v", tt.command, tt.want, got)
+		}
+	}
+	expectResponse(t, h, internal.NewSetData([]internal.Data{}), "SINTER", "a", "missing")
+	expectResponse(t, h, internal.NewIntData(2), "SINTERSTORE", "dst", "a", "b")
+	expectResponse(t, h, internal.NewIntData(5), "SUNIONSTORE", "dst", "a", "b")
+	expectResponse(t, h, internal.NewIntData(5), "SCARD", "dst")
+	// An empty result deletes the destination
+	expectResponse(t, h, zero, "SDIFFSTORE", "dst", "missing", "a")
+	expectResponse(t, h, zero, "EXISTS", "dst")
+
+	popped, _ := handle(t, h, "SPOP", "b", "2")
+	if got := sortedStrings(t, popped); len(got) != 2 {
+		t.Fatalf("SPOP with count. got=%v", got)
+	}
+	expectResponse(t, h, one, "SCARD", "b")
+	handle(t, h, "SPOP", "b")
+	expectResponse(t, h, zero, "EXISTS", "b")
+	expectResponse(t, h, null, "SPOP", "b")
+	expectResponse(t, h, null, "SRANDMEMBER", "b")
+
+	random, _ := handle(t, h, "SRANDMEMBER", "a", "10")
+	if got := sortedStrings(t, random); !slices.Equal(got, []string{"1", "2", "3", "4"}) {
+		t.Fatalf("SRANDMEMBER positive count. got=%v", got)
+	}
+	random, _ = handle(t, h, "SRANDMEMBER", "a", "-10")
+	if got := sortedStrings(t, random); len(got) != 10 {
+		t.Fatalf("SRANDMEMBER negative count. got=%v", got)
+	}
+	expectError(t, h, "ERR value is out of range", "SRANDMEMBER", "a", strconv.FormatInt(math.MinInt64, 10))
+	expectResponse(t, h, internal.NewIntData(4), "SCARD", "a")
+
+	handle(t, h, "SET", "string", "value")
+	expectError(t, h, ErrWrongType.Error(), "SADD", "string", "x")
+	expectError(t, h, ErrWrongType.Error(), "SUNION", "a", "string")
+	expectError(t, h, ErrWrongType.Error(), "SMOVE", "a", "string", "1")
+	expectError(t, h, ErrWrongType.Error(), "GET", "a")
+	expectError(t, h, "ERR value is out of range, must be positive", "SPOP", "a", "-1")
+	expectError(t, h, "ERR wrong number of arguments for 'sadd' command", "SADD", "a")
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	one, zero, null := internal.NewIntData(1), internal.NewIntData(0), internal.NewNullData()
+	double := internal.NewDoubleData
+
+	expectResponse(t, h, internal.NewIntData(3), "ZADD", "board", "10", "alice", "20", "bob", "30", "carol")
+	expectResponse(t, h, zero, "ZADD", "board", "15", "alice")
+	expectResponse(t, h, internal.NewIntData(3), "ZCARD", "board")
+	expectResponse(t, h, double(15), "ZSCORE", "board", "alice")
+	expectResponse(t, h, null, "ZSCORE", "board", "missing")
+
+	// NX, XX, GT, LT and CH
+	expectResponse(t, h, zero, "ZADD", "board", "NX", "1", "alice")
+	expectResponse(t, h, zero, "ZADD", "board", "XX", "1", "dave")
+	expectResponse(t, h, zero, "ZADD", "board", "GT", "CH", "5", "alice")
+	expectResponse(t, h, one, "ZADD", "board", "GT", "CH", "25", "alice")
+	expectResponse(t, h, one, "ZADD", "board", "LT", "CH", "5", "alice", "40", "bob")
+	expectResponse(t, h, double(5), "ZSCORE", "board", "alice")
+	expectResponse(t, h, double(20), "ZSCORE", "board", "bob")
+	expectResponse(t, h, double(7.5), "ZADD", "board", "INCR", "2.5", "alice")
+	expectResponse(t, h, null, "ZADD", "board", "NX", "INCR", "1", "alice")
+	expectResponse(t, h, double(17.5), "ZINCRBY", "board", "10", "alice")
+	expectResponse(t, h, double(-1), "ZINCRBY", "board", "-1", "erin")
+	expectError(t, h, "ERR XX and NX options at the same time are not compatible", "ZADD", "board", "NX", "XX", "1", "a")
+	expectError(t, h, "ERR GT, LT, and/or NX options at the same time are not compatible", "ZADD", "board", "GT", "LT", "1", "a")
+	expectError(t, h, "ERR INCR option supports a single increment-element pair", "ZADD", "board", "INCR", "1", "a", "2", "b")
+	expectError(t, h, "ERR value is not a valid float", "ZADD", "board", "abc", "a")
+	expectError(t, h, ErrSyntax.Error(), "ZADD", "board", "1", "a", "2")
+	// XX on a missing key doesn't create it
+	expectResponse(t, h, zero, "ZADD", "other", "XX", "1", "a")
+	expectResponse(t, h, zero, "EXISTS", "other")
+
+	// board is erin -1, alice 17.5, bob 20, carol 30
+	expectResponse(t, h, one, "ZRANK", "board", "alice")
+	expectResponse(t, h, zero, "ZREVRANK", "board", "carol")
+	expectResponse(t, h, null, "ZRANK", "board", "missing")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{*internal.NewIntData(2), *double(20)}),
+		"ZRANK", "board", "bob", "WITHSCORE")
+
+	expectResponse(t, h, bulkArray("erin", "alice", "bob", "carol"), "ZRANGE", "board", "0", "-1")
+	expectResponse(t, h, bulkArray("carol", "bob"), "ZRANGE", "board", "0", "1", "REV")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("alice"), *double(17.5), *internal.NewBulkStringData("bob"), *double(20),
+	}), "ZRANGE", "board", "(0", "20", "BYSCORE", "WITHSCORES")
+	expectResponse(t, h, bulkArray("carol", "bob", "alice"), "ZRANGE", "board", "+inf", "0", "BYSCORE", "REV")
+	expectResponse(t, h, bulkArray("alice", "bob"), "ZRANGE", "board", "-inf", "+inf", "BYSCORE", "LIMIT", "1", "2")
+	expectResponse(t, h, bulkArray(), "ZRANGE", "board", "5", "1", "BYSCORE")
+	expectResponse(t, h, bulkArray(), "ZRANGE", "missing", "0", "-1")
+	expectError(t, h, "ERR min or max is not a float", "ZRANGE", "board", "x", "1", "BYSCORE")
+	expectError(t, h, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX",
+		"ZRANGE", "board", "0", "1", "LIMIT", "0", "1")
+
+	expectResponse(t, h, internal.NewIntData(2), "ZCOUNT", "board", "0", "(30")
+	expectResponse(t, h, zero, "ZCOUNT", "board", "100", "+inf")
+
+	handle(t, h, "ZADD", "words", "0", "apple", "0", "banana", "0", "cherry", "0", "date")
+	expectResponse(t, h, bulkArray("banana", "cherry"), "ZRANGE", "words", "[b", "(d", "BYLEX")
+	expectResponse(t, h, bulkArray("date", "cherry"), "ZRANGE", "words", "+", "(banana", "BYLEX", "REV")
+	expectResponse(t, h, bulkArray("banana"), "ZRANGE", "words", "-", "+", "BYLEX", "LIMIT", "1", "1")
+	expectError(t, h, "ERR min or max not valid string range item", "ZRANGE", "words", "a", "+", "BYLEX")
+	expectError(t, h, "ERR syntax error, WITHSCORES not supported in combination with BYLEX",
+		"ZRANGE", "words", "-", "+", "BYLEX", "WITHSCORES")
+
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{*internal.NewBulkStringData("erin"), *double(-1)}),
+		"ZPOPMIN", "board")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("carol"), *double(30), *internal.NewBulkStringData("bob"), *double(20),
+	}), "ZPOPMAX", "board", "2")
+	expectResponse(t, h, internal.NewIntData(2), "ZREM", "words", "apple", "missing", "banana")
+	expectResponse(t, h, internal.NewIntData(2), "ZREMRANGEBYSCORE", "words", "-inf", "0")
+	expectResponse(t, h, zero, "EXISTS", "words")
+
+	handle(t, h, "SET", "string", "value")
+	expectError(t, h, ErrWrongType.Error(), "ZADD", "string", "1", "a")
+	expectError(t, h, ErrWrongType.Error(), "ZRANGE", "string", "0", "-1")
+	expectError(t, h, ErrWrongType.Error(), "GET", "board")
+}
+
+// Builds the reply for stream entries, from IDs and field value pairs
+func streamEntries(entries ...[]string) *internal.Data {
+	data := make([]internal.Data, len(entries))
+	for i, entry := range entries {
+		data[i] = *internal.NewArrayData([]internal.Data{
+			*internal.NewBulkStringData(entry[0]), *bulkArray(entry[1:]...),
+		})
+	}
+	return internal.NewArrayData(data)
+}
+
+func TestStreamCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	zero, null := internal.NewIntData(0), internal.NewNullData()
+
+	expectResponse(t, h, internal.NewBulkStringData("1-1"), "XADD", "events", "1-1", "type", "login")
+	expectResponse(t, h, internal.NewBulkStringData("1-2"), "XADD", "events", "1-*", "type", "click")
+	expectResponse(t, h, internal.NewBulkStringData("2-0"), "XADD", "events", "2", "type", "logout")
+	expectError(t, h, "ERR The ID specified in XADD is equal or smaller than the target stream top item",
+		"XADD", "events", "2-0", "type", "x")
+	expectError(t, h, "ERR The ID specified in XADD must be greater than 0-0", "XADD", "new", "0-0", "f", "v")
+	expectError(t, h, "ERR Invalid stream ID specified as stream command argument", "XADD", "events", "abc", "f", "v")
+	expectError(t, h, "ERR wrong number of arguments for 'xadd' command", "XADD", "events", "*", "f")
+	expectResponse(t, h, null, "XADD", "missing", "NOMKSTREAM", "*", "f", "v")
+	expectResponse(t, h, zero, "EXISTS", "missing")
+
+	// Generated IDs are after the last ID, even if the clock is behind it
+	auto, _ := handle(t, h, "XADD", "events", "*", "type", "view")
+	id, _ := auto.GetString()
+	if parsed, err := parseStreamID(id, 0); err != nil || parsed.Compare(StreamID{2, 0}) <= 0 {
+		t.Fatalf("XADD *. got=%q", id)
+	}
+	handle(t, h, "XADD", "future", "9999999999999-5", "f", "v")
+	expectResponse(t, h, internal.NewBulkStringData("9999999999999-6"), "XADD", "future", "*", "f", "v")
+
+	expectResponse(t, h, internal.NewIntData(4), "XLEN", "events")
+	expectResponse(t, h, streamEntries(
+		[]string{"1-1", "type", "login"}, []string{"1-2", "type", "click"}, []string{"2-0", "type", "logout"},
+	), "XRANGE", "events", "-", "2")
+	expectResponse(t, h, streamEntries([]string{"1-2", "type", "click"}), "XRANGE", "events", "(1-1", "1")
+	expectResponse(t, h, streamEntries([]string{"2-0", "type", "logout"}, []string{"1-2", "type", "click"}),
+		"XREVRANGE", "events", "2", "-", "COUNT", "2")
+	expectResponse(t, h, streamEntries(), "XRANGE", "missing", "-", "+")
+
+	expectResponse(t, h, internal.NewIntData(1), "XDEL", "events", "1-2", "5-0")
+	expectResponse(t, h, internal.NewIntData(1), "XTRIM", "events", "MINID", "2")
+	expectResponse(t, h, internal.NewIntData(2), "XLEN", "events")
+	expectResponse(t, h, internal.NewIntData(1), "XTRIM", "events", "MAXLEN", "=", "1")
+	expectError(t, h, "ERR syntax error, LIMIT cannot be used without the special ~ option",
+		"XTRIM", "events", "MAXLEN", "0", "LIMIT", "1")
+	// Trimming a stream to empty keeps the key and its last ID
+	expectResponse(t, h, internal.NewIntData(1), "XTRIM", "events", "MAXLEN", "~", "0")
+	expectResponse(t, h, internal.NewIntData(1), "EXISTS", "events")
+	expectError(t, h, "ERR The ID specified in XADD is equal or smaller than the target stream top item",
+		"XADD", "events", "2-0", "f", "v")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "XSETID", "events", "7")
+	expectError(t, h, "ERR The ID specified in XADD is equal or smaller than the target stream top item",
+		"XADD", "events", "7-0", "f", "v")
+	expectError(t, h, "ERR no such key", "XSETID", "missing", "1-0")
+	handle(t, h, "XADD", "events", "8-0", "f", "v")
+	expectError(t, h, "ERR The ID specified in XSETID is smaller than the target stream top item",
+		"XSETID", "events", "7-0")
+	handle(t, h, "XDEL", "events", "8-0")
+
+	for i := 1; i <= 5; i++ {
+		handle(t, h, "XADD", "capped", "MAXLEN", "3", strconv.Itoa(i), "n", strconv.Itoa(i))
+	}
+	expectResponse(t, h, streamEntries([]string{"3-0", "n", "3"}, []string{"4-0", "n", "4"}, []string{"5-0", "n", "5"}),
+		"XRANGE", "capped", "-", "+")
+
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewArrayData([]internal.Data{
+			*internal.NewBulkStringData("capped"), *streamEntries([]string{"5-0", "n", "5"}),
+		}),
+	}), "XREAD", "COUNT", "5", "STREAMS", "capped", "events", "4-0", "$")
+	expectResponse(t, h, null, "XREAD", "STREAMS", "capped", "$")
+	expectError(t, h, "ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.",
+		"XREAD", "STREAMS", "capped", "events", "0")
+
+	handle(t, h, "SET", "string", "value")
+	expectError(t, h, ErrWrongType.Error(), "XADD", "string", "*", "f", "v")
+	expectError(t, h, ErrWrongType.Error(), "XRANGE", "string", "-", "+")
+	expectError(t, h, ErrWrongType.Error(), "GET", "capped")
+}
+
+func TestStreamGroupCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	ok := internal.NewSimpleStringData("OK")
+
+	expectError(t, h, "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.",
+		"XGROUP", "CREATE", "jobs", "workers", "$")
+	expectResponse(t, h, ok, "XGROUP", "CREATE", "jobs", "workers", "$", "MKSTREAM")
+	expectError(t, h, "BUSYGROUP Consumer Group name already exists", "XGROUP", "CREATE", "jobs", "workers", "0")
+	expectError(t, h, "NOGROUP No such key 'jobs' or consumer group 'missing' in XREADGROUP with GROUP option",
+		"XREADGROUP", "GROUP", "missing", "alice", "STREAMS", "jobs", ">")
+
+	for i := 1; i <= 3; i++ {
+		handle(t, h, "XADD", "jobs", strconv.Itoa(i), "job", strconv.Itoa(i))
+	}
+	readReply := func(entries *internal.Data) *internal.Data {
+		return internal.NewArrayData([]internal.Data{
+			*internal.NewArrayData([]internal.Data{*internal.NewBulkStringData("jobs"), *entries}),
+		})
+	}
+	expectResponse(t, h, readReply(streamEntries([]string{"1-0", "job", "1"}, []string{"2-0", "job", "2"})),
+		"XREADGROUP", "GROUP", "workers", "alice", "COUNT", "2", "STREAMS", "jobs", ">")
+	expectResponse(t, h, readReply(streamEntries([]string{"3-0", "job", "3"})),
+		"XREADGROUP", "GROUP", "workers", "bob", "STREAMS", "jobs", ">")
+	expectResponse(t, h, internal.NewNullData(), "XREADGROUP", "GROUP", "workers", "bob", "STREAMS", "jobs", ">")
+
+	// Reading history returns the consumer's pending entries, with deleted
+	// entries as null
+	handle(t, h, "XDEL", "jobs", "2-0")
+	expectResponse(t, h, readReply(internal.NewArrayData([]internal.Data{
+		*internal.NewArrayData([]internal.Data{*internal.NewBulkStringData("1-0"), *bulkArray("job", "1")}),
+		*internal.NewArrayData([]internal.Data{*internal.NewBulkStringData("2-0"), *internal.NewNullData()}),
+	})), "XREADGROUP", "GROUP", "workers", "alice", "STREAMS", "jobs", "0")
+
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewIntData(3), *internal.NewBulkStringData("1-0"), *internal.NewBulkStringData("3-0"),
+		*internal.NewArrayData([]internal.Data{*bulkArray("alice", "2"), *bulkArray("bob", "1")}),
+	}), "XPENDING", "jobs", "workers")
+
+	pending, _ := handle(t, h, "XPENDING", "jobs", "workers", "-", "+", "10", "bob")
+	entries, _ := pending.GetArray()
+	if len(entries) != 1 {
+		t.Fatalf("XPENDING for consumer. got=%v", pending)
+	}
+	fields, _ := entries[0].GetArray()
+	if id, _ := fields[0].GetString(); id != "3-0" {
+		t.Fatalf("XPENDING for consumer. got=%v", pending)
+	}
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{}), "XPENDING", "jobs", "workers", "IDLE", "60000", "-", "+", "10")
+
+	// Entries must be idle for min-idle-time to be claimed
+	expectResponse(t, h, streamEntries(), "XCLAIM", "jobs", "workers", "carol", "60000", "3-0")
+	expectResponse(t, h, streamEntries([]string{"3-0", "job", "3"}),
+		"XCLAIM", "jobs", "workers", "carol", "0", "3-0", "RETRYCOUNT", "5")
+	expectResponse(t, h, bulkArray("3-0"), "XCLAIM", "jobs", "workers", "carol", "0", "3-0", "JUSTID")
+
+	// Deleted entries are dropped from the pending list rather than claimed
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("3-0"), *streamEntries([]string{"1-0", "job", "1"}), *bulkArray("2-0"),
+	}), "XAUTOCLAIM", "jobs", "workers", "dave", "0", "0", "COUNT", "2")
+	handle(t, h, "XCLAIM", "jobs", "workers", "carol", "0", "3-0", "IDLE", "120000", "JUSTID")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("0-0"), *bulkArray("3-0"), *bulkArray(),
+	}), "XAUTOCLAIM", "jobs", "workers", "dave", "60000", "(1-0", "JUSTID")
+	expectError(t, h, "ERR COUNT must be > 0", "XAUTOCLAIM", "jobs", "workers", "dave", "0", "0", "COUNT", "0")
+	expectError(t, h, "ERR COUNT must be > 0", "XAUTOCLAIM", "jobs", "workers", "dave", "0", "0", "COUNT", strconv.Itoa(math.MaxInt))
+
+	expectResponse(t, h, internal.NewIntData(2), "XACK", "jobs", "workers", "1-0", "3-0", "9-0")
+	expectResponse(t, h, internal.NewIntData(0), "XACK", "jobs", "missing", "1-0")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewIntData(0), *internal.NewNullData(), *internal.NewNullData(), *internal.NewNullData(),
+	}), "XPENDING", "jobs", "workers")
+
+	// FORCE claims entries it adds to the pending list however idle they are
+	expectResponse(t, h, bulkArray("1-0"), "XCLAIM", "jobs", "workers", "carol", "60000", "1-0", "FORCE", "JUSTID")
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewIntData(1), *internal.NewBulkStringData("1-0"), *internal.NewBulkStringData("1-0"),
+		*internal.NewArrayData([]internal.Data{*bulkArray("carol", "1")}),
+	}), "XPENDING", "jobs", "workers")
+	expectError(t, h, "NOGROUP No such key 'jobs' or consumer group 'missing'", "XPENDING", "jobs", "missing")
+}
+
+// Waits until n clients are blocked on key
+func waitForBlocked(t *testing.T, d Dictionary, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		d.m.Lock()
+		blocked := len(d.blocking.waiters[key])
+		d.m.Unlock()
+		if blocked == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d clients blocked on %q", n, key)
+}
+
+func TestBlockingListCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	handle(t, h, "RPUSH", "queue", "a")
+	expectResponse(t, h, bulkArray("queue", "a"), "BLPOP", "missing", "queue", "0")
+	expectResponse(t, h, internal.NewNullData(), "BRPOP", "queue", "0.01")
+	expectError(t, h, "ERR timeout is negative", "BLPOP", "queue", "-1")
+	expectError(t, h, "ERR timeout is not a float or out of range", "BLPOP", "queue", "abc")
+	handle(t, h, "SET", "string", "value")
+	expectError(t, h, ErrWrongType.Error(), "BLPOP", "string", "0")
+
+	// Clients are served in the order they blocked
+	results := make([]chan *internal.Data, 3)
+	for i := range results {
+		results[i] = make(chan *internal.Data, 1)
+		go func() {
+			response, _ := h.Handle(context.Background(), "BRPOP", bulkStrings([]string{"jobs", "5"}))
+			results[i] <- response
+		}()
+		waitForBlocked(t, h.dict, "jobs", i+1)
+	}
+	// LPUSH replies with the length after the push, even though blocked
+	// clients take the elements
+	expectResponse(t, h, internal.NewIntData(2), "LPUSH", "jobs", "first", "second")
+	for i, want := range []string{"first", "second"} {
+		select {
+		case got := <-results[i]:
+			if !reflect.DeepEqual(got, bulkArray("jobs", want)) {
+				t.Fatalf("client %d. want=%q, got=%v", i, want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("client %d was not served", i)
+		}
+	}
+	expectResponse(t, h, internal.NewIntData(0), "EXISTS", "jobs")
+	waitForBlocked(t, h.dict, "jobs", 1)
+
+	// BLMOVE pushes to its destination, which serves clients blocked there
+	moved := make(chan *internal.Data, 1)
+	go func() {
+		response, _ := h.Handle(context.Background(), "BLMOVE", bulkStrings([]string{"pending", "jobs", "LEFT", "RIGHT", "5"}))
+		moved <- response
+	}()
+	waitForBlocked(t, h.dict, "pending", 1)
+	handle(t, h, "RPUSH", "pending", "third")
+	if got := <-moved; !reflect.DeepEqual(got, internal.NewBulkStringData("third")) {
+		t.Fatalf("BLMOVE. got=%v", got)
+	}
+	if got := <-results[2]; !reflect.DeepEqual(got, bulkArray("jobs", "third")) {
+		t.Fatalf("client 2. got=%v", got)
+	}
+}
+
+func TestServerShutdownReleasesBlockedClients(t *testing.T) {
+	config := Config{
+		Address:         "127.0.0.1:0",
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    5 * time.Second,
+		MaxMessageSize:  1024 * 1024,
+		ShutdownTimeout: time.Second,
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := NewDefaultCommandHandler()
+	server := NewServer(config, logger, h)
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	request, _ := internal.Serialize(*bulkArray("BLPOP", "queue", "0"))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	waitForBlocked(t, h.dict, "queue", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shutdown with a blocked client: %v", err)
+	}
+	// The blocked client's connection is closed without a reply
+	if _, err := internal.NewReader(conn, 0).ReadData(); err != io.EOF {
+		t.Fatalf("blocked client. want io.EOF, got %v", err)
+	}
+}
+
+// A client that disconnects while blocked no longer waits for pushes
+func TestServerBlockedClientDisconnects(t *testing.T) {
+	server := startConfiguredTestServer(t, Config{Address: "127.0.0.1:0"})
+	addr := server.listeners[0].Addr().String()
+	h := server.handler.(*DefaultCommandHandler)
+
+	blocked, _ := dialTestServer(t, addr)
+	request, _ := internal.Serialize(*bulkArray("BLPOP", "queue", "0"))
+	if _, err := blocked.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	waitForBlocked(t, h.dict, "queue", 1)
+	blocked.Close()
+	waitForBlocked(t, h.dict, "queue", 0)
+
+	conn, reader := dialTestServer(t, addr)
+	sendCommand(t, conn, reader, "RPUSH", "queue", "job1")
+	if got := sendCommand(t, conn, reader, "LLEN", "queue"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("LLEN after the blocked client left. want 1, got %v", got)
+	}
+}
+
+// A client that half closes after a pipeline gets every reply, and its
+// last command, a script, runs to the end
+func TestServerHalfClosedPipeline(t *testing.T) {
+	addr := startTestServer(t)
+	conn, reader := dialTestServer(t, addr)
+	script := "redis.call('SET', 'a', '1') for i = 1, 1000000 do end return redis.call('LPUSH', 'k', 'x')"
+	var requests []byte
+	for _, command := range [][]string{{"SET", "k", "v"}, {"EVAL", script, "0"}} {
+		request, _ := internal.Serialize(*bulkArray(command...))
+		requests = append(requests, request...)
+	}
+	if _, err := conn.Write(requests); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectMessage(t, reader, internal.NewSimpleStringData("OK"))
+	if got, err := reader.ReadData(); err != nil || got.GetKind() != internal.SimpleErrorKind || !strings.Contains(mustString(t, got), "WRONGTYPE") {
+		t.Fatalf("EVAL. want WRONGTYPE error, got %v, %v", got, err)
+	}
+	other, otherReader := dialTestServer(t, addr)
+	if got := sendCommand(t, other, otherReader, "GET", "a"); !reflect.DeepEqual(got, internal.NewBulkStringData("1")) {
+		t.Fatalf("GET after EVAL. want 1, got %v", got)
+	}
+}
+
+// Reads the next message sent to a connection, and checks it
+func expectMessage(t *testing.T, reader *internal.Reader, want *internal.Data) {
+	t.Helper()
+	got, err := reader.ReadData()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func subscriptionArray(kind string, name string, count int) *internal.Data {
+	return internal.NewArrayData([]internal.Data{*internal.NewBulkStringData(kind), *internal.NewBulkStringData(name), *internal.NewIntData(count)})
+}
+
+func TestServerPubSub(t *testing.T) {
+	addr := startTestServer(t)
+	dial := func() (net.Conn, *internal.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, internal.NewReader(conn, 0)
+	}
+	subscriber, subReader := dial()
+	publisher, pubReader := dial()
+
+	if got := sendCommand(t, subscriber, subReader, "SUBSCRIBE", "news", "weather"); !reflect.DeepEqual(got, subscriptionArray("subscribe", "news", 1)) {
+		t.Fatalf("SUBSCRIBE. got %v", got)
+	}
+	expectMessage(t, subReader, subscriptionArray("subscribe", "weather", 2))
+	if got := sendCommand(t, subscriber, subReader, "PSUBSCRIBE", "news.*"); !reflect.DeepEqual(got, subscriptionArray("psubscribe", "news.*", 3)) {
+		t.Fatalf("PSUBSCRIBE. got %v", got)
+	}
+
+	// Only subscription commands are allowed while subscribed on RESP2
+	got := sendCommand(t, subscriber, subReader, "GET", "key")
+	if s, _ := got.GetString(); got.GetKind() != internal.SimpleErrorKind || !strings.HasPrefix(s, "ERR Can't execute 'get'") {
+		t.Fatalf("GET while subscribed. got %v", got)
+	}
+	if got := sendCommand(t, subscriber, subReader, "PING"); !reflect.DeepEqual(got, bulkArray("pong", "")) {
+		t.Fatalf("PING while subscribed. got %v", got)
+	}
+
+	if got := sendCommand(t, publisher, pubReader, "PUBLISH", "news", "hello"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("PUBLISH news. got %v", got)
+	}
+	expectMessage(t, subReader, bulkArray("message", "news", "hello"))
+	if got := sendCommand(t, publisher, pubReader, "PUBLISH", "news.sports", "goal"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("PUBLISH news.sports. got %v", got)
+	}
+	expectMessage(t, subReader, bulkArray("pmessage", "news.*", "news.sports", "goal"))
+	if got := sendCommand(t, publisher, pubReader, "PUBLISH", "sports", "nobody"); !reflect.DeepEqual(got, internal.NewIntData(0)) {
+		t.Fatalf("PUBLISH sports. got %v", got)
+	}
+
+	if got := sendCommand(t, publisher, pubReader, "PUBSUB", "CHANNELS", "n*"); !reflect.DeepEqual(got, bulkArray("news")) {
+		t.Fatalf("PUBSUB CHANNELS. got %v", got)
+	}
+	want := internal.NewArrayData([]internal.Data{*internal.NewBulkStringData("news"), *internal.NewIntData(1), *internal.NewBulkStringData("sports"), *internal.NewIntData(0)})
+	if got := sendCommand(t, publisher, pubReader, "PUBSUB", "NUMSUB", "news", "sports"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("PUBSUB NUMSUB. got %v", got)
+	}
+	if got := sendCommand(t, publisher, pubReader, "PUBSUB", "NUMPAT"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("PUBSUB NUMPAT. got %v", got)
+	}
+
+	// Without arguments, unsubscribes from every channel
+	if got := sendCommand(t, subscriber, subReader, "UNSUBSCRIBE"); !reflect.DeepEqual(got, subscriptionArray("unsubscribe", "news", 2)) {
+		t.Fatalf("UNSUBSCRIBE. got %v", got)
+	}
+	expectMessage(t, subReader, subscriptionArray("unsubscribe", "weather", 1))
+	if got := sendCommand(t, subscriber, subReader, "PUNSUBSCRIBE", "news.*"); !reflect.DeepEqual(got, subscriptionArray("punsubscribe", "news.*", 0)) {
+		t.Fatalf("PUNSUBSCRIBE. got %v", got)
+	}
+	if got := sendCommand(t, subscriber, subReader, "GET", "key"); got.GetKind() != internal.NullKind {
+		t.Fatalf("GET after unsubscribing. got %v", got)
+	}
+
+	// RESP3 clients get push frames, and can run any command while subscribed
+	sendCommand(t, subscriber, subReader, "HELLO", "3")
+	got = sendCommand(t, subscriber, subReader, "SUBSCRIBE", "news")
+	if got.GetKind() != internal.PushKind {
+		t.Fatalf("SUBSCRIBE on RESP3. kind=%s. want=%s", got.GetKind(), internal.PushKind)
+	}
+	if got := sendCommand(t, subscriber, subReader, "PING"); !reflect.DeepEqual(got, internal.NewSimpleStringData("PONG")) {
+		t.Fatalf("PING on RESP3 while subscribed. got %v", got)
+	}
+	sendCommand(t, publisher, pubReader, "PUBLISH", "news", "pushed")
+	expectMessage(t, subReader, internal.NewPushData(bulkStrings([]string{"message", "news", "pushed"})))
+
+	// Closing the connection drops its subscriptions
+	subscriber.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := sendCommand(t, publisher, pubReader, "PUBLISH", "news", "gone")
+		if reflect.DeepEqual(got, internal.NewIntData(0)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PUBLISH after subscriber closed. got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A subscriber that doesn't read doesn't hold up publishers, and is closed
+// once too much is queued for it
+func TestPubSubSlowSubscriber(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	client := NewClient()
+	client.outputLimit = 100
+	var stall sync.Mutex
+	sent := make(chan *internal.Data, 10)
+	client.send = func(data *internal.Data) error {
+		stall.Lock()
+		defer stall.Unlock()
+		sent <- data
+		return nil
+	}
+	closed := make(chan struct{})
+	client.close = func() { close(closed) }
+	ctx := withClient(context.Background(), client)
+	if _, err := h.Handle(ctx, "SUBSCRIBE", bulkStrings([]string{"news"})); err != nil {
+		t.Fatalf("SUBSCRIBE, unexpected error: %v", err)
+	}
+	expectMessageSent := func(want *internal.Data) {
+		t.Helper()
+		select {
+		case got := <-sent:
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("message. want %v, got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message. want %v, got none", want)
+		}
+	}
+	expectMessageSent(subscriptionData("subscribe", internal.NewBulkStringData("news"), 1))
+
+	stall.Lock()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		expectResponse(t, h, internal.NewIntData(1), "PUBLISH", "news", "first")
+		expectResponse(t, h, internal.NewIntData(1), "PUBLISH", "news", strings.Repeat("x", 100))
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("PUBLISH blocked on a subscriber that doesn't read")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("subscriber over its output limit wasn't closed")
+	}
+
+	// Queued messages are dropped, though the one being written when the
+	// limit was passed may still get out
+	stall.Unlock()
+	handle(t, h, "PUBLISH", "news", "after")
+	first := internal.NewPushData(bulkStrings([]string{"message", "news", "first"}))
+	for {
+		select {
+		case got := <-sent:
+			if !reflect.DeepEqual(got, first) {
+				t.Fatalf("message after closing. got %v", got)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestServerTransactions(t *testing.T) {
+	addr := startTestServer(t)
+	dial := func() (net.Conn, *internal.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, internal.NewReader(conn, 0)
+	}
+	conn, reader := dial()
+	other, otherReader := dial()
+	ok, queued := internal.NewSimpleStringData("OK"), internal.NewSimpleStringData("QUEUED")
+	expect := func(conn net.Conn, reader *internal.Reader, want *internal.Data, args ...string) {
+		t.Helper()
+		if got := sendCommand(t, conn, reader, args...); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%v, want %v, got %v", args, want, got)
+		}
+	}
+
+	// A command failing at run time doesn't stop the rest
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "SET", "counter", "1")
+	expect(conn, reader, queued, "INCR", "counter")
+	expect(conn, reader, queued, "LPUSH", "counter", "x")
+	expect(conn, reader, queued, "BLPOP", "empty", "0")
+	expect(conn, reader, internal.NewArrayData([]internal.Data{
+		*ok,
+		*internal.NewIntData(2),
+		*internal.NewSimpleError(ErrWrongType.Error()),
+		*internal.NewNullData(),
+	}), "EXEC")
+
+	// A command failing to queue aborts the transaction
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "SET", "aborted", "1")
+	expect(conn, reader, internal.NewSimpleError("ERR unknown command 'nosuchcommand', with args beginning with: 'x' "), "NOSUCHCOMMAND", "x")
+	expect(conn, reader, internal.NewSimpleError("ERR wrong number of arguments for 'get' command"), "GET")
+	expect(conn, reader, internal.NewSimpleError("EXECABORT Transaction discarded because of previous errors."), "EXEC")
+	expect(conn, reader, internal.NewNullData(), "GET", "aborted")
+
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, internal.NewSimpleError("ERR MULTI calls can not be nested"), "MULTI")
+	expect(conn, reader, internal.NewSimpleError("ERR WATCH inside MULTI is not allowed"), "WATCH", "counter")
+	expect(conn, reader, queued, "SET", "discarded", "1")
+	expect(conn, reader, ok, "DISCARD")
+	expect(conn, reader, internal.NewNullData(), "GET", "discarded")
+	expect(conn, reader, internal.NewSimpleError("ERR EXEC without MULTI"), "EXEC")
+	expect(conn, reader, internal.NewSimpleError("ERR DISCARD without MULTI"), "DISCARD")
+
+	// A write to a watched key by another client aborts EXEC
+	expect(conn, reader, ok, "WATCH", "counter")
+	expect(other, otherReader, ok, "SET", "counter", "10")
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "INCR", "counter")
+	expect(conn, reader, internal.NewNullData(), "EXEC")
+	expect(conn, reader, internal.NewBulkStringData("10"), "GET", "counter")
+
+	// EXEC unwatches every key, so the next transaction runs
+	expect(other, otherReader, ok, "SET", "counter", "20")
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "INCR", "counter")
+	expect(conn, reader, internal.NewArrayData([]internal.Data{*internal.NewIntData(21)}), "EXEC")
+
+	expect(conn, reader, ok, "WATCH", "counter")
+	expect(conn, reader, ok, "UNWATCH")
+	expect(other, otherReader, internal.NewIntData(22), "INCR", "counter")
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "INCR", "counter")
+	expect(conn, reader, internal.NewArrayData([]internal.Data{*internal.NewIntData(23)}), "EXEC")
+
+	// Deleting fields of a watched hash changes it, even if it isn't emptied
+	expect(other, otherReader, internal.NewIntData(2), "HSET", "hash", "a", "1", "b", "2")
+	expect(conn, reader, ok, "WATCH", "hash")
+	expect(other, otherReader, internal.NewIntData(1), "HDEL", "hash", "a")
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "HLEN", "hash")
+	expect(conn, reader, internal.NewNullData(), "EXEC")
+
+	// A watched key expiring counts as a change
+	expect(conn, reader, ok, "SET", "session", "x", "PX", "50")
+	expect(conn, reader, ok, "WATCH", "session")
+	time.Sleep(100 * time.Millisecond)
+	expect(conn, reader, ok, "MULTI")
+	expect(conn, reader, queued, "GET", "session")
+	expect(conn, reader, internal.NewNullData(), "EXEC")
+}
+
+// EXEC runs its commands without commands from other clients in between
+func TestExecIsAtomic(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	const clients, increments = 4, 200
+
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := withClient(context.Background(), NewClient())
+			run := func(args ...string) *internal.Data {
+				data := make([]internal.Data, len(args)-1)
+				for i, arg := range args[1:] {
+					data[i] = *internal.NewBulkStringData(arg)
+				}
+				response, err := h.Handle(ctx, args[0], data)
+				if err != nil {
+					t.Errorf("%v, unexpected error: %v", args, err)
+				}
+				return response
+			}
+			for range increments {
+				run("MULTI")
+				run("INCR", "a")
+				run("INCR", "b")
+				reply, _ := run("EXEC").GetArray()
+				a, _ := reply[0].GetInt()
+				b, _ := reply[1].GetInt()
+				if a != b {
+					t.Errorf("EXEC interleaved. a=%d, b=%d", a, b)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCommandCommand(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	expectResponse(t, h, internal.NewIntData(len(commandTable)), "COMMAND", "COUNT")
+	all, err := handle(t, h, "COMMAND")
+	if err != nil {
+		t.Fatalf("COMMAND, unexpected error: %v", err)
+	}
+	if entries, _ := all.GetArray(); len(entries) != len(commandTable) {
+		t.Fatalf("COMMAND. want %d entries, got %d", len(commandTable), len(entries))
+	}
+
+	empty := *internal.NewArrayData([]internal.Data{})
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewArrayData([]internal.Data{
+			*internal.NewBulkStringData("get"),
+			*internal.NewIntData(2),
+			*internal.NewArrayData([]internal.Data{*internal.NewSimpleStringData("readonly"), *internal.NewSimpleStringData("fast")}),
+			*internal.NewIntData(1), *internal.NewIntData(1), *internal.NewIntData(1),
+			*internal.NewArrayData([]internal.Data{*internal.NewSimpleStringData("@string"), *internal.NewSimpleStringData("@read"), *internal.NewSimpleStringData("@fast")}),
+			empty, empty, empty,
+		}),
+		*internal.NewNullData(),
+	}), "COMMAND", "INFO", "get", "nope")
+
+	// RESP2 clients get docs as flat arrays, RESP3 clients as maps
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("echo"),
+		*bulkArray("summary", "Returns the given string.", "group", "connection"),
+	}), "COMMAND", "DOCS", "ECHO", "nope")
+	client := NewClient()
+	client.protocol = internal.RESP3
+	docs, err := h.Handle(withClient(context.Background(), client), "COMMAND", []internal.Data{*internal.NewBulkStringData("DOCS"), *internal.NewBulkStringData("echo")})
+	if err != nil {
+		t.Fatalf("COMMAND DOCS with RESP3, unexpected error: %v", err)
+	}
+	want := internal.NewMapData(map[internal.Data]internal.Data{
+		*internal.NewBulkStringData("echo"): *internal.NewMapData(map[internal.Data]internal.Data{
+			*internal.NewBulkStringData("summary"): *internal.NewBulkStringData("Returns the given string."),
+			*internal.NewBulkStringData("group"):   *internal.NewBulkStringData("connection"),
+		}),
+	})
+	if !reflect.DeepEqual(docs, want) {
+		t.Fatalf("COMMAND DOCS with RESP3. want %v, got %v", want, docs)
+	}
+
+	expectResponse(t, h, bulkArray("a", "b", "c"), "COMMAND", "GETKEYS", "DEL", "a", "b", "c")
+	expectResponse(t, h, bulkArray("a", "b"), "COMMAND", "GETKEYS", "BLPOP", "a", "b", "0")
+	expectResponse(t, h, bulkArray("src", "dst"), "COMMAND", "GETKEYS", "LMOVE", "src", "dst", "LEFT", "RIGHT")
+	expectResponse(t, h, bulkArray("k1", "k2"), "COMMAND", "GETKEYS", "EVAL", "return 1", "2", "k1", "k2", "a1")
+	expectResponse(t, h, bulkArray("s1", "s2"), "COMMAND", "GETKEYS", "XREAD", "COUNT", "1", "STREAMS", "s1", "s2", "0", "0")
+	expectError(t, h, "ERR Invalid command specified", "COMMAND", "GETKEYS", "NOPE")
+	expectError(t, h, "ERR Invalid number of arguments specified for command", "COMMAND", "GETKEYS", "GET")
+	expectError(t, h, "ERR The command has no key arguments", "COMMAND", "GETKEYS", "PING")
+	expectError(t, h, "ERR unknown subcommand or wrong number of arguments for 'nope'. Try COMMAND HELP.", "COMMAND", "nope")
+}
+
+// Arity is checked before handlers run, from the command table
+func TestCommandArity(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	expectError(t, h, "ERR wrong number of arguments for 'get' command", "GET", "a", "b")
+	expectError(t, h, "ERR wrong number of arguments for 'lpush' command", "LPUSH", "list")
+	expectError(t, h, "ERR wrong number of arguments for 'multi' command", "MULTI", "x")
+	_, err := handle(t, h, "NOPE", "a")
+	if err == nil || !strings.HasPrefix(err.Error(), "ERR unknown command 'nope'") {
+		t.Fatalf("NOPE. want unknown command, got %v", err)
+	}
+	// Nothing was written
+	expectResponse(t, h, internal.NewIntData(0), "EXISTS", "list")
+}
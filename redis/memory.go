@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"myredis/internal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// EvictionPolicy is which keys are evicted once records use more memory
+// than maxmemory
+type EvictionPolicy int
+
+const (
+	// Nothing is evicted. Writes that need memory fail instead.
+	EvictNoEviction EvictionPolicy = iota
+	// The least recently used keys
+	EvictAllKeysLRU
+	// The least recently used keys with a TTL
+	EvictVolatileLRU
+	// The least frequently used keys
+	EvictAllKeysLFU
+	// The least frequently used keys with a TTL
+	EvictVolatileLFU
+	// Any keys
+	EvictAllKeysRandom
+	// Any keys with a TTL
+	EvictVolatileRandom
+	// The keys with a TTL that expire soonest
+	EvictVolatileTTL
+)
+
+// Names of the policies, as maxmemory-policy takes them
+var evictionPolicyNames = []string{
+	EvictNoEviction:     "noeviction",
+	EvictAllKeysLRU:     "allkeys-lru",
+	EvictVolatileLRU:    "volatile-lru",
+	EvictAllKeysLFU:     "allkeys-lfu",
+	EvictVolatileLFU:    "volatile-lfu",
+	EvictAllKeysRandom:  "allkeys-random",
+	EvictVolatileRandom: "volatile-random",
+	EvictVolatileTTL:    "volatile-ttl",
+}
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	for p, name := range evictionPolicyNames {
+		if strings.EqualFold(s, name) {
+			return EvictionPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maxmemory-policy %q", s)
+}
+
+func (p EvictionPolicy) String() string {
+	return evictionPolicyNames[p]
+}
+
+// Returns true if the policy evicts by access frequency
+func (p EvictionPolicy) lfu() bool {
+	return p == EvictAllKeysLFU || p == EvictVolatileLFU
+}
+
+// Returns true if the policy only evicts keys with a TTL
+func (p EvictionPolicy) volatile() bool {
+	return p == EvictVolatileLRU || p == EvictVolatileLFU || p == EvictVolatileRandom || p == EvictVolatileTTL
+}
+
+// LFU counter parameters, Redis's defaults for lfu-log-factor and
+// lfu-decay-time. The counter is logarithmic, so its 255 stands for about
+// a million accesses, and it loses one for each decay period a key isn't
+// accessed.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// recordAccess is when a record was last accessed, and how often. Copies of
+// the record share it, and it's updated atomically, as reads only hold the
+// read lock.
+type recordAccess struct {
+	// Unix milliseconds of the last access
+	at atomic.Int64
+	// Logarithmic access counter, from 0 to 255
+	counter atomic.Int32
+}
+
+func newRecordAccess(now time.Time) *recordAccess {
+	a := &recordAccess{}
+	a.at.Store(now.UnixMilli())
+	a.counter.Store(lfuInitVal)
+	return a
+}
+
+// Returns how long since the last access
+func (a *recordAccess) idle(now time.Time) time.Duration {
+	return max(now.Sub(time.UnixMilli(a.at.Load())), 0)
+}
+
+// Returns the counter, less its decay since the last access
+func (a *recordAccess) frequency(now time.Time) int {
+	periods := int(a.idle(now) / lfuDecayTime)
+	return max(int(a.counter.Load())-periods, 0)
+}
+
+// Records an access at now. The more accesses counted, the less likely
+// another one increments the counter.
+func (a *recordAccess) access(now time.Time) {
+	counter := a.frequency(now)
+	if counter < 255 && rand.Float64() < 1/float64(max(counter-lfuInitVal, 0)*lfuLogFactor+1) {
+		counter++
+	}
+	a.counter.Store(int32(counter))
+	a.at.Store(now.UnixMilli())
+}
+
+// Rough sizes, in bytes, of what records cost beyond their strings: the
+// record with its map entry, and each element of a collection
+const (
+	recordOverhead  = 128
+	elementOverhead = 48
+	// Elements sampled for the average size of a collection's elements, as
+	// MEMORY USAGE samples by default
+	memorySamples = 5
+)
+
+// Estimates the memory a record uses. Only a few elements of a collection
+// are looked at, so it takes constant time.
+func estimateSize(k string, record KVRecord) int64 {
+	size := recordOverhead + len(k)
+	n, sampled, sampledSize := 0, 0, 0
+	switch record.kind {
+	case StringRecord:
+		size += len(record.value)
+	case ListRecord:
+		n = record.listValue.Len()
+		record.listValue.Each(false, func(i int, s string) bool {
+			sampled++
+			sampledSize += elementOverhead + len(s)
+			return sampled < memorySamples
+		})
+	case HashRecord:
+		n = len(record.hashValue)
+		for field, value := range record.hashValue {
+			if sampled == memorySamples {
+				break
+			}
+			sampled++
+			sampledSize += elementOverhead + len(field) + len(value)
+		}
+	case SetRecord:
+		n = len(record.setValue)
+		for member := range record.setValue {
+			if sampled == memorySamples {
+				break
+			}
+			sampled++
+			sampledSize += elementOverhead + len(member)
+		}
+	case ZSetRecord:
+		// Members are both in the map of scores and in the skiplist
+		n = record.zsetValue.Len()
+		for member := range record.zsetValue.scores {
+			if sampled == memorySamples {
+				break
+			}
+			sampled++
+			sampledSize += 2*elementOverhead + len(member)
+		}
+	case StreamRecord:
+		n = len(record.streamValue.entries)
+		for _, entry := range record.streamValue.entries[:min(n, memorySamples)] {
+			sampled++
+			sampledSize += elementOverhead
+			for _, field := range entry.fields {
+				sampledSize += len(field)
+			}
+		}
+	}
+	if sampled > 0 {
+		size += n * sampledSize / sampled
+	}
+	return int64(size)
+}
+
+// memoryState is an estimate of the memory records use, and the limit past
+// which keys are evicted
+type memoryState struct {
+	// Estimated size of each record. Guarded by the dictionary lock, as is
+	// dirty.
+	sizes map[string]int64
+	// Keys written since their size was estimated
+	dirty map[string]struct{}
+	// Sum of sizes, as of the last estimate. Written under the write lock,
+	// but read without it, so commands only lock to evict once it's over the
+	// limit.
+	used atomic.Int64
+
+	// Set by CONFIG SET, so read without the lock. A limit of 0 is none.
+	limit   atomic.Int64
+	policy  atomic.Int32
+	samples atomic.Int32
+}
+
+func newMemoryState() *memoryState {
+	m := &memoryState{
+		sizes: make(map[string]int64),
+		dirty: make(map[string]struct{}),
+	}
+	m.samples.Store(5)
+	return m
+}
+
+// Private method to estimate the sizes of records written since the last
+// call. Returns the memory used. Consumer must acquire write lock.
+func (d *Dictionary) usedMemory() int64 {
+	m := d.memory
+	used := m.used.Load()
+	for k := range m.dirty {
+		used -= m.sizes[k]
+		if record, ok := d.kv[k]; ok {
+			m.sizes[k] = estimateSize(k, record)
+			used += m.sizes[k]
+		} else {
+			delete(m.sizes, k)
+		}
+	}
+	clear(m.dirty)
+	m.used.Store(used)
+	return used
+}
+
+// UsedMemory returns the estimated memory records use, in bytes
+func (d *Dictionary) UsedMemory() int64 {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return d.usedMemory()
+}
+
+// FreeMemory evicts keys until records use no more memory than the limit.
+// Evicted keys are propagated as deleted. Returns the number evicted, and
+// errOOM if the policy can't evict enough.
+func (d *Dictionary) FreeMemory() (evicted int, err error) {
+	// Writes estimate their sizes as they run, so used is only out of date
+	// by keys expired since, which only makes it too high
+	limit := d.memory.limit.Load()
+	if limit == 0 || d.memory.used.Load() <= limit {
+		return 0, nil
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	policy := EvictionPolicy(d.memory.policy.Load())
+	for d.usedMemory() > limit {
+		k, ok := d.evictionCandidate(policy, time.Now())
+		if !ok {
+			return evicted, errOOM
+		}
+		d.delete(k)
+		d.propagate("DEL", k)
+		evicted++
+	}
+	return evicted, nil
+}
+
+// Private method to pick a key to evict. Like Redis, it approximates the
+// policy by sampling a few keys, and picking the best of those. Map
+// iteration starts at a random position, so ranging over the keys gives a
+// cheap random sample. Consumer must acquire write lock.
+func (d *Dictionary) evictionCandidate(policy EvictionPolicy, now time.Time) (string, bool) {
+	if policy == EvictNoEviction {
+		return "", false
+	}
+	samples := int(d.memory.samples.Load())
+	keys := make([]string, 0, samples)
+	if policy.volatile() {
+		for k := range d.expires {
+			if len(keys) == samples {
+				break
+			}
+			keys = append(keys, k)
+		}
+	} else {
+		for k := range d.kv {
+			if len(keys) == samples {
+				break
+			}
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+
+	// The key with the highest score is evicted
+	best, bestScore := 0, int64(0)
+	for i, k := range keys {
+		record := d.kv[k]
+		var score int64
+		switch policy {
+		case EvictAllKeysLRU, EvictVolatileLRU:
+			score = int64(record.access.idle(now))
+		case EvictAllKeysLFU, EvictVolatileLFU:
+			score = int64(255 - record.access.frequency(now))
+		case EvictVolatileTTL:
+			score = -record.ttl.UnixMilli()
+		}
+		if i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return keys[best], true
+}
+
+// Private method to evict keys until memory use is within maxmemory, as
+// Redis does before each command. Commands that need memory fail if not
+// enough could be evicted. Commands run by EXEC and scripts were checked as
+// a whole, and replicas leave eviction to their primary, whose deletes they
+// apply.
+func (h *DefaultCommandHandler) freeMemory(client *Client, spec *commandSpec) error {
+	_, nested := h.dict.m.(heldLock)
+	if h.dict.memory.limit.Load() == 0 || nested || client.primary || h.repl.isReplica() {
+		return nil
+	}
+	evicted, err := h.dict.FreeMemory()
+	h.stats.evicted.Add(int64(evicted))
+	if err != nil && spec.is(flagDenyOOM) {
+		return err
+	}
+	return nil
+}
+
+// Access returns how long since k was accessed, and its LFU counter,
+// without counting this as an access
+func (d *Dictionary) Access(k string) (idle time.Duration, frequency int, ok bool) {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	now := time.Now()
+	record, ok := d.kv[k]
+	if !ok || record.expired(now) {
+		return 0, 0, false
+	}
+	return record.access.idle(now), record.access.frequency(now), true
+}
+
+// OBJECT FREQ key | IDLETIME key. As in Redis, FREQ needs an LFU policy,
+// and IDLETIME any other.
+func (h *DefaultCommandHandler) handleObjectCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("OBJECT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	subcommand := strings.ToUpper(strs[0])
+	if (subcommand != "FREQ" && subcommand != "IDLETIME") || len(strs) != 2 {
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try OBJECT HELP.", strs[0])
+	}
+	idle, frequency, ok := h.dict.Access(strs[1])
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	lfu := EvictionPolicy(h.dict.memory.policy.Load()).lfu()
+	if subcommand == "FREQ" && !lfu {
+		return nil, fmt.Errorf("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	}
+	if subcommand == "IDLETIME" && lfu {
+		return nil, fmt.Errorf("ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+	}
+	if subcommand == "FREQ" {
+		return internal.NewIntData(frequency), nil
+	}
+	return internal.NewIntData(int(idle / time.Second)), nil
+}
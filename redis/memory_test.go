@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"myredis/internal"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Size of the records the tests write, keys like key:01 with value v
+const testRecordSize = recordOverhead + len("key:01") + len("v")
+
+// Returns a handler with room for n test records, under policy. Every key
+// is sampled, so the policies are exact.
+func newLimitedHandler(t *testing.T, n int, policy string) *DefaultCommandHandler {
+	t.Helper()
+	h := NewDefaultCommandHandler()
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET",
+		"maxmemory", fmt.Sprint(n*testRecordSize), "maxmemory-policy", policy, "maxmemory-samples", "64")
+	return h
+}
+
+// Sets keys key:from to key:to
+func setTestKeys(t *testing.T, h *DefaultCommandHandler, from int, to int, args ...string) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		expectResponse(t, h, internal.NewSimpleStringData("OK"), append([]string{"SET", fmt.Sprintf("key:%02d", i), "v"}, args...)...)
+	}
+}
+
+// Returns the keys from key:from to key:to that still exist
+func existingTestKeys(h *DefaultCommandHandler, from int, to int) []int {
+	var keys []int
+	for i := from; i <= to; i++ {
+		if _, ok := h.dict.Get(fmt.Sprintf("key:%02d", i)); ok {
+			keys = append(keys, i)
+		}
+	}
+	return keys
+}
+
+func TestEstimateSize(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	handle(t, h, "SET", "key:01", "v")
+	if used := h.dict.UsedMemory(); used != int64(testRecordSize) {
+		t.Fatalf("used memory of a string. want %d, got %d", testRecordSize, used)
+	}
+
+	// Collections are estimated from a sample of their elements
+	for i := 0; i < 100; i++ {
+		handle(t, h, "RPUSH", "list", "abcd")
+		handle(t, h, "HSET", "hash", fmt.Sprintf("f%03d", i), "abcd")
+	}
+	want := int64(testRecordSize) + 2*recordOverhead + int64(len("list")+len("hash")) + 100*(2*elementOverhead+4+8)
+	if used := h.dict.UsedMemory(); used != want {
+		t.Fatalf("used memory with collections. want %d, got %d", want, used)
+	}
+
+	handle(t, h, "DEL", "list", "hash", "key:01")
+	if used := h.dict.UsedMemory(); used != 0 {
+		t.Fatalf("used memory after deleting every key. want 0, got %d", used)
+	}
+}
+
+func TestFreeMemoryUnderLimit(t *testing.T) {
+	h := newLimitedHandler(t, 10, "allkeys-lru")
+	setTestKeys(t, h, 1, 5)
+
+	// Under the limit, nothing waits for the write lock
+	h.dict.m.RLock()
+	defer h.dict.m.RUnlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if evicted, err := h.dict.FreeMemory(); evicted != 0 || err != nil {
+			t.Errorf("FreeMemory under the limit. got %d, %v", evicted, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("FreeMemory under the limit took the write lock")
+	}
+}
+
+func TestEvictionNoEviction(t *testing.T) {
+	h := newLimitedHandler(t, 10, "noeviction")
+	setTestKeys(t, h, 1, 11)
+
+	// Writes that need memory fail, while reads and deletes don't
+	oom := "OOM command not allowed when used memory > 'maxmemory'."
+	expectError(t, h, oom, "SET", "key:12", "v")
+	expectError(t, h, oom, "LPUSH", "list", "a")
+	expectResponse(t, h, internal.NewBulkStringData("v"), "GET", "key:01")
+	expectResponse(t, h, internal.NewIntData(1), "DEL", "key:01")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "key:12", "v")
+
+	// Commands refused while queued abort the transaction
+	client := NewClient()
+	ctx := withClient(context.Background(), client)
+	for _, command := range [][]string{{"MULTI"}, {"SET", "key:13", "v"}, {"EXEC"}} {
+		args := make([]internal.Data, len(command)-1)
+		for i, arg := range command[1:] {
+			args[i] = *internal.NewBulkStringData(arg)
+		}
+		_, err := h.Handle(ctx, command[0], args)
+		if command[0] == "SET" && (err == nil || err.Error() != oom) {
+			t.Fatalf("SET in MULTI. want OOM error, got %v", err)
+		}
+		if command[0] == "EXEC" && (err == nil || !strings.HasPrefix(err.Error(), "EXECABORT")) {
+			t.Fatalf("EXEC after OOM. want EXECABORT, got %v", err)
+		}
+	}
+	if got := existingTestKeys(h, 1, 13); len(got) != 11 {
+		t.Fatalf("keys under noeviction. want 11, got %v", got)
+	}
+}
+
+func TestEvictionLRU(t *testing.T) {
+	h := newLimitedHandler(t, 10, "allkeys-lru")
+	setTestKeys(t, h, 1, 10)
+	time.Sleep(5 * time.Millisecond)
+	for i := 1; i <= 5; i++ {
+		handle(t, h, "GET", fmt.Sprintf("key:%02d", i))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The keys used least recently are evicted first
+	setTestKeys(t, h, 11, 15)
+	handle(t, h, "PING")
+	if got, want := existingTestKeys(h, 1, 15), []int{1, 2, 3, 4, 5, 11, 12, 13, 14, 15}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after eviction. want %v, got %v", want, got)
+	}
+	if used, limit := h.dict.UsedMemory(), int64(10*testRecordSize); used > limit {
+		t.Fatalf("used memory after eviction. want at most %d, got %d", limit, used)
+	}
+}
+
+func TestEvictionLFU(t *testing.T) {
+	h := newLimitedHandler(t, 10, "allkeys-lfu")
+	setTestKeys(t, h, 1, 10)
+	// The first access always counts
+	for i := 6; i <= 10; i++ {
+		handle(t, h, "GET", fmt.Sprintf("key:%02d", i))
+	}
+	expectResponse(t, h, internal.NewIntData(lfuInitVal+1), "OBJECT", "FREQ", "key:06")
+	expectResponse(t, h, internal.NewIntData(lfuInitVal), "OBJECT", "FREQ", "key:01")
+
+	// New keys start with the counter of keys that haven't been used, so
+	// either may be evicted
+	setTestKeys(t, h, 11, 11)
+	handle(t, h, "PING")
+	got := existingTestKeys(h, 1, 11)
+	if len(got) != 10 {
+		t.Fatalf("keys after eviction. want 10, got %v", got)
+	}
+	for i := 6; i <= 10; i++ {
+		if !slices.Contains(got, i) {
+			t.Fatalf("keys after eviction. want frequently used key:%02d, got %v", i, got)
+		}
+	}
+}
+
+func TestEvictionVolatile(t *testing.T) {
+	h := newLimitedHandler(t, 10, "volatile-ttl")
+	setTestKeys(t, h, 1, 5)
+	for i := 6; i <= 10; i++ {
+		expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", fmt.Sprintf("key:%02d", i), "v", "EX", fmt.Sprint(1000-i))
+	}
+
+	// The keys expiring soonest go first, and keys without a TTL stay
+	setTestKeys(t, h, 11, 12)
+	handle(t, h, "PING")
+	if got, want := existingTestKeys(h, 1, 12), []int{1, 2, 3, 4, 5, 6, 7, 8, 11, 12}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after eviction. want %v, got %v", want, got)
+	}
+
+	// Once only keys without a TTL are left, writes fail
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET", "maxmemory-policy", "volatile-random")
+	setTestKeys(t, h, 13, 16)
+	expectError(t, h, "OOM command not allowed when used memory > 'maxmemory'.", "SET", "key:17", "v")
+	if got, want := existingTestKeys(h, 1, 17), []int{1, 2, 3, 4, 5, 11, 12, 13, 14, 15, 16}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after volatile-random eviction. want %v, got %v", want, got)
+	}
+}
+
+// Evicted keys are propagated as deleted, and counted
+func TestEvictionPropagates(t *testing.T) {
+	h := newLimitedHandler(t, 2, "allkeys-random")
+	var logged [][]string
+	h.dict.feed.sink = func(commands [][]string) {
+		logged = append(logged, commands...)
+	}
+	setTestKeys(t, h, 1, 3)
+	handle(t, h, "PING")
+
+	remaining := existingTestKeys(h, 1, 3)
+	if len(remaining) != 2 {
+		t.Fatalf("keys after eviction. want 2, got %v", remaining)
+	}
+	evicted := []string{"DEL", "key:01"}
+	for i := 1; i <= 3; i++ {
+		if !slices.Contains(remaining, i) {
+			evicted[1] = fmt.Sprintf("key:%02d", i)
+		}
+	}
+	if !slices.ContainsFunc(logged, func(command []string) bool { return slices.Equal(command, evicted) }) {
+		t.Fatalf("propagated commands. want %v, got %v", evicted, logged)
+	}
+
+	got, err := handle(t, h, "INFO")
+	if err != nil {
+		t.Fatalf("INFO, unexpected error: %v", err)
+	}
+	info := mustString(t, got)
+	for _, field := range []string{
+		fmt.Sprintf("used_memory:%d\r\n", 2*testRecordSize),
+		fmt.Sprintf("maxmemory:%d\r\n", 2*testRecordSize),
+		"maxmemory_policy:allkeys-random\r\n",
+		"evicted_keys:1\r\n",
+	} {
+		if !strings.Contains(info, field) {
+			t.Fatalf("INFO. want %q, got %q", field, info)
+		}
+	}
+}
+
+func TestObjectCommand(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	// FREQ is only tracked under an LFU policy, and IDLETIME under others
+	setPolicy := func(policy string) {
+		t.Helper()
+		expectResponse(t, h, internal.NewSimpleStringData("OK"), "CONFIG", "SET", "maxmemory-policy", policy)
+	}
+	handle(t, h, "SET", "key", "value")
+	expectResponse(t, h, internal.NewIntData(0), "OBJECT", "IDLETIME", "key")
+	expectError(t, h, "ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.", "OBJECT", "FREQ", "key")
+	setPolicy("allkeys-lfu")
+	expectResponse(t, h, internal.NewIntData(lfuInitVal), "OBJECT", "FREQ", "key")
+	expectError(t, h, "ERR An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.", "OBJECT", "IDLETIME", "key")
+
+	// Accesses older than the decay time no longer count
+	record := h.dict.kv["key"]
+	record.access.at.Add(-int64(3 * lfuDecayTime / time.Millisecond))
+	expectResponse(t, h, internal.NewIntData(lfuInitVal-3), "OBJECT", "FREQ", "key")
+	setPolicy("volatile-lru")
+	expectResponse(t, h, internal.NewIntData(180), "OBJECT", "IDLETIME", "key")
+
+	// Overwriting a key is an access, and keeps its counter. Accesses
+	// below the initial count always count.
+	handle(t, h, "SET", "key", "other")
+	expectResponse(t, h, internal.NewIntData(0), "OBJECT", "IDLETIME", "key")
+	setPolicy("volatile-lfu")
+	expectResponse(t, h, internal.NewIntData(lfuInitVal-2), "OBJECT", "FREQ", "key")
+	handle(t, h, "GET", "key")
+	expectResponse(t, h, internal.NewIntData(lfuInitVal-1), "OBJECT", "FREQ", "key")
+
+	expectResponse(t, h, internal.NewNullData(), "OBJECT", "FREQ", "nope")
+	expectError(t, h, "ERR unknown subcommand or wrong number of arguments for 'ENCODING'. Try OBJECT HELP.", "OBJECT", "ENCODING", "key")
+	expectError(t, h, "ERR wrong number of arguments for 'object' command", "OBJECT")
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for i, name := range evictionPolicyNames {
+		policy, err := ParseEvictionPolicy(strings.ToUpper(name))
+		if err != nil || policy != EvictionPolicy(i) || policy.String() != name {
+			t.Fatalf("ParseEvictionPolicy(%s). want %s, got %v, %v", name, name, policy, err)
+		}
+	}
+	if _, err := ParseEvictionPolicy("lru"); err == nil {
+		t.Fatalf("ParseEvictionPolicy(lru). want error, got nil")
+	}
+}
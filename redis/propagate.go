@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"myredis/internal"
+	"sync"
+)
+
+// propagator collects the effects of writes as commands, to log to the AOF.
+// Commands are collected under the dictionary write lock, and passed to
+// sink before it's released, so they're logged in the order the writes
+// were applied.
+type propagator struct {
+	pending [][]string
+	// Where the running write command's own commands go, ahead of those of
+	// clients it unblocked
+	at int
+	// Set once the running write command rewrites what it logs
+	rewritten bool
+	// Counts writes to keys, so commands that change nothing aren't logged
+	dirty int
+	// Receives pending commands. Called under the write lock.
+	sink func(commands [][]string)
+}
+
+// Passes pending commands to the sink
+func (p *propagator) flush() {
+	if len(p.pending) == 0 {
+		return
+	}
+	if p.sink != nil {
+		p.sink(p.pending)
+	}
+	p.pending, p.at = nil, 0
+}
+
+// dictLock is the Dictionary lock. Releasing the write lock flushes the
+// commands propagated while it was held.
+type dictLock struct {
+	sync.RWMutex
+	feed *propagator
+}
+
+func (l *dictLock) Unlock() {
+	l.feed.flush()
+	l.RWMutex.Unlock()
+}
+
+// Locked runs fn under the write lock. fn is passed a Dictionary sharing d's
+// records whose methods don't lock, so everything fn does is atomic.
+func (d *Dictionary) Locked(fn func(tx Dictionary)) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	tx := *d
+	tx.m = heldLock{}
+	fn(tx)
+}
+
+// Private method to propagate a command after the running write command,
+// such as the pop of a client it unblocked. Consumer must acquire write
+// lock.
+func (d *Dictionary) propagate(args ...string) {
+	d.feed.pending = append(d.feed.pending, args)
+}
+
+// Private method to log args in place of the running write command, for
+// commands whose effect depends on when they run, such as a relative
+// expire time. Called with no args, nothing is logged. May be called more
+// than once to log several commands. Consumer must acquire write lock.
+func (d *Dictionary) rewriteCommand(args ...string) {
+	d.feed.rewritten = true
+	if len(args) == 0 {
+		return
+	}
+	d.feed.pending = append(d.feed.pending, nil)
+	copy(d.feed.pending[d.feed.at+1:], d.feed.pending[d.feed.at:])
+	d.feed.pending[d.feed.at] = args
+	d.feed.at++
+}
+
+// Private method to run a write command under the dictionary lock, and
+// propagate it if it changed any key. Unless the handler rewrites it, the
+// command is logged as it was sent.
+func (h *DefaultCommandHandler) handleWrite(ctx context.Context, command string, args []internal.Data) (response *internal.Data, err error) {
+	if err := h.aof.writeError(); err != nil {
+		return nil, err
+	}
+
+	h.dict.Locked(func(tx Dictionary) {
+		txHandler := *h
+		txHandler.dict = tx
+
+		// Writes may be nested, as in EXEC
+		feed := tx.feed
+		at, rewritten := feed.at, feed.rewritten
+		defer func() { feed.at, feed.rewritten = at, rewritten }()
+		feed.at, feed.rewritten = len(feed.pending), false
+		dirty := feed.dirty
+
+		response, err = txHandler.handle(ctx, command, args)
+		if err == nil && !feed.rewritten && feed.dirty != dirty {
+			strs, _ := stringArgs(args)
+			tx.rewriteCommand(append([]string{command}, strs...)...)
+		}
+		// Sizes are estimated as records are written, rather than all at
+		// once when the memory used is next needed
+		tx.usedMemory()
+	})
+	return response, err
+}
+
+// Private method to pass propagated commands on, to the AOF and replicas.
+// Called under the dictionary write lock.
+func (h *DefaultCommandHandler) propagate(commands [][]string) {
+	h.aof.append(commands)
+	h.repl.append(commands)
+}
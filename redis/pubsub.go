@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"myredis/internal"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// PubSub tracks channel and pattern subscriptions, and delivers published
+// messages
+type PubSub struct {
+	m        sync.RWMutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Client]struct{}),
+		patterns: make(map[string]map[*Client]struct{}),
+	}
+}
+
+// Adds c to the subscribers of name, in channels or patterns. Returns false
+// if c was already subscribed.
+func (p *PubSub) subscribe(subscriptions map[string]map[*Client]struct{}, c *Client, name string) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	clients, ok := subscriptions[name]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		subscriptions[name] = clients
+	}
+	if _, ok := clients[c]; ok {
+		return false
+	}
+	clients[c] = struct{}{}
+	return true
+}
+
+// Removes c from the subscribers of name, in channels or patterns
+func (p *PubSub) unsubscribe(subscriptions map[string]map[*Client]struct{}, c *Client, name string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	delete(subscriptions[name], c)
+	if len(subscriptions[name]) == 0 {
+		delete(subscriptions, name)
+	}
+}
+
+// Publish sends message to clients subscribed to channel, or to a pattern
+// matching it. Returns the number of clients sent to. Messages are queued
+// for each subscriber's writer, so a slow subscriber doesn't block the
+// publisher.
+func (p *PubSub) Publish(channel string, message string) int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	n := 0
+	for c := range p.channels[channel] {
+		c.Publish(internal.NewPushData(bulkStrings([]string{"message", channel, message})), len(channel)+len(message))
+		n++
+	}
+	for pattern, clients := range p.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for c := range clients {
+			c.Publish(internal.NewPushData(bulkStrings([]string{"pmessage", pattern, channel, message})), len(pattern)+len(channel)+len(message))
+			n++
+		}
+	}
+	return n
+}
+
+// Channels returns the channels with subscribers that match pattern, or
+// all of them if pattern is empty
+func (p *PubSub) Channels(pattern string) []string {
+	p.m.RLock()
+	defer p.m.RUnlock()
+
+	var channels []string
+	for channel := range p.channels {
+		if pattern == "" || globMatch(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// NumSub returns the number of subscribers to channel
+func (p *PubSub) NumSub(channel string) int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return len(p.channels[channel])
+}
+
+// NumPat returns the number of patterns with subscribers
+func (p *PubSub) NumPat() int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return len(p.patterns)
+}
+
+// Unsubscribes c from every channel and pattern, once its connection closes
+func (p *PubSub) closeClient(c *Client) {
+	for channel := range c.channels {
+		p.unsubscribe(p.channels, c, channel)
+	}
+	for pattern := range c.patterns {
+		p.unsubscribe(p.patterns, c, pattern)
+	}
+}
+
+// Builds a subscribe or unsubscribe confirmation, with the number of
+// subscriptions the client has left. name is null when unsubscribing a
+// client with no subscriptions.
+func subscriptionData(kind string, name *internal.Data, count int) *internal.Data {
+	return internal.NewPushData([]internal.Data{*internal.NewBulkStringData(kind), *name, *internal.NewIntData(count)})
+}
+
+// Commands a RESP2 client may run while subscribed. RESP3 clients can run
+// any command, as pushes are distinguishable from replies.
+func allowedWhileSubscribed(command string) bool {
+	switch command {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		return true
+	default:
+		return false
+	}
+}
+
+// SUBSCRIBE channel [channel ...] and PSUBSCRIBE pattern [pattern ...].
+// Confirmations are sent for each channel, so the reply is nil.
+func (h *DefaultCommandHandler) handleSubscribeCommand(ctx context.Context, command string, args []internal.Data, pattern bool) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	names, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	client := clientFromContext(ctx)
+	subscribed, subscriptions, kind := client.channels, h.pubsub.channels, "subscribe"
+	if pattern {
+		subscribed, subscriptions, kind = client.patterns, h.pubsub.patterns, "psubscribe"
+	}
+
+	// Hold the write lock, so messages published to a new subscription
+	// aren't sent before its confirmation
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	for _, name := range names {
+		if h.pubsub.subscribe(subscriptions, client, name) {
+			subscribed[name] = struct{}{}
+		}
+		if err := client.sendLocked(subscriptionData(kind, internal.NewBulkStringData(name), client.subscriptions())); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// UNSUBSCRIBE [channel ...] and PUNSUBSCRIBE [pattern ...]. Without
+// arguments, unsubscribes from every channel or pattern.
+func (h *DefaultCommandHandler) handleUnsubscribeCommand(ctx context.Context, args []internal.Data, pattern bool) (*internal.Data, error) {
+	names, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	client := clientFromContext(ctx)
+	subscribed, subscriptions, kind := client.channels, h.pubsub.channels, "unsubscribe"
+	if pattern {
+		subscribed, subscriptions, kind = client.patterns, h.pubsub.patterns, "punsubscribe"
+	}
+	if len(names) == 0 {
+		names = slices.Sorted(maps.Keys(subscribed))
+	}
+
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	if len(names) == 0 {
+		return nil, client.sendLocked(subscriptionData(kind, internal.NewNullData(), client.subscriptions()))
+	}
+	for _, name := range names {
+		h.pubsub.unsubscribe(subscriptions, client, name)
+		delete(subscribed, name)
+		if err := client.sendLocked(subscriptionData(kind, internal.NewBulkStringData(name), client.subscriptions())); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// PUBLISH channel message
+func (h *DefaultCommandHandler) handlePublishCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("PUBLISH")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	n := h.pubsub.Publish(strs[0], strs[1])
+	// Messages reach the subscribers of replicas too. They don't change
+	// the keyspace, so aren't logged to the AOF.
+	h.repl.append([][]string{{"PUBLISH", strs[0], strs[1]}})
+	return internal.NewIntData(n), nil
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func (h *DefaultCommandHandler) handlePubsubCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("PUBSUB")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	subcommand := strings.ToUpper(strs[0])
+	switch {
+	case subcommand == "CHANNELS" && len(strs) <= 2:
+		pattern := ""
+		if len(strs) == 2 {
+			pattern = strs[1]
+		}
+		return internal.NewArrayData(bulkStrings(h.pubsub.Channels(pattern))), nil
+	case subcommand == "NUMSUB":
+		// A map for RESP3 clients, and a flat array of channels and counts
+		// in order for RESP2 clients
+		if clientFromContext(ctx).protocol == internal.RESP3 {
+			m := make(map[internal.Data]internal.Data, len(strs)-1)
+			for _, channel := range strs[1:] {
+				m[*internal.NewBulkStringData(channel)] = *internal.NewIntData(h.pubsub.NumSub(channel))
+			}
+			return internal.NewMapData(m), nil
+		}
+		data := make([]internal.Data, 0, 2*(len(strs)-1))
+		for _, channel := range strs[1:] {
+			data = append(data, *internal.NewBulkStringData(channel), *internal.NewIntData(h.pubsub.NumSub(channel)))
+		}
+		return internal.NewArrayData(data), nil
+	case subcommand == "NUMPAT" && len(strs) == 1:
+		return internal.NewIntData(h.pubsub.NumPat()), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", strs[0])
+	}
+}
+
+// PING [message]. A subscribed RESP2 client gets a "pong" array, so it can
+// tell the reply from messages.
+func (h *DefaultCommandHandler) handlePingCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) > 1 {
+		return nil, errWrongNumberOfArgs("PING")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	client := clientFromContext(ctx)
+	if client.subscriptions() > 0 && client.protocol == internal.RESP2 {
+		message := ""
+		if len(strs) == 1 {
+			message = strs[0]
+		}
+		return internal.NewArrayData(bulkStrings([]string{"pong", message})), nil
+	}
+	if len(strs) == 1 {
+		return internal.NewBulkStringData(strs[0]), nil
+	}
+	return internal.NewSimpleStringData("PONG"), nil
+}
@@ -0,0 +1,307 @@
+package main
+
+// Maximum elements in a quicklist node. Bounds the cost of inserting into or
+// shifting a node, so pushes and pops at either end are O(1).
+const quicklistNodeSize = 128
+
+// quicklist is a deque of strings, stored as a doubly linked list of chunks,
+// similar to Redis's quicklist. Pushes and pops at both ends are O(1), and
+// index based reads walk from the nearest end one chunk at a time.
+type quicklist struct {
+	head   *quicklistNode
+	tail   *quicklistNode
+	length int
+}
+
+type quicklistNode struct {
+	prev  *quicklistNode
+	next  *quicklistNode
+	items []string
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+func (q *quicklist) Len() int {
+	return q.length
+}
+
+func (q *quicklist) PushHead(s string) {
+	if q.head == nil || len(q.head.items) >= quicklistNodeSize {
+		q.insertNodeAfter(nil, &quicklistNode{items: make([]string, 0, quicklistNodeSize)})
+	}
+	node := q.head
+	node.items = append(node.items, "")
+	copy(node.items[1:], node.items)
+	node.items[0] = s
+	q.length++
+}
+
+func (q *quicklist) PushTail(s string) {
+	if q.tail == nil || len(q.tail.items) >= quicklistNodeSize {
+		q.insertNodeAfter(q.tail, &quicklistNode{items: make([]string, 0, quicklistNodeSize)})
+	}
+	q.tail.items = append(q.tail.items, s)
+	q.length++
+}
+
+// PopHead removes the first element. Returns false if the list is empty.
+func (q *quicklist) PopHead() (string, bool) {
+	if q.head == nil {
+		return "", false
+	}
+	node := q.head
+	s := node.items[0]
+	// Shift rather than reslice, so the node's capacity is reused
+	copy(node.items, node.items[1:])
+	node.items[len(node.items)-1] = ""
+	node.items = node.items[:len(node.items)-1]
+	q.length--
+	if len(node.items) == 0 {
+		q.removeNode(node)
+	}
+	return s, true
+}
+
+// PopTail removes the last element. Returns false if the list is empty.
+func (q *quicklist) PopTail() (string, bool) {
+	if q.tail == nil {
+		return "", false
+	}
+	node := q.tail
+	last := len(node.items) - 1
+	s := node.items[last]
+	node.items[last] = ""
+	node.items = node.items[:last]
+	q.length--
+	if len(node.items) == 0 {
+		q.removeNode(node)
+	}
+	return s, true
+}
+
+// Index returns the element at i, which must be in range
+func (q *quicklist) Index(i int) string {
+	node, offset := q.find(i)
+	return node.items[offset]
+}
+
+// Set replaces the element at i, which must be in range
+func (q *quicklist) Set(i int, s string) {
+	node, offset := q.find(i)
+	node.items[offset] = s
+}
+
+// Range returns a copy of the elements in [from, to)
+func (q *quicklist) Range(from int, to int) []string {
+	result := make([]string, 0, to-from)
+	if from >= to {
+		return result
+	}
+	node, offset := q.find(from)
+	for node != nil && len(result) < to-from {
+		n := min(len(node.items)-offset, to-from-len(result))
+		result = append(result, node.items[offset:offset+n]...)
+		node, offset = node.next, 0
+	}
+	return result
+}
+
+// Insert inserts s so it ends up at index i. i may equal Len to append.
+func (q *quicklist) Insert(i int, s string) {
+	if i == q.length {
+		q.PushTail(s)
+		return
+	}
+	if i == 0 {
+		q.PushHead(s)
+		return
+	}
+
+	node, offset := q.find(i)
+	// Split full nodes in half, so later inserts nearby are cheap
+	if len(node.items) >= quicklistNodeSize {
+		half := len(node.items) / 2
+		split := &quicklistNode{items: make([]string, 0, quicklistNodeSize)}
+		split.items = append(split.items, node.items[half:]...)
+		clear(node.items[half:])
+		node.items = node.items[:half]
+		q.insertNodeAfter(node, split)
+		if offset >= half {
+			node, offset = split, offset-half
+		}
+	}
+	node.items = append(node.items, "")
+	copy(node.items[offset+1:], node.items[offset:])
+	node.items[offset] = s
+	q.length++
+}
+
+// Each calls fn with each element and its index, from the head, or from the
+// tail if reverse is set. Stops when fn returns false.
+func (q *quicklist) Each(reverse bool, fn func(i int, s string) bool) {
+	if !reverse {
+		i := 0
+		for node := q.head; node != nil; node = node.next {
+			for _, s := range node.items {
+				if !fn(i, s) {
+					return
+				}
+				i++
+			}
+		}
+		return
+	}
+
+	i := q.length - 1
+	for node := q.tail; node != nil; node = node.prev {
+		for j := len(node.items) - 1; j >= 0; j-- {
+			if !fn(i, node.items[j]) {
+				return
+			}
+			i--
+		}
+	}
+}
+
+// RemoveFunc removes elements for which remove returns true, visiting from
+// the head, or from the tail if reverse is set. Stops visiting once remove
+// has returned true limit times, unless limit is 0. Returns the number
+// removed.
+func (q *quicklist) RemoveFunc(reverse bool, limit int, remove func(s string) bool) int {
+	removed := 0
+	node := q.head
+	if reverse {
+		node = q.tail
+	}
+	for node != nil && (limit == 0 || removed < limit) {
+		next := node.next
+		if reverse {
+			next = node.prev
+		}
+
+		// Mark matches first, so the limit applies from the visiting end
+		drop := make([]bool, len(node.items))
+		for j := range node.items {
+			if limit != 0 && removed == limit {
+				break
+			}
+			if reverse {
+				j = len(node.items) - 1 - j
+			}
+			if remove(node.items[j]) {
+				drop[j] = true
+				removed++
+			}
+		}
+		kept := node.items[:0]
+		for j, s := range node.items {
+			if !drop[j] {
+				kept = append(kept, s)
+			}
+		}
+		clear(node.items[len(kept):])
+		node.items = kept
+
+		if len(node.items) == 0 {
+			q.removeNode(node)
+		}
+		node = next
+	}
+	q.length -= removed
+	return removed
+}
+
+// Trim keeps only the elements in [from, to)
+func (q *quicklist) Trim(from int, to int) {
+	q.removeHead(from)
+	q.removeTail(q.length - (to - from))
+}
+
+// Removes the first n elements, dropping whole nodes where possible
+func (q *quicklist) removeHead(n int) {
+	for n > 0 && q.head != nil {
+		node := q.head
+		if n >= len(node.items) {
+			n -= len(node.items)
+			q.length -= len(node.items)
+			q.removeNode(node)
+			continue
+		}
+		copy(node.items, node.items[n:])
+		clear(node.items[len(node.items)-n:])
+		node.items = node.items[:len(node.items)-n]
+		q.length -= n
+		n = 0
+	}
+}
+
+// Removes the last n elements, dropping whole nodes where possible
+func (q *quicklist) removeTail(n int) {
+	for n > 0 && q.tail != nil {
+		node := q.tail
+		if n >= len(node.items) {
+			n -= len(node.items)
+			q.length -= len(node.items)
+			q.removeNode(node)
+			continue
+		}
+		clear(node.items[len(node.items)-n:])
+		node.items = node.items[:len(node.items)-n]
+		q.length -= n
+		n = 0
+	}
+}
+
+// Returns the node holding index i and the offset within it, walking from
+// the nearest end. i must be in range.
+func (q *quicklist) find(i int) (*quicklistNode, int) {
+	if i < q.length/2 {
+		node := q.head
+		for i >= len(node.items) {
+			i -= len(node.items)
+			node = node.next
+		}
+		return node, i
+	}
+
+	node := q.tail
+	fromTail := q.length - 1 - i
+	for fromTail >= len(node.items) {
+		fromTail -= len(node.items)
+		node = node.prev
+	}
+	return node, len(node.items) - 1 - fromTail
+}
+
+// Links node after prev, or at the head if prev is nil
+func (q *quicklist) insertNodeAfter(prev *quicklistNode, node *quicklistNode) {
+	node.prev = prev
+	if prev == nil {
+		node.next = q.head
+		q.head = node
+	} else {
+		node.next = prev.next
+		prev.next = node
+	}
+	if node.next == nil {
+		q.tail = node
+	} else {
+		node.next.prev = node
+	}
+}
+
+func (q *quicklist) removeNode(node *quicklistNode) {
+	if node.prev == nil {
+		q.head = node.next
+	} else {
+		node.prev.next = node.next
+	}
+	if node.next == nil {
+		q.tail = node.prev
+	} else {
+		node.next.prev = node.prev
+	}
+	node.prev, node.next = nil, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Runs random operations against a quicklist and a plain slice, and checks
+// they always hold the same elements
+func TestQuicklistMatchesSlice(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	q := newQuicklist()
+	var model []string
+
+	for op := 0; op < 20000; op++ {
+		s := strconv.Itoa(r.Intn(50))
+		switch r.Intn(9) {
+		case 0, 1:
+			q.PushHead(s)
+			model = append([]string{s}, model...)
+		case 2, 3:
+			q.PushTail(s)
+			model = append(model, s)
+		case 4:
+			got, ok := q.PopHead()
+			if ok != (len(model) > 0) || (ok && got != model[0]) {
+				t.Fatalf("op %d PopHead. got=%q, ok=%t", op, got, ok)
+			}
+			if ok {
+				model = model[1:]
+			}
+		case 5:
+			got, ok := q.PopTail()
+			if ok != (len(model) > 0) || (ok && got != model[len(model)-1]) {
+				t.Fatalf("op %d PopTail. got=%q, ok=%t", op, got, ok)
+			}
+			if ok {
+				model = model[:len(model)-1]
+			}
+		case 6:
+			i := r.Intn(len(model) + 1)
+			q.Insert(i, s)
+			model = slices.Insert(model, i, s)
+		case 7:
+			if len(model) == 0 {
+				continue
+			}
+			i := r.Intn(len(model))
+			if got := q.Index(i); got != model[i] {
+				t.Fatalf("op %d Index(%d). got=%q, want=%q", op, i, got, model[i])
+			}
+			q.Set(i, s)
+			model[i] = s
+		case 8:
+			reverse, limit := r.Intn(2) == 0, r.Intn(3)
+			removed := q.RemoveFunc(reverse, limit, func(e string) bool { return e == s })
+			want := 0
+			if reverse {
+				slices.Reverse(model)
+			}
+			model = slices.DeleteFunc(model, func(e string) bool {
+				if e != s || (limit != 0 && want == limit) {
+					return false
+				}
+				want++
+				return true
+			})
+			if reverse {
+				slices.Reverse(model)
+			}
+			if removed != want {
+				t.Fatalf("op %d RemoveFunc. removed=%d, want=%d", op, removed, want)
+			}
+		}
+
+		if q.Len() != len(model) {
+			t.Fatalf("op %d Len. got=%d, want=%d", op, q.Len(), len(model))
+		}
+	}
+
+	if got := q.Range(0, q.Len()); !slices.Equal(got, model) {
+		t.Fatalf("Range after ops. got=%v, want=%v", got, model)
+	}
+	var reversed []string
+	q.Each(true, func(i int, s string) bool {
+		if s != model[i] {
+			t.Fatalf("Each reverse at %d. got=%q, want=%q", i, s, model[i])
+		}
+		reversed = append(reversed, s)
+		return true
+	})
+	if len(reversed) != len(model) {
+		t.Fatalf("Each reverse visited %d, want %d", len(reversed), len(model))
+	}
+}
+
+func TestQuicklistTrim(t *testing.T) {
+	for _, tt := range []struct{ n, from, to int }{
+		{1000, 0, 1000}, {1000, 300, 700}, {1000, 0, 1}, {1000, 999, 1000}, {1000, 0, 0}, {10, 2, 5},
+	} {
+		q := newQuicklist()
+		var model []string
+		for i := 0; i < tt.n; i++ {
+			q.PushTail(strconv.Itoa(i))
+			model = append(model, strconv.Itoa(i))
+		}
+		q.Trim(tt.from, tt.to)
+		if got, want := q.Range(0, q.Len()), model[tt.from:tt.to]; !slices.Equal(got, want) {
+			t.Fatalf("Trim(%d, %d) of %d. got=%v, want=%v", tt.from, tt.to, tt.n, got, want)
+		}
+	}
+}
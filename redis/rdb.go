@@ -0,0 +1,1248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"maps"
+	"math"
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RDB file format, as written by Redis
+// https://rdb.fnordig.de/file_format.html
+const (
+	rdbMagic   = "REDIS"
+	rdbVersion = 9
+
+	rdbTypeString = 0
+	rdbTypeList   = 1
+	rdbTypeSet    = 2
+	rdbTypeZSet   = 3
+	rdbTypeHash   = 4
+	rdbTypeZSet2  = 5
+	// A stream, as listpacks of its entries, and its consumer groups
+	rdbTypeStreamListpacks = 15
+
+	// Types only read, for the compact encodings Redis saves small
+	// collections in, and those of older and newer versions
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZSetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+
+	// Nodes of a quicklist, from version 10, are a single element or a
+	// listpack
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+
+	rdbOpcodeIdle         = 0xf8
+	rdbOpcodeFreq         = 0xf9
+	rdbOpcodeAux          = 0xfa
+	rdbOpcodeResizeDB     = 0xfb
+	rdbOpcodeExpireTimeMs = 0xfc
+	rdbOpcodeExpireTime   = 0xfd
+	rdbOpcodeSelectDB     = 0xfe
+	rdbOpcodeEOF          = 0xff
+
+	// The top two bits of the first byte of a length give its encoding
+	rdbLen6Bit    = 0
+	rdbLen14Bit   = 1
+	rdbLenEncoded = 3
+	rdbLen32Bit   = 0x80
+	rdbLen64Bit   = 0x81
+
+	// Special string encodings, after rdbLenEncoded
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+var ErrRDBCorrupt = errors.New("rdb file is corrupt")
+
+// Redis checksums RDB files with the Jones CRC-64, with no inversion of the
+// initial or final value. hash/crc64 inverts both, so they're inverted back.
+var rdbCRCTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func rdbCRC(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, rdbCRCTable, p)
+}
+
+// rdbEntry is a key and its record, copied out of the dictionary so it can
+// be written without holding the lock
+type rdbEntry struct {
+	key      string
+	kind     RecordKind
+	value    string
+	list     []string
+	hash     map[string]string
+	set      []string
+	zset     []ZSetMember
+	stream   *stream
+	expire   bool
+	expireAt time.Time
+}
+
+// Snapshot copies the live records, for saving
+func (d *Dictionary) Snapshot() []rdbEntry {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	now := time.Now()
+	entries := make([]rdbEntry, 0, len(d.kv))
+	for k, record := range d.kv {
+		if record.expired(now) {
+			continue
+		}
+		entry := rdbEntry{key: k, kind: record.kind, expire: record.expire, expireAt: record.ttl}
+		switch record.kind {
+		case StringRecord:
+			entry.value = record.value
+		case ListRecord:
+			entry.list = record.listValue.Range(0, record.listValue.Len())
+		case HashRecord:
+			entry.hash = maps.Clone(record.hashValue)
+		case SetRecord:
+			entry.set = slices.Collect(maps.Keys(record.setValue))
+		case ZSetRecord:
+			for member, score := range record.zsetValue.scores {
+				entry.zset = append(entry.zset, ZSetMember{member: member, score: score})
+			}
+		case StreamRecord:
+			entry.stream = record.streamValue.clone()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Load stores loaded records, replacing existing ones. Records that have
+// expired since they were saved are skipped.
+func (d *Dictionary) Load(entries []rdbEntry) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := time.Now()
+	for _, entry := range entries {
+		record := KVRecord{kind: entry.kind, expire: entry.expire, ttl: entry.expireAt}
+		if record.expired(now) {
+			continue
+		}
+		switch entry.kind {
+		case StringRecord:
+			record.value = entry.value
+		case ListRecord:
+			record.listValue = newQuicklist()
+			for _, element := range entry.list {
+				record.listValue.PushTail(element)
+			}
+		case HashRecord:
+			record.hashValue = entry.hash
+		case SetRecord:
+			record.setValue = make(map[string]struct{}, len(entry.set))
+			for _, member := range entry.set {
+				record.setValue[member] = struct{}{}
+			}
+		case ZSetRecord:
+			record.zsetValue = newZset()
+			for _, m := range entry.zset {
+				record.zsetValue.Add(m.member, m.score)
+			}
+		case StreamRecord:
+			record.streamValue = entry.stream
+		}
+		d.setRecord(entry.key, record)
+	}
+}
+
+// Writes entries to path. The file is written in full to a temp file
+// first, and then renamed, so a failed save leaves the last one in place.
+func writeRDBFile(path string, entries []rdbEntry, now time.Time) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return fmt.Errorf("failed to create temp rdb file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := writeRDB(w, entries, now); err != nil {
+		return fmt.Errorf("failed to write rdb file: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write rdb file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync rdb file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close rdb file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename rdb file: %w", err)
+	}
+	return nil
+}
+
+// Reads the entries saved at path
+func readRDBFile(path string) ([]rdbEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRDB(bufio.NewReader(f))
+}
+
+// rdbWriter writes RDB encoded values, keeping a checksum of everything
+// written
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (w *rdbWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc = rdbCRC(w.crc, p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *rdbWriter) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{byte(n>>8) | rdbLen14Bit<<6, byte(n)})
+	case n <= math.MaxUint32:
+		w.writeByte(rdbLen32Bit)
+		w.write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		w.writeByte(rdbLen64Bit)
+		w.write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func (w *rdbWriter) writeString(s string) {
+	w.writeLength(uint64(len(s)))
+	w.write([]byte(s))
+}
+
+func writeRDB(out io.Writer, entries []rdbEntry, now time.Time) error {
+	w := &rdbWriter{w: out}
+	w.write(fmt.Appendf(nil, "%s%04d", rdbMagic, rdbVersion))
+
+	for _, aux := range [][2]string{
+		{"redis-ver", ServerVersion},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(now.Unix(), 10)},
+	} {
+		w.writeByte(rdbOpcodeAux)
+		w.writeString(aux[0])
+		w.writeString(aux[1])
+	}
+
+	expires := 0
+	for _, entry := range entries {
+		if entry.expire {
+			expires++
+		}
+	}
+	w.writeByte(rdbOpcodeSelectDB)
+	w.writeLength(0)
+	w.writeByte(rdbOpcodeResizeDB)
+	w.writeLength(uint64(len(entries)))
+	w.writeLength(uint64(expires))
+
+	for _, entry := range entries {
+		if entry.expire {
+			w.writeByte(rdbOpcodeExpireTimeMs)
+			w.write(binary.LittleEndian.AppendUint64(nil, uint64(entry.expireAt.UnixMilli())))
+		}
+		switch entry.kind {
+		case StringRecord:
+			w.writeByte(rdbTypeString)
+			w.writeString(entry.key)
+			w.writeString(entry.value)
+		case ListRecord:
+			w.writeByte(rdbTypeList)
+			w.writeString(entry.key)
+			w.writeLength(uint64(len(entry.list)))
+			for _, element := range entry.list {
+				w.writeString(element)
+			}
+		case HashRecord:
+			w.writeByte(rdbTypeHash)
+			w.writeString(entry.key)
+			w.writeLength(uint64(len(entry.hash)))
+			for field, value := range entry.hash {
+				w.writeString(field)
+				w.writeString(value)
+			}
+		case SetRecord:
+			w.writeByte(rdbTypeSet)
+			w.writeString(entry.key)
+			w.writeLength(uint64(len(entry.set)))
+			for _, member := range entry.set {
+				w.writeString(member)
+			}
+		case ZSetRecord:
+			w.writeByte(rdbTypeZSet2)
+			w.writeString(entry.key)
+			w.writeLength(uint64(len(entry.zset)))
+			for _, m := range entry.zset {
+				w.writeString(m.member)
+				w.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(m.score)))
+			}
+		case StreamRecord:
+			w.writeByte(rdbTypeStreamListpacks)
+			w.writeString(entry.key)
+			w.writeStream(entry.stream)
+		}
+	}
+
+	w.writeByte(rdbOpcodeEOF)
+	if w.err != nil {
+		return w.err
+	}
+	_, err := out.Write(binary.LittleEndian.AppendUint64(nil, w.crc))
+	return err
+}
+
+// rdbReader reads RDB encoded values, keeping a checksum of everything read
+type rdbReader struct {
+	r   io.Reader
+	crc uint64
+}
+
+func (r *rdbReader) read(n int) ([]byte, error) {
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: unexpected end of file", ErrRDBCorrupt)
+		}
+		return nil, err
+	}
+	r.crc = rdbCRC(r.crc, p)
+	return p, nil
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	p, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+// Reads a length. If encoded is set, the length is instead one of the
+// special string encodings.
+func (r *rdbReader) readLength() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdbLen6Bit:
+		return uint64(b & 0x3f), false, nil
+	case rdbLen14Bit:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case rdbLenEncoded:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdbLen32Bit:
+		p, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case rdbLen64Bit:
+		p, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	default:
+		return 0, false, fmt.Errorf("%w: unknown length encoding %#x", ErrRDBCorrupt, b)
+	}
+}
+
+func (r *rdbReader) readPlainLength() (int, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: invalid length", ErrRDBCorrupt)
+	}
+	return int(n), nil
+}
+
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > math.MaxInt32 {
+			return "", fmt.Errorf("%w: invalid string length", ErrRDBCorrupt)
+		}
+		p, err := r.read(int(n))
+		return string(p), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := r.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		p, err := r.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p)))), nil
+	case rdbEncInt32:
+		p, err := r.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p)))), nil
+	case rdbEncLZF:
+		compressedLen, err := r.readPlainLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := r.readPlainLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := r.read(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		return lzfDecompress(compressed, length)
+	default:
+		return "", fmt.Errorf("%w: unknown string encoding %d", ErrRDBCorrupt, n)
+	}
+}
+
+// Reads the value of an entry of type t
+func (r *rdbReader) readValue(t byte, entry *rdbEntry) error {
+	var err error
+	switch t {
+	case rdbTypeString:
+		entry.kind = StringRecord
+		entry.value, err = r.readString()
+		return err
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		entry.kind = StreamRecord
+		entry.stream, err = r.readStream(t)
+		return err
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return r.readQuicklist(t, entry)
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist, rdbTypeHashZiplist,
+		rdbTypeHashListpack, rdbTypeZSetListpack, rdbTypeSetListpack:
+		p, err := r.readString()
+		if err != nil {
+			return err
+		}
+		return readEncodedValue(t, []byte(p), entry)
+	}
+
+	n, err := r.readPlainLength()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case rdbTypeList:
+		entry.kind = ListRecord
+		for range n {
+			element, err := r.readString()
+			if err != nil {
+				return err
+			}
+			entry.list = append(entry.list, element)
+		}
+	case rdbTypeSet:
+		entry.kind = SetRecord
+		for range n {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			entry.set = append(entry.set, member)
+		}
+	case rdbTypeHash:
+		entry.kind = HashRecord
+		entry.hash = make(map[string]string, n)
+		for range n {
+			field, err := r.readString()
+			if err != nil {
+				return err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return err
+			}
+			entry.hash[field] = value
+		}
+	case rdbTypeZSet2:
+		entry.kind = ZSetRecord
+		for range n {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			p, err := r.read(8)
+			if err != nil {
+				return err
+			}
+			score := math.Float64frombits(binary.LittleEndian.Uint64(p))
+			entry.zset = append(entry.zset, ZSetMember{member: member, score: score})
+		}
+	case rdbTypeZSet:
+		// Before version 8, scores were saved as strings
+		entry.kind = ZSetRecord
+		for range n {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			score, err := r.readStringScore()
+			if err != nil {
+				return err
+			}
+			entry.zset = append(entry.zset, ZSetMember{member: member, score: score})
+		}
+	}
+	return nil
+}
+
+// Reads a score saved as a string, with a length of one byte. Lengths of
+// 253 to 255 stand for NaN, +inf and -inf.
+func (r *rdbReader) readStringScore() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := r.read(int(n))
+	if err != nil {
+		return 0, err
+	}
+	score, err := strconv.ParseFloat(string(p), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid score %q", ErrRDBCorrupt, p)
+	}
+	return score, nil
+}
+
+// Reads a list saved as a quicklist, whose nodes are ziplists, or from
+// version 10, listpacks or single elements
+func (r *rdbReader) readQuicklist(t byte, entry *rdbEntry) error {
+	entry.kind = ListRecord
+	n, err := r.readPlainLength()
+	if err != nil {
+		return err
+	}
+	for range n {
+		container := rdbQuicklistNodePacked
+		if t == rdbTypeListQuicklist2 {
+			if container, err = r.readPlainLength(); err != nil {
+				return err
+			}
+		}
+		p, err := r.readString()
+		if err != nil {
+			return err
+		}
+
+		var elements []string
+		switch {
+		case t == rdbTypeListQuicklist:
+			elements, err = readZiplist([]byte(p))
+		case container == rdbQuicklistNodePlain:
+			elements = []string{p}
+		case container == rdbQuicklistNodePacked:
+			elements, err = readListpack([]byte(p))
+		default:
+			err = fmt.Errorf("%w: unknown quicklist container %d", ErrRDBCorrupt, container)
+		}
+		if err != nil {
+			return err
+		}
+		entry.list = append(entry.list, elements...)
+	}
+	return nil
+}
+
+// Decodes a collection saved as a single blob, p, in one of the compact
+// encodings of type t
+func readEncodedValue(t byte, p []byte, entry *rdbEntry) error {
+	var elements []string
+	var err error
+	switch t {
+	case rdbTypeHashZipmap:
+		elements, err = readZipmap(p)
+	case rdbTypeSetIntset:
+		elements, err = readIntset(p)
+	case rdbTypeListZiplist, rdbTypeZSetZiplist, rdbTypeHashZiplist:
+		elements, err = readZiplist(p)
+	default:
+		elements, err = readListpack(p)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case rdbTypeListZiplist:
+		entry.kind = ListRecord
+		entry.list = elements
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		entry.kind = SetRecord
+		entry.set = elements
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		// Fields and values alternate
+		if len(elements)%2 != 0 {
+			return fmt.Errorf("%w: hash with a field without a value", ErrRDBCorrupt)
+		}
+		entry.kind = HashRecord
+		entry.hash = make(map[string]string, len(elements)/2)
+		for i := 0; i < len(elements); i += 2 {
+			entry.hash[elements[i]] = elements[i+1]
+		}
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		// Members and scores alternate
+		if len(elements)%2 != 0 {
+			return fmt.Errorf("%w: sorted set member without a score", ErrRDBCorrupt)
+		}
+		entry.kind = ZSetRecord
+		for i := 0; i < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(elements[i+1], 64)
+			if err != nil {
+				return fmt.Errorf("%w: invalid score %q", ErrRDBCorrupt, elements[i+1])
+			}
+			entry.zset = append(entry.zset, ZSetMember{member: elements[i], score: score})
+		}
+	}
+	return nil
+}
+
+func readRDB(in io.Reader) ([]rdbEntry, error) {
+	r := &rdbReader{r: in}
+	header, err := r.read(len(rdbMagic) + 4)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(rdbMagic)]) != rdbMagic {
+		return nil, fmt.Errorf("%w: wrong signature", ErrRDBCorrupt)
+	}
+	version, err := strconv.Atoi(string(header[len(rdbMagic):]))
+	if err != nil || version < 1 || version > 11 {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrRDBCorrupt, header[len(rdbMagic):])
+	}
+
+	var entries []rdbEntry
+	var expire bool
+	var expireAt time.Time
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			// Versions before 5 have no checksum, and a checksum of 0 means
+			// it was disabled when saving
+			if version < 5 {
+				return entries, nil
+			}
+			want := r.crc
+			p, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			if got := binary.LittleEndian.Uint64(p); got != 0 && got != want {
+				return nil, fmt.Errorf("%w: wrong checksum", ErrRDBCorrupt)
+			}
+			return entries, nil
+		case rdbOpcodeAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case rdbOpcodeSelectDB:
+			if _, err := r.readPlainLength(); err != nil {
+				return nil, err
+			}
+		case rdbOpcodeResizeDB:
+			for range 2 {
+				if _, err := r.readPlainLength(); err != nil {
+					return nil, err
+				}
+			}
+		case rdbOpcodeExpireTimeMs:
+			p, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			expire, expireAt = true, time.UnixMilli(int64(binary.LittleEndian.Uint64(p)))
+		case rdbOpcodeExpireTime:
+			p, err := r.read(4)
+			if err != nil {
+				return nil, err
+			}
+			expire, expireAt = true, time.Unix(int64(binary.LittleEndian.Uint32(p)), 0)
+		case rdbOpcodeIdle:
+			if _, _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case rdbTypeString, rdbTypeList, rdbTypeSet, rdbTypeZSet, rdbTypeHash, rdbTypeZSet2,
+			rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZSetZiplist, rdbTypeHashZiplist,
+			rdbTypeListQuicklist, rdbTypeStreamListpacks, rdbTypeHashListpack, rdbTypeZSetListpack,
+			rdbTypeListQuicklist2, rdbTypeStreamListpacks2, rdbTypeSetListpack, rdbTypeStreamListpacks3:
+			entry := rdbEntry{expire: expire, expireAt: expireAt}
+			expire, expireAt = false, time.Time{}
+			if entry.key, err = r.readString(); err != nil {
+				return nil, err
+			}
+			if err := r.readValue(opcode, &entry); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		default:
+			return nil, fmt.Errorf("%w: unsupported type or opcode %#x", ErrRDBCorrupt, opcode)
+		}
+	}
+}
+
+// Streams are saved as a radix tree of listpacks, each holding up to
+// rdbStreamNodeEntries entries, keyed by the ID of its first entry, which
+// the IDs in it are relative to. The consumer groups follow, with their
+// pending entries, and then the consumers, with the IDs of the pending
+// entries each owns.
+const (
+	rdbStreamNodeEntries = 100
+
+	// Flags of an entry in a listpack
+	rdbStreamItemDeleted    = 1
+	rdbStreamItemSameFields = 2
+)
+
+// Returns an ID as saved, big endian so IDs sort as their bytes do
+func rdbStreamID(id StreamID) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, id.ms), id.seq)
+}
+
+func (w *rdbWriter) writeStream(s *stream) {
+	w.writeLength(uint64((len(s.entries) + rdbStreamNodeEntries - 1) / rdbStreamNodeEntries))
+	for entries := s.entries; len(entries) > 0; {
+		n := min(len(entries), rdbStreamNodeEntries)
+		w.writeString(string(rdbStreamID(entries[0].id)))
+		w.writeString(string(appendListpack(nil, streamNodeElements(entries[:n]))))
+		entries = entries[n:]
+	}
+	w.writeLength(uint64(len(s.entries)))
+	w.writeLength(s.lastID.ms)
+	w.writeLength(s.lastID.seq)
+
+	w.writeLength(uint64(len(s.groups)))
+	for name, g := range s.groups {
+		w.writeString(name)
+		w.writeLength(g.lastID.ms)
+		w.writeLength(g.lastID.seq)
+
+		ids := g.pendingIDs()
+		w.writeLength(uint64(len(ids)))
+		var consumers []string
+		owned := make(map[string][]StreamID)
+		// Consumers aren't kept apart from their pending entries, so the
+		// last delivery stands in for when each was last seen
+		seen := make(map[string]time.Time)
+		for _, id := range ids {
+			p := g.pending[id]
+			w.write(rdbStreamID(id))
+			w.write(binary.LittleEndian.AppendUint64(nil, uint64(p.deliveryTime.UnixMilli())))
+			w.writeLength(uint64(p.deliveryCount))
+			if _, ok := owned[p.consumer]; !ok {
+				consumers = append(consumers, p.consumer)
+			}
+			owned[p.consumer] = append(owned[p.consumer], id)
+			if p.deliveryTime.After(seen[p.consumer]) {
+				seen[p.consumer] = p.deliveryTime
+			}
+		}
+		w.writeLength(uint64(len(consumers)))
+		for _, consumer := range consumers {
+			w.writeString(consumer)
+			w.write(binary.LittleEndian.AppendUint64(nil, uint64(seen[consumer].UnixMilli())))
+			w.writeLength(uint64(len(owned[consumer])))
+			for _, id := range owned[consumer] {
+				w.write(rdbStreamID(id))
+			}
+		}
+	}
+}
+
+// Returns the listpack elements of a node of entries. The node starts with
+// the number of entries, of deleted entries, and the fields of the first
+// entry. Entries with the same fields only list their values.
+func streamNodeElements(entries []streamEntry) []string {
+	master := entries[0]
+	var fields []string
+	for i := 0; i < len(master.fields); i += 2 {
+		fields = append(fields, master.fields[i])
+	}
+	elements := []string{strconv.Itoa(len(entries)), "0", strconv.Itoa(len(fields))}
+	elements = append(elements, fields...)
+	elements = append(elements, "0")
+
+	for _, entry := range entries {
+		sameFields := len(entry.fields) == 2*len(fields)
+		for i := 0; sameFields && i < len(fields); i++ {
+			sameFields = entry.fields[2*i] == fields[i]
+		}
+		flags := 0
+		if sameFields {
+			flags = rdbStreamItemSameFields
+		}
+		// The sequence number may be lower than the first entry's, in a
+		// later millisecond, so the difference wraps
+		elements = append(elements,
+			strconv.Itoa(flags),
+			strconv.FormatInt(int64(entry.id.ms-master.id.ms), 10),
+			strconv.FormatInt(int64(entry.id.seq-master.id.seq), 10),
+		)
+		n := len(entry.fields) / 2
+		if sameFields {
+			for i := 1; i < len(entry.fields); i += 2 {
+				elements = append(elements, entry.fields[i])
+			}
+			// Each entry ends with its number of elements, to walk back
+			elements = append(elements, strconv.Itoa(n+3))
+		} else {
+			elements = append(elements, strconv.Itoa(n))
+			elements = append(elements, entry.fields...)
+			elements = append(elements, strconv.Itoa(2*n+4))
+		}
+	}
+	return elements
+}
+
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	p, err := r.read(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])}, nil
+}
+
+// Reads a length that's a number, rather than the size of what follows
+func (r *rdbReader) readUint() (uint64, error) {
+	n, encoded, err := r.readLength()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: invalid number", ErrRDBCorrupt)
+	}
+	return n, err
+}
+
+// Reads a stream of type t. Later versions save more about the stream and
+// its groups, for XINFO, which isn't kept.
+func (r *rdbReader) readStream(t byte) (*stream, error) {
+	s := newStream()
+	nodes, err := r.readPlainLength()
+	if err != nil {
+		return nil, err
+	}
+	for range nodes {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, fmt.Errorf("%w: invalid stream node key", ErrRDBCorrupt)
+		}
+		master := StreamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elements, err := readListpack([]byte(lp))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := readStreamNode(master, elements)
+		if err != nil {
+			return nil, err
+		}
+		s.entries = append(s.entries, entries...)
+	}
+
+	// The number of entries is known from the nodes
+	if _, err := r.readUint(); err != nil {
+		return nil, err
+	}
+	if s.lastID.ms, err = r.readUint(); err != nil {
+		return nil, err
+	}
+	if s.lastID.seq, err = r.readUint(); err != nil {
+		return nil, err
+	}
+	if t >= rdbTypeStreamListpacks2 {
+		// The first ID, the largest deleted ID, and the number of entries
+		// ever added
+		for range 5 {
+			if _, err := r.readUint(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	groups, err := r.readPlainLength()
+	if err != nil {
+		return nil, err
+	}
+	for range groups {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		g := &streamGroup{pending: make(map[StreamID]*streamPendingEntry)}
+		if g.lastID.ms, err = r.readUint(); err != nil {
+			return nil, err
+		}
+		if g.lastID.seq, err = r.readUint(); err != nil {
+			return nil, err
+		}
+		if t >= rdbTypeStreamListpacks2 {
+			// The number of entries the group has read
+			if _, err := r.readUint(); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.readStreamPending(t, g); err != nil {
+			return nil, err
+		}
+		s.groups[name] = g
+	}
+	return s, nil
+}
+
+// Reads the pending entries of a group, and the consumers that own them
+func (r *rdbReader) readStreamPending(t byte, g *streamGroup) error {
+	n, err := r.readPlainLength()
+	if err != nil {
+		return err
+	}
+	for range n {
+		id, err := r.readStreamID()
+		if err != nil {
+			return err
+		}
+		p, err := r.read(8)
+		if err != nil {
+			return err
+		}
+		count, err := r.readUint()
+		if err != nil {
+			return err
+		}
+		g.pending[id] = &streamPendingEntry{
+			deliveryTime:  time.UnixMilli(int64(binary.LittleEndian.Uint64(p))),
+			deliveryCount: int(count),
+		}
+	}
+
+	consumers, err := r.readPlainLength()
+	if err != nil {
+		return err
+	}
+	owners := 0
+	for range consumers {
+		name, err := r.readString()
+		if err != nil {
+			return err
+		}
+		// When the consumer was last seen, and from type 21, last active
+		times := 1
+		if t >= rdbTypeStreamListpacks3 {
+			times = 2
+		}
+		if _, err := r.read(8 * times); err != nil {
+			return err
+		}
+		owned, err := r.readPlainLength()
+		if err != nil {
+			return err
+		}
+		for range owned {
+			id, err := r.readStreamID()
+			if err != nil {
+				return err
+			}
+			p, ok := g.pending[id]
+			if !ok {
+				return fmt.Errorf("%w: consumer %s owns %s, which isn't pending", ErrRDBCorrupt, name, id)
+			}
+			p.consumer = name
+			owners++
+		}
+	}
+	if owners != len(g.pending) {
+		return fmt.Errorf("%w: pending entries without a consumer", ErrRDBCorrupt)
+	}
+	return nil
+}
+
+// Decodes the entries of a stream node, with IDs relative to master.
+// Deleted entries are skipped.
+func readStreamNode(master StreamID, elements []string) ([]streamEntry, error) {
+	corrupt := fmt.Errorf("%w: invalid stream node", ErrRDBCorrupt)
+	next := func(n int) ([]string, bool) {
+		if n < 0 || n > len(elements) {
+			return nil, false
+		}
+		taken := elements[:n]
+		elements = elements[n:]
+		return taken, true
+	}
+	nextInt := func() (int64, bool) {
+		taken, ok := next(1)
+		if !ok {
+			return 0, false
+		}
+		i, err := strconv.ParseInt(taken[0], 10, 64)
+		return i, err == nil
+	}
+
+	// The number of entries, and of those deleted, are known from the
+	// entries themselves
+	if _, ok := next(2); !ok {
+		return nil, corrupt
+	}
+	n, ok := nextInt()
+	if !ok {
+		return nil, corrupt
+	}
+	fields, ok := next(int(n))
+	if !ok {
+		return nil, corrupt
+	}
+	if _, ok := next(1); !ok {
+		return nil, corrupt
+	}
+
+	var entries []streamEntry
+	for len(elements) > 0 {
+		flags, ok1 := nextInt()
+		ms, ok2 := nextInt()
+		seq, ok3 := nextInt()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, corrupt
+		}
+		entry := streamEntry{id: StreamID{master.ms + uint64(ms), master.seq + uint64(seq)}}
+		if flags&rdbStreamItemSameFields != 0 {
+			values, ok := next(len(fields))
+			if !ok {
+				return nil, corrupt
+			}
+			for i, field := range fields {
+				entry.fields = append(entry.fields, field, values[i])
+			}
+		} else {
+			n, ok := nextInt()
+			if !ok {
+				return nil, corrupt
+			}
+			if entry.fields, ok = next(2 * int(n)); !ok {
+				return nil, corrupt
+			}
+		}
+		// The entry's number of elements, for walking back
+		if _, ok := next(1); !ok {
+			return nil, corrupt
+		}
+		if flags&rdbStreamItemDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Decompresses LZF data, as Redis compresses long strings
+func lzfDecompress(in []byte, length int) (string, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// A literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) {
+				return "", fmt.Errorf("%w: invalid compressed string", ErrRDBCorrupt)
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// A back reference, copying n bytes from offset back in the output
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return "", fmt.Errorf("%w: invalid compressed string", ErrRDBCorrupt)
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return "", fmt.Errorf("%w: invalid compressed string", ErrRDBCorrupt)
+		}
+		offset := (ctrl&0x1f)<<8 + int(in[i]) + 1
+		i++
+		start := len(out) - offset
+		if start < 0 {
+			return "", fmt.Errorf("%w: invalid compressed string", ErrRDBCorrupt)
+		}
+		// The copy may overlap the bytes it appends, so copy byte by byte
+		for j := range n + 2 {
+			out = append(out, out[start+j])
+		}
+	}
+	if len(out) != length {
+		return "", fmt.Errorf("%w: invalid compressed string length", ErrRDBCorrupt)
+	}
+	return string(out), nil
+}
+
+// rdbState tracks saves of the dictionary to the RDB file
+type rdbState struct {
+	// Guards the fields below. Held by SAVE while it writes.
+	m    sync.Mutex
+	path string
+	// The last successful save, or when the server started
+	lastSave time.Time
+	// Set while BGSAVE writes in the background
+	saving bool
+}
+
+func newRDBState(path string) *rdbState {
+	return &rdbState{path: path, lastSave: time.Now()}
+}
+
+// LoadRDB loads the RDB file into the dictionary. A missing file isn't an
+// error, as there's nothing saved yet.
+func (h *DefaultCommandHandler) LoadRDB() error {
+	entries, err := readRDBFile(h.rdb.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", h.rdb.path, err)
+	}
+	h.dict.Load(entries)
+	return nil
+}
+
+// SAVE
+func (h *DefaultCommandHandler) handleSaveCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("SAVE")
+	}
+
+	h.rdb.m.Lock()
+	defer h.rdb.m.Unlock()
+	if h.rdb.saving {
+		return nil, fmt.Errorf("ERR Background save already in progress")
+	}
+	now := time.Now()
+	if err := writeRDBFile(h.rdb.path, h.dict.Snapshot(), now); err != nil {
+		return nil, fmt.Errorf("ERR %w", err)
+	}
+	h.rdb.lastSave = now
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// BGSAVE. The snapshot is taken under the dictionary lock, so it's a point
+// in time, and written without holding it.
+func (h *DefaultCommandHandler) handleBgsaveCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("BGSAVE")
+	}
+
+	h.rdb.m.Lock()
+	defer h.rdb.m.Unlock()
+	if h.rdb.saving {
+		return nil, fmt.Errorf("ERR Background save already in progress")
+	}
+	h.rdb.saving = true
+	now := time.Now()
+	entries := h.dict.Snapshot()
+
+	go func() {
+		err := writeRDBFile(h.rdb.path, entries, now)
+
+		h.rdb.m.Lock()
+		defer h.rdb.m.Unlock()
+		h.rdb.saving = false
+		if err == nil {
+			h.rdb.lastSave = now
+		}
+	}()
+	return internal.NewSimpleStringData("Background saving started"), nil
+}
+
+// LASTSAVE
+func (h *DefaultCommandHandler) handleLastsaveCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("LASTSAVE")
+	}
+
+	h.rdb.m.Lock()
+	defer h.rdb.m.Unlock()
+	return internal.NewIntData(int(h.rdb.lastSave.Unix())), nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRDBChecksum(t *testing.T) {
+	// The check value Redis tests its CRC-64 against
+	if got := rdbCRC(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("rdbCRC. want=%#x, got=%#x", uint64(0xe9c6d914c4b8d9ca), got)
+	}
+}
+
+// Returns a stream spanning several listpack nodes, with entries whose
+// fields differ from the first's, and a group with pending entries
+func testStream() *stream {
+	s := newStream()
+	for i := range 2*rdbStreamNodeEntries + 10 {
+		// IDs with lower sequence numbers than the first in their node
+		id := StreamID{uint64(1000 + i/3), uint64(i%3) * 7}
+		fields := []string{"n", strconv.Itoa(i), "name", "x"}
+		if i%10 == 0 {
+			fields = []string{"other", strings.Repeat("v", 100)}
+		}
+		s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	}
+	s.lastID = StreamID{2000, 1}
+	deliveredAt := time.UnixMilli(time.Now().UnixMilli())
+	s.groups["workers"] = &streamGroup{
+		lastID: s.entries[2].id,
+		pending: map[StreamID]*streamPendingEntry{
+			s.entries[0].id: {consumer: "alice", deliveryTime: deliveredAt, deliveryCount: 1},
+			s.entries[1].id: {consumer: "bob", deliveryTime: deliveredAt, deliveryCount: 3},
+			s.entries[2].id: {consumer: "alice", deliveryTime: deliveredAt.Add(-time.Hour), deliveryCount: 2},
+		},
+	}
+	s.groups["idle"] = &streamGroup{lastID: StreamID{}, pending: map[StreamID]*streamPendingEntry{}}
+	return s
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	entries := []rdbEntry{
+		{key: "string", kind: StringRecord, value: "value"},
+		{key: "empty", kind: StringRecord, value: ""},
+		{key: "long", kind: StringRecord, value: strings.Repeat("x", 1<<15)},
+		{key: "list", kind: ListRecord, list: []string{"a", "b", strings.Repeat("c", 100)}},
+		{key: "expiring", kind: StringRecord, value: "soon", expire: true, expireAt: expireAt},
+		{key: "hash", kind: HashRecord, hash: map[string]string{"f1": "v1", "f2": ""}},
+		{key: "set", kind: SetRecord, set: []string{"a", "b"}},
+		{key: "zset", kind: ZSetRecord, zset: []ZSetMember{{member: "a", score: 1.5}, {member: "b", score: math.Inf(-1)}}},
+		{key: "stream", kind: StreamRecord, stream: testStream()},
+		{key: "emptystream", kind: StreamRecord, stream: &stream{lastID: StreamID{5, 0}, groups: map[string]*streamGroup{}}},
+	}
+
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, entries, time.Now()); err != nil {
+		t.Fatalf("writeRDB. unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("REDIS0009")) {
+		t.Fatalf("writeRDB. header=%q", buf.Bytes()[:9])
+	}
+	got, err := readRDB(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("readRDB. unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Fatalf("readRDB. want %v, got %v", entries, got)
+	}
+
+	// Truncated and corrupted files are rejected
+	if _, err := readRDB(bytes.NewReader(buf.Bytes()[:buf.Len()-20])); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("readRDB truncated. want ErrRDBCorrupt, got %v", err)
+	}
+	corrupt := bytes.Clone(buf.Bytes())
+	corrupt[len(corrupt)-20] ^= 0xff
+	if _, err := readRDB(bytes.NewReader(corrupt)); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("readRDB corrupted. want ErrRDBCorrupt, got %v", err)
+	}
+}
+
+// Redis saves integer and long strings in compact encodings
+func TestReadRDBStringEncodings(t *testing.T) {
+	file := []byte("REDIS0009")
+	file = append(file, rdbTypeString, 1, 'a', 0xc0, 0x7b)
+	file = append(file, rdbTypeString, 1, 'b', 0xc1, 0xfe, 0xff)
+	file = append(file, rdbTypeString, 1, 'c', 0xc2, 0x40, 0xe2, 0x01, 0x00)
+	// "a" as a literal, then a back reference copying it 9 times
+	file = append(file, rdbTypeString, 1, 'd', 0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00)
+	// A checksum of 0 isn't checked
+	file = append(file, rdbOpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	entries, err := readRDB(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("readRDB. unexpected error: %v", err)
+	}
+	want := []rdbEntry{
+		{key: "a", kind: StringRecord, value: "123"},
+		{key: "b", kind: StringRecord, value: "-2"},
+		{key: "c", kind: StringRecord, value: "123456"},
+		{key: "d", kind: StringRecord, value: "aaaaaaaaaa"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("readRDB. want %v, got %v", want, entries)
+	}
+}
+
+// Redis saves small collections in compact encodings, which differ by
+// version
+func TestReadRDBCompactEncodings(t *testing.T) {
+	// A string of p, with its length
+	blob := func(p ...byte) []byte {
+		return append([]byte{byte(len(p))}, p...)
+	}
+	file := []byte("REDIS0011")
+	// A ziplist of "a", 1, -2 and 300
+	file = append(file, rdbTypeListZiplist, 2, 'z', 'l')
+	file = append(file, blob(0x17, 0, 0, 0, 0x12, 0, 0, 0, 4, 0,
+		0, 0x01, 'a', 3, 0xf2, 2, 0xfe, 0xfe, 3, 0xc0, 0x2c, 0x01, 0xff)...)
+	// An intset of 2 byte integers
+	file = append(file, rdbTypeSetIntset, 2, 'i', 's')
+	file = append(file, blob(2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 5, 0)...)
+	// A listpack of "f", "v", "n" and 1000
+	file = append(file, rdbTypeHashListpack, 2, 'l', 'h')
+	file = append(file, blob(0x13, 0, 0, 0, 4, 0,
+		0x81, 'f', 2, 0x81, 'v', 2, 0x81, 'n', 2, 0xc3, 0xe8, 2, 0xff)...)
+	file = append(file, rdbTypeZSetListpack, 2, 'l', 'z')
+	file = append(file, blob(0x0f, 0, 0, 0, 2, 0, 0x81, 'm', 2, 0x83, '1', '.', '5', 4, 0xff)...)
+	file = append(file, rdbTypeSetListpack, 2, 'l', 's')
+	file = append(file, blob(0x0b, 0, 0, 0, 1, 0, 0x82, 's', '1', 3, 0xff)...)
+	// A quicklist of a plain node, and a listpack of "y" and -5000
+	file = append(file, rdbTypeListQuicklist2, 2, 'q', 'l', 2, rdbQuicklistNodePlain, 1, 'x', rdbQuicklistNodePacked)
+	file = append(file, blob(0x0e, 0, 0, 0, 2, 0, 0x81, 'y', 2, 0xf1, 0x78, 0xec, 3, 0xff)...)
+	file = append(file, rdbTypeHashZipmap, 2, 'z', 'm')
+	file = append(file, blob(1, 1, 'k', 1, 0, 'v', 0xff)...)
+	// Scores as strings, with 254 for +inf
+	file = append(file, rdbTypeZSet, 2, 'o', 'z', 2, 1, 'a', 3, '2', '.', '5', 1, 'b', 254)
+	file = append(file, rdbOpcodeEOF, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	entries, err := readRDB(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("readRDB. unexpected error: %v", err)
+	}
+	want := []rdbEntry{
+		{key: "zl", kind: ListRecord, list: []string{"a", "1", "-2", "300"}},
+		{key: "is", kind: SetRecord, set: []string{"-1", "5"}},
+		{key: "lh", kind: HashRecord, hash: map[string]string{"f": "v", "n": "1000"}},
+		{key: "lz", kind: ZSetRecord, zset: []ZSetMember{{member: "m", score: 1.5}}},
+		{key: "ls", kind: SetRecord, set: []string{"s1"}},
+		{key: "ql", kind: ListRecord, list: []string{"x", "y", "-5000"}},
+		{key: "zm", kind: HashRecord, hash: map[string]string{"k": "v"}},
+		{key: "oz", kind: ZSetRecord, zset: []ZSetMember{{member: "a", score: 2.5}, {member: "b", score: math.Inf(1)}}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("readRDB. want %v, got %v", want, entries)
+	}
+
+	// Encodings that don't add up are rejected
+	corrupt := []byte("REDIS0011")
+	corrupt = append(corrupt, rdbTypeSetIntset, 1, 'i')
+	corrupt = append(corrupt, blob(2, 0, 0, 0, 3, 0, 0, 0, 1, 0)...)
+	if _, err := readRDB(bytes.NewReader(corrupt)); !errors.Is(err, ErrRDBCorrupt) {
+		t.Fatalf("readRDB with a short intset. want ErrRDBCorrupt, got %v", err)
+	}
+}
+
+// Integers in listpacks take the smallest encoding that fits
+func TestListpackIntegers(t *testing.T) {
+	elements := []string{"0", "127", "128", "-4096", "4095", "-32768", "32767", "-8388608", "8388607",
+		"-2147483648", "2147483647", "-9223372036854775808", "9223372036854775807", "007", strings.Repeat("s", 5000)}
+	p := appendListpack(nil, elements)
+	got, err := readListpack(p)
+	if err != nil {
+		t.Fatalf("readListpack. unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, elements) {
+		t.Fatalf("readListpack. want %v, got %v", elements, got)
+	}
+	// 0 to 127 take a byte, and its length another
+	if small := appendListpack(nil, []string{"127"}); !bytes.Equal(small, []byte{9, 0, 0, 0, 1, 0, 127, 1, 0xff}) {
+		t.Fatalf("appendListpack(127). got %v", small)
+	}
+}
+
+func TestSaveCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	h := NewDefaultCommandHandler()
+	h.rdb = newRDBState(path)
+
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "string", "value")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "expiring", "value", "EX", "100")
+	expectResponse(t, h, internal.NewIntData(2), "RPUSH", "list", "a", "b")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SAVE")
+
+	loaded := NewDefaultCommandHandler()
+	loaded.rdb = newRDBState(path)
+	if err := loaded.LoadRDB(); err != nil {
+		t.Fatalf("LoadRDB. unexpected error: %v", err)
+	}
+	expectResponse(t, loaded, internal.NewBulkStringData("value"), "GET", "string")
+	expectResponse(t, loaded, bulkArray("a", "b"), "LRANGE", "list", "0", "-1")
+	if ttl, _ := handle(t, loaded, "TTL", "expiring"); !reflect.DeepEqual(ttl, internal.NewIntData(100)) && !reflect.DeepEqual(ttl, internal.NewIntData(99)) {
+		t.Fatalf("TTL after loading. got %v", ttl)
+	}
+
+	// BGSAVE writes a snapshot taken when it's run
+	expectResponse(t, h, internal.NewSimpleStringData("Background saving started"), "BGSAVE")
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SET", "after", "bgsave")
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.rdb.m.Lock()
+		saving := h.rdb.saving
+		h.rdb.m.Unlock()
+		if !saving {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGSAVE didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := readRDBFile(path)
+	if err != nil {
+		t.Fatalf("readRDBFile. unexpected error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("BGSAVE. saved %d keys, want %d", len(entries), 3)
+	}
+
+	lastSave, _ := handle(t, h, "LASTSAVE")
+	if n, _ := lastSave.GetInt(); time.Since(time.Unix(int64(n), 0)) > time.Minute {
+		t.Fatalf("LASTSAVE. got %d", n)
+	}
+
+	// A missing file loads nothing
+	missing := NewDefaultCommandHandler()
+	missing.rdb = newRDBState(filepath.Join(t.TempDir(), "dump.rdb"))
+	if err := missing.LoadRDB(); err != nil {
+		t.Fatalf("LoadRDB missing file. unexpected error: %v", err)
+	}
+
+	// No temp files are left behind
+	files, _ := os.ReadDir(filepath.Dir(path))
+	if len(files) != 1 {
+		t.Fatalf("files after saving. got %d, want %d", len(files), 1)
+	}
+}
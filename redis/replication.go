@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"myredis/internal"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication. A replica connects to its primary, which sends it a snapshot
+// and then streams the commands it propagates, as they're logged to the
+// AOF. Offsets count the bytes streamed. Replicas ack the offset they've
+// applied, for WAIT, and one that reconnects continues from the backlog of
+// recent bytes with PSYNC, rather than needing another snapshot.
+const (
+	// Bytes of the stream kept for partial resyncs
+	replBacklogSize = 1 << 20
+	// A replica that falls this far behind is dropped, and resyncs once it
+	// times out and reconnects
+	replOutputLimit = 256 << 20
+	// A link with nothing read or written for this long is dropped
+	replTimeout = 60 * time.Second
+	// How often a primary pings its replicas, so they know it's up
+	replPingPeriod = 10 * time.Second
+	// How often a replica acks its offset
+	replAckPeriod = time.Second
+	// How long a replica waits before reconnecting to its primary
+	replRetryDelay = time.Second
+)
+
+var errReadOnly = errors.New("READONLY You can't write against a read only replica.")
+
+// replication is the replication state of the server, both as a primary to
+// its replicas, and as a replica of another server
+type replication struct {
+	// Guards the fields below
+	m sync.Mutex
+	// Identifies the stream, so a replica of another stream can't continue
+	// at its offset
+	id string
+	// Bytes streamed so far
+	offset int64
+	// The offset after the last write streamed. Unlike offset, it doesn't
+	// count pings and GETACKs, so is what WAIT waits for replicas to ack.
+	written int64
+	// The last bytes streamed, ending at offset. Nil until a replica first
+	// connects, as there's no stream to keep until then.
+	backlog []byte
+	// Connected replicas, by client
+	replicas map[*Client]*replica
+	// Closed and replaced when a replica acks, to wake WAIT
+	acked chan struct{}
+
+	// The link to this server's primary. Nil while it's a primary.
+	link *replicaLink
+	// Whether a replica rejects writes from its clients
+	readOnly bool
+}
+
+// replica is a connected replica, as seen by its primary
+type replica struct {
+	client *Client
+	// Streamed bytes yet to be written, and a signal to write them
+	pending []byte
+	wake    chan struct{}
+	// Closed once the replica is removed
+	done chan struct{}
+	// The offset the replica has acked
+	ack int64
+}
+
+// replicaLink is a replica's connection to its primary
+type replicaLink struct {
+	host string
+	port int
+	// Port to tell the primary this server listens on, if known
+	listeningPort int
+	// Stops the link
+	cancel context.CancelFunc
+	// State, as ROLE reports it: connect, connecting, sync or connected
+	state string
+	// The primary's stream, and the offset applied, to continue from with
+	// PSYNC. Empty until the first sync.
+	id     string
+	offset int64
+}
+
+func newReplication() *replication {
+	return &replication{
+		id:       newReplID(),
+		replicas: make(map[*Client]*replica),
+		acked:    make(chan struct{}),
+		readOnly: true,
+	}
+}
+
+// Returns a random stream id, as 40 hex chars like Redis
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Private method to stream commands to replicas. Called under the
+// dictionary write lock, so commands are streamed in the order they were
+// applied.
+func (r *replication) append(commands [][]string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.backlog == nil {
+		return
+	}
+	r.stream(aofCommands(commands))
+	r.written = r.offset
+}
+
+// Private method to add p to the stream. Consumer must acquire lock.
+func (r *replication) stream(p []byte) {
+	r.offset += int64(len(p))
+	r.backlog = append(r.backlog, p...)
+	// Trim only once double the size, so bytes aren't copied on every write
+	if len(r.backlog) > 2*replBacklogSize {
+		r.backlog = append([]byte{}, r.backlog[len(r.backlog)-replBacklogSize:]...)
+	}
+
+	for _, rep := range r.replicas {
+		rep.pending = append(rep.pending, p...)
+		if len(rep.pending) > replOutputLimit {
+			r.removeLocked(rep.client)
+			continue
+		}
+		select {
+		case rep.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Private method to add a replica, which is sent the stream from p on.
+// Consumer must acquire lock.
+func (r *replication) addLocked(client *Client, p []byte) *replica {
+	if r.backlog == nil {
+		r.backlog = []byte{}
+	}
+	rep := &replica{
+		client:  client,
+		pending: append([]byte{}, p...),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	r.replicas[client] = rep
+	return rep
+}
+
+// Private method to remove the replica of client, if it is one
+func (r *replication) remove(client *Client) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.removeLocked(client)
+}
+
+// Private method to remove a replica. Consumer must acquire lock.
+func (r *replication) removeLocked(client *Client) {
+	rep, ok := r.replicas[client]
+	if !ok {
+		return
+	}
+	delete(r.replicas, client)
+	close(rep.done)
+	r.wakeWaiters()
+}
+
+// Private method to wake WAIT. Consumer must acquire lock.
+func (r *replication) wakeWaiters() {
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// Private method to write the stream to a replica until it's removed. A
+// failed write removes it.
+func (r *replication) runReplica(rep *replica) {
+	// The replica is woken for bytes it was added with
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+	for {
+		select {
+		case <-rep.done:
+			return
+		case <-rep.wake:
+		}
+
+		r.m.Lock()
+		p := rep.pending
+		rep.pending = nil
+		r.m.Unlock()
+		if len(p) == 0 {
+			continue
+		}
+		if err := rep.client.SendRaw(p); err != nil {
+			r.remove(rep.client)
+			return
+		}
+	}
+}
+
+// Private method to count the replicas that acked offset
+func (r *replication) ackedCount(offset int64) int {
+	n := 0
+	for _, rep := range r.replicas {
+		if rep.ack >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// Private method to ping replicas periodically, until ctx is done. Pings
+// are part of the stream, so replicas see the primary is up.
+func (r *replication) runPing(ctx context.Context) {
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.m.Lock()
+			if len(r.replicas) > 0 {
+				r.stream(aofCommands([][]string{{"PING"}}))
+			}
+			r.m.Unlock()
+		}
+	}
+}
+
+// Private method to stop the link to the primary, if there is one
+func (r *replication) stopLink() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.link != nil {
+		r.link.cancel()
+		r.link = nil
+	}
+}
+
+// Returns whether writes from client are rejected, as it's a client of a
+// read only replica
+func (r *replication) rejectsWrites(client *Client) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.link != nil && r.readOnly && !client.primary
+}
+
+// Returns whether the server is a replica
+func (r *replication) isReplica() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.link != nil
+}
+
+// Replace swaps every record for entries, as a replica does with the
+// snapshot of a full sync
+func (d *Dictionary) Replace(entries []rdbEntry) {
+	d.Locked(func(tx Dictionary) {
+		for k := range tx.kv {
+			tx.delete(k)
+		}
+		tx.Load(entries)
+	})
+}
+
+// Private method to replicate the primary of link until ctx is done,
+// reconnecting whenever the connection drops
+func (h *DefaultCommandHandler) replicate(ctx context.Context, link *replicaLink) {
+	for {
+		h.syncWithPrimary(ctx, link)
+
+		h.repl.m.Lock()
+		link.state = "connect"
+		h.repl.m.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// Private method to connect to the primary of link, sync with it, and apply
+// the stream until the connection drops or ctx is done
+func (h *DefaultCommandHandler) syncWithPrimary(ctx context.Context, link *replicaLink) error {
+	h.repl.m.Lock()
+	link.state = "connecting"
+	address := net.JoinHostPort(link.host, strconv.Itoa(link.port))
+	listeningPort, id, offset := link.listeningPort, link.id, link.offset
+	h.repl.m.Unlock()
+
+	conn, err := (&net.Dialer{Timeout: replTimeout}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Unblocks reads once the link is stopped
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	counter := &countingReader{r: conn}
+	reader := internal.NewReader(counter, 0)
+	var writeMu sync.Mutex
+	send := func(args ...string) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(replTimeout)); err != nil {
+			return err
+		}
+		_, err := conn.Write(aofCommands([][]string{args}))
+		return err
+	}
+	// Sends a handshake command, and returns the primary's reply
+	request := func(args ...string) (string, error) {
+		if err := send(args...); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		reply, err := reader.ReadData()
+		if err != nil {
+			return "", err
+		}
+		if reply.GetKind() == internal.SimpleErrorKind {
+			return "", fmt.Errorf("%s replied %s", args[0], reply)
+		}
+		return reply.GetString()
+	}
+
+	if _, err := request("PING"); err != nil {
+		return err
+	}
+	if listeningPort > 0 {
+		if _, err := request("REPLCONF", "listening-port", strconv.Itoa(listeningPort)); err != nil {
+			return err
+		}
+	}
+	if _, err := request("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	psync := []string{"PSYNC", "?", "-1"}
+	if id != "" {
+		psync = []string{"PSYNC", id, strconv.FormatInt(offset+1, 10)}
+	}
+	reply, err := request(psync...)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		id = fields[1]
+		if offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
+		}
+		h.repl.m.Lock()
+		link.state = "sync"
+		h.repl.m.Unlock()
+
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		snapshot, err := reader.ReadSnapshot()
+		if err != nil {
+			return err
+		}
+		entries, err := readRDB(bytes.NewReader(snapshot))
+		if err != nil {
+			return err
+		}
+		h.dict.Replace(entries)
+		// The snapshot isn't logged as commands, so the AOF is rewritten
+		// to hold it
+		if h.aof.enabled() {
+			h.handleBgrewriteaofCommand(nil)
+		}
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		// The primary may continue under a new id, after a failover
+		if len(fields) == 2 {
+			id = fields[1]
+		}
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", reply)
+	}
+
+	h.repl.m.Lock()
+	link.state, link.id, link.offset = "connected", id, offset
+	h.repl.m.Unlock()
+
+	// Offset of the stream's first byte in what's been read
+	start := counter.n - int64(reader.Buffered())
+	ack := func() error {
+		h.repl.m.Lock()
+		offset := link.offset
+		h.repl.m.Unlock()
+		return send("REPLCONF", "ACK", strconv.FormatInt(offset, 10))
+	}
+	go func() {
+		ticker := time.NewTicker(replAckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if ack() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	client := NewClient()
+	client.primary = true
+	clientCtx := withClient(ctx, client)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		data, err := reader.ReadData()
+		if err != nil {
+			return err
+		}
+		command, err := data.GetArray()
+		if err != nil || len(command) == 0 {
+			return fmt.Errorf("invalid command in replication stream")
+		}
+		args, err := stringArgs(command)
+		if err != nil {
+			return fmt.Errorf("invalid command in replication stream")
+		}
+
+		// GETACK is answered with the offset before it
+		name := strings.ToUpper(args[0])
+		if name == "REPLCONF" && len(args) == 3 && strings.EqualFold(args[1], "GETACK") {
+			if err := ack(); err != nil {
+				return err
+			}
+		} else if name != "REPLCONF" {
+			// Only commands that succeeded on the primary are streamed, and
+			// the replica starts from a snapshot of the same records, so
+			// replies are ignored
+			h.Handle(clientCtx, name, command[1:])
+		}
+
+		h.repl.m.Lock()
+		link.offset = offset + counter.n - int64(reader.Buffered()) - start
+		h.repl.m.Unlock()
+	}
+}
+
+// REPLICAOF host port | NO ONE. Also run as SLAVEOF.
+func (h *DefaultCommandHandler) handleReplicaofCommand(ctx context.Context, command string, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	host := strs[0]
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(strs[1], "one") {
+		h.repl.m.Lock()
+		defer h.repl.m.Unlock()
+		if h.repl.link != nil {
+			h.repl.link.cancel()
+			h.repl.link = nil
+			// The stream diverges from the primary's from here
+			h.repl.id = newReplID()
+		}
+		return internal.NewSimpleStringData("OK"), nil
+	}
+
+	port, err := strconv.Atoi(strs[1])
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("ERR Invalid master port")
+	}
+	listeningPort := 0
+	if _, p, err := net.SplitHostPort(clientFromContext(ctx).laddr); err == nil {
+		listeningPort, _ = strconv.Atoi(p)
+	}
+
+	h.repl.m.Lock()
+	defer h.repl.m.Unlock()
+	if link := h.repl.link; link != nil {
+		if link.host == host && link.port == port {
+			return internal.NewSimpleStringData("OK Already connected to specified master"), nil
+		}
+		link.cancel()
+	}
+	linkCtx, cancel := context.WithCancel(context.Background())
+	link := &replicaLink{host: host, port: port, listeningPort: listeningPort, cancel: cancel, state: "connect"}
+	h.repl.link = link
+	go h.replicate(linkCtx, link)
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// PSYNC replicationid offset. Continues the stream from offset if it's
+// still in the backlog, and otherwise sends a snapshot and streams from
+// there. The connection is a replica from then on. A replica streams the
+// writes it applies, so replicas may be chained.
+func (h *DefaultCommandHandler) handlePsyncCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("PSYNC")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	client := clientFromContext(ctx)
+
+	// The offset asked for is that of the next byte wanted, counting from 1
+	if next, err := strconv.ParseInt(strs[1], 10, 64); err == nil {
+		h.repl.m.Lock()
+		start := h.repl.offset - int64(len(h.repl.backlog))
+		if h.repl.backlog != nil && strs[0] == h.repl.id && next > start && next <= h.repl.offset+1 {
+			rep := h.repl.addLocked(client, h.repl.backlog[next-1-start:])
+			id := h.repl.id
+			h.repl.m.Unlock()
+
+			if err := client.Send(internal.NewSimpleStringData("CONTINUE " + id)); err != nil {
+				return nil, err
+			}
+			go h.repl.runReplica(rep)
+			return nil, nil
+		}
+		h.repl.m.Unlock()
+	}
+
+	// The snapshot and the stream start at the same point, as writes are
+	// streamed under the dictionary lock
+	var entries []rdbEntry
+	var rep *replica
+	var id string
+	var offset int64
+	h.dict.Locked(func(tx Dictionary) {
+		entries = tx.Snapshot()
+		h.repl.m.Lock()
+		defer h.repl.m.Unlock()
+		rep = h.repl.addLocked(client, nil)
+		id, offset = h.repl.id, h.repl.offset
+	})
+
+	var buf bytes.Buffer
+	writeRDB(&buf, entries, time.Now())
+	reply := internal.NewSimpleStringData(fmt.Sprintf("FULLRESYNC %s %d", id, offset))
+	if err := client.Send(reply); err != nil {
+		return nil, err
+	}
+	if err := client.SendRaw(append(fmt.Appendf(nil, "$%d\r\n", buf.Len()), buf.Bytes()...)); err != nil {
+		return nil, err
+	}
+	go h.repl.runReplica(rep)
+	return nil, nil
+}
+
+// REPLCONF option value [option value ...]. Sent by replicas, to configure
+// the link, and to ack their offset.
+func (h *DefaultCommandHandler) handleReplconfCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errWrongNumberOfArgs("REPLCONF")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	client := clientFromContext(ctx)
+
+	for i := 0; i < len(strs); i += 2 {
+		switch strings.ToLower(strs[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(strs[i+1])
+			if err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("ERR Invalid listening port")
+			}
+			client.listeningPort = port
+		case "capa":
+			// Every capability is supported
+		case "ack":
+			// Acks get no reply
+			offset, err := strconv.ParseInt(strs[i+1], 10, 64)
+			if err != nil {
+				return nil, nil
+			}
+			h.repl.m.Lock()
+			if rep, ok := h.repl.replicas[client]; ok && offset > rep.ack {
+				rep.ack = offset
+				h.repl.wakeWaiters()
+			}
+			h.repl.m.Unlock()
+			return nil, nil
+		case "getack":
+			// Only answered by a replica, to its primary
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("ERR Unrecognized REPLCONF option: %s", strs[i])
+		}
+	}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// WAIT numreplicas timeout. Blocks until numreplicas replicas ack every
+// write streamed so far, or timeout ms pass, with 0 blocking forever.
+// Replies with the number that acked.
+func (h *DefaultCommandHandler) handleWaitCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("WAIT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strs[0])
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	timeout, err := strconv.ParseInt(strs[1], 10, 64)
+	if err != nil {
+		return nil, ErrNotInteger
+	}
+	if timeout < 0 {
+		return nil, fmt.Errorf("ERR timeout is negative")
+	}
+	if h.repl.isReplica() {
+		return nil, fmt.Errorf("ERR WAIT cannot be used with replica instances.")
+	}
+	// Run by EXEC, WAIT holds the dictionary lock, so can't block. As Redis
+	// does for clients that can't block, it replies with the replicas that
+	// have acked already.
+	if _, nested := h.dict.m.(heldLock); nested {
+		h.repl.m.Lock()
+		defer h.repl.m.Unlock()
+		return internal.NewIntData(h.repl.ackedCount(h.repl.written)), nil
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	h.repl.m.Lock()
+	target := h.repl.written
+	count := h.repl.ackedCount(target)
+	if count < n && count < len(h.repl.replicas) {
+		// Replicas behind are asked to ack now, rather than in up to a second
+		h.repl.stream(aofCommands([][]string{{"REPLCONF", "GETACK", "*"}}))
+	}
+	for count < n {
+		acked := h.repl.acked
+		h.repl.m.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			h.repl.m.Lock()
+			count = h.repl.ackedCount(target)
+			h.repl.m.Unlock()
+			return internal.NewIntData(count), nil
+		case <-acked:
+		}
+
+		h.repl.m.Lock()
+		count = h.repl.ackedCount(target)
+	}
+	h.repl.m.Unlock()
+	return internal.NewIntData(count), nil
+}
+
+// ROLE
+func (h *DefaultCommandHandler) handleRoleCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("ROLE")
+	}
+
+	h.repl.m.Lock()
+	defer h.repl.m.Unlock()
+	if link := h.repl.link; link != nil {
+		offset := int64(-1)
+		if link.id != "" {
+			offset = link.offset
+		}
+		return internal.NewArrayData([]internal.Data{
+			*internal.NewBulkStringData("slave"),
+			*internal.NewBulkStringData(link.host),
+			*internal.NewIntData(link.port),
+			*internal.NewBulkStringData(link.state),
+			*internal.NewIntData(int(offset)),
+		}), nil
+	}
+
+	replicas := make([]internal.Data, 0, len(h.repl.replicas))
+	for client, rep := range h.repl.replicas {
+		host, _, _ := net.SplitHostPort(client.addr)
+		replicas = append(replicas, *internal.NewArrayData(bulkStrings([]string{
+			host,
+			strconv.Itoa(client.listeningPort),
+			strconv.FormatInt(rep.ack, 10),
+		})))
+	}
+	return internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData("master"),
+		*internal.NewIntData(int(h.repl.offset)),
+		*internal.NewArrayData(replicas),
+	}), nil
+}
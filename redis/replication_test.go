@@ -0,0 +1,218 @@
+package main
+
+import (
+	"myredis/internal"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects to the server at addr
+func dialTestServer(t *testing.T, addr string) (net.Conn, *internal.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, internal.NewReader(conn, 0)
+}
+
+// Sends a command until it replies want, failing after a few seconds
+func waitForReply(t *testing.T, conn net.Conn, reader *internal.Reader, want *internal.Data, args ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := sendCommand(t, conn, reader, args...)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v. want %v, got %v", args, want, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primaryAddr := startTestServer(t)
+	replicaAddr := startTestServer(t)
+	primary, primaryReader := dialTestServer(t, primaryAddr)
+	replica, replicaReader := dialTestServer(t, replicaAddr)
+
+	// Records written before the replica connects come with the snapshot
+	sendCommand(t, primary, primaryReader, "SET", "string", "value")
+	sendCommand(t, primary, primaryReader, "HSET", "hash", "field", "value")
+	sendCommand(t, primary, primaryReader, "RPUSH", "list", "a", "b")
+	sendCommand(t, primary, primaryReader, "XADD", "stream", "1-1", "field", "value")
+	sendCommand(t, primary, primaryReader, "XGROUP", "CREATE", "stream", "group", "0")
+	sendCommand(t, primary, primaryReader, "XREADGROUP", "GROUP", "group", "consumer", "STREAMS", "stream", ">")
+	sendCommand(t, replica, replicaReader, "SET", "stale", "value")
+
+	host, port, _ := net.SplitHostPort(primaryAddr)
+	if got := sendCommand(t, replica, replicaReader, "REPLICAOF", host, port); !reflect.DeepEqual(got, internal.NewSimpleStringData("OK")) {
+		t.Fatalf("REPLICAOF. want OK, got %v", got)
+	}
+	waitForReply(t, replica, replicaReader, internal.NewBulkStringData("value"), "GET", "string")
+	if got := sendCommand(t, replica, replicaReader, "HGET", "hash", "field"); !reflect.DeepEqual(got, internal.NewBulkStringData("value")) {
+		t.Fatalf("HGET after sync. want value, got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "LRANGE", "list", "0", "-1"); !reflect.DeepEqual(got, bulkArray("a", "b")) {
+		t.Fatalf("LRANGE after sync. want [a b], got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "XRANGE", "stream", "-", "+"); !reflect.DeepEqual(got, streamEntries([]string{"1-1", "field", "value"})) {
+		t.Fatalf("XRANGE after sync. want 1-1, got %v", got)
+	}
+	wantPending := internal.NewArrayData([]internal.Data{
+		*internal.NewIntData(1), *internal.NewBulkStringData("1-1"), *internal.NewBulkStringData("1-1"),
+		*internal.NewArrayData([]internal.Data{*bulkArray("consumer", "1")}),
+	})
+	if got := sendCommand(t, replica, replicaReader, "XPENDING", "stream", "group"); !reflect.DeepEqual(got, wantPending) {
+		t.Fatalf("XPENDING after sync. want %v, got %v", wantPending, got)
+	}
+	// The snapshot replaces what the replica had
+	if got := sendCommand(t, replica, replicaReader, "EXISTS", "stale"); !reflect.DeepEqual(got, internal.NewIntData(0)) {
+		t.Fatalf("EXISTS after sync. want 0, got %v", got)
+	}
+
+	// Writes are streamed, and WAIT returns once the replica acks them
+	sendCommand(t, primary, primaryReader, "SET", "streamed", "value", "EX", "100")
+	sendCommand(t, primary, primaryReader, "INCR", "counter")
+	sendCommand(t, primary, primaryReader, "XADD", "stream", "2-1", "field", "streamed")
+	if got := sendCommand(t, primary, primaryReader, "WAIT", "1", "5000"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("WAIT. want 1, got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "GET", "streamed"); !reflect.DeepEqual(got, internal.NewBulkStringData("value")) {
+		t.Fatalf("GET after WAIT. want value, got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "GET", "counter"); !reflect.DeepEqual(got, internal.NewBulkStringData("1")) {
+		t.Fatalf("GET after WAIT. want 1, got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "XLEN", "stream"); !reflect.DeepEqual(got, internal.NewIntData(2)) {
+		t.Fatalf("XLEN after WAIT. want 2, got %v", got)
+	}
+	// Messages published on the primary reach subscribers of the replica
+	subscriber, subscriberReader := dialTestServer(t, replicaAddr)
+	sendCommand(t, subscriber, subscriberReader, "SUBSCRIBE", "news")
+	sendCommand(t, primary, primaryReader, "PUBLISH", "news", "hello")
+	subscriber.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectMessage(t, subscriberReader, bulkArray("message", "news", "hello"))
+
+	// With fewer replicas than asked for, WAIT times out with those that acked
+	if got := sendCommand(t, primary, primaryReader, "WAIT", "2", "50"); !reflect.DeepEqual(got, internal.NewIntData(1)) {
+		t.Fatalf("WAIT for 2. want 1, got %v", got)
+	}
+	// In a transaction WAIT can't block the other clients, so replies with
+	// the replicas that acked already
+	sendCommand(t, primary, primaryReader, "MULTI")
+	sendCommand(t, primary, primaryReader, "WAIT", "2", "0")
+	primary.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got := sendCommand(t, primary, primaryReader, "EXEC"); !reflect.DeepEqual(got, internal.NewArrayData([]internal.Data{*internal.NewIntData(1)})) {
+		t.Fatalf("WAIT in MULTI. want [1], got %v", got)
+	}
+	primary.SetReadDeadline(time.Time{})
+
+	// Replicas are read only
+	if got := sendCommand(t, replica, replicaReader, "SET", "key", "value"); !reflect.DeepEqual(got, internal.NewSimpleError(errReadOnly.Error())) {
+		t.Fatalf("SET on replica. want READONLY, got %v", got)
+	}
+	sendCommand(t, replica, replicaReader, "MULTI")
+	sendCommand(t, replica, replicaReader, "DEL", "string")
+	if got := sendCommand(t, replica, replicaReader, "EXEC"); got.GetKind() != internal.SimpleErrorKind || !strings.HasPrefix(mustString(t, got), "EXECABORT") {
+		t.Fatalf("EXEC with write on replica. want EXECABORT, got %v", got)
+	}
+
+	role := sendCommand(t, replica, replicaReader, "ROLE")
+	fields, _ := role.GetArray()
+	if len(fields) != 5 || mustString(t, &fields[0]) != "slave" || mustString(t, &fields[3]) != "connected" {
+		t.Fatalf("ROLE on replica. got %v", role)
+	}
+	role = sendCommand(t, primary, primaryReader, "ROLE")
+	fields, _ = role.GetArray()
+	if len(fields) != 3 || mustString(t, &fields[0]) != "master" {
+		t.Fatalf("ROLE on primary. got %v", role)
+	}
+	if replicas, _ := fields[2].GetArray(); len(replicas) != 1 {
+		t.Fatalf("ROLE on primary. want 1 replica, got %v", fields[2])
+	}
+
+	// Promoted, the replica takes writes, and no longer follows the primary
+	if got := sendCommand(t, replica, replicaReader, "SLAVEOF", "NO", "ONE"); !reflect.DeepEqual(got, internal.NewSimpleStringData("OK")) {
+		t.Fatalf("SLAVEOF NO ONE. want OK, got %v", got)
+	}
+	if got := sendCommand(t, replica, replicaReader, "SET", "key", "value"); !reflect.DeepEqual(got, internal.NewSimpleStringData("OK")) {
+		t.Fatalf("SET after promotion. want OK, got %v", got)
+	}
+	waitForReply(t, primary, primaryReader, internal.NewIntData(0), "WAIT", "1", "10")
+}
+
+// Runs PSYNC on conn, returning the reply
+func psync(t *testing.T, conn net.Conn, reader *internal.Reader, id string, offset int64) []string {
+	t.Helper()
+	reply := sendCommand(t, conn, reader, "PSYNC", id, strconv.FormatInt(offset, 10))
+	s, err := reply.GetString()
+	if err != nil || reply.GetKind() != internal.SimpleStringKind {
+		t.Fatalf("PSYNC. want simple string, got %v", reply)
+	}
+	return strings.Fields(s)
+}
+
+// Reads the next command in a replication stream
+func expectStreamed(t *testing.T, reader *internal.Reader, want ...string) int64 {
+	t.Helper()
+	got, err := reader.ReadData()
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if !reflect.DeepEqual(got, bulkArray(want...)) {
+		t.Fatalf("stream. want %v, got %v", want, got)
+	}
+	serialized, _ := internal.Serialize(*got)
+	return int64(len(serialized))
+}
+
+func TestPartialResync(t *testing.T) {
+	addr := startTestServer(t)
+	client, clientReader := dialTestServer(t, addr)
+	first, firstReader := dialTestServer(t, addr)
+
+	fields := psync(t, first, firstReader, "?", -1)
+	if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		t.Fatalf("PSYNC ? -1. want FULLRESYNC, got %v", fields)
+	}
+	id := fields[1]
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	snapshot, err := firstReader.ReadSnapshot()
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	if !strings.HasPrefix(string(snapshot), "REDIS0009") {
+		t.Fatalf("snapshot. want RDB, got %q", snapshot)
+	}
+
+	sendCommand(t, client, clientReader, "SET", "a", "1")
+	offset += expectStreamed(t, firstReader, "SET", "a", "1")
+	first.Close()
+	sendCommand(t, client, clientReader, "SET", "b", "2")
+
+	// A replica that reconnects continues where it left off
+	second, secondReader := dialTestServer(t, addr)
+	fields = psync(t, second, secondReader, id, offset+1)
+	if !reflect.DeepEqual(fields, []string{"CONTINUE", id}) {
+		t.Fatalf("PSYNC at offset. want CONTINUE %s, got %v", id, fields)
+	}
+	expectStreamed(t, secondReader, "SET", "b", "2")
+
+	// Offsets of another stream, or past the backlog, need a full sync
+	third, thirdReader := dialTestServer(t, addr)
+	if fields := psync(t, third, thirdReader, "0000000000000000000000000000000000000000", offset+1); fields[0] != "FULLRESYNC" {
+		t.Fatalf("PSYNC with another id. want FULLRESYNC, got %v", fields)
+	}
+	fourth, fourthReader := dialTestServer(t, addr)
+	if fields := psync(t, fourth, fourthReader, id, offset+1000); fields[0] != "FULLRESYNC" {
+		t.Fatalf("PSYNC past the backlog. want FULLRESYNC, got %v", fields)
+	}
+}
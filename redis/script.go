@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"myredis/internal"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+// scriptCache holds compiled scripts by the SHA1 of their body
+type scriptCache struct {
+	m       sync.Mutex
+	scripts map[string]*lua.FunctionProto
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{scripts: make(map[string]*lua.FunctionProto)}
+}
+
+// Returns the hex SHA1 of body, by which scripts are known
+func scriptSHA(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Private method to compile body, and cache it. Returns its SHA1.
+func (c *scriptCache) load(body string) (string, *lua.FunctionProto, error) {
+	sha := scriptSHA(body)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if proto, ok := c.scripts[sha]; ok {
+		return sha, proto, nil
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(body), "@user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("ERR Error compiling script (new function): %s", err)
+	}
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("ERR Error compiling script (new function): %s", err)
+	}
+	c.scripts[sha] = proto
+	return sha, proto, nil
+}
+
+// Private method to get a cached script
+func (c *scriptCache) get(sha string) (*lua.FunctionProto, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	proto, ok := c.scripts[strings.ToLower(sha)]
+	return proto, ok
+}
+
+// Converts a reply to a Lua value, as Redis does for RESP2. Status and
+// error replies become tables with an ok or err field, and null becomes
+// false.
+func dataToLua(L *lua.LState, data *internal.Data) lua.LValue {
+	switch data.GetKind() {
+	case internal.IntKind:
+		i, _ := data.GetInt()
+		return lua.LNumber(i)
+	case internal.BulkStringKind:
+		s, _ := data.GetString()
+		return lua.LString(s)
+	case internal.SimpleStringKind:
+		s, _ := data.GetString()
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(s))
+		return t
+	case internal.SimpleErrorKind, internal.BulkErrorKind:
+		s, _ := data.GetString()
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(s))
+		return t
+	case internal.ArrayKind, internal.SetKind, internal.PushKind:
+		var elements []internal.Data
+		switch data.GetKind() {
+		case internal.ArrayKind:
+			elements, _ = data.GetArray()
+		case internal.SetKind:
+			elements, _ = data.GetSet()
+		default:
+			elements, _ = data.GetPush()
+		}
+		t := L.CreateTable(len(elements), 0)
+		for i := range elements {
+			t.Append(dataToLua(L, &elements[i]))
+		}
+		return t
+	case internal.MapKind:
+		// Flattened to keys and values, as RESP2 clients get maps
+		m, _ := data.GetMap()
+		t := L.CreateTable(2*len(m), 0)
+		for k, v := range m {
+			t.Append(dataToLua(L, &k))
+			t.Append(dataToLua(L, &v))
+		}
+		return t
+	case internal.BooleanKind:
+		if b, _ := data.GetBool(); b {
+			return lua.LNumber(1)
+		}
+		return lua.LFalse
+	case internal.DoubleKind:
+		f, _ := data.GetDouble()
+		return lua.LString(formatFloat(f))
+	case internal.BigNumberKind:
+		n, _ := data.GetBigNumber()
+		return lua.LString(n.String())
+	case internal.VerbatimStringKind:
+		v, _ := data.GetVerbatim()
+		return lua.LString(v.Text)
+	case internal.AttributeKind:
+		a, _ := data.GetAttribute()
+		return dataToLua(L, &a.Value)
+	default:
+		return lua.LFalse
+	}
+}
+
+// Converts a value returned by a script to a reply, as Redis does. Numbers
+// are truncated to integers, and an array table ends at its first nil.
+func luaToData(v lua.LValue) *internal.Data {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return internal.NewIntData(int(math.Trunc(float64(v))))
+	case lua.LString:
+		return internal.NewBulkStringData(string(v))
+	case lua.LBool:
+		if v {
+			return internal.NewIntData(1)
+		}
+		return internal.NewNullData()
+	case *lua.LTable:
+		if err, ok := v.RawGetString("err").(lua.LString); ok {
+			return internal.NewSimpleError(string(err))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return internal.NewSimpleStringData(string(status))
+		}
+		var elements []internal.Data
+		for i := 1; ; i++ {
+			element := v.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			elements = append(elements, *luaToData(element))
+		}
+		return internal.NewArrayData(elements)
+	default:
+		return internal.NewNullData()
+	}
+}
+
+// Private method to run a command for redis.call and redis.pcall. Returns
+// the reply, or the error as an err table.
+func (h *DefaultCommandHandler) scriptCall(ctx context.Context, L *lua.LState) (lua.LValue, bool) {
+	errorTable := func(msg string) (lua.LValue, bool) {
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(msg))
+		return t, false
+	}
+
+	n := L.GetTop()
+	if n == 0 {
+		return errorTable("ERR Please specify at least one argument for this redis lib call")
+	}
+	args := make([]internal.Data, n)
+	for i := range n {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = *internal.NewBulkStringData(string(v))
+		case lua.LNumber:
+			args[i] = *internal.NewBulkStringData(strconv.FormatFloat(float64(v), 'g', 17, 64))
+		default:
+			return errorTable("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	name, _ := args[0].GetString()
+	name = strings.ToUpper(name)
+	spec, ok := commands[name]
+	if !ok {
+		return errorTable("ERR Unknown Redis command called from script")
+	}
+	// Some commands would break atomicity, or reply outside the script
+	if spec.is(flagNoScript) {
+		return errorTable("ERR This Redis command is not allowed from script")
+	}
+	if _, err := checkCommand(name, args[1:]); err != nil {
+		return errorTable(err.Error())
+	}
+	// Scripts run commands as their caller's user
+	if client := clientFromContext(ctx); client.user != "" {
+		if err := h.acl.check(client, spec, args[1:]); err != nil {
+			return errorTable(err.Error())
+		}
+	}
+
+	reply, err := h.Handle(ctx, name, args[1:])
+	if err != nil {
+		return errorTable(err.Error())
+	}
+	return dataToLua(L, reply), true
+}
+
+// Private method to run a compiled script with keys and argv, under the
+// dictionary lock so it's atomic
+func (h *DefaultCommandHandler) runScript(ctx context.Context, sha string, proto *lua.FunctionProto, keys []string, argv []string) (*internal.Data, error) {
+	// Scripts call commands as a RESP2 client of their own, with the
+	// caller's user and right to write to a replica
+	caller := clientFromContext(ctx)
+	client := NewClient()
+	client.primary, client.user = caller.primary, caller.user
+	scriptCtx := withClient(ctx, client)
+
+	var response *internal.Data
+	var err error
+	h.dict.Atomically(func(tx Dictionary) {
+		txHandler := *h
+		txHandler.dict = tx
+
+		L := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer L.Close()
+		L.SetContext(ctx)
+		openScriptLibs(L)
+
+		redis := L.NewTable()
+		L.SetFuncs(redis, map[string]lua.LGFunction{
+			// Errors are raised as err tables, so they keep their code
+			"call": func(L *lua.LState) int {
+				reply, ok := txHandler.scriptCall(scriptCtx, L)
+				if !ok {
+					L.Error(reply, 1)
+				}
+				L.Push(reply)
+				return 1
+			},
+			"pcall": func(L *lua.LState) int {
+				reply, _ := txHandler.scriptCall(scriptCtx, L)
+				L.Push(reply)
+				return 1
+			},
+			"error_reply": func(L *lua.LState) int {
+				t := L.NewTable()
+				t.RawSetString("err", lua.LString(L.CheckString(1)))
+				L.Push(t)
+				return 1
+			},
+			"status_reply": func(L *lua.LState) int {
+				t := L.NewTable()
+				t.RawSetString("ok", lua.LString(L.CheckString(1)))
+				L.Push(t)
+				return 1
+			},
+			"sha1hex": func(L *lua.LState) int {
+				L.Push(lua.LString(scriptSHA(L.CheckString(1))))
+				return 1
+			},
+		})
+		L.SetGlobal("redis", redis)
+		L.SetGlobal("KEYS", stringsTable(L, keys))
+		L.SetGlobal("ARGV", stringsTable(L, argv))
+
+		L.Push(L.NewFunctionFromProto(proto))
+		if callErr := L.PCall(0, 1, nil); callErr != nil {
+			err = scriptError(sha, callErr)
+			return
+		}
+		response = luaToData(L.Get(-1))
+	})
+	return response, err
+}
+
+// Opens the libraries scripts may use. Loading code from files isn't
+// allowed.
+func openScriptLibs(L *lua.LState) {
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+}
+
+func stringsTable(L *lua.LState, strs []string) *lua.LTable {
+	t := L.CreateTable(len(strs), 0)
+	for _, s := range strs {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+// Returns the error a failed script replies with. An error raised by
+// redis.call keeps the command's error.
+func scriptError(sha string, err error) error {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		if t, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := t.RawGetString("err").(lua.LString); ok {
+				return errors.New(string(msg))
+			}
+		}
+		return fmt.Errorf("ERR Error running script (call to f_%s): %s", sha, apiErr.Object)
+	}
+	return fmt.Errorf("ERR Error running script (call to f_%s): %s", sha, err)
+}
+
+// Private method to parse numkeys key [key ...] arg [arg ...]
+func parseScriptArgs(strs []string) (keys []string, argv []string, err error) {
+	numKeys, err := strconv.Atoi(strs[0])
+	if err != nil {
+		return nil, nil, ErrNotInteger
+	}
+	if numKeys < 0 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(strs)-1 {
+		return nil, nil, fmt.Errorf("ERR Number of keys can't be greater than number of args")
+	}
+	return strs[1 : 1+numKeys], strs[1+numKeys:], nil
+}
+
+// EVAL script numkeys [key ...] [arg ...]
+func (h *DefaultCommandHandler) handleEvalCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("EVAL")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	keys, argv, err := parseScriptArgs(strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	sha, proto, err := h.scripts.load(strs[0])
+	if err != nil {
+		return nil, err
+	}
+	return h.runScript(ctx, sha, proto, keys, argv)
+}
+
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+func (h *DefaultCommandHandler) handleEvalshaCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("EVALSHA")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	keys, argv, err := parseScriptArgs(strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	proto, ok := h.scripts.get(strs[0])
+	if !ok {
+		return nil, errNoScript
+	}
+	return h.runScript(ctx, strings.ToLower(strs[0]), proto, keys, argv)
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC | SYNC]
+func (h *DefaultCommandHandler) handleScriptCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("SCRIPT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	subcommand := strings.ToUpper(strs[0])
+	switch {
+	case subcommand == "LOAD" && len(strs) == 2:
+		sha, _, err := h.scripts.load(strs[1])
+		if err != nil {
+			return nil, err
+		}
+		return internal.NewBulkStringData(sha), nil
+	case subcommand == "EXISTS" && len(strs) >= 2:
+		data := make([]internal.Data, len(strs)-1)
+		for i, sha := range strs[1:] {
+			if _, ok := h.scripts.get(sha); ok {
+				data[i] = *internal.NewIntData(1)
+			} else {
+				data[i] = *internal.NewIntData(0)
+			}
+		}
+		return internal.NewArrayData(data), nil
+	case subcommand == "FLUSH" && len(strs) <= 2:
+		if len(strs) == 2 && !strings.EqualFold(strs[1], "ASYNC") && !strings.EqualFold(strs[1], "SYNC") {
+			return nil, fmt.Errorf("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+		h.scripts.m.Lock()
+		clear(h.scripts.scripts)
+		h.scripts.m.Unlock()
+		return internal.NewSimpleStringData("OK"), nil
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try SCRIPT HELP.", strs[0])
+	}
+}
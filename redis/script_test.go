@@ -0,0 +1,150 @@
+package main
+
+import (
+	"myredis/internal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEvalConversions(t *testing.T) {
+	h := NewDefaultCommandHandler()
+
+	// Lua values to replies
+	expectResponse(t, h, internal.NewIntData(3), "EVAL", "return 3.99", "0")
+	expectResponse(t, h, internal.NewBulkStringData("s"), "EVAL", "return 's'", "0")
+	expectResponse(t, h, internal.NewIntData(1), "EVAL", "return true", "0")
+	expectResponse(t, h, internal.NewNullData(), "EVAL", "return false", "0")
+	expectResponse(t, h, internal.NewNullData(), "EVAL", "return nil", "0")
+	expectResponse(t, h, internal.NewSimpleStringData("FINE"), "EVAL", "return {ok='FINE'}", "0")
+	expectResponse(t, h, internal.NewSimpleStringData("FINE"), "EVAL", "return redis.status_reply('FINE')", "0")
+	expectResponse(t, h, internal.NewSimpleError("MY error"), "EVAL", "return redis.error_reply('MY error')", "0")
+	// An array ends at its first nil
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{
+		*internal.NewIntData(1),
+		*internal.NewBulkStringData("two"),
+		*internal.NewArrayData([]internal.Data{*internal.NewIntData(3)}),
+	}), "EVAL", "return {1, 'two', {3}, nil, 5}", "0")
+
+	// Replies to Lua values
+	h.dict.Set("string", "value")
+	expectResponse(t, h, internal.NewBulkStringData("string"), "EVAL", "return type(redis.call('GET', KEYS[1]))", "1", "string")
+	expectResponse(t, h, internal.NewBulkStringData("boolean"), "EVAL", "return type(redis.call('GET', 'missing'))", "0")
+	expectResponse(t, h, internal.NewBulkStringData("number"), "EVAL", "return type(redis.call('EXISTS', 'string'))", "0")
+	expectResponse(t, h, internal.NewBulkStringData("OK"), "EVAL", "return redis.call('SET', 'k', 'v')['ok']", "0")
+	expectResponse(t, h, internal.NewBulkStringData("WRONGTYPE"), "EVAL", "return string.sub(redis.pcall('LPUSH', 'string', 'x')['err'], 1, 9)", "0")
+	h.dict.RightPushList("list", []string{"a", "b"})
+	expectResponse(t, h, bulkArray("a", "b"), "EVAL", "return redis.call('LRANGE', 'list', 0, -1)", "0")
+
+	expectResponse(t, h, bulkArray("k1", "k2", "a1"), "EVAL", "return {KEYS[1], KEYS[2], ARGV[1]}", "2", "k1", "k2", "a1")
+	expectResponse(t, h, internal.NewBulkStringData(scriptSHA("x")), "EVAL", "return redis.sha1hex('x')", "0")
+}
+
+func TestEvalErrors(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	h.dict.Set("string", "value")
+
+	expectError(t, h, "ERR Number of keys can't be greater than number of args", "EVAL", "return 1", "2", "k")
+	expectError(t, h, "ERR Number of keys can't be negative", "EVAL", "return 1", "-1")
+	expectError(t, h, ErrNotInteger.Error(), "EVAL", "return 1", "x")
+
+	// Errors from redis.call keep the command's error
+	expectError(t, h, ErrWrongType.Error(), "EVAL", "return redis.call('LPUSH', 'string', 'x')", "0")
+	expectError(t, h, "ERR Unknown Redis command called from script", "EVAL", "return redis.call('NOPE')", "0")
+	expectError(t, h, "ERR This Redis command is not allowed from script", "EVAL", "return redis.call('MULTI')", "0")
+	expectError(t, h, "ERR wrong number of arguments for 'get' command", "EVAL", "return redis.call('GET')", "0")
+	expectError(t, h, "ERR Lua redis lib command arguments must be strings or integers", "EVAL", "return redis.call('GET', {})", "0")
+
+	_, err := handle(t, h, "EVAL", "return +", "0")
+	if err == nil || !strings.HasPrefix(err.Error(), "ERR Error compiling script") {
+		t.Fatalf("EVAL with syntax error. want compile error, got %v", err)
+	}
+	_, err = handle(t, h, "EVAL", "error('boom')", "0")
+	if err == nil || !strings.HasPrefix(err.Error(), "ERR Error running script") || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("EVAL raising an error. want run error, got %v", err)
+	}
+	// Files can't be loaded
+	if _, err := handle(t, h, "EVAL", "return dofile('/etc/passwd')", "0"); err == nil {
+		t.Fatalf("EVAL calling dofile. want error, got nil")
+	}
+}
+
+func TestScriptCommands(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	body := "return redis.call('INCR', KEYS[1])"
+	sha := scriptSHA(body)
+
+	expectError(t, h, errNoScript.Error(), "EVALSHA", sha, "1", "counter")
+	expectResponse(t, h, internal.NewBulkStringData(sha), "SCRIPT", "LOAD", body)
+	expectResponse(t, h, internal.NewArrayData([]internal.Data{*internal.NewIntData(1), *internal.NewIntData(0)}), "SCRIPT", "EXISTS", sha, "ffff")
+	expectResponse(t, h, internal.NewIntData(1), "EVALSHA", sha, "1", "counter")
+	expectResponse(t, h, internal.NewIntData(2), "EVALSHA", strings.ToUpper(sha), "1", "counter")
+
+	expectResponse(t, h, internal.NewSimpleStringData("OK"), "SCRIPT", "FLUSH")
+	expectError(t, h, errNoScript.Error(), "EVALSHA", sha, "1", "counter")
+	// EVAL caches the script too
+	expectResponse(t, h, internal.NewIntData(3), "EVAL", body, "1", "counter")
+	expectResponse(t, h, internal.NewIntData(4), "EVALSHA", sha, "1", "counter")
+	expectError(t, h, "ERR unknown subcommand or wrong number of arguments for 'nope'. Try SCRIPT HELP.", "SCRIPT", "nope")
+}
+
+// A script's writes are logged as a transaction, rather than as EVAL, so
+// replaying them doesn't depend on the script cache
+func TestEvalPropagation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	h := newAOFHandler(t, path)
+
+	expectResponse(t, h, internal.NewIntData(2), "EVAL", `
+		redis.call('SET', KEYS[1], ARGV[1])
+		redis.call('GET', KEYS[1])
+		return redis.call('RPUSH', KEYS[2], 'a', 'b')
+	`, "2", "string", "list", "value")
+	// A single write needs no transaction
+	expectResponse(t, h, internal.NewIntData(1), "EVAL", "return redis.call('DEL', 'string')", "0")
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read AOF: %v", err)
+	}
+	want := aofCommands([][]string{
+		{"MULTI"},
+		{"SET", "string", "value"},
+		{"RPUSH", "list", "a", "b"},
+		{"EXEC"},
+		{"DEL", "string"},
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("AOF. want %q, got %q", want, got)
+	}
+}
+
+// A script reading and then writing a key sees no writes in between
+func TestEvalIsAtomic(t *testing.T) {
+	h := NewDefaultCommandHandler()
+	const clients, increments = 4, 100
+	body := "local n = tonumber(redis.call('GET', KEYS[1]) or '0'); return redis.call('SET', KEYS[1], n + 1)"
+
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				if _, err := handle(t, h, "EVAL", body, "1", "counter"); err != nil {
+					t.Errorf("EVAL, unexpected error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := strconv.Itoa(clients * increments)
+	if got, _ := h.dict.Get("counter"); got != want {
+		t.Fatalf("counter. want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"myredis/internal"
+	"slices"
+)
+
+// SetOperation combines sets for SINTER, SUNION and SDIFF
+type SetOperation int
+
+const (
+	SetIntersection SetOperation = iota
+	SetUnion
+	SetDifference
+)
+
+// Private method to get a set record for writing. Returns ErrWrongType if
+// the key holds another kind. Consumer must acquire write lock.
+func (d *Dictionary) lookupSet(k string) (KVRecord, bool, error) {
+	record, ok := d.lookup(k)
+	if !ok {
+		return KVRecord{}, false, nil
+	}
+	if record.kind != SetRecord {
+		return KVRecord{}, false, ErrWrongType
+	}
+	return record, true, nil
+}
+
+// Private method to store a modified set. Empty sets are deleted, as Redis
+// never stores them. Consumer must acquire write lock.
+func (d *Dictionary) storeSet(k string, record KVRecord) {
+	if len(record.setValue) == 0 {
+		d.delete(k)
+		return
+	}
+	d.setRecord(k, record)
+}
+
+// Private method to run fn with the set at k under the read lock. fn is not
+// called if the key doesn't exist.
+func (d *Dictionary) readSet(k string, fn func(set map[string]struct{})) (err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != SetRecord {
+			err = ErrWrongType
+			return
+		}
+		fn(record.setValue)
+	})
+	return err
+}
+
+// SetAdd adds members to a set record. Returns the number of members added.
+func (d *Dictionary) SetAdd(k string, members []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupSet(k)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		record = KVRecord{kind: SetRecord, setValue: make(map[string]struct{}, len(members))}
+	}
+
+	added := 0
+	for _, member := range members {
+		if _, ok := record.setValue[member]; !ok {
+			record.setValue[member] = struct{}{}
+			added++
+		}
+	}
+	if added > 0 {
+		d.setRecord(k, record)
+	}
+	return added, nil
+}
+
+// SetRemove removes members from a set record, deleting the key once the set
+// is empty. Returns the number of members removed.
+func (d *Dictionary) SetRemove(k string, members []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupSet(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if _, ok := record.setValue[member]; ok {
+			delete(record.setValue, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		d.storeSet(k, record)
+	}
+	return removed, nil
+}
+
+// SetIsMember reports whether each of members is in the set record
+func (d *Dictionary) SetIsMember(k string, members []string) ([]bool, error) {
+	found := make([]bool, len(members))
+	err := d.readSet(k, func(set map[string]struct{}) {
+		for i, member := range members {
+			_, found[i] = set[member]
+		}
+	})
+	return found, err
+}
+
+// SetMembers returns the members of a set record
+func (d *Dictionary) SetMembers(k string) (members []string, err error) {
+	err = d.readSet(k, func(set map[string]struct{}) {
+		members = slices.Collect(maps.Keys(set))
+	})
+	return members, err
+}
+
+// SetCard returns the number of members in a set record
+func (d *Dictionary) SetCard(k string) (n int, err error) {
+	err = d.readSet(k, func(set map[string]struct{}) {
+		n = len(set)
+	})
+	return n, err
+}
+
+// SetPop removes and returns up to count random members.
+// Returns false if the key doesn't exist.
+func (d *Dictionary) SetPop(k string, count int) ([]string, bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupSet(k)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+
+	popped := randomMembers(record.setValue, count)
+	for _, member := range popped {
+		delete(record.setValue, member)
+	}
+	d.storeSet(k, record)
+	return popped, true, nil
+}
+
+// SetRandMember returns random members without removing them. A positive
+// count returns up to count distinct members. A negative count returns
+// exactly -count members, which may repeat.
+func (d *Dictionary) SetRandMember(k string, count int) (members []string, err error) {
+	err = d.readSet(k, func(set map[string]struct{}) {
+		if count >= 0 {
+			members = randomMembers(set, count)
+			return
+		}
+		all := slices.Collect(maps.Keys(set))
+		members = make([]string, -count)
+		for i := range members {
+			members[i] = all[rand.Intn(len(all))]
+		}
+	})
+	return members, err
+}
+
+// SetMove moves member from the src set to the dst set.
+// Returns false if member is not in src.
+func (d *Dictionary) SetMove(src string, dst string, member string) (bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	source, exists, err := d.lookupSet(src)
+	if err != nil {
+		return false, err
+	}
+	destination, dstExists, err := d.lookupSet(dst)
+	if err != nil || !exists {
+		return false, err
+	}
+	if _, ok := source.setValue[member]; !ok {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+
+	delete(source.setValue, member)
+	d.storeSet(src, source)
+	if !dstExists {
+		destination = KVRecord{kind: SetRecord, setValue: make(map[string]struct{})}
+	}
+	destination.setValue[member] = struct{}{}
+	d.setRecord(dst, destination)
+	return true, nil
+}
+
+// SetCombine returns the intersection, union or difference of set records.
+// Missing keys are empty sets. For difference, later sets are subtracted from
+// the first.
+func (d *Dictionary) SetCombine(op SetOperation, keys []string) (members []string, err error) {
+	d.readKeys(keys, func(records []KVRecord, ok []bool) {
+		sets := make([]map[string]struct{}, len(keys))
+		for i, record := range records {
+			if ok[i] && record.kind != SetRecord {
+				err = ErrWrongType
+				return
+			}
+			sets[i] = record.setValue
+		}
+		members = slices.Collect(maps.Keys(combineSets(op, sets)))
+	})
+	return members, err
+}
+
+// SetCombineStore stores the result of SetCombine at dst, replacing any
+// existing value. Returns the number of members in the result.
+func (d *Dictionary) SetCombineStore(op SetOperation, dst string, keys []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	sets := make([]map[string]struct{}, len(keys))
+	for i, k := range keys {
+		record, _, err := d.lookupSet(k)
+		if err != nil {
+			return 0, err
+		}
+		sets[i] = record.setValue
+	}
+	result := combineSets(op, sets)
+	d.storeSet(dst, KVRecord{kind: SetRecord, setValue: result})
+	return len(result), nil
+}
+
+// Combines sets into a new set. Missing sets are nil.
+func combineSets(op SetOperation, sets []map[string]struct{}) map[string]struct{} {
+	var result map[string]struct{}
+	switch op {
+	case SetIntersection:
+		// Start from the smallest set, as the result can't be larger
+		smallest := slices.MinFunc(sets, func(a, b map[string]struct{}) int { return len(a) - len(b) })
+		result = make(map[string]struct{}, len(smallest))
+		for member := range smallest {
+			if !slices.ContainsFunc(sets, func(set map[string]struct{}) bool {
+				_, ok := set[member]
+				return !ok
+			}) {
+				result[member] = struct{}{}
+			}
+		}
+	case SetUnion:
+		result = make(map[string]struct{})
+		for _, set := range sets {
+			maps.Copy(result, set)
+		}
+	case SetDifference:
+		result = maps.Clone(sets[0])
+		if result == nil {
+			result = make(map[string]struct{})
+		}
+		for _, set := range sets[1:] {
+			for member := range set {
+				delete(result, member)
+			}
+		}
+	}
+	return result
+}
+
+// Returns up to count distinct random members of set
+func randomMembers(set map[string]struct{}, count int) []string {
+	all := slices.Collect(maps.Keys(set))
+	if count >= len(all) {
+		return all
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	return all[:count]
+}
+
+// SADD key member [member ...]
+func (h *DefaultCommandHandler) handleSaddCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("SADD")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	added, err := h.dict.SetAdd(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(added), nil
+}
+
+// SREM key member [member ...]
+func (h *DefaultCommandHandler) handleSremCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("SREM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := h.dict.SetRemove(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(removed), nil
+}
+
+// SISMEMBER key member
+func (h *DefaultCommandHandler) handleSismemberCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("SISMEMBER")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := h.dict.SetIsMember(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	if found[0] {
+		return internal.NewIntData(1), nil
+	}
+	return internal.NewIntData(0), nil
+}
+
+// SMISMEMBER key member [member ...]
+func (h *DefaultCommandHandler) handleSmismemberCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("SMISMEMBER")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := h.dict.SetIsMember(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]internal.Data, len(found))
+	for i, ok := range found {
+		if ok {
+			data[i] = *internal.NewIntData(1)
+		} else {
+			data[i] = *internal.NewIntData(0)
+		}
+	}
+	return internal.NewArrayData(data), nil
+}
+
+// SMEMBERS key. Replies with a set, which RESP2 clients get as an array.
+func (h *DefaultCommandHandler) handleSmembersCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("SMEMBERS")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	members, err := h.dict.SetMembers(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewSetData(bulkStrings(members)), nil
+}
+
+// SCARD key
+func (h *DefaultCommandHandler) handleScardCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("SCARD")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.SetCard(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// SPOP key [count]
+func (h *DefaultCommandHandler) handleSpopCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongNumberOfArgs("SPOP")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 1
+	if len(strs) == 2 {
+		n, err := parseInt(strs[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ERR value is out of range, must be positive")
+		}
+		count = int(n)
+	}
+
+	popped, ok, err := h.dict.SetPop(strs[0], count)
+	if err != nil {
+		return nil, err
+	}
+	// Members are popped at random, so the ones popped are logged
+	if len(popped) > 0 {
+		h.dict.rewriteCommand(append([]string{"SREM", strs[0]}, popped...)...)
+	} else {
+		h.dict.rewriteCommand()
+	}
+	// Without count, reply with a single member
+	if len(strs) == 1 {
+		if !ok {
+			return internal.NewNullData(), nil
+		}
+		return internal.NewBulkStringData(popped[0]), nil
+	}
+	return internal.NewSetData(bulkStrings(popped)), nil
+}
+
+// SRANDMEMBER key [count]
+func (h *DefaultCommandHandler) handleSrandmemberCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongNumberOfArgs("SRANDMEMBER")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int64(1)
+	if len(strs) == 2 {
+		count, err = parseInt(strs[1])
+		if err != nil {
+			return nil, err
+		}
+		// As Redis does, so negating count can't overflow
+		if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+			return nil, fmt.Errorf("ERR value is out of range")
+		}
+	}
+
+	members, err := h.dict.SetRandMember(strs[0], int(count))
+	if err != nil {
+		return nil, err
+	}
+	// Without count, reply with a single member
+	if len(strs) == 1 {
+		if len(members) == 0 {
+			return internal.NewNullData(), nil
+		}
+		return internal.NewBulkStringData(members[0]), nil
+	}
+	// Members may repeat, so this is an array rather than a set
+	return internal.NewArrayData(bulkStrings(members)), nil
+}
+
+// SMOVE source destination member
+func (h *DefaultCommandHandler) handleSmoveCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("SMOVE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := h.dict.SetMove(strs[0], strs[1], strs[2])
+	if err != nil {
+		return nil, err
+	}
+	if moved {
+		return internal.NewIntData(1), nil
+	}
+	return internal.NewIntData(0), nil
+}
+
+// SINTER, SUNION and SDIFF key [key ...]
+func (h *DefaultCommandHandler) handleSetCombineCommand(command string, args []internal.Data, op SetOperation) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	keys, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := h.dict.SetCombine(op, keys)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewSetData(bulkStrings(members)), nil
+}
+
+// SINTERSTORE, SUNIONSTORE and SDIFFSTORE destination key [key ...]
+func (h *DefaultCommandHandler) handleSetCombineStoreCommand(command string, args []internal.Data, op SetOperation) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := h.dict.SetCombineStore(op, strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
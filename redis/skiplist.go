@@ -0,0 +1,235 @@
+package main
+
+import "math/rand"
+
+// Skiplist levels, as in Redis. With p = 1/4, 32 levels is enough for 2^64
+// elements.
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+// skiplist orders members by score, then member, similar to Redis's zskiplist.
+// Each level tracks the span it jumps, so ranks are found in O(log n) as
+// well as members.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func (sl *skiplist) Len() int {
+	return sl.length
+}
+
+// Returns true if node sorts before score and member
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+// Returns true if node sorts after score and member
+func (n *skiplistNode) after(score float64, member string) bool {
+	return n.score > score || (n.score == score && n.member > member)
+}
+
+// Next returns the following node, or nil at the tail
+func (n *skiplistNode) Next() *skiplistNode {
+	return n.level[0].forward
+}
+
+// Prev returns the preceding node, or nil at the head
+func (n *skiplistNode) Prev() *skiplistNode {
+	return n.backward
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// Insert adds member with score. member must not already be in the list.
+func (sl *skiplist) Insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// Levels above the new node now jump over it
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+}
+
+// Delete removes member with score. Returns false if it isn't in the list.
+func (sl *skiplist) Delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// Rank returns the 0 based rank of member with score, which must be in the
+// list
+func (sl *skiplist) Rank(score float64, member string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !x.level[i].forward.after(score, member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.member == member {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// ByRank returns the node at the 0 based rank, or nil if out of range
+func (sl *skiplist) ByRank(rank int) *skiplistNode {
+	if rank < 0 || rank >= sl.length {
+		return nil
+	}
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank+1 {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
+
+// First returns the first node for which aboveMin and belowMax are both true,
+// or nil if there is none. aboveMin must be false then true along the list,
+// and belowMax true then false, as for a score or lex range.
+func (sl *skiplist) First(aboveMin func(n *skiplistNode) bool, belowMax func(n *skiplistNode) bool) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// Last returns the last node for which aboveMin and belowMax are both true,
+// or nil if there is none. See First.
+func (sl *skiplist) Last(aboveMin func(n *skiplistNode) bool, belowMax func(n *skiplistNode) bool) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == sl.header || !aboveMin(x) {
+		return nil
+	}
+	return x
+}
+
+// Head returns the first node, or nil if the list is empty
+func (sl *skiplist) Head() *skiplistNode {
+	return sl.header.level[0].forward
+}
+
+// Tail returns the last node, or nil if the list is empty
+func (sl *skiplist) Tail() *skiplistNode {
+	return sl.tail
+}
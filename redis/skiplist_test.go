@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cmp"
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Runs random inserts and deletes against a skiplist and a sorted slice, and
+// checks order, ranks and ranges always agree
+func TestSkiplistMatchesSortedSlice(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sl := newSkiplist()
+	scores := make(map[string]float64)
+	var model []ZSetMember
+
+	compare := func(a, b ZSetMember) int {
+		return cmp.Or(cmp.Compare(a.score, b.score), cmp.Compare(a.member, b.member))
+	}
+
+	for op := 0; op < 5000; op++ {
+		member := strconv.Itoa(r.Intn(200))
+		if score, ok := scores[member]; ok {
+			if !sl.Delete(score, member) {
+				t.Fatalf("op %d Delete(%v, %q) returned false", op, score, member)
+			}
+			delete(scores, member)
+			model = slices.DeleteFunc(model, func(m ZSetMember) bool { return m.member == member })
+		} else {
+			score := float64(r.Intn(20))
+			sl.Insert(score, member)
+			scores[member] = score
+			model = append(model, ZSetMember{member, score})
+			slices.SortFunc(model, compare)
+		}
+
+		if sl.Len() != len(model) {
+			t.Fatalf("op %d Len. got=%d, want=%d", op, sl.Len(), len(model))
+		}
+		if len(model) == 0 {
+			continue
+		}
+		i := r.Intn(len(model))
+		if got := sl.Rank(model[i].score, model[i].member); got != i {
+			t.Fatalf("op %d Rank(%v). got=%d, want=%d", op, model[i], got, i)
+		}
+		if node := sl.ByRank(i); node.member != model[i].member {
+			t.Fatalf("op %d ByRank(%d). got=%q, want=%q", op, i, node.member, model[i].member)
+		}
+	}
+
+	var forward, backward []ZSetMember
+	for node := sl.Head(); node != nil; node = node.Next() {
+		forward = append(forward, ZSetMember{node.member, node.score})
+	}
+	for node := sl.Tail(); node != nil; node = node.Prev() {
+		backward = append(backward, ZSetMember{node.member, node.score})
+	}
+	slices.Reverse(backward)
+	if !slices.Equal(forward, model) || !slices.Equal(backward, model) {
+		t.Fatalf("walk. forward=%v, backward=%v, want=%v", forward, backward, model)
+	}
+
+	rng := scoreRange{min: 5, max: 10, minExclusive: true}
+	first, last := sl.First(rng.aboveMin, rng.belowMax), sl.Last(rng.aboveMin, rng.belowMax)
+	want := slices.DeleteFunc(slices.Clone(model), func(m ZSetMember) bool { return m.score <= 5 || m.score > 10 })
+	if first.member != want[0].member || last.member != want[len(want)-1].member {
+		t.Fatalf("First/Last. got=%q..%q, want=%q..%q", first.member, last.member, want[0].member, want[len(want)-1].member)
+	}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"myredis/internal"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidStreamID  = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+)
+
+// StreamID identifies a stream entry. IDs are a millisecond timestamp and a
+// sequence number for entries added in the same millisecond.
+type StreamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id StreamID) Compare(other StreamID) int {
+	if id.ms != other.ms {
+		return cmp.Compare(id.ms, other.ms)
+	}
+	return cmp.Compare(id.seq, other.seq)
+}
+
+// Returns the smallest ID after id. Returns false if id is the largest.
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return StreamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return StreamID{id.ms + 1, 0}, true
+	default:
+		return id, false
+	}
+}
+
+// Returns the largest ID before id. Returns false if id is 0-0.
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id.seq > 0:
+		return StreamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return StreamID{id.ms - 1, math.MaxUint64}, true
+	default:
+		return id, false
+	}
+}
+
+// Parses an ID such as "1526919030474-55". A missing sequence number is
+// defaultSeq.
+func parseStreamID(s string, defaultSeq uint64) (StreamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return StreamID{ms, defaultSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, errInvalidStreamID
+	}
+	return StreamID{ms, seq}, nil
+}
+
+// Parses the start or end of an XRANGE interval. "-" and "+" are the smallest
+// and largest IDs, and a "(" prefix makes the bound exclusive.
+func parseStreamRangeBound(s string, start bool) (id StreamID, ok bool, err error) {
+	switch s {
+	case "-":
+		return StreamID{}, true, nil
+	case "+":
+		return maxStreamID, true, nil
+	}
+
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	defaultSeq := uint64(0)
+	if !start {
+		defaultSeq = math.MaxUint64
+	}
+	id, err = parseStreamID(s, defaultSeq)
+	if err != nil || !exclusive {
+		return id, true, err
+	}
+	// An exclusive bound is the inclusive bound next to it, which may not
+	// exist
+	if start {
+		id, ok = id.next()
+	} else {
+		id, ok = id.prev()
+	}
+	return id, ok, nil
+}
+
+type streamEntry struct {
+	id     StreamID
+	fields []string
+}
+
+// stream is an append only log of entries, ordered by ID
+type stream struct {
+	entries []streamEntry
+	// The last ID added. New IDs must be greater, even once the entry is
+	// deleted.
+	lastID StreamID
+	groups map[string]*streamGroup
+}
+
+func newStream() *stream {
+	return &stream{groups: make(map[string]*streamGroup)}
+}
+
+// Returns a copy of the stream that shares nothing it may change. The
+// fields of entries are never changed, so are shared.
+func (s *stream) clone() *stream {
+	c := &stream{entries: slices.Clone(s.entries), lastID: s.lastID, groups: make(map[string]*streamGroup, len(s.groups))}
+	for name, g := range s.groups {
+		group := &streamGroup{lastID: g.lastID, pending: make(map[StreamID]*streamPendingEntry, len(g.pending))}
+		for id, p := range g.pending {
+			pending := *p
+			group.pending[id] = &pending
+		}
+		c.groups[name] = group
+	}
+	return c
+}
+
+// Returns the index of the first entry with an ID at or after id
+func (s *stream) search(id StreamID) int {
+	i, _ := slices.BinarySearchFunc(s.entries, id, func(e streamEntry, id StreamID) int {
+		return e.id.Compare(id)
+	})
+	return i
+}
+
+// Returns the entry with id, or false if it doesn't exist
+func (s *stream) get(id StreamID) (streamEntry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i], true
+	}
+	return streamEntry{}, false
+}
+
+// Range returns up to count entries between start and end inclusive, in
+// order, or in reverse if rev is set. A count of 0 returns all entries.
+func (s *stream) Range(start StreamID, end StreamID, count int, rev bool) []streamEntry {
+	from, to := s.search(start), s.search(end)
+	if to < len(s.entries) && s.entries[to].id == end {
+		to++
+	}
+	if from >= to {
+		return []streamEntry{}
+	}
+	entries := slices.Clone(s.entries[from:to])
+	if rev {
+		slices.Reverse(entries)
+	}
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
+
+// Returns the next ID to generate at time ms, for XADD with "*"
+func (s *stream) nextID(ms uint64) (StreamID, error) {
+	if ms > s.lastID.ms {
+		return StreamID{ms, 0}, nil
+	}
+	// The clock went backwards or hasn't moved, so continue from the last ID
+	id, ok := s.lastID.next()
+	if !ok {
+		return StreamID{}, fmt.Errorf("ERR The stream has exhausted the last possible ID, unable to add more items")
+	}
+	return id, nil
+}
+
+// Returns the next ID with timestamp ms, for XADD with "ms-*"
+func (s *stream) nextSeqID(ms uint64) (StreamID, error) {
+	switch {
+	case ms > s.lastID.ms:
+		return StreamID{ms, 0}, nil
+	case ms == s.lastID.ms && s.lastID.seq < math.MaxUint64:
+		return StreamID{ms, s.lastID.seq + 1}, nil
+	default:
+		return StreamID{}, errStreamIDTooSmall
+	}
+}
+
+// StreamTrimStrategy selects which entries XTRIM and XADD remove
+type StreamTrimStrategy int
+
+const (
+	StreamTrimNone StreamTrimStrategy = iota
+	StreamTrimMaxLen
+	StreamTrimMinID
+)
+
+// StreamTrimOptions holds the MAXLEN or MINID argument of XADD and XTRIM
+type StreamTrimOptions struct {
+	strategy StreamTrimStrategy
+	maxLen   int
+	minID    StreamID
+	// Maximum entries to remove with ~, or 0 for no limit. Approximate
+	// trimming otherwise trims exactly.
+	limit int
+}
+
+// Trim removes the oldest entries per opts. Returns the number removed.
+func (s *stream) Trim(opts StreamTrimOptions) int {
+	n := 0
+	switch opts.strategy {
+	case StreamTrimMaxLen:
+		n = max(len(s.entries)-opts.maxLen, 0)
+	case StreamTrimMinID:
+		n = s.search(opts.minID)
+	}
+	if opts.limit > 0 {
+		n = min(n, opts.limit)
+	}
+	s.entries = slices.Delete(s.entries, 0, n)
+	return n
+}
+
+// StreamAddOptions holds the options of XADD
+type StreamAddOptions struct {
+	noMkStream bool
+	trim       StreamTrimOptions
+}
+
+// Private method to get a stream record for writing. Returns ErrWrongType if
+// the key holds another kind. Consumer must acquire write lock.
+func (d *Dictionary) lookupStream(k string) (KVRecord, bool, error) {
+	record, ok := d.lookup(k)
+	if !ok {
+		return KVRecord{}, false, nil
+	}
+	if record.kind != StreamRecord {
+		return KVRecord{}, false, ErrWrongType
+	}
+	return record, true, nil
+}
+
+// Private method to run fn with the stream at k under the read lock. fn is
+// not called if the key doesn't exist.
+func (d *Dictionary) readStream(k string, fn func(s *stream)) (err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != StreamRecord {
+			err = ErrWrongType
+			return
+		}
+		fn(record.streamValue)
+	})
+	return err
+}
+
+// StreamAdd appends an entry to a stream record, creating the stream unless
+// NOMKSTREAM is set. id is "*" to generate an ID, "ms-*" to generate the
+// sequence number, or an explicit ID. Returns the entry's ID, or false if the
+// stream doesn't exist and NOMKSTREAM is set.
+func (d *Dictionary) StreamAdd(k string, id string, fields []string, opts StreamAddOptions) (StreamID, bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil {
+		return StreamID{}, false, err
+	}
+	if !exists {
+		if opts.noMkStream {
+			return StreamID{}, false, nil
+		}
+		record = KVRecord{kind: StreamRecord, streamValue: newStream()}
+	}
+	s := record.streamValue
+
+	var entryID StreamID
+	switch {
+	case id == "*":
+		entryID, err = s.nextID(uint64(time.Now().UnixMilli()))
+	case strings.HasSuffix(id, "-*"):
+		var ms uint64
+		ms, err = strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return StreamID{}, false, errInvalidStreamID
+		}
+		entryID, err = s.nextSeqID(ms)
+	default:
+		entryID, err = parseStreamID(id, 0)
+		if err == nil && entryID == (StreamID{}) {
+			err = fmt.Errorf("ERR The ID specified in XADD must be greater than 0-0")
+		} else if err == nil && entryID.Compare(s.lastID) <= 0 {
+			err = errStreamIDTooSmall
+		}
+	}
+	if err != nil {
+		return StreamID{}, false, err
+	}
+
+	s.entries = append(s.entries, streamEntry{id: entryID, fields: fields})
+	s.lastID = entryID
+	s.Trim(opts.trim)
+	d.setRecord(k, record)
+	return entryID, true, nil
+}
+
+// StreamRange returns up to count entries between start and end inclusive.
+// See stream.Range.
+func (d *Dictionary) StreamRange(k string, start StreamID, end StreamID, count int, rev bool) (entries []streamEntry, err error) {
+	entries = []streamEntry{}
+	err = d.readStream(k, func(s *stream) {
+		entries = s.Range(start, end, count, rev)
+	})
+	return entries, err
+}
+
+// StreamLen returns the number of entries in a stream record
+func (d *Dictionary) StreamLen(k string) (n int, err error) {
+	err = d.readStream(k, func(s *stream) {
+		n = len(s.entries)
+	})
+	return n, err
+}
+
+// StreamLastID returns the ID last added to a stream record, or 0-0 if the
+// key doesn't exist
+func (d *Dictionary) StreamLastID(k string) (id StreamID, err error) {
+	err = d.readStream(k, func(s *stream) {
+		id = s.lastID
+	})
+	return id, err
+}
+
+// StreamDelete removes entries by ID. Returns the number removed.
+func (d *Dictionary) StreamDelete(k string, ids []StreamID) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	s := record.streamValue
+	deleted := 0
+	for _, id := range ids {
+		i := s.search(id)
+		if i < len(s.entries) && s.entries[i].id == id {
+			s.entries = slices.Delete(s.entries, i, i+1)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		d.setRecord(k, record)
+	}
+	return deleted, nil
+}
+
+// StreamTrim removes the oldest entries of a stream record. Returns the
+// number removed.
+func (d *Dictionary) StreamTrim(k string, opts StreamTrimOptions) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+	n := record.streamValue.Trim(opts)
+	d.setRecord(k, record)
+	return n, nil
+}
+
+// StreamSetID sets the last ID of a stream record, which new IDs must be
+// greater than. It can't be set below the ID of the last entry.
+func (d *Dictionary) StreamSetID(k string, id StreamID) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("ERR no such key")
+	}
+	s := record.streamValue
+	if len(s.entries) > 0 && id.Compare(s.entries[len(s.entries)-1].id) < 0 {
+		return fmt.Errorf("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	s.lastID = id
+	d.setRecord(k, record)
+	return nil
+}
+
+// StreamRead returns up to count entries after id, for XREAD. A count of 0
+// returns all entries.
+func (d *Dictionary) StreamRead(k string, after StreamID, count int) (entries []streamEntry, err error) {
+	err = d.readStream(k, func(s *stream) {
+		start, ok := after.next()
+		if ok {
+			entries = s.Range(start, maxStreamID, count, false)
+		}
+	})
+	return entries, err
+}
+
+// Parses MAXLEN or MINID and its arguments, starting at strs[i]. Returns the
+// index after the last argument parsed.
+func parseStreamTrim(strs []string, i int) (StreamTrimOptions, int, error) {
+	var opts StreamTrimOptions
+	switch strings.ToUpper(strs[i]) {
+	case "MAXLEN":
+		opts.strategy = StreamTrimMaxLen
+	case "MINID":
+		opts.strategy = StreamTrimMinID
+	default:
+		return opts, i, ErrSyntax
+	}
+	i++
+
+	approx := false
+	if i < len(strs) && (strs[i] == "=" || strs[i] == "~") {
+		approx = strs[i] == "~"
+		i++
+	}
+	if i >= len(strs) {
+		return opts, i, ErrSyntax
+	}
+	if opts.strategy == StreamTrimMaxLen {
+		n, err := parseInt(strs[i])
+		if err != nil {
+			return opts, i, err
+		}
+		if n < 0 {
+			return opts, i, fmt.Errorf("ERR The MAXLEN argument must be >= 0.")
+		}
+		opts.maxLen = int(n)
+	} else {
+		id, err := parseStreamID(strs[i], 0)
+		if err != nil {
+			return opts, i, err
+		}
+		opts.minID = id
+	}
+	i++
+
+	if i+1 < len(strs) && strings.ToUpper(strs[i]) == "LIMIT" {
+		if !approx {
+			return opts, i, fmt.Errorf("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+		n, err := parseInt(strs[i+1])
+		if err != nil {
+			return opts, i, err
+		}
+		if n < 0 {
+			return opts, i, fmt.Errorf("ERR The LIMIT argument must be >= 0.")
+		}
+		opts.limit = int(n)
+		i += 2
+	}
+	return opts, i, nil
+}
+
+// Converts an entry to its reply, an array of the ID and the field values.
+// Deleted entries, which have nil fields, reply with null fields.
+func streamEntryData(entry streamEntry) internal.Data {
+	fields := internal.NewNullData()
+	if entry.fields != nil {
+		fields = internal.NewArrayData(bulkStrings(entry.fields))
+	}
+	return *internal.NewArrayData([]internal.Data{*internal.NewBulkStringData(entry.id.String()), *fields})
+}
+
+func streamEntriesData(entries []streamEntry) *internal.Data {
+	data := make([]internal.Data, len(entries))
+	for i, entry := range entries {
+		data[i] = streamEntryData(entry)
+	}
+	return internal.NewArrayData(data)
+}
+
+// Builds the reply of XREAD and XREADGROUP, with the entries read from each
+// key. RESP3 clients get a map of key to entries, and RESP2 clients get an
+// array of key and entries pairs.
+func streamReadReply(ctx context.Context, keys []string, entries []*internal.Data) *internal.Data {
+	if clientFromContext(ctx).protocol == internal.RESP3 {
+		m := make(map[internal.Data]internal.Data, len(keys))
+		for i, k := range keys {
+			m[*internal.NewBulkStringData(k)] = *entries[i]
+		}
+		return internal.NewMapData(m)
+	}
+	data := make([]internal.Data, len(keys))
+	for i, k := range keys {
+		data[i] = *internal.NewArrayData([]internal.Data{*internal.NewBulkStringData(k), *entries[i]})
+	}
+	return internal.NewArrayData(data)
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN | MINID [= | ~] threshold [LIMIT count]]
+// * | id field value [field value ...]
+func (h *DefaultCommandHandler) handleXaddCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 4 {
+		return nil, errWrongNumberOfArgs("XADD")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts StreamAddOptions
+	i := 1
+options:
+	for i < len(strs) {
+		switch strings.ToUpper(strs[i]) {
+		case "NOMKSTREAM":
+			opts.noMkStream = true
+			i++
+		case "MAXLEN", "MINID":
+			opts.trim, i, err = parseStreamTrim(strs, i)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			break options
+		}
+	}
+	if i >= len(strs) || (len(strs)-i-1)%2 != 0 || len(strs)-i-1 == 0 {
+		return nil, errWrongNumberOfArgs("XADD")
+	}
+
+	id, ok, err := h.dict.StreamAdd(strs[0], strs[i], slices.Clone(strs[i+1:]), opts)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		h.dict.rewriteCommand()
+		return internal.NewNullData(), nil
+	}
+	// IDs are generated from the time, so the ID added is logged
+	rewritten := append([]string{"XADD"}, strs...)
+	rewritten[i+1] = id.String()
+	h.dict.rewriteCommand(rewritten...)
+	return internal.NewBulkStringData(id.String()), nil
+}
+
+// XRANGE key start end [COUNT count], and XREVRANGE key end start
+// [COUNT count]
+func (h *DefaultCommandHandler) handleXrangeCommand(command string, args []internal.Data, rev bool) (*internal.Data, error) {
+	if len(args) != 3 && len(args) != 5 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	startArg, endArg := strs[1], strs[2]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, startOK, err := parseStreamRangeBound(startArg, true)
+	if err != nil {
+		return nil, err
+	}
+	end, endOK, err := parseStreamRangeBound(endArg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	if len(strs) == 5 {
+		if strings.ToUpper(strs[3]) != "COUNT" {
+			return nil, ErrSyntax
+		}
+		n, err := parseInt(strs[4])
+		if err != nil {
+			return nil, err
+		}
+		// A negative count returns nothing, like 0 would in Redis
+		if n <= 0 {
+			return internal.NewArrayData([]internal.Data{}), nil
+		}
+		count = int(n)
+	}
+	if !startOK || !endOK {
+		return internal.NewArrayData([]internal.Data{}), nil
+	}
+
+	entries, err := h.dict.StreamRange(strs[0], start, end, count, rev)
+	if err != nil {
+		return nil, err
+	}
+	return streamEntriesData(entries), nil
+}
+
+// XLEN key
+func (h *DefaultCommandHandler) handleXlenCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("XLEN")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.StreamLen(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// XDEL key id [id ...]
+func (h *DefaultCommandHandler) handleXdelCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("XDEL")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]StreamID, len(strs)-1)
+	for i, s := range strs[1:] {
+		if ids[i], err = parseStreamID(s, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := h.dict.StreamDelete(strs[0], ids)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// XTRIM key MAXLEN | MINID [= | ~] threshold [LIMIT count]
+func (h *DefaultCommandHandler) handleXtrimCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumberOfArgs("XTRIM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts, i, err := parseStreamTrim(strs, 1)
+	if err != nil {
+		return nil, err
+	}
+	if i != len(strs) {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.StreamTrim(strs[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// XSETID key last-id
+func (h *DefaultCommandHandler) handleXsetidCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("XSETID")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	id, err := parseStreamID(strs[1], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.dict.StreamSetID(strs[0], id); err != nil {
+		return nil, err
+	}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// Parses the STREAMS key [key ...] id [id ...] arguments of XREAD and
+// XREADGROUP, starting after STREAMS
+func parseStreamsArgs(command string, strs []string) ([]string, []string, error) {
+	if len(strs) == 0 || len(strs)%2 != 0 {
+		return nil, nil, fmt.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", strings.ToLower(command))
+	}
+	return strs[:len(strs)/2], strs[len(strs)/2:], nil
+}
+
+// XREAD [COUNT count] STREAMS key [key ...] id [id ...]
+func (h *DefaultCommandHandler) handleXreadCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 0
+	i := 0
+	for ; i < len(strs) && strings.ToUpper(strs[i]) != "STREAMS"; i++ {
+		if strings.ToUpper(strs[i]) != "COUNT" || i+1 >= len(strs) {
+			return nil, ErrSyntax
+		}
+		n, err := parseInt(strs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		count = max(int(n), 0)
+		i++
+	}
+	if i >= len(strs) {
+		return nil, ErrSyntax
+	}
+	keys, idArgs, err := parseStreamsArgs("XREAD", strs[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]StreamID, len(keys))
+	for j, s := range idArgs {
+		if s == "$" {
+			ids[j], err = h.dict.StreamLastID(keys[j])
+		} else {
+			ids[j], err = parseStreamID(s, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var readKeys []string
+	var readEntries []*internal.Data
+	for j, k := range keys {
+		entries, err := h.dict.StreamRead(k, ids[j], count)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			readKeys = append(readKeys, k)
+			readEntries = append(readEntries, streamEntriesData(entries))
+		}
+	}
+	if len(readKeys) == 0 {
+		return internal.NewNullData(), nil
+	}
+	return streamReadReply(ctx, readKeys, readEntries), nil
+}
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"myredis/internal"
+	"slices"
+	"strings"
+	"time"
+)
+
+// streamGroup is a consumer group. Entries delivered to its consumers stay
+// in the pending entries list until acknowledged with XACK.
+type streamGroup struct {
+	// The last ID delivered to the group
+	lastID  StreamID
+	pending map[StreamID]*streamPendingEntry
+}
+
+type streamPendingEntry struct {
+	consumer      string
+	deliveryTime  time.Time
+	deliveryCount int
+}
+
+// Returns the IDs of pending entries, in order
+func (g *streamGroup) pendingIDs() []StreamID {
+	return slices.SortedFunc(maps.Keys(g.pending), StreamID.Compare)
+}
+
+func errNoGroup(k string, group string) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", k, group)
+}
+
+// Private method to get a consumer group for writing. Returns a NOGROUP error
+// if the key or group doesn't exist. Consumer must acquire write lock.
+func (d *Dictionary) lookupStreamGroup(k string, group string) (KVRecord, *streamGroup, error) {
+	record, exists, err := d.lookupStream(k)
+	if err != nil {
+		return KVRecord{}, nil, err
+	}
+	if !exists {
+		return KVRecord{}, nil, errNoGroup(k, group)
+	}
+	g, ok := record.streamValue.groups[group]
+	if !ok {
+		return KVRecord{}, nil, errNoGroup(k, group)
+	}
+	return record, g, nil
+}
+
+// StreamGroupCreate creates a consumer group that delivers entries after id,
+// or after the last entry if latest is set. With mkStream, a missing stream
+// is created empty.
+func (d *Dictionary) StreamGroupCreate(k string, group string, id StreamID, latest bool, mkStream bool) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if !mkStream {
+			return fmt.Errorf("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+		}
+		record = KVRecord{kind: StreamRecord, streamValue: newStream()}
+	}
+
+	s := record.streamValue
+	if _, ok := s.groups[group]; ok {
+		return fmt.Errorf("BUSYGROUP Consumer Group name already exists")
+	}
+	if latest {
+		id = s.lastID
+	}
+	s.groups[group] = &streamGroup{lastID: id, pending: make(map[StreamID]*streamPendingEntry)}
+	d.setRecord(k, record)
+	return nil
+}
+
+// StreamReadGroup reads entries for consumer in group, up to count, or all
+// if count is 0. If newOnly is set, entries not yet delivered to the group
+// are read and added to the pending entries list, unless noAck is set.
+// Otherwise, the consumer's pending entries after id are read again, with
+// nil fields for entries that have since been deleted.
+func (d *Dictionary) StreamReadGroup(k string, group string, consumer string, after StreamID, newOnly bool, count int, noAck bool) ([]streamEntry, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, g, err := d.lookupStreamGroup(k, group)
+	if errors.Is(err, ErrWrongType) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w in XREADGROUP with GROUP option", err)
+	}
+	s := record.streamValue
+
+	if !newOnly {
+		entries := []streamEntry{}
+		for _, id := range g.pendingIDs() {
+			if count > 0 && len(entries) == count {
+				break
+			}
+			if id.Compare(after) <= 0 || g.pending[id].consumer != consumer {
+				continue
+			}
+			entry, ok := s.get(id)
+			if !ok {
+				entry = streamEntry{id: id}
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+
+	start, ok := g.lastID.next()
+	if !ok {
+		return nil, nil
+	}
+	entries := s.Range(start, maxStreamID, count, false)
+	if len(entries) > 0 {
+		d.touch(k)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if !noAck {
+			g.pending[entry.id] = &streamPendingEntry{consumer: consumer, deliveryTime: now, deliveryCount: 1}
+		}
+		g.lastID = entry.id
+	}
+	return entries, nil
+}
+
+// StreamAck removes entries from the pending entries list of group. Returns
+// the number removed.
+func (d *Dictionary) StreamAck(k string, group string, ids []StreamID) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupStream(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+	// Nothing to acknowledge without a group
+	g, ok := record.streamValue.groups[group]
+	if !ok {
+		return 0, nil
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked++
+		}
+	}
+	if acked > 0 {
+		d.touch(k)
+	}
+	return acked, nil
+}
+
+// StreamPendingSummary summarizes the pending entries list of a group
+type StreamPendingSummary struct {
+	count int
+	first StreamID
+	last  StreamID
+	// The number of pending entries of each consumer
+	consumers map[string]int
+}
+
+// StreamPendingEntry describes an entry in the pending entries list
+type StreamPendingEntry struct {
+	id            StreamID
+	consumer      string
+	idle          time.Duration
+	deliveryCount int
+}
+
+// StreamPendingOptions filters the pending entries XPENDING returns
+type StreamPendingOptions struct {
+	minIdle  time.Duration
+	start    StreamID
+	end      StreamID
+	count    int
+	consumer string
+}
+
+// StreamPendingSummary returns a summary of the pending entries of group
+func (d *Dictionary) StreamPendingSummary(k string, group string) (StreamPendingSummary, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	_, g, err := d.lookupStreamGroup(k, group)
+	if err != nil {
+		return StreamPendingSummary{}, err
+	}
+
+	ids := g.pendingIDs()
+	summary := StreamPendingSummary{count: len(ids), consumers: make(map[string]int)}
+	if len(ids) > 0 {
+		summary.first, summary.last = ids[0], ids[len(ids)-1]
+	}
+	for _, p := range g.pending {
+		summary.consumers[p.consumer]++
+	}
+	return summary, nil
+}
+
+// StreamPending returns up to opts.count pending entries of group between
+// opts.start and opts.end inclusive
+func (d *Dictionary) StreamPending(k string, group string, opts StreamPendingOptions) ([]StreamPendingEntry, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	_, g, err := d.lookupStreamGroup(k, group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := []StreamPendingEntry{}
+	for _, id := range g.pendingIDs() {
+		if len(entries) == opts.count {
+			break
+		}
+		p := g.pending[id]
+		idle := now.Sub(p.deliveryTime)
+		if id.Compare(opts.start) < 0 || id.Compare(opts.end) > 0 || idle < opts.minIdle ||
+			(opts.consumer != "" && p.consumer != opts.consumer) {
+			continue
+		}
+		entries = append(entries, StreamPendingEntry{id, p.consumer, idle, p.deliveryCount})
+	}
+	return entries, nil
+}
+
+// StreamClaimOptions holds the options of XCLAIM
+type StreamClaimOptions struct {
+	// The delivery time to set. The zero time means now.
+	deliveryTime time.Time
+	// The delivery count to set, or -1 to increment it
+	retryCount int
+	force      bool
+	justID     bool
+	lastID     StreamID
+}
+
+// StreamClaim transfers pending entries that have been idle for at least
+// minIdle to consumer. Returns the claimed entries. Entries that have since
+// been deleted are removed from the pending entries list instead.
+func (d *Dictionary) StreamClaim(k string, group string, consumer string, minIdle time.Duration, ids []StreamID, opts StreamClaimOptions) ([]streamEntry, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, g, err := d.lookupStreamGroup(k, group)
+	if err != nil {
+		return nil, err
+	}
+	s := record.streamValue
+
+	d.touch(k)
+	if opts.lastID.Compare(g.lastID) > 0 {
+		g.lastID = opts.lastID
+	}
+	now := time.Now()
+	claimed := []streamEntry{}
+	for _, id := range ids {
+		entry, exists := s.get(id)
+		p, pending := g.pending[id]
+		forced := false
+		if !pending {
+			// FORCE creates the pending entry, as long as the entry exists
+			if !opts.force || !exists {
+				continue
+			}
+			p = &streamPendingEntry{deliveryTime: now}
+			g.pending[id] = p
+			forced = true
+		}
+		if !exists {
+			delete(g.pending, id)
+			continue
+		}
+		// Entries FORCE just created are claimed however idle, as in Redis
+		if !forced && minIdle > 0 && now.Sub(p.deliveryTime) < minIdle {
+			continue
+		}
+		g.claim(p, consumer, now, opts)
+		claimed = append(claimed, entry)
+	}
+	return claimed, nil
+}
+
+// Transfers a pending entry to consumer
+func (g *streamGroup) claim(p *streamPendingEntry, consumer string, now time.Time, opts StreamClaimOptions) {
+	p.consumer = consumer
+	p.deliveryTime = now
+	if !opts.deliveryTime.IsZero() {
+		p.deliveryTime = opts.deliveryTime
+	}
+	switch {
+	case opts.retryCount >= 0:
+		p.deliveryCount = opts.retryCount
+	case !opts.justID:
+		p.deliveryCount++
+	}
+}
+
+// XAUTOCLAIM scans up to this many pending entries per entry it may claim
+const autoClaimAttemptsFactor = 10
+
+// StreamAutoClaim claims up to count pending entries from start onwards that
+// have been idle for at least minIdle, like XCLAIM. Returns the ID to resume
+// from, or 0-0 once every pending entry has been scanned, the claimed
+// entries, and the IDs of deleted entries removed from the pending list.
+func (d *Dictionary) StreamAutoClaim(k string, group string, consumer string, minIdle time.Duration, start StreamID, count int, justID bool) (StreamID, []streamEntry, []StreamID, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, g, err := d.lookupStreamGroup(k, group)
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+	s := record.streamValue
+
+	d.touch(k)
+	now := time.Now()
+	opts := StreamClaimOptions{retryCount: -1, justID: justID}
+	claimed, deleted := []streamEntry{}, []StreamID{}
+	ids := g.pendingIDs()
+	i, _ := slices.BinarySearchFunc(ids, start, StreamID.Compare)
+	// Bound the scan, as Redis does, so a long list of recently delivered
+	// entries can't block the server
+	attempts := count * autoClaimAttemptsFactor
+	for ; i < len(ids) && attempts > 0 && len(claimed)+len(deleted) < count; i++ {
+		attempts--
+		id := ids[i]
+		p := g.pending[id]
+		if now.Sub(p.deliveryTime) < minIdle {
+			continue
+		}
+		entry, ok := s.get(id)
+		if !ok {
+			delete(g.pending, id)
+			deleted = append(deleted, id)
+			continue
+		}
+		g.claim(p, consumer, now, opts)
+		claimed = append(claimed, entry)
+	}
+
+	next := StreamID{}
+	if i < len(ids) {
+		next = ids[i]
+	}
+	return next, claimed, deleted, nil
+}
+
+// Parses a non-negative millisecond duration argument
+func parseMilliseconds(s string) (time.Duration, error) {
+	n, err := parseInt(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(max(n, 0)) * time.Millisecond, nil
+}
+
+func entryIDs(entries []streamEntry) []StreamID {
+	ids := make([]StreamID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.id
+	}
+	return ids
+}
+
+func streamIDsData(ids []StreamID) *internal.Data {
+	data := make([]internal.Data, len(ids))
+	for i, id := range ids {
+		data[i] = *internal.NewBulkStringData(id.String())
+	}
+	return internal.NewArrayData(data)
+}
+
+// XGROUP CREATE key group id | $ [MKSTREAM] [ENTRIESREAD entries-read]
+func (h *DefaultCommandHandler) handleXgroupCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("XGROUP")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToUpper(strs[0]) != "CREATE" {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try XGROUP HELP.", strs[0])
+	}
+	if len(strs) < 4 {
+		return nil, errWrongNumberOfArgs("XGROUP|CREATE")
+	}
+
+	mkStream := false
+	for i := 4; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "MKSTREAM":
+			mkStream = true
+		case "ENTRIESREAD":
+			// Only used for lag in XINFO, which isn't supported
+			if i+1 >= len(strs) {
+				return nil, ErrSyntax
+			}
+			if _, err := parseInt(strs[i+1]); err != nil {
+				return nil, err
+			}
+			i++
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	var id StreamID
+	latest := strs[3] == "$"
+	if !latest {
+		if id, err = parseStreamID(strs[3], 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.dict.StreamGroupCreate(strs[1], strs[2], id, latest, mkStream); err != nil {
+		return nil, err
+	}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [NOACK] STREAMS key
+// [key ...] id [id ...]
+func (h *DefaultCommandHandler) handleXreadgroupCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs) < 6 || strings.ToUpper(strs[0]) != "GROUP" {
+		return nil, ErrSyntax
+	}
+	group, consumer := strs[1], strs[2]
+
+	count, noAck := 0, false
+	i := 3
+	for ; i < len(strs) && strings.ToUpper(strs[i]) != "STREAMS"; i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "COUNT":
+			if i+1 >= len(strs) {
+				return nil, ErrSyntax
+			}
+			n, err := parseInt(strs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			count = max(int(n), 0)
+			i++
+		case "NOACK":
+			noAck = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if i >= len(strs) {
+		return nil, ErrSyntax
+	}
+	keys, idArgs, err := parseStreamsArgs("XREADGROUP", strs[i+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]StreamID, len(keys))
+	for j, s := range idArgs {
+		if s == ">" {
+			continue
+		}
+		if ids[j], err = parseStreamID(s, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	var readKeys []string
+	var readEntries []*internal.Data
+	for j, k := range keys {
+		newOnly := idArgs[j] == ">"
+		entries, err := h.dict.StreamReadGroup(k, group, consumer, ids[j], newOnly, count, noAck)
+		if err != nil {
+			return nil, err
+		}
+		// Pending entries are replied even if there are none, so consumers
+		// know they've caught up
+		if len(entries) > 0 || !newOnly {
+			readKeys = append(readKeys, k)
+			readEntries = append(readEntries, streamEntriesData(entries))
+		}
+	}
+	if len(readKeys) == 0 {
+		return internal.NewNullData(), nil
+	}
+	return streamReadReply(ctx, readKeys, readEntries), nil
+}
+
+// XACK key group id [id ...]
+func (h *DefaultCommandHandler) handleXackCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumberOfArgs("XACK")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]StreamID, len(strs)-2)
+	for i, s := range strs[2:] {
+		if ids[i], err = parseStreamID(s, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := h.dict.StreamAck(strs[0], strs[1], ids)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (h *DefaultCommandHandler) handleXpendingCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("XPENDING")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strs) == 2 {
+		summary, err := h.dict.StreamPendingSummary(strs[0], strs[1])
+		if err != nil {
+			return nil, err
+		}
+		if summary.count == 0 {
+			null := *internal.NewNullData()
+			return internal.NewArrayData([]internal.Data{*internal.NewIntData(0), null, null, null}), nil
+		}
+		consumers := make([]internal.Data, 0, len(summary.consumers))
+		for _, name := range slices.Sorted(maps.Keys(summary.consumers)) {
+			consumers = append(consumers, *internal.NewArrayData(bulkStrings([]string{
+				name, fmt.Sprint(summary.consumers[name]),
+			})))
+		}
+		return internal.NewArrayData([]internal.Data{
+			*internal.NewIntData(summary.count),
+			*internal.NewBulkStringData(summary.first.String()),
+			*internal.NewBulkStringData(summary.last.String()),
+			*internal.NewArrayData(consumers),
+		}), nil
+	}
+
+	var opts StreamPendingOptions
+	rest := strs[2:]
+	if strings.ToUpper(rest[0]) == "IDLE" {
+		if len(rest) < 2 {
+			return nil, ErrSyntax
+		}
+		if opts.minIdle, err = parseMilliseconds(rest[1]); err != nil {
+			return nil, err
+		}
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return nil, ErrSyntax
+	}
+	start, startOK, err := parseStreamRangeBound(rest[0], true)
+	if err != nil {
+		return nil, err
+	}
+	end, endOK, err := parseStreamRangeBound(rest[1], false)
+	if err != nil {
+		return nil, err
+	}
+	count, err := parseInt(rest[2])
+	if err != nil {
+		return nil, err
+	}
+	opts.start, opts.end, opts.count = start, end, max(int(count), 0)
+	if len(rest) == 4 {
+		opts.consumer = rest[3]
+	}
+
+	entries, err := h.dict.StreamPending(strs[0], strs[1], opts)
+	if err != nil {
+		return nil, err
+	}
+	if !startOK || !endOK {
+		entries = nil
+	}
+	data := make([]internal.Data, len(entries))
+	for i, p := range entries {
+		data[i] = *internal.NewArrayData([]internal.Data{
+			*internal.NewBulkStringData(p.id.String()),
+			*internal.NewBulkStringData(p.consumer),
+			*internal.NewIntData(int(p.idle.Milliseconds())),
+			*internal.NewIntData(p.deliveryCount),
+		})
+	}
+	return internal.NewArrayData(data), nil
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+// [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID]
+// [LASTID lastid]
+func (h *DefaultCommandHandler) handleXclaimCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 5 {
+		return nil, errWrongNumberOfArgs("XCLAIM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	minIdle, err := parseMilliseconds(strs[3])
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs come first, then options, which aren't valid IDs
+	var ids []StreamID
+	i := 4
+	for ; i < len(strs); i++ {
+		id, err := parseStreamID(strs[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errInvalidStreamID
+	}
+
+	opts := StreamClaimOptions{retryCount: -1}
+	for ; i < len(strs); i++ {
+		option := strings.ToUpper(strs[i])
+		switch option {
+		case "FORCE":
+			opts.force = true
+			continue
+		case "JUSTID":
+			opts.justID = true
+			continue
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+		default:
+			return nil, fmt.Errorf("ERR Unrecognized XCLAIM option '%s'", strs[i])
+		}
+
+		if i+1 >= len(strs) {
+			return nil, ErrSyntax
+		}
+		i++
+		if option == "LASTID" {
+			if opts.lastID, err = parseStreamID(strs[i], 0); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n, err := parseInt(strs[i])
+		if err != nil {
+			return nil, err
+		}
+		switch option {
+		case "IDLE":
+			opts.deliveryTime = time.Now().Add(-time.Duration(max(n, 0)) * time.Millisecond)
+		case "TIME":
+			opts.deliveryTime = time.UnixMilli(n)
+		case "RETRYCOUNT":
+			opts.retryCount = int(max(n, 0))
+		}
+	}
+
+	claimed, err := h.dict.StreamClaim(strs[0], strs[1], strs[2], minIdle, ids, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.justID {
+		return streamIDsData(entryIDs(claimed)), nil
+	}
+	return streamEntriesData(claimed), nil
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (h *DefaultCommandHandler) handleXautoclaimCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 5 {
+		return nil, errWrongNumberOfArgs("XAUTOCLAIM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	minIdle, err := parseMilliseconds(strs[3])
+	if err != nil {
+		return nil, err
+	}
+	start, _, err := parseStreamRangeBound(strs[4], true)
+	if err != nil {
+		return nil, err
+	}
+
+	count, justID := 100, false
+	for i := 5; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "COUNT":
+			if i+1 >= len(strs) {
+				return nil, ErrSyntax
+			}
+			n, err := parseInt(strs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			// Redis rejects counts the scan bound would overflow the same way
+			if n < 1 || n > math.MaxInt/autoClaimAttemptsFactor {
+				return nil, fmt.Errorf("ERR COUNT must be > 0")
+			}
+			count = int(n)
+			i++
+		case "JUSTID":
+			justID = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	next, claimed, deleted, err := h.dict.StreamAutoClaim(strs[0], strs[1], strs[2], minIdle, start, count, justID)
+	if err != nil {
+		return nil, err
+	}
+	claimedData := streamEntriesData(claimed)
+	if justID {
+		claimedData = streamIDsData(entryIDs(claimed))
+	}
+	return internal.NewArrayData([]internal.Data{
+		*internal.NewBulkStringData(next.String()),
+		*claimedData,
+		*streamIDsData(deleted),
+	}), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TLSAuthClients is whether TLS clients must present a certificate
+type TLSAuthClients int
+
+const (
+	// Clients must present a certificate signed by the CA
+	TLSAuthClientsYes TLSAuthClients = iota
+	// Clients may present a certificate, which is verified if they do
+	TLSAuthClientsOptional
+	// Client certificates aren't asked for
+	TLSAuthClientsNo
+)
+
+func ParseTLSAuthClients(s string) (TLSAuthClients, error) {
+	switch strings.ToLower(s) {
+	case "yes":
+		return TLSAuthClientsYes, nil
+	case "optional":
+		return TLSAuthClientsOptional, nil
+	case "no":
+		return TLSAuthClientsNo, nil
+	default:
+		return 0, fmt.Errorf("invalid tls-auth-clients %q, must be one of yes, optional or no", s)
+	}
+}
+
+func (a TLSAuthClients) clientAuth() tls.ClientAuthType {
+	switch a {
+	case TLSAuthClientsYes:
+		return tls.RequireAndVerifyClientCert
+	case TLSAuthClientsOptional:
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// Loads the certificate, key and CA named by config
+func loadTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		return nil, errors.New("TLS needs a certificate and key file")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   config.TLSAuthClients.clientAuth(),
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSCAFile != "" {
+		pem, err := os.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA file: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in TLS CA file %s", config.TLSCAFile)
+		}
+	} else if config.TLSAuthClients != TLSAuthClientsNo {
+		return nil, errors.New("TLS client authentication needs a CA file")
+	}
+	return tlsConfig, nil
+}
+
+// tlsState holds the TLS config new connections use. It's swapped on
+// reload, so connections already established keep theirs.
+type tlsState struct {
+	m      sync.RWMutex
+	config *tls.Config
+}
+
+func (t *tlsState) current() *tls.Config {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.config
+}
+
+func (t *tlsState) set(config *tls.Config) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.config = config
+}
+
+// Returns a config that looks up the current one for each handshake
+func (t *tlsState) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+	}
+}
+
+// ReloadTLS loads the certificate, key and CA files again, for connections
+// made from now on. If loading fails, the previous files are kept.
+func (s *Server) ReloadTLS() error {
+	if s.tls.current() == nil {
+		return errors.New("TLS is not enabled")
+	}
+	tlsConfig, err := loadTLSConfig(s.config)
+	if err != nil {
+		return err
+	}
+	s.tls.set(tlsConfig)
+	s.logger.Info("reloaded TLS certificates", "cert", s.config.TLSCertFile)
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"myredis/internal"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by a test CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Creates a certificate for name. Signed by parent, or self-signed if
+// parent is nil, in which case it's a CA.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// Writes the certificate and key as PEM files
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if keyFile == "" {
+		return
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// Connects to the server at addr with TLS, presenting cert if it's set
+func dialTLSTestServer(t *testing.T, addr string, roots *x509.CertPool, cert *testCert) (*tls.Conn, *internal.Reader, error) {
+	t.Helper()
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{cert.tlsCertificate()}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, internal.NewReader(conn, 0), nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "redis.crt"), filepath.Join(dir, "redis.key"), filepath.Join(dir, "ca.crt")
+	ca := newTestCert(t, "Test CA", nil)
+	ca.write(t, caFile, "")
+	newTestCert(t, "first", ca).write(t, certFile, keyFile)
+	client := newTestCert(t, "client", ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	server := startConfiguredTestServer(t, Config{
+		Address:        "127.0.0.1:0",
+		Endpoints:      []Endpoint{{Kind: EndpointTLS, Address: "127.0.0.1:0"}},
+		TLSCertFile:    certFile,
+		TLSKeyFile:     keyFile,
+		TLSCAFile:      caFile,
+		TLSAuthClients: TLSAuthClientsYes,
+	})
+	addr := server.listeners[1].Addr().String()
+	pong := internal.NewSimpleStringData("PONG")
+
+	// Plaintext connections are still served, beside TLS ones
+	plain, plainReader := dialTestServer(t, server.listeners[0].Addr().String())
+	if got := sendCommand(t, plain, plainReader, "PING"); !reflect.DeepEqual(got, pong) {
+		t.Fatalf("PING over plaintext. want PONG, got %v", got)
+	}
+	conn, reader, err := dialTLSTestServer(t, addr, roots, client)
+	if err != nil {
+		t.Fatalf("failed to dial with TLS: %v", err)
+	}
+	if got := sendCommand(t, conn, reader, "PING"); !reflect.DeepEqual(got, pong) {
+		t.Fatalf("PING over TLS. want PONG, got %v", got)
+	}
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "first" {
+		t.Fatalf("server certificate. want first, got %s", name)
+	}
+
+	// Clients must present a certificate signed by the CA. TLS 1.3 clients
+	// only learn of it once they read.
+	for _, cert := range []*testCert{nil, newTestCert(t, "stranger", nil)} {
+		other, otherReader, err := dialTLSTestServer(t, addr, roots, cert)
+		if err == nil {
+			other.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			_, err = otherReader.ReadData()
+		}
+		if err == nil {
+			t.Fatalf("connection with client certificate %v. want handshake error", cert)
+		}
+	}
+
+	// Reloaded certificates are used for new connections, while the
+	// connections already made carry on
+	newTestCert(t, "second", ca).write(t, certFile, keyFile)
+	if err := server.ReloadTLS(); err != nil {
+		t.Fatalf("failed to reload TLS: %v", err)
+	}
+	reloaded, reloadedReader, err := dialTLSTestServer(t, addr, roots, client)
+	if err != nil {
+		t.Fatalf("failed to dial after reload: %v", err)
+	}
+	if name := reloaded.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "second" {
+		t.Fatalf("server certificate after reload. want second, got %s", name)
+	}
+	if got := sendCommand(t, reloaded, reloadedReader, "PING"); !reflect.DeepEqual(got, pong) {
+		t.Fatalf("PING after reload. want PONG, got %v", got)
+	}
+	if got := sendCommand(t, conn, reader, "PING"); !reflect.DeepEqual(got, pong) {
+		t.Fatalf("PING on connection made before reload. want PONG, got %v", got)
+	}
+
+	// A failed reload keeps the certificates in use
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := server.ReloadTLS(); err == nil {
+		t.Fatalf("reload with invalid certificate. want error, got nil")
+	}
+	if _, _, err := dialTLSTestServer(t, addr, roots, client); err != nil {
+		t.Fatalf("failed to dial after failed reload: %v", err)
+	}
+}
+
+func TestServerTLSOnly(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "redis.crt"), filepath.Join(dir, "redis.key")
+	ca := newTestCert(t, "Test CA", nil)
+	newTestCert(t, "server", ca).write(t, certFile, keyFile)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// Without client authentication no CA is needed
+	server := startConfiguredTestServer(t, Config{
+		Endpoints:      []Endpoint{{Kind: EndpointTLS, Address: "127.0.0.1:0"}},
+		TLSCertFile:    certFile,
+		TLSKeyFile:     keyFile,
+		TLSAuthClients: TLSAuthClientsNo,
+	})
+	if len(server.listeners) != 1 {
+		t.Fatalf("listeners without a plaintext address. want 1, got %d", len(server.listeners))
+	}
+	conn, reader, err := dialTLSTestServer(t, server.listeners[0].Addr().String(), roots, nil)
+	if err != nil {
+		t.Fatalf("failed to dial with TLS: %v", err)
+	}
+	if got := sendCommand(t, conn, reader, "PING"); !reflect.DeepEqual(got, internal.NewSimpleStringData("PONG")) {
+		t.Fatalf("PING over TLS. want PONG, got %v", got)
+	}
+
+	// Client authentication can't be checked without a CA
+	_, err = loadTLSConfig(Config{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSAuthClients: TLSAuthClientsYes})
+	if err == nil {
+		t.Fatalf("client authentication without a CA. want error, got nil")
+	}
+}
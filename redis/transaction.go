@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"myredis/internal"
+	"slices"
+	"time"
+)
+
+// watcher holds the keys a client watches with WATCH. Guarded by the
+// Dictionary lock.
+type watcher struct {
+	// Watched keys, and whether each held a live record when watched
+	keys map[string]bool
+	// Set once a watched key is written to
+	dirty bool
+}
+
+func newWatcher() *watcher {
+	return &watcher{keys: make(map[string]bool)}
+}
+
+// transaction holds a client's state between MULTI and EXEC or DISCARD
+type transaction struct {
+	active bool
+	// Set when a command fails to queue, so EXEC aborts
+	failed bool
+	queued []queuedCommand
+}
+
+type queuedCommand struct {
+	name string
+	args []internal.Data
+}
+
+// Watch adds keys to those watched by w
+func (d *Dictionary) Watch(w *watcher, keys []string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		if _, ok := w.keys[k]; ok {
+			continue
+		}
+		record, ok := d.kv[k]
+		w.keys[k] = ok && !record.expired(now)
+
+		watchers, ok := d.watchers[k]
+		if !ok {
+			watchers = make(map[*watcher]struct{})
+			d.watchers[k] = watchers
+		}
+		watchers[w] = struct{}{}
+	}
+}
+
+// Unwatch stops w watching every key, and clears whether they changed
+func (d *Dictionary) Unwatch(w *watcher) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.unwatch(w)
+}
+
+// Private method to unwatch every key. Consumer must acquire write lock.
+func (d *Dictionary) unwatch(w *watcher) {
+	for k := range w.keys {
+		delete(d.watchers[k], w)
+		if len(d.watchers[k]) == 0 {
+			delete(d.watchers, k)
+		}
+	}
+	clear(w.keys)
+	w.dirty = false
+}
+
+// Private method to mark the clients watching k as changed, after a write
+// to k, its size to be estimated again, and the write to be propagated.
+// Consumer must acquire write lock.
+func (d *Dictionary) touch(k string) {
+	for w := range d.watchers[k] {
+		w.dirty = true
+	}
+	d.memory.dirty[k] = struct{}{}
+	d.feed.dirty++
+}
+
+// Private method to check whether a key watched by w changed. A key that
+// expired since it was watched has changed, even if it's yet to be deleted.
+// Consumer must acquire write lock.
+func (d *Dictionary) watchedKeysChanged(w *watcher, now time.Time) bool {
+	if w.dirty {
+		return true
+	}
+	for k, live := range w.keys {
+		if live && d.kv[k].expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// heldLock stands in for the lock of a Dictionary while Locked holds it, so
+// the commands run don't take it again
+type heldLock struct{}
+
+func (heldLock) Lock()    {}
+func (heldLock) Unlock()  {}
+func (heldLock) RLock()   {}
+func (heldLock) RUnlock() {}
+
+// Exec runs fn atomically, unless a key watched by w has changed. w stops
+// watching every key. Returns false if a watched key changed, and fn wasn't
+// run.
+func (d *Dictionary) Exec(w *watcher, fn func(tx Dictionary)) bool {
+	ok := false
+	d.Atomically(func(tx Dictionary) {
+		changed := tx.watchedKeysChanged(w, time.Now())
+		tx.unwatch(w)
+		if changed {
+			return
+		}
+		ok = true
+		fn(tx)
+	})
+	return ok
+}
+
+// Atomically runs fn under the write lock like Locked, and propagates the
+// writes fn makes as a transaction. Run within another Atomically, as by a
+// script in EXEC, the writes are part of the outer transaction.
+func (d *Dictionary) Atomically(fn func(tx Dictionary)) {
+	if _, ok := d.m.(heldLock); ok {
+		fn(*d)
+		return
+	}
+	d.Locked(func(tx Dictionary) {
+		start := len(tx.feed.pending)
+		fn(tx)
+		// A single command is atomic already
+		if len(tx.feed.pending)-start > 1 {
+			tx.feed.pending = slices.Insert(tx.feed.pending, start, []string{"MULTI"})
+			tx.feed.pending = append(tx.feed.pending, []string{"EXEC"})
+		}
+	})
+}
+
+// Commands that run at once while in MULTI, rather than being queued
+func runsInMulti(command string) bool {
+	switch command {
+	case "MULTI", "EXEC", "DISCARD", "WATCH":
+		return true
+	default:
+		return false
+	}
+}
+
+// Private method to queue a command between MULTI and EXEC, once checked
+func (h *DefaultCommandHandler) queueCommand(client *Client, command string, args []internal.Data) (*internal.Data, error) {
+	// Subscribing replies outside of EXEC's reply
+	switch command {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		client.tx.failed = true
+		return nil, fmt.Errorf("ERR Command not allowed inside a transaction")
+	}
+
+	client.tx.queued = append(client.tx.queued, queuedCommand{name: command, args: args})
+	return internal.NewSimpleStringData("QUEUED"), nil
+}
+
+// MULTI
+func (h *DefaultCommandHandler) handleMultiCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("MULTI")
+	}
+	client := clientFromContext(ctx)
+	if client.tx.active {
+		return nil, fmt.Errorf("ERR MULTI calls can not be nested")
+	}
+	client.tx = transaction{active: true}
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// EXEC. Runs the queued commands atomically, replying with each of their
+// replies. A command that fails doesn't stop the rest, and its error is
+// part of the reply. Replies null if a watched key changed.
+func (h *DefaultCommandHandler) handleExecCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("EXEC")
+	}
+	client := clientFromContext(ctx)
+	if !client.tx.active {
+		return nil, fmt.Errorf("ERR EXEC without MULTI")
+	}
+	tx := client.tx
+	client.tx = transaction{}
+	if tx.failed {
+		h.dict.Unwatch(client.watch)
+		return nil, fmt.Errorf("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	replies := make([]internal.Data, 0, len(tx.queued))
+	ok := h.dict.Exec(client.watch, func(dict Dictionary) {
+		txHandler := *h
+		txHandler.dict = dict
+		for _, command := range tx.queued {
+			reply, err := txHandler.Handle(ctx, command.name, command.args)
+			if err != nil {
+				reply = internal.NewSimpleError(err.Error())
+			}
+			replies = append(replies, *reply)
+		}
+	})
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewArrayData(replies), nil
+}
+
+// DISCARD
+func (h *DefaultCommandHandler) handleDiscardCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("DISCARD")
+	}
+	client := clientFromContext(ctx)
+	if !client.tx.active {
+		return nil, fmt.Errorf("ERR DISCARD without MULTI")
+	}
+	client.tx = transaction{}
+	h.dict.Unwatch(client.watch)
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// WATCH key [key ...]
+func (h *DefaultCommandHandler) handleWatchCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 1 {
+		return nil, errWrongNumberOfArgs("WATCH")
+	}
+	keys, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	client := clientFromContext(ctx)
+	if client.tx.active {
+		return nil, fmt.Errorf("ERR WATCH inside MULTI is not allowed")
+	}
+	h.dict.Watch(client.watch, keys)
+	return internal.NewSimpleStringData("OK"), nil
+}
+
+// UNWATCH
+func (h *DefaultCommandHandler) handleUnwatchCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) != 0 {
+		return nil, errWrongNumberOfArgs("UNWATCH")
+	}
+	h.dict.Unwatch(clientFromContext(ctx).watch)
+	return internal.NewSimpleStringData("OK"), nil
+}
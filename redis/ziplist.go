@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Ziplists, zipmaps and intsets are compact encodings older versions of
+// Redis save small collections in. They're only read, when loading an RDB
+// file.
+const (
+	ziplistHeaderSize = 10
+	ziplistEnd        = 0xff
+
+	// Encodings of an element, after the length of the previous one
+	ziplistStr14Bit = 1
+	ziplistStr32Bit = 2
+	ziplistInt16    = 0xc0
+	ziplistInt32    = 0xd0
+	ziplistInt64    = 0xe0
+	ziplistInt24    = 0xf0
+	ziplistInt8     = 0xfe
+	// 0xf1 to 0xfd are the integers 0 to 12
+	ziplistIntImmMin = 0xf1
+	ziplistIntImmMax = 0xfd
+
+	zipmapEnd = 0xff
+)
+
+// Decodes the elements of a ziplist. A ziplist is a header with its size,
+// the offset of its last element, and its number of elements, then the
+// elements, each after the length of the one before, and an end byte.
+// Integers are formatted as strings.
+func readZiplist(p []byte) ([]string, error) {
+	corrupt := fmt.Errorf("%w: invalid ziplist", ErrRDBCorrupt)
+	if len(p) < ziplistHeaderSize+1 || int(binary.LittleEndian.Uint32(p)) != len(p) {
+		return nil, corrupt
+	}
+
+	var elements []string
+	for i := ziplistHeaderSize; ; {
+		if i >= len(p) {
+			return nil, corrupt
+		}
+		if p[i] == ziplistEnd {
+			if i != len(p)-1 {
+				return nil, corrupt
+			}
+			return elements, nil
+		}
+		// The length of the previous element, to walk back, is a byte, or
+		// 0xfe and 4 bytes
+		if p[i] < 0xfe {
+			i++
+		} else {
+			i += 5
+		}
+		if i >= len(p) {
+			return nil, corrupt
+		}
+
+		b := p[i]
+		header, strLen, intLen := 1, -1, 0
+		switch {
+		case b>>6 == 0:
+			strLen = int(b & 0x3f)
+		case b>>6 == ziplistStr14Bit:
+			header = 2
+		case b>>6 == ziplistStr32Bit:
+			header = 5
+		case b == ziplistInt8:
+			intLen = 1
+		case b == ziplistInt16:
+			intLen = 2
+		case b == ziplistInt24:
+			intLen = 3
+		case b == ziplistInt32:
+			intLen = 4
+		case b == ziplistInt64:
+			intLen = 8
+		case b >= ziplistIntImmMin && b <= ziplistIntImmMax:
+		default:
+			return nil, corrupt
+		}
+		if i+header+intLen > len(p) {
+			return nil, corrupt
+		}
+		switch b >> 6 {
+		case ziplistStr14Bit:
+			strLen = int(b&0x3f)<<8 | int(p[i+1])
+		case ziplistStr32Bit:
+			strLen = int(binary.BigEndian.Uint32(p[i+1:]))
+		}
+		i += header
+
+		if strLen >= 0 {
+			if strLen > len(p)-i {
+				return nil, corrupt
+			}
+			elements = append(elements, string(p[i:i+strLen]))
+			i += strLen
+			continue
+		}
+		// Integers are little endian, and sign extended from intLen bytes
+		var u uint64
+		for j := intLen - 1; j >= 0; j-- {
+			u = u<<8 | uint64(p[i+j])
+		}
+		value := int64(u<<(64-8*intLen)) >> (64 - 8*intLen)
+		if intLen == 0 {
+			value = int64(b&0x0f) - 1
+		}
+		elements = append(elements, strconv.FormatInt(value, 10))
+		i += intLen
+	}
+}
+
+// Decodes the fields and values of a zipmap, which hashes were saved as
+// before ziplists. Lengths are a byte, or 0xfe and 4 bytes. Values are
+// followed by a byte with the number of unused bytes after them.
+func readZipmap(p []byte) ([]string, error) {
+	corrupt := fmt.Errorf("%w: invalid zipmap", ErrRDBCorrupt)
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(p) || p[i] > 0xfe {
+			return 0, false
+		}
+		if p[i] < 0xfe {
+			i++
+			return int(p[i-1]), true
+		}
+		if i+5 > len(p) {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(p[i+1:]))
+		i += 5
+		return n, true
+	}
+
+	var elements []string
+	for {
+		if i >= len(p) {
+			return nil, corrupt
+		}
+		if p[i] == zipmapEnd {
+			return elements, nil
+		}
+		n, ok := readLen()
+		if !ok || n > len(p)-i {
+			return nil, corrupt
+		}
+		elements = append(elements, string(p[i:i+n]))
+		i += n
+
+		n, ok = readLen()
+		if !ok || i >= len(p) {
+			return nil, corrupt
+		}
+		free := int(p[i])
+		i++
+		if n+free > len(p)-i {
+			return nil, corrupt
+		}
+		elements = append(elements, string(p[i:i+n]))
+		i += n + free
+	}
+}
+
+// Decodes the members of an intset, a set of integers saved as a sorted
+// array of 2, 4 or 8 byte integers
+func readIntset(p []byte) ([]string, error) {
+	corrupt := fmt.Errorf("%w: invalid intset", ErrRDBCorrupt)
+	if len(p) < 8 {
+		return nil, corrupt
+	}
+	size, n := int(binary.LittleEndian.Uint32(p)), int(binary.LittleEndian.Uint32(p[4:]))
+	if (size != 2 && size != 4 && size != 8) || len(p) != 8+size*n {
+		return nil, corrupt
+	}
+
+	members := make([]string, n)
+	for i := range members {
+		member := p[8+size*i:]
+		var value int64
+		switch size {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(member)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(member)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(member))
+		}
+		members[i] = strconv.FormatInt(value, 10)
+	}
+	return members, nil
+}
@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"myredis/internal"
+	"strings"
+)
+
+// zset is a sorted set. The map finds a member's score in O(1), and the
+// skiplist keeps members ordered for ranks and ranges.
+type zset struct {
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+func newZset() *zset {
+	return &zset{scores: make(map[string]float64), zsl: newSkiplist()}
+}
+
+func (z *zset) Len() int {
+	return len(z.scores)
+}
+
+// Add sets the score of member. Returns true if member was added rather
+// than updated.
+func (z *zset) Add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.zsl.Delete(old, member)
+	}
+	z.scores[member] = score
+	z.zsl.Insert(score, member)
+	return !exists
+}
+
+// Remove deletes member. Returns false if it isn't in the set.
+func (z *zset) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.zsl.Delete(score, member)
+	return true
+}
+
+// ZSetMember is a member of a sorted set and its score
+type ZSetMember struct {
+	member string
+	score  float64
+}
+
+// ZAddOptions holds the flags of ZADD
+type ZAddOptions struct {
+	nx   bool
+	xx   bool
+	gt   bool
+	lt   bool
+	ch   bool
+	incr bool
+}
+
+// zaddResult is the outcome of ZADD for one member
+type zaddResult int
+
+const (
+	zaddSkipped zaddResult = iota
+	zaddUnchanged
+	zaddAdded
+	zaddUpdated
+)
+
+// Applies ZADD to a single member. With INCR, score is added to the current
+// score. Returns the member's resulting score.
+func (z *zset) addWithOptions(member string, score float64, opts ZAddOptions) (float64, zaddResult, error) {
+	current, exists := z.scores[member]
+	if !exists {
+		if opts.xx {
+			return 0, zaddSkipped, nil
+		}
+		z.Add(member, score)
+		return score, zaddAdded, nil
+	}
+
+	if opts.nx {
+		return current, zaddSkipped, nil
+	}
+	if opts.incr {
+		score += current
+		if math.IsNaN(score) {
+			return 0, zaddSkipped, fmt.Errorf("ERR resulting score is not a number (NaN)")
+		}
+	}
+	if (opts.gt && score <= current) || (opts.lt && score >= current) {
+		return current, zaddSkipped, nil
+	}
+	if score == current {
+		return current, zaddUnchanged, nil
+	}
+	z.Add(member, score)
+	return score, zaddUpdated, nil
+}
+
+// scoreRange is a range of scores for ZRANGE BYSCORE, ZCOUNT and
+// ZREMRANGEBYSCORE
+type scoreRange struct {
+	min          float64
+	max          float64
+	minExclusive bool
+	maxExclusive bool
+}
+
+func (r scoreRange) aboveMin(n *skiplistNode) bool {
+	if r.minExclusive {
+		return n.score > r.min
+	}
+	return n.score >= r.min
+}
+
+func (r scoreRange) belowMax(n *skiplistNode) bool {
+	if r.maxExclusive {
+		return n.score < r.max
+	}
+	return n.score <= r.max
+}
+
+// lexBound is one end of a lex range. "-" and "+" are below and above every
+// member.
+type lexBound struct {
+	value     string
+	exclusive bool
+	// -1 for "-", 1 for "+" and 0 for a value
+	infinite int
+}
+
+// lexRange is a range of members for ZRANGE BYLEX. Only meaningful when all
+// members have the same score.
+type lexRange struct {
+	min lexBound
+	max lexBound
+}
+
+func (r lexRange) aboveMin(n *skiplistNode) bool {
+	switch {
+	case r.min.infinite != 0:
+		return r.min.infinite < 0
+	case r.min.exclusive:
+		return n.member > r.min.value
+	default:
+		return n.member >= r.min.value
+	}
+}
+
+func (r lexRange) belowMax(n *skiplistNode) bool {
+	switch {
+	case r.max.infinite != 0:
+		return r.max.infinite > 0
+	case r.max.exclusive:
+		return n.member < r.max.value
+	default:
+		return n.member <= r.max.value
+	}
+}
+
+// ZRangeBy selects how ZRANGE interprets its start and stop arguments
+type ZRangeBy int
+
+const (
+	ZRangeByRank ZRangeBy = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeSpec describes a ZRANGE query
+type ZRangeSpec struct {
+	by ZRangeBy
+	// Inclusive ranks for ZRangeByRank, which may be negative
+	start int
+	stop  int
+	score scoreRange
+	lex   lexRange
+	rev   bool
+	// LIMIT for ZRangeByScore and ZRangeByLex. A negative count returns all
+	// members after offset.
+	offset int
+	count  int
+}
+
+// Range returns the members matching spec, in order
+func (z *zset) Range(spec ZRangeSpec) []ZSetMember {
+	var members []ZSetMember
+	if spec.by == ZRangeByRank {
+		start, end, ok := normalizeRange(spec.start, spec.stop, z.Len())
+		if !ok {
+			return members
+		}
+		node := z.zsl.ByRank(start)
+		if spec.rev {
+			node = z.zsl.ByRank(z.Len() - 1 - start)
+		}
+		for i := start; i < end; i++ {
+			members = append(members, ZSetMember{node.member, node.score})
+			if spec.rev {
+				node = node.Prev()
+			} else {
+				node = node.Next()
+			}
+		}
+		return members
+	}
+
+	aboveMin, belowMax := spec.score.aboveMin, spec.score.belowMax
+	if spec.by == ZRangeByLex {
+		aboveMin, belowMax = spec.lex.aboveMin, spec.lex.belowMax
+	}
+	if spec.offset < 0 {
+		return members
+	}
+
+	var node *skiplistNode
+	if spec.rev {
+		node = z.zsl.Last(aboveMin, belowMax)
+	} else {
+		node = z.zsl.First(aboveMin, belowMax)
+	}
+	for skipped := 0; node != nil && skipped < spec.offset; skipped++ {
+		node = z.next(node, spec.rev)
+	}
+	for node != nil && (spec.count < 0 || len(members) < spec.count) {
+		if (spec.rev && !aboveMin(node)) || (!spec.rev && !belowMax(node)) {
+			break
+		}
+		members = append(members, ZSetMember{node.member, node.score})
+		node = z.next(node, spec.rev)
+	}
+	return members
+}
+
+// Steps forwards, or backwards if reverse is set
+func (z *zset) next(node *skiplistNode, reverse bool) *skiplistNode {
+	if reverse {
+		return node.Prev()
+	}
+	return node.Next()
+}
+
+// Private method to get a sorted set record for writing. Returns
+// ErrWrongType if the key holds another kind. Consumer must acquire write
+// lock.
+func (d *Dictionary) lookupZSet(k string) (KVRecord, bool, error) {
+	record, ok := d.lookup(k)
+	if !ok {
+		return KVRecord{}, false, nil
+	}
+	if record.kind != ZSetRecord {
+		return KVRecord{}, false, ErrWrongType
+	}
+	return record, true, nil
+}
+
+// Private method to get a sorted set record for writing, or a new empty one
+// if the key doesn't exist. Consumer must store the record with storeZSet
+// and acquire write lock.
+func (d *Dictionary) lookupOrNewZSet(k string) (KVRecord, error) {
+	record, exists, err := d.lookupZSet(k)
+	if err != nil {
+		return KVRecord{}, err
+	}
+	if !exists {
+		record = KVRecord{kind: ZSetRecord, zsetValue: newZset()}
+	}
+	return record, nil
+}
+
+// Private method to store a modified sorted set. Empty sets are deleted.
+// Consumer must acquire write lock.
+func (d *Dictionary) storeZSet(k string, record KVRecord) {
+	if record.zsetValue.Len() == 0 {
+		d.delete(k)
+		return
+	}
+	d.setRecord(k, record)
+}
+
+// Private method to run fn with the sorted set at k under the read lock. fn
+// is not called if the key doesn't exist.
+func (d *Dictionary) readZSet(k string, fn func(z *zset)) (err error) {
+	d.read(k, func(record KVRecord, ok bool) {
+		if !ok {
+			return
+		}
+		if record.kind != ZSetRecord {
+			err = ErrWrongType
+			return
+		}
+		fn(record.zsetValue)
+	})
+	return err
+}
+
+// ZSetAdd adds or updates members of a sorted set record. Returns the number
+// of members added, or with ch the number added or updated.
+func (d *Dictionary) ZSetAdd(k string, members []ZSetMember, opts ZAddOptions) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewZSet(k)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, m := range members {
+		_, result, _ := record.zsetValue.addWithOptions(m.member, m.score, opts)
+		if result == zaddAdded || (opts.ch && result == zaddUpdated) {
+			n++
+		}
+	}
+	d.storeZSet(k, record)
+	return n, nil
+}
+
+// ZSetIncrBy adds incr to the score of member, adding it with score incr if
+// it doesn't exist. Returns the new score, or false if NX, XX, GT or LT in
+// opts skipped the update.
+func (d *Dictionary) ZSetIncrBy(k string, member string, incr float64, opts ZAddOptions) (float64, bool, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, err := d.lookupOrNewZSet(k)
+	if err != nil {
+		return 0, false, err
+	}
+
+	opts.incr = true
+	score, result, err := record.zsetValue.addWithOptions(member, incr, opts)
+	d.storeZSet(k, record)
+	if err != nil {
+		return 0, false, err
+	}
+	return score, result != zaddSkipped, nil
+}
+
+// ZSetRemove removes members from a sorted set record, deleting the key once
+// the set is empty. Returns the number of members removed.
+func (d *Dictionary) ZSetRemove(k string, members []string) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupZSet(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	removed := 0
+	for _, member := range members {
+		if record.zsetValue.Remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		d.storeZSet(k, record)
+	}
+	return removed, nil
+}
+
+// ZSetScore returns the score of member. Returns false if the key or member
+// doesn't exist.
+func (d *Dictionary) ZSetScore(k string, member string) (score float64, ok bool, err error) {
+	err = d.readZSet(k, func(z *zset) {
+		score, ok = z.scores[member]
+	})
+	return score, ok, err
+}
+
+// ZSetCard returns the number of members in a sorted set record
+func (d *Dictionary) ZSetCard(k string) (n int, err error) {
+	err = d.readZSet(k, func(z *zset) {
+		n = z.Len()
+	})
+	return n, err
+}
+
+// ZSetRank returns the 0 based rank and score of member, ordered from the
+// lowest score, or from the highest if reverse is set. Returns false if the
+// key or member doesn't exist.
+func (d *Dictionary) ZSetRank(k string, member string, reverse bool) (rank int, score float64, ok bool, err error) {
+	err = d.readZSet(k, func(z *zset) {
+		score, ok = z.scores[member]
+		if !ok {
+			return
+		}
+		rank = z.zsl.Rank(score, member)
+		if reverse {
+			rank = z.Len() - 1 - rank
+		}
+	})
+	return rank, score, ok, err
+}
+
+// ZSetRange returns the members of a sorted set record matching spec
+func (d *Dictionary) ZSetRange(k string, spec ZRangeSpec) (members []ZSetMember, err error) {
+	err = d.readZSet(k, func(z *zset) {
+		members = z.Range(spec)
+	})
+	return members, err
+}
+
+// ZSetCount returns the number of members with scores in r
+func (d *Dictionary) ZSetCount(k string, r scoreRange) (n int, err error) {
+	err = d.readZSet(k, func(z *zset) {
+		first := z.zsl.First(r.aboveMin, r.belowMax)
+		if first == nil {
+			return
+		}
+		last := z.zsl.Last(r.aboveMin, r.belowMax)
+		n = z.zsl.Rank(last.score, last.member) - z.zsl.Rank(first.score, first.member) + 1
+	})
+	return n, err
+}
+
+// ZSetPop removes and returns up to count members with the lowest scores,
+// or the highest if max is set
+func (d *Dictionary) ZSetPop(k string, count int, max bool) ([]ZSetMember, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupZSet(k)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var popped []ZSetMember
+	for len(popped) < count {
+		node := record.zsetValue.zsl.Head()
+		if max {
+			node = record.zsetValue.zsl.Tail()
+		}
+		if node == nil {
+			break
+		}
+		popped = append(popped, ZSetMember{node.member, node.score})
+		record.zsetValue.Remove(node.member)
+	}
+	d.storeZSet(k, record)
+	return popped, nil
+}
+
+// ZSetRemoveRangeByScore removes members with scores in r. Returns the
+// number removed.
+func (d *Dictionary) ZSetRemoveRangeByScore(k string, r scoreRange) (int, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	record, exists, err := d.lookupZSet(k)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	members := record.zsetValue.Range(ZRangeSpec{by: ZRangeByScore, score: r, count: -1})
+	for _, m := range members {
+		record.zsetValue.Remove(m.member)
+	}
+	d.storeZSet(k, record)
+	return len(members), nil
+}
+
+// Parses a score range bound, such as "1.5", "(1.5" or "-inf"
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, err := parseFloat(s)
+	if err != nil {
+		return 0, false, fmt.Errorf("ERR min or max is not a float")
+	}
+	return f, exclusive, nil
+}
+
+// Parses the min and max arguments of a score range
+func parseScoreRange(min string, max string) (scoreRange, error) {
+	var r scoreRange
+	var err error
+	if r.min, r.minExclusive, err = parseScoreBound(min); err != nil {
+		return r, err
+	}
+	if r.max, r.maxExclusive, err = parseScoreBound(max); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// Parses a lex range bound, which is "-", "+", or a value prefixed with "["
+// or "("
+func parseLexBound(s string) (lexBound, error) {
+	switch {
+	case s == "-":
+		return lexBound{infinite: -1}, nil
+	case s == "+":
+		return lexBound{infinite: 1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, nil
+	default:
+		return lexBound{}, fmt.Errorf("ERR min or max not valid string range item")
+	}
+}
+
+// Builds the reply for sorted set members. With scores, the reply is a flat
+// array of members and scores, or of member and score pairs if nested is set.
+func zsetReply(members []ZSetMember, withScores bool, nested bool) *internal.Data {
+	data := make([]internal.Data, 0, len(members))
+	for _, m := range members {
+		if !withScores {
+			data = append(data, *internal.NewBulkStringData(m.member))
+			continue
+		}
+		pair := []internal.Data{*internal.NewBulkStringData(m.member), *internal.NewDoubleData(m.score)}
+		if nested {
+			data = append(data, *internal.NewArrayData(pair))
+		} else {
+			data = append(data, pair...)
+		}
+	}
+	return internal.NewArrayData(data)
+}
+
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...]
+func (h *DefaultCommandHandler) handleZaddCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumberOfArgs("ZADD")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts ZAddOptions
+	i := 1
+flags:
+	for ; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		case "CH":
+			opts.ch = true
+		case "INCR":
+			opts.incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := strs[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	if opts.nx && opts.xx {
+		return nil, fmt.Errorf("ERR XX and NX options at the same time are not compatible")
+	}
+	if (opts.gt && opts.lt) || (opts.nx && (opts.gt || opts.lt)) {
+		return nil, fmt.Errorf("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if opts.incr && len(pairs) != 2 {
+		return nil, fmt.Errorf("ERR INCR option supports a single increment-element pair")
+	}
+
+	members := make([]ZSetMember, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseFloat(pairs[j])
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, ZSetMember{member: pairs[j+1], score: score})
+	}
+
+	if opts.incr {
+		score, ok, err := h.dict.ZSetIncrBy(strs[0], members[0].member, members[0].score, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return internal.NewNullData(), nil
+		}
+		return internal.NewDoubleData(score), nil
+	}
+
+	n, err := h.dict.ZSetAdd(strs[0], members, opts)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// ZINCRBY key increment member
+func (h *DefaultCommandHandler) handleZincrbyCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("ZINCRBY")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	incr, err := parseFloat(strs[1])
+	if err != nil {
+		return nil, err
+	}
+
+	score, _, err := h.dict.ZSetIncrBy(strs[0], strs[2], incr, ZAddOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewDoubleData(score), nil
+}
+
+// ZREM key member [member ...]
+func (h *DefaultCommandHandler) handleZremCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArgs("ZREM")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := h.dict.ZSetRemove(strs[0], strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(removed), nil
+}
+
+// ZSCORE key member
+func (h *DefaultCommandHandler) handleZscoreCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArgs("ZSCORE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	score, ok, err := h.dict.ZSetScore(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	return internal.NewDoubleData(score), nil
+}
+
+// ZCARD key
+func (h *DefaultCommandHandler) handleZcardCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 1 {
+		return nil, errWrongNumberOfArgs("ZCARD")
+	}
+	key, err := args[0].GetString()
+	if err != nil {
+		return nil, ErrSyntax
+	}
+
+	n, err := h.dict.ZSetCard(key)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// ZRANK and ZREVRANK key member [WITHSCORE]
+func (h *DefaultCommandHandler) handleZrankCommand(command string, args []internal.Data, reverse bool) (*internal.Data, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	withScore := len(strs) == 3
+	if withScore && strings.ToUpper(strs[2]) != "WITHSCORE" {
+		return nil, ErrSyntax
+	}
+
+	rank, score, ok, err := h.dict.ZSetRank(strs[0], strs[1], reverse)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return internal.NewNullData(), nil
+	}
+	if withScore {
+		return internal.NewArrayData([]internal.Data{*internal.NewIntData(rank), *internal.NewDoubleData(score)}), nil
+	}
+	return internal.NewIntData(rank), nil
+}
+
+// ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]
+func (h *DefaultCommandHandler) handleZrangeCommand(ctx context.Context, args []internal.Data) (*internal.Data, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumberOfArgs("ZRANGE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := ZRangeSpec{count: -1}
+	withScores, limit := false, false
+	for i := 3; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "BYSCORE":
+			spec.by = ZRangeByScore
+		case "BYLEX":
+			spec.by = ZRangeByLex
+		case "REV":
+			spec.rev = true
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(strs) {
+				return nil, ErrSyntax
+			}
+			offset, err := parseInt(strs[i+1])
+			if err != nil {
+				return nil, err
+			}
+			count, err := parseInt(strs[i+2])
+			if err != nil {
+				return nil, err
+			}
+			spec.offset, spec.count = int(offset), int(count)
+			limit = true
+			i += 2
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if limit && spec.by == ZRangeByRank {
+		return nil, fmt.Errorf("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && spec.by == ZRangeByLex {
+		return nil, fmt.Errorf("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	start, stop := strs[1], strs[2]
+	// Reversed score and lex ranges are given from max to min
+	if spec.rev && spec.by != ZRangeByRank {
+		start, stop = stop, start
+	}
+	switch spec.by {
+	case ZRangeByRank:
+		startIndex, err := parseInt(start)
+		if err != nil {
+			return nil, err
+		}
+		stopIndex, err := parseInt(stop)
+		if err != nil {
+			return nil, err
+		}
+		spec.start, spec.stop = int(startIndex), int(stopIndex)
+	case ZRangeByScore:
+		if spec.score, err = parseScoreRange(start, stop); err != nil {
+			return nil, err
+		}
+	case ZRangeByLex:
+		if spec.lex.min, err = parseLexBound(start); err != nil {
+			return nil, err
+		}
+		if spec.lex.max, err = parseLexBound(stop); err != nil {
+			return nil, err
+		}
+	}
+
+	members, err := h.dict.ZSetRange(strs[0], spec)
+	if err != nil {
+		return nil, err
+	}
+	// RESP3 clients get member and score pairs
+	nested := clientFromContext(ctx).protocol == internal.RESP3
+	return zsetReply(members, withScores, nested), nil
+}
+
+// ZCOUNT key min max
+func (h *DefaultCommandHandler) handleZcountCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("ZCOUNT")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseScoreRange(strs[1], strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := h.dict.ZSetCount(strs[0], r)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(n), nil
+}
+
+// ZPOPMIN and ZPOPMAX key [count]
+func (h *DefaultCommandHandler) handleZpopCommand(ctx context.Context, command string, args []internal.Data, max bool) (*internal.Data, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errWrongNumberOfArgs(command)
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	count := 1
+	if len(strs) == 2 {
+		n, err := parseInt(strs[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ERR value is out of range, must be positive")
+		}
+		count = int(n)
+	}
+
+	popped, err := h.dict.ZSetPop(strs[0], count, max)
+	if err != nil {
+		return nil, err
+	}
+	// Without count, the reply is a flat member and score in every protocol
+	nested := len(strs) == 2 && clientFromContext(ctx).protocol == internal.RESP3
+	return zsetReply(popped, true, nested), nil
+}
+
+// ZREMRANGEBYSCORE key min max
+func (h *DefaultCommandHandler) handleZremrangebyscoreCommand(args []internal.Data) (*internal.Data, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumberOfArgs("ZREMRANGEBYSCORE")
+	}
+	strs, err := stringArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseScoreRange(strs[1], strs[2])
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := h.dict.ZSetRemoveRangeByScore(strs[0], r)
+	if err != nil {
+		return nil, err
+	}
+	return internal.NewIntData(removed), nil
+}